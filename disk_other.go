@@ -0,0 +1,8 @@
+//go:build !(linux || darwin || freebsd)
+
+package main
+
+// freeSpace is not available on this platform
+func freeSpace(dir string) (uint64, bool) {
+	return 0, false
+}
@@ -2,7 +2,10 @@ module github.com/Ardakilic/lilt
 
 go 1.24.5
 
-require github.com/spf13/cobra v1.10.1
+require (
+	github.com/spf13/cobra v1.10.1
+	golang.org/x/text v0.28.0
+)
 
 require (
 	github.com/inconshreveable/mousetrap v1.1.0 // indirect
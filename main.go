@@ -4,21 +4,42 @@ import (
 	"archive/tar"
 	"archive/zip"
 	"bufio"
+	"bytes"
+	"cmp"
 	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"maps"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"regexp"
 	"runtime"
+	"runtime/debug"
 	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/spf13/cobra"
+	"golang.org/x/text/unicode/norm"
 )
 
 // Config holds the application configuration
@@ -26,1080 +47,8960 @@ type Config struct {
 	SourceDir           string
 	TargetDir           string
 	CopyImages          bool
+	CopyPlaylists       bool // Copy .m3u/.m3u8 playlists with entries pointing at the produced files
 	UseDocker           bool
 	DockerImage         string
 	SoxCommand          string
 	NoPreserveMetadata  bool
-	EnforceOutputFormat string // "flac", "mp3", "alac", or empty for default behavior
+	EnforceOutputFormat string // "flac", "mp3", "alac", "vorbis", "opus", a comma separated list of them, or empty for default behavior
+	FormatSubdir        bool   // Place outputs under <target>/<format>/
+	ReportOrphans       bool   // List target files that no longer have a source
+	ReportPath          string // Write a JSON report of the run to this file
+	ReportAppend        bool   // Append the report to the file as one JSON line per run
+	BucketBy            string // "added" to bucket outputs by source mtime, or empty
+	CompareWith         string // Reference tree to compare produced outputs against
+	SanitizeFilenames   bool   // Rewrite target names to a FAT32/exFAT safe set
+	NormalizeUnicode    string // "nfc" or "nfd" to normalize target names, empty keeps them as they are
+	MaxPathLength       int    // Longest full target path in bytes, 0 for no limit
+	AlwaysMerge         bool   // Always run the FFmpeg metadata merge, even when SoX kept the tags
+	RenameMapPath       string // CSV file mapping source relative paths to target relative paths
+	VerifyCopies        bool   // Hash copies and compare the destination against the source
+	ProgressFD          int    // File descriptor receiving NDJSON progress events, 0 disables
+	Strict              bool   // Treat unreadable source files as fatal errors
+	FlatOutput          bool   // Print per-file lines without grouping them by album directory
+	Progress            bool   // Show a progress line with the number of files done and the ETA
+	Quiet               bool   // Print only warnings, errors and the progress line while processing
+	NiceOutput          bool   // Print one tree line per track under each album instead of the file's log lines
+	JSONLogs            bool   // Write log lines to stderr as JSON objects instead of text
+	MP3Mode             string // "cbr", "vbr" or "abr", empty means cbr
+	MP3Bitrate          int    // Bitrate in kbps for CBR and ABR, 0 means 320
+	MP3Quality          int    // LAME VBR quality from 0 (best) to 9
+	MP3Preset           string // VBR preset given as --mp3-bitrate, "V0" to "V9"
+	VorbisQuality       int    // Vorbis quality from 1 to 10, 0 for the default of 6
+	OpusBitrate         int    // Opus bitrate in kbps, 0 for the default of 160
+	MP3Rate             int    // Fixed MP3 sample rate, 0 keeps the source's rate family
+	MP3MinCopyBitrate   int    // MP3 sources below this bitrate in kbps are re-encoded in mp3 mode, 0 copies all
+	NoProbeCopy         bool   // Copy sources a format rule copies without probing them
+	ProbeOnlyExtensions string // Comma separated extensions whose copies are still probed, the others are not
+	ALACCompression     int    // FFmpeg ALAC compression_level from 0 to 2, negative keeps FFmpeg's default
+	VerifyRoundtrip     bool   // Compare decoded PCM of sample-preserving lossless conversions
+	NoPostcheck         bool   // Skip checking the bit depth and sample rate of SoX output
+	Sort                string // Deprecated work queue order: "path" (default) or "size-desc", see Order
+	Order               string // Work queue order: "name" (default), "newest", "oldest", "largest" or "smallest"
+	NameTemplate        string // Tag based target path template, e.g. "{artist}/{album}/{track:00} {title}"
+	PadTracks           bool   // Zero-pad leading track numbers of mirrored file names
+	TrackWidth          int    // Digits track numbers are padded to in names, 0 uses the track total
+	DownsampleOnly      bool   // Resample high-rate files but keep their bit depth
+	ResampleAbove       int    // Only resample sources above this rate, 0 keeps the default rule
+	ReduceBitsAbove     int    // Only reduce sources deeper than this many bits, to it; 0 keeps the default rule
+	TargetBitDepth      int    // Bit depth deeper sources are reduced to by default: 16 or 24, 0 means 16
+	NormalizeTags       bool   // Clean up tag values of outputs during the metadata merge
+	TitleCaseTags       string // Comma separated tags to title-case when normalizing, e.g. "genre"
+	TagRulesPath        string // CSV file of find,replace pairs applied to output tag values
+	SourceRoot          string // Base for source relative paths, defaults to SourceDir
+	DropTags            string // Comma separated tag globs removed from outputs, "@default" for the built-in list
+	ResampleAll         int    // Convert every output to this sample rate, 0 keeps rate families
+	TargetSampleRate    string // Rate high sample rate sources are reduced to: "auto", "44100" or "48000"; empty means auto
+	NoUpsample          bool   // Keep the source rate instead of upsampling to a forced rate
+	StrictUpsample      bool   // Fail files a forced rate would upsample
+	PassthroughSubdir   string // Subdirectory of the target for files copied because they are already compliant
+	EstimateOnly        bool   // Print a processing time estimate instead of converting
+	Tree                bool   // Print the target directory tree the run would produce instead of converting
+	Diff                bool   // Print how the target differs from what the run would produce instead of converting
+	DryRun              bool   // Print what would be done with every file instead of converting
+	ComparePlan         bool   // Print the files whose plan AltFlags changes instead of converting
+	AltFlags            string // Flags applied on top of the current ones for the --compare-plan alternative
+	Calibrate           bool   // Measure throughput on one file before estimating
+	StatusAddr          string // Address for the HTTP status endpoint, empty disables it
+	ArtSource           string // Cover art precedence: "embedded" (default), "folder" or "largest"
+	ArtOnly             bool   // Embed the folder image into compliant files instead of copying them
+	DedupeArt           string // Keep identical album art once per directory: "folder" or "embedded", empty disables it
+	ErrorLogDir         string // Directory receiving command logs of failed conversions, empty disables them
+	NoScannerMarkers    bool   // Do not mark the working and error log directories for media scanners to skip
+	SkipMultichannel    bool   // Skip sources with more than two channels instead of converting them
+	MinDuration         string // Skip sources shorter than this, in seconds or mm:ss
+	MaxDuration         string // Skip sources longer than this, in seconds or mm:ss
+	Downmix             bool   // Downmix sources with more than two channels to stereo in ALAC output
+	ProbeDuration       int64  // ffprobe -analyzeduration in microseconds, 0 keeps FFmpeg's default
+	ProbeSize           int64  // ffprobe -probesize in bytes, 0 keeps FFmpeg's default
+	ReencodeLossy       bool   // Transcode AAC sources to MP3 in MP3 mode instead of copying them
+	KeepOriginal        bool   // Copy the original when an enforced format conversion fails
+	Benchmark           bool   // Time conversions across formats and concurrency levels instead of converting
+	BenchSample         string // Sample file for --benchmark, empty synthesizes one with SoX
+	BenchJobs           []int  // Concurrency levels for --benchmark, empty means 1 and the CPU count
+	Verbose             bool   // Print the tools each file went through
+	CopyOnly            bool   // Copy audio files and images unchanged without SoX or FFmpeg
+	FromStdin           bool   // Process the files listed on stdin instead of walking the source
+	NullSeparated       bool   // The --from-stdin list is separated by NUL bytes instead of newlines
+	CopyBufferSize      int    // Copy buffer size in KiB, 0 means defaultCopyBufferKiB
+	MetricsTextfile     string // node_exporter textfile receiving the run's metrics, empty disables it
+	DumpConfig          bool   // Print the effective configuration as JSON and exit
+	TempDir             string // Parent of the run's working directory, defaults to the target directory
+	Prune               bool   // Delete target files that no longer have a source, after confirmation
+	Yes                 bool   // Skip confirmation prompts of destructive operations
+	AbortIfNoFiles      bool   // Fail the run when no audio file was found to process
+	ChangedOnly         bool   // Skip sources not modified since the last successful --changed-only run
+	SkipExisting        bool   // Skip sources whose output already exists and is not older than them
+	SourceChecksumCache bool   // With --changed-only, compare source content using cached SHA-256 digests
+	Retries             int    // Extra attempts for files whose external tool failed
+	RetryExitCodes      []int  // Tool exit codes worth retrying, empty retries every tool failure
+	SpecFile            string // JSON file of per-file output specs overriding the automatic decision
+	ConvertToMatch      bool   // Convert sources to the format and spec of the audio already in their target directory
+	Channels            int    // Output channel count, set per file by --spec-file; 0 keeps the source's
+	SummaryJSON         bool   // Print only the final summary as JSON on stdout, logging to stderr
+	IncludeHidden       bool   // Process dot-files and dot-directories of the source, skipped by default
+	FixPermissions      bool   // Make produced files and directories readable by everyone
+	Jobs                int    // Files processed at a time, 0 means 1; the flag defaults to the CPU count
+
+	// OnEvent receives the typed events of a run when lilt is embedded. It
+	// runs on the converting goroutine, one event at a time even with
+	// several jobs, so it should return quickly.
+	OnEvent func(Event) `json:"-"`
 }
 
-// AudioInfo holds information about an audio file
-type AudioInfo struct {
-	Bits   int
-	Rate   int
-	Format string // "flac" or "alac"
+// ProgressEvent is a machine-readable progress event, written as one JSON
+// object per line
+type ProgressEvent struct {
+	Event     string `json:"event"` // "run_started", "file_started", "file_completed" or "run_completed"
+	Time      string `json:"time"`
+	Path      string `json:"path,omitempty"`
+	Status    string `json:"status,omitempty"` // "ok" or "failed"
+	Error     string `json:"error,omitempty"`
+	Completed int    `json:"completed,omitempty"`
+	Failed    int    `json:"failed,omitempty"`
+	Total     int    `json:"total,omitempty"`     // Number of audio files queued, on run_started
+	Remaining int    `json:"remaining,omitempty"` // Files left unprocessed by an interrupted run, on run_completed
 }
 
-var (
-	config         Config
-	version        = "dev" // This will be set during build time
-	selfUpdateFlag bool
-)
+// Event is a typed progress event of a run: RunStarted, FileStarted,
+// FileProgress, FileCompleted or RunCompleted. Events are delivered to the
+// console, the --progress-fd stream and Config.OnEvent, in that order.
+type Event interface {
+	isEvent()
+}
 
-var rootCmd = &cobra.Command{
-	Use:   "lilt <source_directory>",
-	Short: "Convert Hi-Res FLAC/ALAC files to 16-bit FLAC files",
-	Long: `Lilt - FLAC/ALAC Audio Converter
+// RunStarted is published once the audio files to process are known
+type RunStarted struct {
+	Total int
+}
 
-This tool converts Hi-Res FLAC and ALAC files to 16-bit FLAC files with a sample rate of 44.1kHz or 48kHz.
-It also copies MP3 files and image files (JPG, PNG) to the target directory.
+// FileStarted is published before an audio file is processed
+type FileStarted struct {
+	Path string
+}
 
-With the --enforce-output-format flag, you can convert all audio files to a specific format:
-- flac: Convert all files to 16-bit FLAC
-- mp3: Convert all files to 320kbps MP3
-- alac: Convert all files to 16-bit ALAC (M4A)
+// FileProgress reports the bytes copied so far of a file being copied. It is
+// only published when Config.OnEvent is set.
+type FileProgress struct {
+	Path  string
+	Bytes int64
+	Total int64
+}
 
-Copyright (C) 2025 Arda Kilicdagi
-Licensed under MIT License`,
-	Args:    cobra.MaximumNArgs(1),
-	RunE:    runConverter,
-	Version: version,
+// FileCompleted is published after an audio file was processed
+type FileCompleted struct {
+	Path     string
+	Action   string // actionConverted, actionCopied, actionSkipped or actionFailed
+	BytesIn  int64
+	BytesOut int64
+	Duration time.Duration // Audio duration of the source, 0 when it was not probed
+	Err      error
 }
 
-func init() {
-	rootCmd.Flags().StringVar(&config.TargetDir, "target-dir", "./transcoded", "Specify target directory")
-	rootCmd.Flags().BoolVar(&config.CopyImages, "copy-images", false, "Copy JPG and PNG files")
-	rootCmd.Flags().BoolVar(&config.UseDocker, "use-docker", false, "Use Docker to run Sox instead of local installation")
-	rootCmd.Flags().StringVar(&config.DockerImage, "docker-image", "ardakilic/sox_ng:latest", "Specify Docker image")
-	rootCmd.Flags().BoolVar(&config.NoPreserveMetadata, "no-preserve-metadata", false, "Do not preserve ID3 tags and cover art using FFmpeg (metadata is preserved by default)")
-	rootCmd.Flags().StringVar(&config.EnforceOutputFormat, "enforce-output-format", "", "Enforce output format for all files: flac, mp3, or alac")
-	rootCmd.Flags().BoolVar(&selfUpdateFlag, "self-update", false, "Check for updates and self-update if newer version available")
+// RunCompleted is published when the run finished or was interrupted
+type RunCompleted struct {
+	Summary RunSummary
+}
 
-	// Set default values
-	config.SoxCommand = "sox"
+// RunSummary totals a run
+type RunSummary struct {
+	Completed   int
+	Failed      int
+	Unprocessed []string // Files never started because the run was interrupted
+	Interrupted bool
+	Results     map[string]int // Files by action
+	BytesIn     int64
+	BytesOut    int64
+
+	// Audio duration of the probed sources, in total and by action, and the
+	// wall clock time of the run
+	Duration         time.Duration
+	DurationByAction map[string]time.Duration
+	Elapsed          time.Duration
 }
 
-func main() {
-	if err := rootCmd.Execute(); err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		os.Exit(1)
-	}
+func (RunStarted) isEvent()    {}
+func (FileStarted) isEvent()   {}
+func (FileProgress) isEvent()  {}
+func (FileCompleted) isEvent() {}
+func (RunCompleted) isEvent()  {}
+
+// progressReporter tracks the run and publishes its events. The counts also
+// back the final summary and the --status-addr endpoint.
+type progressReporter struct {
+	mu        sync.Mutex
+	events    sync.Mutex    // Delivers OnEvent calls of concurrent files one at a time
+	encoder   *json.Encoder // --progress-fd stream, nil disables it
+	started   time.Time
+	total     int
+	completed int
+	failed    int
+	current   []string // Files currently being processed
+	results   map[string]int
+	bytesIn   int64
+	bytesOut  int64
+	remaining []string // Files never started because the run was interrupted
+	unchanged int      // Files skipped by --changed-only
+	durations map[string]time.Duration
 }
 
-func runConverter(cmd *cobra.Command, args []string) error {
-	if selfUpdateFlag {
-		if len(args) > 0 {
-			return fmt.Errorf("--self-update does not take arguments")
+// RunStatus is a point-in-time view of the run served on /status
+type RunStatus struct {
+	Total          int      `json:"total"`
+	Completed      int      `json:"completed"`
+	Failed         int      `json:"failed"`
+	Current        []string `json:"current"`
+	ElapsedSeconds float64  `json:"elapsed_seconds"`
+	ETASeconds     float64  `json:"eta_seconds,omitempty"` // Omitted until the first file finished
+}
+
+var progress = &progressReporter{}
+
+// publish delivers an event to the console, the --progress-fd stream and
+// Config.OnEvent
+func (p *progressReporter) publish(event Event) {
+	console.handleEvent(event)
+	if line, ok := progressEventFor(event); ok {
+		p.mu.Lock()
+		if p.encoder != nil {
+			line.Time = time.Now().UTC().Format(time.RFC3339)
+			p.encoder.Encode(line)
 		}
-		return selfUpdate(http.DefaultClient)
+		p.mu.Unlock()
 	}
-
-	if len(args) == 0 {
-		return fmt.Errorf("source directory required")
+	if config.OnEvent != nil {
+		p.events.Lock()
+		config.OnEvent(event)
+		p.events.Unlock()
 	}
+}
 
-	config.SourceDir = args[0]
-
-	// Validate enforce-output-format flag
-	if config.EnforceOutputFormat != "" {
-		validFormats := []string{"flac", "mp3", "alac"}
-		if !slices.Contains(validFormats, config.EnforceOutputFormat) {
-			return fmt.Errorf("invalid enforce-output-format: %s. Valid options are: flac, mp3, alac", config.EnforceOutputFormat)
+// progressEventFor converts an event to its --progress-fd line. FileProgress
+// has none.
+func progressEventFor(event Event) (ProgressEvent, bool) {
+	switch e := event.(type) {
+	case RunStarted:
+		return ProgressEvent{Event: "run_started", Total: e.Total}, true
+	case FileStarted:
+		return ProgressEvent{Event: "file_started", Path: e.Path}, true
+	case FileCompleted:
+		line := ProgressEvent{Event: "file_completed", Path: e.Path, Status: "ok"}
+		if e.Err != nil {
+			line.Status = "failed"
+			line.Error = e.Err.Error()
 		}
+		return line, true
+	case RunCompleted:
+		return ProgressEvent{Event: "run_completed", Completed: e.Summary.Completed, Failed: e.Summary.Failed, Remaining: len(e.Summary.Unprocessed)}, true
 	}
+	return ProgressEvent{}, false
+}
 
-	// Validate source directory
-	if _, err := os.Stat(config.SourceDir); os.IsNotExist(err) {
-		return fmt.Errorf("source directory does not exist: %s", config.SourceDir)
-	}
+func (p *progressReporter) runStarted(total int) {
+	p.mu.Lock()
+	p.started = time.Now()
+	p.total = total
+	p.mu.Unlock()
+	p.publish(RunStarted{Total: total})
+}
 
-	// Setup Sox command
-	if err := setupSoxCommand(); err != nil {
-		return err
-	}
+func (p *progressReporter) fileStarted(path string) {
+	p.mu.Lock()
+	p.current = append(p.current, path)
+	p.mu.Unlock()
+	p.publish(FileStarted{Path: path})
+}
 
-	// Create target directory
-	if err := os.MkdirAll(config.TargetDir, 0755); err != nil {
-		return fmt.Errorf("failed to create target directory: %w", err)
+// fileCompleted counts a processed file, how it was handled and the bytes it
+// read and wrote
+func (p *progressReporter) fileCompleted(event FileCompleted) {
+	p.mu.Lock()
+	if i := slices.Index(p.current, event.Path); i >= 0 {
+		p.current = slices.Delete(p.current, i, i+1)
 	}
-
-	// Process audio files
-	if err := processAudioFiles(); err != nil {
-		return err
+	if event.Err != nil {
+		p.failed++
+	} else {
+		p.completed++
 	}
-
-	// Copy image files if requested
-	if config.CopyImages {
-		if err := copyImageFiles(); err != nil {
-			return err
+	if p.results == nil {
+		p.results = make(map[string]int)
+	}
+	p.results[event.Action]++
+	p.bytesIn += event.BytesIn
+	p.bytesOut += event.BytesOut
+	if event.Duration > 0 {
+		if p.durations == nil {
+			p.durations = make(map[string]time.Duration)
 		}
+		p.durations[event.Action] += event.Duration
 	}
-
-	fmt.Println("Processing complete!")
-	return nil
+	p.mu.Unlock()
+	p.publish(event)
 }
 
-func setupSoxCommand() error {
-	if config.UseDocker {
-		// Check if docker is installed
-		if _, err := exec.LookPath("docker"); err != nil {
-			return fmt.Errorf("docker is not installed. Please install Docker to use this option")
-		}
-
-		// Get absolute paths
-		sourceAbs, err := filepath.Abs(config.SourceDir)
-		if err != nil {
-			return fmt.Errorf("failed to get absolute path for source directory: %w", err)
-		}
-
-		targetAbs, err := filepath.Abs(config.TargetDir)
-		if err != nil {
-			return fmt.Errorf("failed to get absolute path for target directory: %w", err)
-		}
+// snapshot returns the current run status. The ETA extrapolates the average
+// time per finished file, not counting time spent paused.
+func (p *progressReporter) snapshot() RunStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	status := RunStatus{
+		Total:     p.total,
+		Completed: p.completed,
+		Failed:    p.failed,
+		Current:   append([]string{}, p.current...),
+	}
+	if p.started.IsZero() {
+		return status
+	}
+	elapsed := time.Since(p.started)
+	status.ElapsedSeconds = elapsed.Seconds()
+	done := p.completed + p.failed
+	if done > 0 && done < p.total {
+		working := max(elapsed-control.pausedFor(), 0)
+		status.ETASeconds = (working / time.Duration(done) * time.Duration(p.total-done)).Seconds()
+	}
+	return status
+}
 
-		config.SourceDir = sourceAbs
-		config.TargetDir = targetAbs
-	} else {
-		// Check if sox is installed locally
-		if _, err := exec.LookPath(config.SoxCommand); err != nil {
-			return fmt.Errorf("sox is not installed. Please install sox or use --use-docker option")
-		}
+// skippedUnchanged counts a file skipped by --changed-only
+func (p *progressReporter) skippedUnchanged() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.unchanged++
+}
 
-		// Check for FFmpeg only when needed
-		needsFFmpeg := !config.NoPreserveMetadata
+// unchangedCount returns the number of files skipped by --changed-only
+func (p *progressReporter) unchangedCount() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.unchanged
+}
 
-		// Quick check if directory contains ALAC files (if metadata preservation is disabled)
-		if !needsFFmpeg {
-			hasALAC, _ := hasALACFiles(config.SourceDir)
-			needsFFmpeg = hasALAC
-		}
+// interrupted records the files a drained run did not start
+func (p *progressReporter) interrupted(remaining []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.remaining = remaining
+}
 
-		if needsFFmpeg {
-			if _, err := exec.LookPath("ffmpeg"); err != nil {
-				return fmt.Errorf("ffmpeg is not installed. Please install FFmpeg for ALAC support and metadata preservation, or use --use-docker option")
-			}
-		}
+// summary totals the run so far
+func (p *progressReporter) summary() RunSummary {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	summary := RunSummary{
+		Completed:        p.completed,
+		Failed:           p.failed,
+		Unprocessed:      slices.Clone(p.remaining),
+		Interrupted:      control.isDraining(),
+		Results:          maps.Clone(p.results),
+		BytesIn:          p.bytesIn,
+		BytesOut:         p.bytesOut,
+		DurationByAction: maps.Clone(p.durations),
 	}
-	return nil
+	for _, duration := range p.durations {
+		summary.Duration += duration
+	}
+	if !p.started.IsZero() {
+		summary.Elapsed = time.Since(p.started)
+	}
+	return summary
 }
 
-func hasALACFiles(dir string) (bool, error) {
-	hasALAC := false
-	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return nil // Continue walking even if there's an error with a specific file
-		}
-
-		if !info.IsDir() && strings.ToLower(filepath.Ext(path)) == ".m4a" {
-			hasALAC = true
-			return filepath.SkipAll // Found ALAC file, no need to continue
-		}
-		return nil
-	})
-	return hasALAC, err
+// RealtimeFactor returns how many times faster than realtime the run
+// processed its audio, or 0 when no duration is known
+func (s RunSummary) RealtimeFactor() float64 {
+	if s.Duration <= 0 || s.Elapsed <= 0 {
+		return 0
+	}
+	return s.Duration.Seconds() / s.Elapsed.Seconds()
 }
 
-func processAudioFiles() error {
-	return filepath.Walk(config.SourceDir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-
-		if info.IsDir() {
-			return nil
-		}
-
-		ext := strings.ToLower(filepath.Ext(path))
-		if ext != ".flac" && ext != ".mp3" && ext != ".m4a" {
-			return nil
-		}
+func (p *progressReporter) runCompleted() {
+	p.publish(RunCompleted{Summary: p.summary()})
+}
 
-		fmt.Printf("Processing: %s\n", path)
+// startStatusServer serves the run status on addr until the returned stop
+// function is called
+func startStatusServer(addr string) (func(), error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on status address %s: %v", addr, err)
+	}
 
-		// Create target directory structure
-		relPath, err := filepath.Rel(config.SourceDir, path)
-		if err != nil {
-			return err
-		}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(progress.snapshot())
+	})
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
 
-		targetPath := filepath.Join(config.TargetDir, relPath)
-		targetDir := filepath.Dir(targetPath)
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+	go server.Serve(listener)
+	logf("Serving status on http://%s/status\n", listener.Addr())
 
-		if err := os.MkdirAll(targetDir, 0755); err != nil {
-			return fmt.Errorf("failed to create target directory: %w", err)
-		}
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	}, nil
+}
 
-		// Handle enforce-output-format mode
-		if config.EnforceOutputFormat != "" {
-			return processAudioFileWithEnforcedFormat(path, targetPath, ext)
-		}
+// openProgressFD wraps an inherited file descriptor and makes sure it is open
+// for writing
+func openProgressFD(fd int) (*os.File, error) {
+	file := os.NewFile(uintptr(fd), fmt.Sprintf("progress-fd-%d", fd))
+	if file == nil {
+		return nil, fmt.Errorf("invalid progress-fd: %d", fd)
+	}
+	if _, err := file.Stat(); err != nil {
+		return nil, fmt.Errorf("progress-fd %d is not open: %w", fd, err)
+	}
+	if _, err := file.Write(nil); err != nil {
+		return nil, fmt.Errorf("progress-fd %d is not writable: %w", fd, err)
+	}
+	return file, nil
+}
 
-		// Original processing logic when no format enforcement
-		// Handle MP3 files - just copy them
-		if ext == ".mp3" {
-			fmt.Printf("Copying MP3 file: %s\n", path)
-			return copyFile(path, targetPath)
-		}
+// Exit codes, listed in the --help text
+const (
+	exitUsage        = 1 // Invalid flags or configuration, and errors without a class
+	exitEnvironment  = 2 // SoX, FFmpeg or Docker is missing
+	exitFileFailures = 3 // The run completed but some files failed
+	exitInterrupted  = 4 // Stopped by a signal
+	exitUpdate       = 5 // --self-update failed
+)
 
-		// Process FLAC and ALAC files
-		audioInfo, err := getAudioInfo(path)
-		if err != nil {
-			fmt.Printf("Warning: Could not get audio info for %s, copying original\n", path)
-			return copyFile(path, targetPath)
-		}
+// exitError attaches an exit code to an error returned by runConverter
+type exitError struct {
+	code int
+	err  error
+}
 
-		fmt.Printf("Detected: %d bits, %d Hz, %s format\n", audioInfo.Bits, audioInfo.Rate, audioInfo.Format)
+func (e *exitError) Error() string {
+	return e.err.Error()
+}
 
-		needsConversion, bitrateArgs, sampleRateArgs := determineConversion(audioInfo)
+func (e *exitError) Unwrap() error {
+	return e.err
+}
 
-		if needsConversion || audioInfo.Format == "alac" {
-			// Determine target sample rate for display based on source rate
-			var targetRate string
-			switch audioInfo.Rate {
-			case 48000, 96000, 192000, 384000:
-				targetRate = "48000 Hz"
-			case 44100, 88200, 176400, 352800:
-				targetRate = "44100 Hz"
-			default:
-				targetRate = "same rate"
-			}
+// exitCode maps an error returned by runConverter to the process exit code
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var coded *exitError
+	if errors.As(err, &coded) {
+		return coded.code
+	}
+	if errors.Is(err, errInterrupted) {
+		return exitInterrupted
+	}
+	return exitUsage
+}
 
-			if audioInfo.Format == "alac" {
-				if needsConversion {
-					fmt.Printf("Converting ALAC to FLAC: %s (%d-bit %d Hz → 16-bit %s)\n", path, audioInfo.Bits, audioInfo.Rate, targetRate)
-				} else {
-					fmt.Printf("Converting ALAC to FLAC: %s (maintaining %d-bit %d Hz)\n", path, audioInfo.Bits, audioInfo.Rate)
-				}
-				// Always convert ALAC to FLAC, even if bit depth and sample rate are acceptable
-				targetPath = changeExtensionToFlac(targetPath)
-			} else {
-				fmt.Printf("Converting FLAC: %s (%d-bit %d Hz → 16-bit %s)\n", path, audioInfo.Bits, audioInfo.Rate, targetRate)
-			}
+// errNoFiles is returned by --abort-if-no-files when nothing was queued
+var errNoFiles = errors.New("no audio files found")
+
+// errInterrupted is returned when a run was stopped by a signal
+var errInterrupted = errors.New("interrupted by signal")
+
+// runControl coordinates stopping a run. The first interrupt drains the run:
+// no new files are started but in-flight ones finish. A second interrupt
+// kills running tools and removes their partial outputs.
+type runControl struct {
+	ctx      context.Context
+	cancel   context.CancelFunc
+	draining atomic.Bool
+	mu       sync.Mutex
+	temps    map[string]bool
+	workDir  string // Run-scoped directory holding intermediate files
+
+	// Pausing holds back new files until resumed; pausedFor excludes the
+	// time spent paused from time estimates
+	resumed     *sync.Cond
+	paused      bool
+	pausedSince time.Time
+	pausedTotal time.Duration
+}
 
-			if err := processAudioFile(path, targetPath, audioInfo, needsConversion, bitrateArgs, sampleRateArgs); err != nil {
-				fmt.Printf("Error: Audio conversion failed. Copying original file instead. Error: %v\n", err)
-				return copyFile(path, targetPath)
-			}
-		} else {
-			fmt.Printf("Copying FLAC: %s\n", path)
-			return copyFile(path, targetPath)
-		}
+var control = newRunControl()
 
-		return nil
-	})
+func newRunControl() *runControl {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &runControl{ctx: ctx, cancel: cancel, temps: make(map[string]bool)}
+	c.resumed = sync.NewCond(&c.mu)
+	return c
 }
 
-func processAudioFileWithEnforcedFormat(sourcePath, targetPath, sourceExt string) error {
-	// Get audio info for source file
-	var audioInfo *AudioInfo
-	var err error
+func (c *runControl) requestDrain() {
+	c.draining.Store(true)
+	// Wake a paused dispatcher so it can notice the drain
+	c.mu.Lock()
+	c.resumed.Broadcast()
+	c.mu.Unlock()
+}
 
-	// Skip MP3 files if they don't need processing
-	if sourceExt == ".mp3" && config.EnforceOutputFormat == "mp3" {
-		fmt.Printf("Copying MP3 file: %s (already in target format)\n", sourcePath)
-		return copyFile(sourcePath, targetPath)
+// pause stops new files from being started. Files in progress finish.
+func (c *runControl) pause() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.paused {
+		return
 	}
+	c.paused = true
+	c.pausedSince = time.Now()
+	logf("Paused: in-flight files will finish, no new files will be started. Send SIGUSR2 (or SIGUSR1 again) to resume.\n")
+}
 
-	// Get audio info for FLAC and ALAC files
-	if sourceExt == ".flac" || sourceExt == ".m4a" {
-		audioInfo, err = getAudioInfo(sourcePath)
-		if err != nil {
-			fmt.Printf("Warning: Could not get audio info for %s, copying original\n", sourcePath)
-			return copyFile(sourcePath, targetPath)
-		}
-		fmt.Printf("Detected: %d bits, %d Hz, %s format\n", audioInfo.Bits, audioInfo.Rate, audioInfo.Format)
+func (c *runControl) resume() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.paused {
+		return
 	}
+	c.paused = false
+	c.pausedTotal += time.Since(c.pausedSince)
+	c.resumed.Broadcast()
+	logf("Resumed\n")
+}
 
-	// Determine target file extension and process accordingly
-	switch config.EnforceOutputFormat {
-	case "flac":
-		return processToFLAC(sourcePath, targetPath, sourceExt, audioInfo)
-	case "mp3":
-		return processToMP3(sourcePath, targetPath, sourceExt, audioInfo)
-	case "alac":
-		return processToALAC(sourcePath, targetPath, sourceExt, audioInfo)
-	default:
-		return fmt.Errorf("unsupported enforce-output-format: %s", config.EnforceOutputFormat)
+func (c *runControl) togglePause() {
+	if c.isPaused() {
+		c.resume()
+	} else {
+		c.pause()
 	}
 }
 
-func processToFLAC(sourcePath, targetPath, sourceExt string, audioInfo *AudioInfo) error {
-	// Change target extension to .flac
-	targetPath = changeExtensionToFlac(targetPath)
+func (c *runControl) isPaused() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.paused
+}
 
-	if sourceExt == ".mp3" {
-		// Never convert MP3 to FLAC - just copy the original MP3
-		fmt.Printf("Copying MP3: %s (MP3 files are not converted to lossless formats)\n", sourcePath)
-		// Keep original extension for MP3
-		originalTargetPath := strings.TrimSuffix(targetPath, ".flac") + ".mp3"
-		return copyFile(sourcePath, originalTargetPath)
+// pausedFor returns the total time the run spent paused so far
+func (c *runControl) pausedFor() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	total := c.pausedTotal
+	if c.paused {
+		total += time.Since(c.pausedSince)
 	}
+	return total
+}
 
-	if sourceExt == ".flac" && audioInfo != nil {
-		// Check if FLAC needs conversion or can be copied
-		needsConversion, bitrateArgs, sampleRateArgs := determineConversion(audioInfo)
-		if !needsConversion {
-			fmt.Printf("Copying FLAC: %s (already 16-bit)\n", sourcePath)
-			return copyFile(sourcePath, targetPath)
-		} else {
-			fmt.Printf("Converting FLAC: %s (reducing quality to 16-bit)\n", sourcePath)
-			return processAudioFile(sourcePath, targetPath, audioInfo, needsConversion, bitrateArgs, sampleRateArgs)
-		}
+// waitIfPaused blocks while the run is paused, unless a drain is requested
+func (c *runControl) waitIfPaused() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for c.paused && !c.isDraining() {
+		c.resumed.Wait()
 	}
+}
 
-	if sourceExt == ".m4a" && audioInfo != nil {
-		// Convert ALAC to FLAC
-		needsConversion, bitrateArgs, sampleRateArgs := determineConversion(audioInfo)
-		if needsConversion {
-			fmt.Printf("Converting ALAC to FLAC: %s (reducing quality to 16-bit)\n", sourcePath)
-		} else {
-			fmt.Printf("Converting ALAC to FLAC: %s (maintaining quality)\n", sourcePath)
-		}
-		return processAudioFile(sourcePath, targetPath, audioInfo, needsConversion, bitrateArgs, sampleRateArgs)
-	}
+func (c *runControl) isDraining() bool {
+	return c.draining.Load()
+}
 
-	return fmt.Errorf("unsupported source format for FLAC conversion: %s", sourceExt)
+// trackTemp registers a file being written by an external tool, so it can be
+// removed when the run is force-stopped
+func (c *runControl) trackTemp(path string) {
+	c.mu.Lock()
+	c.temps[path] = true
+	c.mu.Unlock()
 }
 
-func processToMP3(sourcePath, targetPath, sourceExt string, audioInfo *AudioInfo) error {
-	// Change target extension to .mp3
-	targetPath = changeExtensionToMP3(targetPath)
+func (c *runControl) releaseTemp(path string) {
+	c.mu.Lock()
+	delete(c.temps, path)
+	c.mu.Unlock()
+}
 
-	if sourceExt == ".mp3" {
-		fmt.Printf("Copying MP3: %s (already in target format)\n", sourcePath)
-		return copyFile(sourcePath, targetPath)
+// forceStop kills running tools and removes the files they were writing
+func (c *runControl) forceStop() {
+	c.cancel()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for path := range c.temps {
+		os.Remove(path)
+	}
+	if c.workDir != "" {
+		os.RemoveAll(c.workDir)
 	}
-
-	// Convert FLAC or ALAC to MP3 at 320kbps
-	fmt.Printf("Converting %s to MP3: %s (320kbps)\n", strings.ToUpper(strings.TrimPrefix(sourceExt, ".")), sourcePath)
-	return convertToMP3(sourcePath, targetPath, audioInfo)
 }
 
-func processToALAC(sourcePath, targetPath, sourceExt string, audioInfo *AudioInfo) error {
-	// Change target extension to .m4a
-	targetPath = changeExtensionToM4A(targetPath)
+// minFreeSpace is the free space below which a directory is considered full
+const minFreeSpace = 1 << 20
 
-	if sourceExt == ".m4a" && audioInfo != nil {
-		// Check if ALAC needs conversion or can be copied
-		if audioInfo.Bits == 16 && (audioInfo.Rate == 44100 || audioInfo.Rate == 48000) {
-			fmt.Printf("Copying ALAC: %s (already 16-bit)\n", sourcePath)
-			return copyFile(sourcePath, targetPath)
-		} else {
-			fmt.Printf("Converting ALAC: %s (reducing quality to 16-bit)\n", sourcePath)
-			return convertToALAC(sourcePath, targetPath, audioInfo)
-		}
-	}
+// diskFreeSpace reports the free space of a directory's filesystem
+var diskFreeSpace = freeSpace
 
-	if sourceExt == ".flac" {
-		// Convert FLAC to ALAC
-		fmt.Printf("Converting FLAC to ALAC: %s\n", sourcePath)
-		return convertToALAC(sourcePath, targetPath, audioInfo)
+// checkWritable writes and deletes a small file in dir and checks that its
+// filesystem has space left, so an unusable directory fails the run once
+// instead of failing every file
+func checkWritable(name, dir string) error {
+	file, err := os.CreateTemp(dir, ".lilt-write-test-*")
+	if err != nil {
+		return fmt.Errorf("%s directory %s is not writable: %w", name, dir, err)
+	}
+	_, err = file.WriteString("lilt")
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	os.Remove(file.Name())
+	if err != nil {
+		return fmt.Errorf("%s directory %s is not writable: %w", name, dir, err)
+	}
+	if free, ok := diskFreeSpace(dir); ok && free < minFreeSpace {
+		return fmt.Errorf("%s directory %s is full (%d bytes free)", name, dir, free)
 	}
+	return nil
+}
 
-	if sourceExt == ".mp3" {
-		// Never convert MP3 to ALAC - just copy the original MP3
-		fmt.Printf("Copying MP3: %s (MP3 files are not converted to lossless formats)\n", sourcePath)
-		// Keep original extension for MP3
-		originalTargetPath := strings.TrimSuffix(targetPath, ".m4a") + ".mp3"
-		return copyFile(sourcePath, originalTargetPath)
+// workDirPrefix starts the name of every run's working directory
+const workDirPrefix = ".lilt-work-"
+
+// createWorkDir creates the working directory of the run under parent
+func (c *runControl) createWorkDir(parent string) error {
+	dir := filepath.Join(parent, fmt.Sprintf("%s%s-%d", workDirPrefix, time.Now().Format("20060102-150405"), os.Getpid()))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create working directory: %w", err)
 	}
+	writeScannerMarkers(dir)
+	c.mu.Lock()
+	c.workDir = dir
+	c.mu.Unlock()
+	return nil
+}
 
-	return fmt.Errorf("unsupported source format for ALAC conversion: %s", sourceExt)
+// scannerMarker is a file that makes media scanners skip its directory and
+// everything below it
+type scannerMarker struct {
+	name    string
+	content string
 }
 
-func getAudioInfo(filePath string) (*AudioInfo, error) {
-	ext := strings.ToLower(filepath.Ext(filePath))
+// scannerMarkers are .nomedia for Android and Kodi and .plexignore for Plex
+var scannerMarkers = []scannerMarker{
+	{".nomedia", ""},
+	{".plexignore", "*\n"},
+}
 
-	if ext == ".m4a" {
-		return getALACInfo(filePath)
-	} else {
-		return getFLACInfo(filePath)
+// writeScannerMarkers marks dir for media scanners to skip, unless
+// --no-scanner-markers is given. Existing markers are left alone, and a
+// marker that cannot be written only costs a warning.
+func writeScannerMarkers(dir string) {
+	if config.NoScannerMarkers {
+		return
+	}
+	for _, marker := range scannerMarkers {
+		path := filepath.Join(dir, marker.name)
+		if _, err := os.Lstat(path); err == nil {
+			continue
+		}
+		if err := os.WriteFile(path, []byte(marker.content), 0644); err != nil {
+			logf("Warning: Failed to write %s: %v\n", path, err)
+		}
 	}
 }
 
-func getFLACInfo(filePath string) (*AudioInfo, error) {
-	var cmd *exec.Cmd
+// isScannerMarker reports whether name is one of the scannerMarkers
+func isScannerMarker(name string) bool {
+	return slices.ContainsFunc(scannerMarkers, func(marker scannerMarker) bool { return marker.name == name })
+}
 
-	if config.UseDocker {
-		dockerPath := getDockerPath(filePath)
-		args := []string{"run", "--rm",
-			"-v", fmt.Sprintf("%s:/source", config.SourceDir),
-			"-v", fmt.Sprintf("%s:/target", config.TargetDir),
-			config.DockerImage, "--i", dockerPath}
-		cmd = exec.Command("docker", args...)
-	} else {
-		cmd = exec.Command(config.SoxCommand, "--i", filePath)
-	}
+// isBookkeepingFile reports whether name is a file lilt keeps in a target
+// tree for itself rather than an output: the state file or a scanner marker
+func isBookkeepingFile(name string) bool {
+	return name == stateFileName || isScannerMarker(name)
+}
 
-	output, err := cmd.Output()
-	if err != nil {
-		return nil, err
-	}
+// isPartialFile reports whether name is a partialPath, an output a stopped
+// run left unfinished
+func isPartialFile(name string) bool {
+	ext := filepath.Ext(name)
+	return strings.HasPrefix(name, ".") && (ext == ".partial" || strings.HasSuffix(strings.TrimSuffix(name, ext), ".partial"))
+}
 
-	audioInfo, err := parseAudioInfo(string(output))
-	if err != nil {
-		return nil, err
+// removeWorkDir removes the working directory with anything left in it
+func (c *runControl) removeWorkDir() {
+	c.mu.Lock()
+	dir := c.workDir
+	c.workDir = ""
+	c.mu.Unlock()
+	if dir != "" {
+		os.RemoveAll(dir)
 	}
-
-	audioInfo.Format = "flac"
-	return audioInfo, nil
 }
 
-func getALACInfo(filePath string) (*AudioInfo, error) {
-	var cmd *exec.Cmd
+func (c *runControl) workDirPath() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.workDir
+}
 
-	if config.UseDocker {
-		dockerPath := getDockerPath(filePath)
-		args := []string{"run", "--rm", "--entrypoint", "ffprobe",
-			"-v", fmt.Sprintf("%s:/source", config.SourceDir),
-			"-v", fmt.Sprintf("%s:/target", config.TargetDir),
-			config.DockerImage,
-			"-v", "quiet", "-show_entries", "stream=sample_rate,bits_per_raw_sample", "-of", "csv=p=0", dockerPath}
-		cmd = exec.Command("docker", args...)
-	} else {
-		// Check if ffprobe is available
-		if _, err := exec.LookPath("ffprobe"); err != nil {
-			return nil, fmt.Errorf("ffprobe is not installed. Please install FFmpeg for ALAC support or use --use-docker option")
-		}
-		cmd = exec.Command("ffprobe", "-v", "quiet", "-show_entries", "stream=sample_rate,bits_per_raw_sample", "-of", "csv=p=0", filePath)
+// dispatchWorker is the scratch of work done outside the file workers, such
+// as stripping embedded art once the files are done. The workers of the pool
+// are numbered from 1.
+const dispatchWorker = 0
+
+// workerScratch returns the scratch directory of a worker inside the run's
+// working directory, or an empty string when there is none. Workers never
+// share intermediate names, and each cleans up by removing its directory.
+// Being under the working directory, it is reached through the /target mount
+// in Docker mode like any other intermediate.
+func (c *runControl) workerScratch(worker int) string {
+	dir := c.workDirPath()
+	if dir == "" {
+		return ""
 	}
+	return filepath.Join(dir, fmt.Sprintf("worker-%d", worker))
+}
 
-	output, err := cmd.Output()
-	if err != nil {
-		return nil, err
+// removeWorkerScratch removes a worker's scratch directory with anything it
+// left behind
+func (c *runControl) removeWorkerScratch(worker int) {
+	if dir := c.workerScratch(worker); dir != "" {
+		os.RemoveAll(dir)
 	}
-
-	return parseALACInfo(string(output))
 }
 
-func parseALACInfo(info string) (*AudioInfo, error) {
-	lines := strings.Split(strings.TrimSpace(info), "\n")
-	if len(lines) == 0 {
-		return nil, fmt.Errorf("no audio stream information found")
+// tempPathFor returns where the intermediate output for targetPath is
+// written: inside the scratch directory of the worker converting t, mirroring
+// the target layout, or next to the target when there is no working directory
+func tempPathFor(t *fileTask, targetPath string) string {
+	ext := filepath.Ext(targetPath)
+	sibling := strings.TrimSuffix(targetPath, ext) + ".tmp" + ext
+	worker := dispatchWorker
+	if t != nil {
+		worker = t.worker
+	}
+	workDir := control.workerScratch(worker)
+	if workDir == "" {
+		return sibling
+	}
+	rel, err := filepath.Rel(config.TargetDir, targetPath)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		rel = filepath.Base(targetPath)
+	}
+	path := filepath.Join(workDir, strings.TrimSuffix(rel, ext)+".tmp"+ext)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return sibling
 	}
+	return path
+}
 
-	// Look for the first line that contains valid audio stream data (both rate and bits)
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if line == "" {
-			continue
-		}
+// partialPath returns the hidden name an output is written under next to
+// targetPath until it is complete. The extension is kept for the tools that
+// pick the format from it.
+func partialPath(targetPath string) string {
+	dir, base := filepath.Split(targetPath)
+	ext := filepath.Ext(base)
+	return filepath.Join(dir, "."+strings.TrimSuffix(base, ext)+".partial"+ext)
+}
 
-		parts := strings.Split(line, ",")
-		if len(parts) < 2 {
-			continue // Skip lines that don't have both values
-		}
+// moveIntoPlace moves a finished intermediate to its target. A rename fails
+// when --temp-dir is on another filesystem, in which case the file is copied.
+func moveIntoPlace(tempPath, targetPath string) error {
+	err := os.Rename(tempPath, targetPath)
+	var linkErr *os.LinkError
+	if err == nil || !errors.As(err, &linkErr) || !errors.Is(linkErr.Err, syscall.EXDEV) {
+		return err
+	}
+	if err := copyFile(nil, tempPath, targetPath); err != nil {
+		return err
+	}
+	return os.Remove(tempPath)
+}
 
-		rate, err := strconv.Atoi(strings.TrimSpace(parts[0]))
-		if err != nil {
-			continue // Skip lines with invalid sample rate
+// watchInterrupts drains the run on the first SIGINT/SIGTERM and force-stops
+// it on the second. The returned function stops watching.
+func watchInterrupts() func() {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	done := make(chan struct{})
+
+	go func() {
+		count := 0
+		for {
+			select {
+			case <-signals:
+				count++
+				if count == 1 {
+					logf("\nInterrupt received, finishing in-flight files. Press Ctrl-C again to stop immediately.\n")
+					control.requestDrain()
+					continue
+				}
+				logf("\nStopping immediately, removing partial files.\n")
+				control.forceStop()
+				// The run returns through runConverter once the killed
+				// tools exit. Another interrupt terminates the process.
+				signal.Stop(signals)
+			case <-done:
+				return
+			}
 		}
+	}()
 
-		bits, err := strconv.Atoi(strings.TrimSpace(parts[1]))
-		if err != nil {
-			continue // Skip lines with invalid bit depth
-		}
+	return func() {
+		signal.Stop(signals)
+		close(done)
+	}
+}
 
-		// Skip streams that don't look like audio (rate should be reasonable)
-		if rate < 8000 || rate > 500000 {
-			continue
+// newCommand creates an external tool command bound to the run, so it is
+// killed on a forced stop. Tools are started in their own process group to
+// let them finish their current file when the terminal sends an interrupt.
+// Commands run for a source file are created with fileTask.command instead.
+func newCommand(name string, args ...string) *exec.Cmd {
+	container := ""
+	if name == "docker" && len(args) > 0 && args[0] == "run" {
+		args, container = dockerRunArgs(args)
+	}
+	cmd := exec.CommandContext(control.ctx, name, args...)
+	configureCommand(cmd)
+	if container != "" {
+		// Killing the docker client leaves its container running
+		cmd.Cancel = func() error {
+			exec.Command("docker", "kill", container).Run()
+			return cmd.Process.Kill()
 		}
+	}
+	return cmd
+}
 
-		return &AudioInfo{
-			Bits:   bits,
-			Rate:   rate,
-			Format: "alac",
-		}, nil
+// commandOutput runs cmd and returns its standard output. It replaces
+// cmd.Output, which refuses commands whose output newCommand already captures.
+func commandOutput(cmd *exec.Cmd) ([]byte, error) {
+	captured, ok := cmd.Stdout.(*bytes.Buffer)
+	if !ok {
+		return cmd.Output()
 	}
+	err := cmd.Run()
+	return captured.Bytes(), err
+}
 
-	return nil, fmt.Errorf("no valid audio stream information found")
+// commandStep is an external command run for a source file, kept so a
+// failure can be written to --error-log-dir
+type commandStep struct {
+	args   []string
+	stdout bytes.Buffer
+	stderr bytes.Buffer
 }
 
-func changeExtensionToFlac(filePath string) string {
-	ext := filepath.Ext(filePath)
-	return strings.TrimSuffix(filePath, ext) + ".flac"
+// fileTask is the processing of one source file. It is passed down the
+// conversion functions and holds the conversion policy of the file, the
+// commands run for it, the pipeline of tools they make up and the policy
+// decision behind them. Functions also used outside of processing accept a
+// nil task.
+type fileTask struct {
+	path     string
+	format   string // Enforced output format, "" in the default mode
+	policy   ConversionPolicy
+	out      *fileOutput // Holds the lines of the file back, nil to write them as they are logged
+	worker   int         // Worker whose scratch directory holds the intermediates
+	steps    []*commandStep
+	pipeline []string
+	decision *Decision
 }
 
-func changeExtensionToMP3(filePath string) string {
-	ext := filepath.Ext(filePath)
-	return strings.TrimSuffix(filePath, ext) + ".mp3"
+// newFileTask starts processing the source file at path into the output
+// format of a single format run, under the policy of the configuration
+func newFileTask(path string) *fileTask {
+	return &fileTask{path: path, format: config.EnforceOutputFormat, policy: policyFromConfig()}
 }
 
-func changeExtensionToM4A(filePath string) string {
-	ext := filepath.Ext(filePath)
-	return strings.TrimSuffix(filePath, ext) + ".m4a"
+// start begins an output of the file in a format under a policy, forgetting
+// what was run for an earlier output format
+func (t *fileTask) start(format string, policy ConversionPolicy) {
+	t.format = format
+	t.policy = policy
+	t.steps = nil
+	t.pipeline = nil
+	t.decision = nil
 }
 
-func convertToMP3(sourcePath, targetPath string, audioInfo *AudioInfo) error {
-	// MP3 conversion: Use SoX to convert audio, then FFmpeg to preserve metadata
-	var tempPath string
+// command creates an external tool command like newCommand and records it
+// in the file's pipeline, capturing its output for --error-log-dir
+func (t *fileTask) command(name string, args ...string) *exec.Cmd {
+	cmd := newCommand(name, args...)
+	if t == nil {
+		return cmd
+	}
+	t.note(pipelineStage(name, args))
+	if config.ErrorLogDir != "" {
+		step := &commandStep{args: cmd.Args}
+		cmd.Stdout = &step.stdout
+		cmd.Stderr = &step.stderr
+		t.steps = append(t.steps, step)
+	}
+	return cmd
+}
 
-	if !config.NoPreserveMetadata {
-		// Create temporary path for conversion output with proper extension
-		ext := filepath.Ext(targetPath)
-		tempPath = strings.TrimSuffix(targetPath, ext) + ".tmp" + ext
-	} else {
-		tempPath = targetPath
+// logf logs a line of the file, through its output when it has one
+func (t *fileTask) logf(format string, args ...any) {
+	if t == nil || t.out == nil {
+		logf(format, args...)
+		return
 	}
+	console.print(t.out, fmt.Sprintf(format, args...))
+}
 
-	// Determine appropriate sample rate for MP3
-	targetSampleRate := "44100"
-	if audioInfo != nil {
-		switch audioInfo.Rate {
-		case 48000, 96000, 192000, 384000:
-			targetSampleRate = "48000"
-		default:
-			targetSampleRate = "44100"
-		}
+// note appends a stage to the pipeline of the file
+func (t *fileTask) note(stage string) {
+	if t != nil {
+		t.pipeline = append(t.pipeline, stage)
 	}
+}
 
-	var cmd *exec.Cmd
+// decide returns the policy decision for the file, keeping it for the report
+func (t *fileTask) decide(info *AudioInfo) Decision {
+	decision := t.policy.Decide(info)
+	t.decision = &decision
+	return decision
+}
 
-	if config.UseDocker {
-		dockerSourcePath := getDockerPath(sourcePath)
-		dockerTempPath := getDockerTargetPath(tempPath)
-		args := []string{"run", "--rm",
-			"-v", fmt.Sprintf("%s:/source", config.SourceDir),
-			"-v", fmt.Sprintf("%s:/target", config.TargetDir),
-			config.DockerImage, dockerSourcePath, "-t", "mp3", "-C", "320", "-r", targetSampleRate, dockerTempPath}
-		cmd = exec.Command("docker", args...)
-	} else {
-		cmd = exec.Command(config.SoxCommand, sourcePath, "-t", "mp3", "-C", "320", "-r", targetSampleRate, tempPath)
-	}
+// containerCount numbers the Docker containers started by the process
+var containerCount atomic.Int64
 
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("conversion to MP3 failed: %w", err)
-	}
+// dockerRunArgs names the container of a "docker run" and runs it with
+// --init, so a forced stop can kill it and the tool inside gets the signal
+func dockerRunArgs(args []string) ([]string, string) {
+	name := fmt.Sprintf("lilt-%d-%d", os.Getpid(), containerCount.Add(1))
+	return slices.Concat([]string{"run", "--init", "--name", name}, args[1:]), name
+}
 
-	if !config.NoPreserveMetadata {
-		// Merge metadata using FFmpeg
-		if mergeErr := mergeMetadataWithFFmpeg(sourcePath, tempPath, targetPath); mergeErr != nil {
-			fmt.Printf("Warning: Metadata preservation failed for %s, keeping converted audio without tags: %v\n", targetPath, mergeErr)
-			// Fallback: rename temp to target
-			if renameErr := os.Rename(tempPath, targetPath); renameErr != nil {
-				return fmt.Errorf("fallback rename failed after metadata merge error: %w", renameErr)
+// pipelineStage names the stage an external command is: the tool, with
+// "-merge" for FFmpeg's metadata merge and "(docker)" when it runs in the
+// container, whose default entrypoint is SoX
+func pipelineStage(name string, args []string) string {
+	docker := name == "docker"
+	if docker {
+		name = "sox"
+		if i := slices.Index(args, "--entrypoint"); i >= 0 && i+1 < len(args) {
+			name = args[i+1]
+		}
+	}
+	name = filepath.Base(name)
+	switch {
+	case name == filepath.Base(config.SoxCommand) || strings.HasPrefix(name, "sox"):
+		name = "sox"
+	case name == "ffmpeg" && slices.Contains(args, "-map_metadata"):
+		// The merge maps the converted audio from its second input
+		for i := range len(args) - 1 {
+			if args[i] == "-map" && args[i+1] == "1" {
+				name = "ffmpeg-merge"
 			}
-			return nil
 		}
-		// If merge succeeded, temp is already removed in merge function
-	} else {
-		// If not preserving metadata, tempPath == targetPath, no action needed
 	}
-
-	return nil
+	if docker {
+		name += "(docker)"
+	}
+	return name
 }
 
-func convertToALAC(sourcePath, targetPath string, audioInfo *AudioInfo) error {
-	// ALAC conversion:
-	// To preserve the best quality and metadata:
-	// First Use SoX to process and downsample audio to a temp FLAC, since sox can do this better
-	// Then since SoX can't encode to ALAC, use FFmpeg to convert to ALAC and preserve metadata
-
-	var tempPath string
+// FilePipeline records the tools a source file went through for one output
+// format
+type FilePipeline struct {
+	Path     string    `json:"path"`
+	Format   string    `json:"format"`
+	Pipeline string    `json:"pipeline"`
+	Decision *Decision `json:"decision,omitempty"`
+}
 
-	if !config.NoPreserveMetadata {
-		// Create temporary path for conversion output with proper extension
-		ext := filepath.Ext(targetPath)
-		tempPath = strings.TrimSuffix(targetPath, ext) + ".tmp" + ext
-	} else {
-		tempPath = targetPath
+// pipelines collects the pipelines of the current run by path and format
+var pipelines = struct {
+	sync.Mutex
+	byFile map[string]FilePipeline
+}{byFile: make(map[string]FilePipeline)}
+
+// recordPipeline keeps the pipeline a file went through, replacing the one
+// of an earlier attempt, and prints it with --verbose
+func recordPipeline(t *fileTask) {
+	pipeline := strings.Join(t.pipeline, "→")
+	decision := t.decision
+	if pipeline == "" {
+		return
 	}
+	if config.Verbose {
+		t.logf("Pipeline: %s\n", pipeline)
+		if decision != nil {
+			t.logf("Decision: %s\n", decision)
+		}
+	}
+	format := t.policy.Format
+	pipelines.Lock()
+	pipelines.byFile[t.path+"\x00"+format] = FilePipeline{Path: t.path, Format: format, Pipeline: pipeline, Decision: decision}
+	pipelines.Unlock()
+}
 
-	// Step 1: Use SoX to convert source to intermediate FLAC with proper bit depth/sample rate
-	tempFlacPath := strings.TrimSuffix(tempPath, ".m4a") + ".temp.flac"
+func recordedPipelines() []FilePipeline {
+	pipelines.Lock()
+	defer pipelines.Unlock()
+	list := slices.Collect(maps.Values(pipelines.byFile))
+	slices.SortFunc(list, func(a, b FilePipeline) int {
+		return cmp.Or(strings.Compare(a.Path, b.Path), strings.Compare(a.Format, b.Format))
+	})
+	return list
+}
 
-	// Determine if we need SoX processing for bit depth/sample rate conversion
-	needsConversion := false
-	var bitrateArgs []string
-	sampleRateArgs := []string{"rate", "-v", "-L"}
+func resetPipelines() {
+	pipelines.Lock()
+	clear(pipelines.byFile)
+	pipelines.Unlock()
+}
 
-	if audioInfo != nil {
-		// Check bit depth
-		if audioInfo.Bits > 16 {
-			needsConversion = true
-			bitrateArgs = []string{"-b", "16"}
-		}
+// ConversionFailure records a conversion that failed, with the log of the
+// commands that were tried
+type ConversionFailure struct {
+	Path  string `json:"path"`
+	Error string `json:"error"`
+	Log   string `json:"log,omitempty"`
+}
 
-		// Check sample rate
-		switch audioInfo.Rate {
-		case 96000, 192000, 384000:
-			needsConversion = true
-			sampleRateArgs = append(sampleRateArgs, "48000")
-		case 88200, 176400, 352800:
-			needsConversion = true
-			sampleRateArgs = append(sampleRateArgs, "44100")
+var conversionFailures = struct {
+	sync.Mutex
+	list []ConversionFailure
+}{}
+
+// recordConversionFailure writes the commands run for a file to a log file
+// named after its relative path and records the failure for the report. The
+// log directory is only created once something fails.
+func recordConversionFailure(t *fileTask, err error) {
+	failure := ConversionFailure{Path: t.path, Error: err.Error()}
+	if config.ErrorLogDir != "" {
+		logPath, writeErr := writeErrorLog(t, err)
+		if writeErr != nil {
+			t.logf("Warning: Failed to write error log for %s: %v\n", t.path, writeErr)
+		} else {
+			failure.Log = logPath
 		}
 	}
+	conversionFailures.Lock()
+	conversionFailures.list = append(conversionFailures.list, failure)
+	conversionFailures.Unlock()
+}
 
-	var cmd *exec.Cmd
+func writeErrorLog(t *fileTask, err error) (string, error) {
+	relPath, relErr := filepath.Rel(sourceRoot(), t.path)
+	if relErr != nil || strings.HasPrefix(relPath, "..") {
+		relPath = filepath.Base(t.path)
+	}
+	logPath := filepath.Join(config.ErrorLogDir, relPath+".log")
+	if err := os.MkdirAll(filepath.Dir(logPath), 0755); err != nil {
+		return "", err
+	}
+	writeScannerMarkers(config.ErrorLogDir)
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Source: %s\nError: %v\n", t.path, err)
+	for _, step := range t.steps {
+		fmt.Fprintf(&buf, "\n$ %s\n", quoteArgs(step.args))
+		fmt.Fprintf(&buf, "--- stdout ---\n%s", step.stdout.String())
+		fmt.Fprintf(&buf, "--- stderr ---\n%s", step.stderr.String())
+	}
+	if err := os.WriteFile(logPath, buf.Bytes(), 0644); err != nil {
+		return "", err
+	}
+	return logPath, nil
+}
 
-	if needsConversion {
-		// Use SoX for quality conversion to FLAC first
-		if config.UseDocker {
-			dockerSource := getDockerPath(sourcePath)
-			dockerTempFlac := getDockerTargetPath(tempFlacPath)
+// quoteArgs formats a command line, quoting arguments with spaces or quotes
+func quoteArgs(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		if arg == "" || strings.ContainsAny(arg, " \t\"'\\") {
+			arg = strconv.Quote(arg)
+		}
+		quoted[i] = arg
+	}
+	return strings.Join(quoted, " ")
+}
 
-			args := []string{"run", "--rm",
-				"-v", fmt.Sprintf("%s:/source", config.SourceDir),
-				"-v", fmt.Sprintf("%s:/target", config.TargetDir),
-				config.DockerImage, "--multi-threaded", "-G", dockerSource}
+func recordedConversionFailures() []ConversionFailure {
+	conversionFailures.Lock()
+	defer conversionFailures.Unlock()
+	list := slices.Clone(conversionFailures.list)
+	slices.SortFunc(list, func(a, b ConversionFailure) int { return strings.Compare(a.Path, b.Path) })
+	return list
+}
 
-			args = append(args, bitrateArgs...)
-			args = append(args, dockerTempFlac)
-			args = append(args, sampleRateArgs...)
-			args = append(args, "dither")
+func resetConversionFailures() {
+	conversionFailures.Lock()
+	conversionFailures.list = nil
+	conversionFailures.Unlock()
+}
 
-			cmd = exec.Command("docker", args...)
-		} else {
-			args := []string{"--multi-threaded", "-G", sourcePath}
-			args = append(args, bitrateArgs...)
-			args = append(args, tempFlacPath)
-			args = append(args, sampleRateArgs...)
-			args = append(args, "dither")
+// Actions a source file can end up with
+const (
+	actionConverted = "converted"
+	actionCopied    = "copied"
+	actionFailed    = "failed"
+	actionSkipped   = "skipped"
+)
 
-			cmd = exec.Command(config.SoxCommand, args...)
-		}
+// fileActions remembers how source files were handled while they are being
+// processed. Copies mark themselves, everything else that succeeds converted.
+var fileActions = struct {
+	sync.Mutex
+	byPath map[string]string
+}{byPath: make(map[string]string)}
+
+// fileDurations holds the audio duration probed for files being processed
+var fileDurations = struct {
+	sync.Mutex
+	byPath map[string]time.Duration
+}{byPath: make(map[string]time.Duration)}
+
+func noteDuration(path string, duration time.Duration) {
+	if duration <= 0 {
+		return
+	}
+	fileDurations.Lock()
+	fileDurations.byPath[path] = duration
+	fileDurations.Unlock()
+}
 
-		if err := cmd.Run(); err != nil {
-			return fmt.Errorf("SoX conversion to FLAC failed: %w", err)
-		}
-	} else {
-		// Direct conversion to FLAC without quality changes
-		if config.UseDocker {
-			dockerSource := getDockerPath(sourcePath)
-			dockerTempFlac := getDockerTargetPath(tempFlacPath)
+// takeDuration returns the probed duration of a processed file and forgets it
+func takeDuration(path string) time.Duration {
+	fileDurations.Lock()
+	defer fileDurations.Unlock()
+	duration := fileDurations.byPath[path]
+	delete(fileDurations.byPath, path)
+	return duration
+}
 
-			args := []string{"run", "--rm",
-				"-v", fmt.Sprintf("%s:/source", config.SourceDir),
-				"-v", fmt.Sprintf("%s:/target", config.TargetDir),
-				config.DockerImage, dockerSource, dockerTempFlac}
+func markAction(path, action string) {
+	fileActions.Lock()
+	fileActions.byPath[path] = action
+	fileActions.Unlock()
+}
 
-			cmd = exec.Command("docker", args...)
-		} else {
-			cmd = exec.Command(config.SoxCommand, sourcePath, tempFlacPath)
-		}
+// resultAction returns the action a processed file ended up with and forgets it
+func resultAction(path string, err error) string {
+	fileActions.Lock()
+	action, ok := fileActions.byPath[path]
+	delete(fileActions.byPath, path)
+	fileActions.Unlock()
 
-		if err := cmd.Run(); err != nil {
-			return fmt.Errorf("SoX conversion to FLAC failed: %w", err)
-		}
+	if err != nil {
+		return actionFailed
+	}
+	if !ok {
+		return actionConverted
 	}
+	return action
+}
 
-	// Step 2: Convert FLAC to ALAC using FFmpeg
-	if config.UseDocker {
-		dockerTempFlac := getDockerTargetPath(tempFlacPath)
-		dockerTemp := getDockerTargetPath(tempPath)
+// consoleWriter prints per-file output. When grouping, the lines of each
+// source directory are indented under a header and the directory ends with a
+// one-line summary of what happened to its files.
+type consoleWriter struct {
+	mu    sync.Mutex
+	group bool
+
+	// The group being written streams its lines. Groups whose files come up
+	// meanwhile are held back and written after it, so every directory gets
+	// one header and one summary.
+	current *dirGroup
+	groups  map[string]*dirGroup
+	held    []*dirGroup
+
+	// With --per-file-nice-output the lines logged for each file are held
+	// back and it is printed as a single tree line when it completes
+	nice    bool
+	pending map[string][]string
+
+	// With --jobs above 1 the lines of every file come through its
+	// fileOutput, and there is no single file being processed
+	concurrent bool
+
+	// With --json-logs every line is written to stderr as a LogEntry
+	json  bool
+	stage string
+	file  string
+
+	// out receives the text output, stdout when nil. With --summary-json it
+	// is stderr and the summary alone is printed to stdout as JSON.
+	out     io.Writer
+	summary bool
+
+	// With --progress a line with the progress of the run stays below the
+	// output on a terminal, other outputs get it every progressLineInterval.
+	// --quiet drops everything but warnings and errors while files are
+	// processed.
+	progress bool
+	terminal bool
+	quiet    bool
+	bar      string
+	lastLine time.Time
+}
 
-		args := []string{"run", "--rm", "--entrypoint", "ffmpeg",
-			"-v", fmt.Sprintf("%s:/source", config.SourceDir),
-			"-v", fmt.Sprintf("%s:/target", config.TargetDir),
-			config.DockerImage,
-			"-y", "-i", dockerTempFlac, "-c:a", "alac", "-sample_fmt", "s16p", dockerTemp}
+// dirGroup is the console output of a source directory
+type dirGroup struct {
+	dir     string
+	pending int // Files still to finish, below 0 for a directory nothing was expected in
+	counts  map[string]int
+	files   int
+	text    strings.Builder // Lines held back while another group is written
+	held    bool
+}
 
-		cmd = exec.Command("docker", args...)
-	} else {
-		cmd = exec.Command("ffmpeg", "-y", "-i", tempFlacPath, "-c:a", "alac", "-sample_fmt", "s16p", tempPath)
+// fileOutput holds the lines logged for a file that were not written yet.
+// With --jobs above 1 every file being processed has one, so the lines of
+// concurrent files do not mix.
+type fileOutput struct {
+	path    string
+	text    strings.Builder
+	flushed time.Time
+}
+
+// fileOutputFlushInterval is how long the complete lines of a long running
+// file are held back before they are written anyway
+const fileOutputFlushInterval = 10 * time.Second
+
+// output returns the writer receiving the console's text output, which
+// keeps the progress line below it while one is shown
+func (c *consoleWriter) output() io.Writer {
+	if c.bar != "" {
+		return progressLineWriter{c}
 	}
+	return c.writer()
+}
 
-	if err := cmd.Run(); err != nil {
-		os.Remove(tempFlacPath) // Clean up temp FLAC file
-		return fmt.Errorf("FFmpeg FLAC to ALAC conversion failed: %w", err)
+// writer returns where the console writes, stdout when out is nil
+func (c *consoleWriter) writer() io.Writer {
+	if c.out == nil {
+		return os.Stdout
 	}
+	return c.out
+}
 
-	// Clean up temp FLAC file
-	os.Remove(tempFlacPath)
+// progressLineWriter clears the progress line before output is written and
+// draws it again after each complete line
+type progressLineWriter struct {
+	c *consoleWriter
+}
 
-	if !config.NoPreserveMetadata {
-		// Merge metadata using FFmpeg
-		if mergeErr := mergeMetadataWithFFmpeg(sourcePath, tempPath, targetPath); mergeErr != nil {
-			fmt.Printf("Warning: Metadata preservation failed for %s, keeping converted audio without tags: %v\n", targetPath, mergeErr)
-			// Fallback: rename temp to target
-			if renameErr := os.Rename(tempPath, targetPath); renameErr != nil {
-				return fmt.Errorf("fallback rename failed after metadata merge error: %w", renameErr)
-			}
-			return nil
-		}
-		// If merge succeeded, temp is already removed in merge function
-	} else {
-		// If not preserving metadata, tempPath == targetPath, no action needed
+func (w progressLineWriter) Write(p []byte) (int, error) {
+	out := w.c.writer()
+	fmt.Fprint(out, "\r\033[K")
+	n, err := out.Write(p)
+	if bytes.HasSuffix(p, []byte("\n")) {
+		fmt.Fprint(out, w.c.bar)
 	}
+	return n, err
+}
 
-	return nil
+// isTerminal reports whether output goes to a terminal, where the progress
+// line is redrawn in place
+var isTerminal = func(w io.Writer) bool {
+	file, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := file.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
 }
 
-func processAudioFile(sourcePath, targetPath string, audioInfo *AudioInfo, needsConversion bool, bitrateArgs, sampleRateArgs []string) error {
-	if audioInfo.Format == "alac" {
-		return processALAC(sourcePath, targetPath, needsConversion, bitrateArgs, sampleRateArgs)
-	} else {
-		return processFlac(sourcePath, targetPath, needsConversion, bitrateArgs, sampleRateArgs)
+// progressLineInterval is how often the progress line is printed when the
+// output is not a terminal
+const progressLineInterval = 30 * time.Second
+
+// updateProgress shows the progress of the run: redrawn in place on a
+// terminal, otherwise as a plain line every progressLineInterval and when
+// the last file finished
+func (c *consoleWriter) updateProgress(status RunStatus) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.progress || status.Total == 0 {
+		return
+	}
+	line := progressLine(status)
+	if c.terminal {
+		c.bar = line
+		fmt.Fprint(c.writer(), "\r\033[K"+line)
+		return
+	}
+	if time.Since(c.lastLine) >= progressLineInterval || status.Completed+status.Failed == status.Total {
+		c.lastLine = time.Now()
+		fmt.Fprintln(c.writer(), line)
 	}
 }
 
-func processALAC(sourcePath, targetPath string, needsConversion bool, bitrateArgs, sampleRateArgs []string) error {
-	var tempPath string
+// finishProgress leaves the last progress line on the terminal
+func (c *consoleWriter) finishProgress() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.bar != "" {
+		fmt.Fprintln(c.writer())
+		c.bar = ""
+	}
+}
 
-	if !config.NoPreserveMetadata {
-		// Create temporary path for conversion output with proper extension
-		ext := filepath.Ext(targetPath)
-		tempPath = strings.TrimSuffix(targetPath, ext) + ".tmp" + ext
-	} else {
-		tempPath = targetPath
+// progressLine formats the progress of a run, e.g.
+// "[123/1890] 6.5% – ETA 00:14:32 – currently: Artist/Album/track.flac"
+func progressLine(status RunStatus) string {
+	done := status.Completed + status.Failed
+	line := fmt.Sprintf("[%d/%d] %.1f%%", done, status.Total, float64(done)*100/float64(status.Total))
+	if status.ETASeconds > 0 {
+		eta := int(status.ETASeconds + 0.5)
+		line += fmt.Sprintf(" – ETA %02d:%02d:%02d", eta/3600, eta/60%60, eta%60)
+	} else if done < status.Total {
+		line += " – ETA --:--:--"
+	}
+	if len(status.Current) > 0 {
+		current := status.Current[0]
+		if rel, err := filepath.Rel(sourceRoot(), current); err == nil {
+			current = filepath.ToSlash(rel)
+		}
+		line += " – currently: " + current
+		if more := len(status.Current) - 1; more > 0 {
+			line += fmt.Sprintf(" (+%d more)", more)
+		}
 	}
+	return line
+}
 
-	// Convert ALAC to FLAC using FFmpeg, with optional quality adjustments via SoX
-	var cmd *exec.Cmd
+// LogEntry is a log line in --json-logs mode
+type LogEntry struct {
+	Level   string `json:"level"` // "info", "warn" or "error"
+	Time    string `json:"time"`
+	Message string `json:"message"`
+	Stage   string `json:"stage,omitempty"` // "audio" or "images"
+	File    string `json:"file,omitempty"`
+}
 
-	if needsConversion {
-		// Two-step process: ALAC -> temp FLAC via FFmpeg, then temp FLAC -> final FLAC via SoX
-		tempAlacFlac := strings.TrimSuffix(tempPath, ".flac") + ".alac_temp.flac"
+var console = &consoleWriter{}
 
-		// Step 1: Convert ALAC to FLAC using FFmpeg
-		if config.UseDocker {
-			dockerSource := getDockerPath(sourcePath)
-			dockerTempAlac := getDockerTargetPath(tempAlacFlac)
+// logf prints a log message through the console writer
+func logf(format string, args ...any) {
+	console.printf(format, args...)
+}
 
-			args := []string{"run", "--rm", "--entrypoint", "ffmpeg",
-				"-v", fmt.Sprintf("%s:/source", config.SourceDir),
-				"-v", fmt.Sprintf("%s:/target", config.TargetDir),
-				config.DockerImage,
-				"-i", dockerSource,
-				"-c:a", "flac",
-				dockerTempAlac}
+func (c *consoleWriter) printf(format string, args ...any) {
+	c.print(nil, fmt.Sprintf(format, args...))
+}
 
-			cmd = exec.Command("docker", args...)
-		} else {
-			// Check if ffmpeg is available
-			if _, err := exec.LookPath("ffmpeg"); err != nil {
-				return fmt.Errorf("ffmpeg is not installed. Please install FFmpeg for ALAC support or use --use-docker option")
+// print writes text, or holds it back in the output of a file when given
+func (c *consoleWriter) print(out *fileOutput, text string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	file := c.file
+	if out != nil {
+		file = out.path
+	}
+	if c.json {
+		c.writeJSON(text, file)
+		return
+	}
+	if c.nice && file != "" {
+		if c.pending == nil {
+			c.pending = make(map[string][]string)
+		}
+		c.pending[file] = append(c.pending[file], text)
+		return
+	}
+	if c.quiet && c.stage != "" {
+		if text = warningLines(text); text == "" {
+			return
+		}
+	}
+	if out != nil {
+		out.text.WriteString(text)
+		if strings.HasSuffix(text, "\n") && time.Since(out.flushed) >= fileOutputFlushInterval {
+			c.flushLocked(out)
+		}
+		return
+	}
+	c.writeLocked(fileDir(file), text)
+}
+
+// fileDir returns the directory of a file, "" without one
+func fileDir(path string) string {
+	if path == "" {
+		return ""
+	}
+	return filepath.Dir(path)
+}
+
+// writeLocked writes text logged for a file in dir, or outside of files when
+// dir is empty. Text of a directory other than the group being written is
+// held back in its group.
+func (c *consoleWriter) writeLocked(dir, text string) {
+	if c.group && dir != "" {
+		g := c.groupLocked(dir)
+		if c.current == nil {
+			c.openLocked(g)
+		}
+		if g != c.current {
+			c.holdLocked(g)
+			g.text.WriteString(text)
+			return
+		}
+	}
+	c.writeText(text)
+}
+
+// writeText writes text to the output, indented under the current group
+func (c *consoleWriter) writeText(text string) {
+	if c.current != nil {
+		lines := strings.SplitAfter(text, "\n")
+		for i, line := range lines {
+			if line != "" {
+				lines[i] = "   " + line
 			}
-			cmd = exec.Command("ffmpeg", "-i", sourcePath, "-c:a", "flac", tempAlacFlac)
 		}
+		text = strings.Join(lines, "")
+	}
+	fmt.Fprint(c.output(), text)
+}
 
-		if err := cmd.Run(); err != nil {
-			return fmt.Errorf("FFmpeg ALAC to FLAC conversion failed: %w", err)
+// warningLines returns the warning and error lines of text
+func warningLines(text string) string {
+	var b strings.Builder
+	for _, line := range strings.SplitAfter(text, "\n") {
+		if strings.HasPrefix(line, "Warning:") || strings.HasPrefix(line, "Error:") {
+			b.WriteString(line)
 		}
-		defer os.Remove(tempAlacFlac) // Clean up intermediate file
+	}
+	return b.String()
+}
 
-		// Step 2: Process with SoX for quality adjustment
-		if config.UseDocker {
-			dockerTempAlac := getDockerTargetPath(tempAlacFlac)
-			dockerTemp := getDockerTargetPath(tempPath)
+// beginFile returns the output collecting the lines of the file at path,
+// until endFile writes them in one piece
+func (c *consoleWriter) beginFile(path string) *fileOutput {
+	return &fileOutput{path: path, flushed: time.Now()}
+}
 
-			args := []string{"run", "--rm",
-				"-v", fmt.Sprintf("%s:/source", config.SourceDir),
-				"-v", fmt.Sprintf("%s:/target", config.TargetDir),
-				config.DockerImage, "--multi-threaded", "-G", dockerTempAlac}
+// endFile writes the lines collected for a file, under its directory group
+func (c *consoleWriter) endFile(out *fileOutput) {
+	if out == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.flushLocked(out)
+}
 
-			args = append(args, bitrateArgs...)
-			args = append(args, dockerTemp)
-			args = append(args, sampleRateArgs...)
-			args = append(args, "dither")
+func (c *consoleWriter) flushLocked(out *fileOutput) {
+	if out.text.Len() > 0 {
+		c.writeLocked(fileDir(out.path), out.text.String())
+		out.text.Reset()
+	}
+	out.flushed = time.Now()
+}
+
+// writeJSON writes every non-empty line of text as a LogEntry. The level is
+// taken from a "Warning:" or "Error:" prefix, which is removed.
+func (c *consoleWriter) writeJSON(text, file string) {
+	encoder := json.NewEncoder(os.Stderr)
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		entry := LogEntry{Level: "info", Time: time.Now().UTC().Format(time.RFC3339), Message: line, Stage: c.stage, File: file}
+		if message, ok := strings.CutPrefix(line, "Warning:"); ok {
+			entry.Level, entry.Message = "warn", strings.TrimSpace(message)
+		} else if message, ok := strings.CutPrefix(line, "Error:"); ok {
+			entry.Level, entry.Message = "error", strings.TrimSpace(message)
+		}
+		encoder.Encode(entry)
+	}
+}
+
+// setStage records the stage of the run for structured logs
+func (c *consoleWriter) setStage(stage string) {
+	c.mu.Lock()
+	c.stage = stage
+	c.mu.Unlock()
+}
+
+// setFile records the file being processed for structured logs
+func (c *consoleWriter) setFile(path string) {
+	c.mu.Lock()
+	c.file = path
+	c.mu.Unlock()
+}
+
+// expectFiles counts the files each directory group waits for before its
+// summary is written
+func (c *consoleWriter) expectFiles(work []audioWork) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, item := range work {
+		c.groupLocked(filepath.Dir(item.path)).pending++
+	}
+}
+
+// groupLocked returns the group of a directory, creating it when needed
+func (c *consoleWriter) groupLocked(dir string) *dirGroup {
+	if c.groups == nil {
+		c.groups = make(map[string]*dirGroup)
+	}
+	g, ok := c.groups[dir]
+	if !ok {
+		g = &dirGroup{dir: dir, counts: make(map[string]int)}
+		c.groups[dir] = g
+	}
+	return g
+}
+
+// enterDir starts the group of a directory when processing moves to it, or
+// holds it back while another group is written
+func (c *consoleWriter) enterDir(dir string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.group {
+		return
+	}
+	g := c.groupLocked(dir)
+	if c.current == nil {
+		c.openLocked(g)
+	} else if g != c.current {
+		c.holdLocked(g)
+	}
+}
+
+// holdLocked queues a group to be written after the current one
+func (c *consoleWriter) holdLocked(g *dirGroup) {
+	if !g.held {
+		g.held = true
+		c.held = append(c.held, g)
+	}
+}
+
+// openLocked writes the header of a group, and its lines held back so far,
+// and makes it the group being written
+func (c *consoleWriter) openLocked(g *dirGroup) {
+	name, err := filepath.Rel(sourceRoot(), g.dir)
+	if err != nil || name == "." {
+		name = filepath.Base(g.dir)
+	}
+	fmt.Fprintf(c.output(), "── %s (%d files)\n", filepath.ToSlash(name), countAudioFiles(g.dir))
+	c.current = g
+	c.writeText(g.text.String())
+	g.text.Reset()
+}
+
+// recordResult counts a finished file towards the summary of its group. The
+// group is written out once its last file finished.
+func (c *consoleWriter) recordResult(path, action string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.group {
+		return
+	}
+	g := c.groupLocked(filepath.Dir(path))
+	g.counts[action]++
+	g.files++
+	g.pending--
+	if g == c.current && g.pending == 0 {
+		c.closeLocked()
+		c.advanceLocked(false)
+	}
+}
+
+// trackCompleted prints a finished file as one tree line with
+// --per-file-nice-output, followed by the warnings and errors it logged
+func (c *consoleWriter) trackCompleted(e FileCompleted) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	pending := c.pending[e.Path]
+	delete(c.pending, e.Path)
+	if !c.nice || c.json {
+		return
+	}
+	line := fmt.Sprintf("├ %s: %s", filepath.Base(e.Path), e.Action)
+	if e.Err != nil {
+		line += fmt.Sprintf(" (%v)", e.Err)
+	}
+	text := line + "\n"
+	for _, logged := range pending {
+		for _, message := range strings.Split(logged, "\n") {
+			if strings.HasPrefix(message, "Warning:") || strings.HasPrefix(message, "Error:") {
+				text += "│   " + message + "\n"
+			}
+		}
+	}
+	c.writeLocked(filepath.Dir(e.Path), text)
+}
+
+// closeDir writes the summary of the current group and every group held
+// back, finished or not
+func (c *consoleWriter) closeDir() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closeLocked()
+	c.advanceLocked(true)
+}
+
+// closeLocked writes the summary of the current group
+func (c *consoleWriter) closeLocked() {
+	g := c.current
+	if g == nil {
+		return
+	}
+	var parts []string
+	for _, action := range []string{actionConverted, actionCopied, actionSkipped, actionFailed} {
+		if count := g.counts[action]; count > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", count, action))
+		}
+	}
+	unit := "files"
+	if c.nice {
+		unit = "tracks"
+	}
+	fmt.Fprintf(c.output(), "   └ %d %s: %s\n", g.files, unit, strings.Join(parts, ", "))
+	c.current = nil
+	delete(c.groups, g.dir)
+}
+
+// advanceLocked writes the held back groups in the order they came up. The
+// first one with files still to finish stays open, unless all are closed.
+func (c *consoleWriter) advanceLocked(all bool) {
+	for c.current == nil && len(c.held) > 0 {
+		g := c.held[0]
+		c.held = c.held[1:]
+		c.openLocked(g)
+		if all || g.pending == 0 {
+			c.closeLocked()
+		}
+	}
+}
 
-			cmd = exec.Command("docker", args...)
+// handleEvent prints the console's view of a run event. Grouping and the
+// file of structured log lines follow the files being processed.
+func (c *consoleWriter) handleEvent(event Event) {
+	switch e := event.(type) {
+	case FileStarted:
+		c.enterDir(filepath.Dir(e.Path))
+		if !c.concurrent {
+			c.setFile(e.Path)
+		}
+		c.updateProgress(progress.snapshot())
+	case FileCompleted:
+		c.trackCompleted(e)
+		c.recordResult(e.Path, e.Action)
+		c.setFile("")
+		c.updateProgress(progress.snapshot())
+	case RunCompleted:
+		c.finishProgress()
+		if e.Summary.Interrupted {
+			c.printf("Run interrupted: %d processed, %d failed, %d not processed.\n", e.Summary.Completed, e.Summary.Failed, len(e.Summary.Unprocessed))
 		} else {
-			args := []string{"--multi-threaded", "-G", tempAlacFlac}
-			args = append(args, bitrateArgs...)
-			args = append(args, tempPath)
-			args = append(args, sampleRateArgs...)
-			args = append(args, "dither")
+			c.printf("Processing complete! (%d processed, %d failed)\n", e.Summary.Completed, e.Summary.Failed)
+		}
+		if e.Summary.Duration > 0 {
+			c.printf("%.1f hours of audio processed at %.0f× realtime\n", e.Summary.Duration.Hours(), e.Summary.RealtimeFactor())
+		}
+		if c.summary {
+			json.NewEncoder(os.Stdout).Encode(summaryOutputFor(e.Summary))
+		}
+	}
+}
+
+// SummaryOutput is the object --summary-json prints on stdout when a run ends
+type SummaryOutput struct {
+	Completed      int            `json:"completed"`
+	Failed         int            `json:"failed"`
+	Unprocessed    int            `json:"unprocessed"`
+	Interrupted    bool           `json:"interrupted"`
+	Results        map[string]int `json:"results"` // Files by action
+	BytesIn        int64          `json:"bytes_in"`
+	BytesOut       int64          `json:"bytes_out"`
+	ElapsedSeconds float64        `json:"elapsed_seconds"`
+	Audio          *AudioTotals   `json:"audio,omitempty"`
+}
+
+func summaryOutputFor(summary RunSummary) SummaryOutput {
+	results := summary.Results
+	if results == nil {
+		results = map[string]int{}
+	}
+	return SummaryOutput{
+		Completed:      summary.Completed,
+		Failed:         summary.Failed,
+		Unprocessed:    len(summary.Unprocessed),
+		Interrupted:    summary.Interrupted,
+		Results:        results,
+		BytesIn:        summary.BytesIn,
+		BytesOut:       summary.BytesOut,
+		ElapsedSeconds: summary.Elapsed.Seconds(),
+		Audio:          audioTotals(summary),
+	}
+}
 
-			cmd = exec.Command(config.SoxCommand, args...)
+// countAudioFiles counts the audio files directly inside dir
+func countAudioFiles(dir string) int {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0
+	}
+	count := 0
+	for _, entry := range entries {
+		if !entry.IsDir() && isAudioExtension(strings.ToLower(filepath.Ext(entry.Name()))) {
+			count++
 		}
+	}
+	return count
+}
 
-		if err := cmd.Run(); err != nil {
-			return fmt.Errorf("SoX quality adjustment failed: %w", err)
+// TreeComparison classifies produced outputs against a reference tree.
+// Paths are relative to the tree roots.
+type TreeComparison struct {
+	Added     []string
+	Changed   []string
+	Identical []string
+	Removed   []string
+}
+
+// RunReport is the JSON report written with --report
+type RunReport struct {
+	Build               BuildInfo           `json:"build"`
+	RunID               string              `json:"run_id"`
+	Finished            time.Time           `json:"finished"`
+	Failures            []FileFailure       `json:"failures,omitempty"`
+	ConversionFailures  []ConversionFailure `json:"conversion_failures,omitempty"`
+	SkippedMultichannel []string            `json:"skipped_multichannel,omitempty"`
+	SkippedDuration     []string            `json:"skipped_duration,omitempty"`
+	ShortenedPaths      map[string]string   `json:"shortened_paths,omitempty"` // Source paths and the targets --max-path-length shortened
+	Upsampling          []UpsampleDecision  `json:"upsampling,omitempty"`
+	Pipelines           []FilePipeline      `json:"pipelines,omitempty"`
+	Audio               *AudioTotals        `json:"audio,omitempty"`
+	Orphans             []string            `json:"orphans,omitempty"`
+	Interrupted         bool                `json:"interrupted,omitempty"`
+	Unprocessed         []string            `json:"unprocessed,omitempty"` // Source files an interrupted run did not start
+}
+
+// AudioTotals is the duration of the audio a run processed, for sources
+// whose duration was probed
+type AudioTotals struct {
+	Seconds         float64            `json:"seconds"`
+	SecondsByAction map[string]float64 `json:"seconds_by_action"`
+	RealtimeFactor  float64            `json:"realtime_factor"`
+}
+
+// audioTotals returns the report's audio totals, nil when no duration is known
+func audioTotals(summary RunSummary) *AudioTotals {
+	if summary.Duration <= 0 {
+		return nil
+	}
+	totals := &AudioTotals{Seconds: summary.Duration.Seconds(), SecondsByAction: make(map[string]float64), RealtimeFactor: summary.RealtimeFactor()}
+	for action, duration := range summary.DurationByAction {
+		totals.SecondsByAction[action] = duration.Seconds()
+	}
+	return totals
+}
+
+// FileFailure records a source file or directory that could not be read
+type FileFailure struct {
+	Path  string `json:"path"`
+	Error string `json:"error"`
+	Errno int    `json:"errno,omitempty"`
+}
+
+// failures collects the per-file access errors of the current run
+var failures = struct {
+	sync.Mutex
+	list []FileFailure
+}{}
+
+func recordFailure(path string, err error) {
+	failure := FileFailure{Path: path, Error: err.Error()}
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		failure.Errno = int(errno)
+	}
+	failures.Lock()
+	failures.list = append(failures.list, failure)
+	failures.Unlock()
+}
+
+// recordedFailures returns the failures ordered by path, independent of the
+// order files were processed in
+func recordedFailures() []FileFailure {
+	failures.Lock()
+	list := slices.Clone(failures.list)
+	failures.Unlock()
+	slices.SortStableFunc(list, func(a, b FileFailure) int {
+		return strings.Compare(a.Path, b.Path)
+	})
+	return list
+}
+
+func resetFailures() {
+	failures.Lock()
+	failures.list = nil
+	failures.Unlock()
+}
+
+// handleAccessError turns a failure to read a file or directory inside the
+// source tree into a recorded failure so the run can continue. Errors on the
+// source root, errors outside the source tree and everything in --strict mode
+// are returned unchanged.
+func handleAccessError(path string, err error) error {
+	if config.Strict || filepath.Clean(path) == filepath.Clean(config.SourceDir) || !isSourceAccessError(err) {
+		return err
+	}
+	logf("Warning: Cannot read %s, skipping: %v\n", path, err)
+	recordFailure(path, err)
+	return nil
+}
+
+// isSourceAccessError reports whether err is a filesystem error on a path
+// inside the source directory (and not inside the target directory)
+func isSourceAccessError(err error) bool {
+	var pathErr *fs.PathError
+	if !errors.As(err, &pathErr) {
+		return false
+	}
+	return isWithin(config.SourceDir, pathErr.Path) && !isWithin(config.TargetDir, pathErr.Path)
+}
+
+// isWithin reports whether path is base or inside it
+func isWithin(base, path string) bool {
+	baseAbs, err := filepath.Abs(base)
+	if err != nil {
+		return false
+	}
+	pathAbs, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(baseAbs, pathAbs)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// AudioInfo holds information about an audio file
+type AudioInfo struct {
+	Bits          int
+	Rate          int
+	Channels      int           // 0 when the tool did not report it
+	ChannelLayout string        // FFmpeg layout name such as "5.1(side)", empty when unknown
+	Format        string        // "flac", "alac", or "mp3" for lossy sources being re-encoded
+	Duration      time.Duration // 0 when the tool did not report it
+}
+
+var (
+	config         Config
+	renameMap      map[string]string // Loaded from --rename-map, keyed by source relative path
+	version        = "dev"           // This will be set during build time
+	commit         = ""              // Set with -X main.commit, falls back to the VCS revision Go embeds
+	buildDate      = ""              // Set with -X main.buildDate, falls back to the VCS commit time
+	selfUpdateFlag bool
+	versionJSON    bool
+	probeJSON      bool
+)
+
+// BuildInfo describes the running binary. It is printed by the version
+// command and recorded at the top of JSON reports.
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	Date      string `json:"date"`
+	GoVersion string `json:"goVersion"`
+	OS        string `json:"os"`
+	Arch      string `json:"arch"`
+}
+
+// buildInfo combines the values set with -ldflags and the build information
+// embedded by the Go toolchain
+func buildInfo() BuildInfo {
+	info := BuildInfo{
+		Version:   version,
+		Commit:    commit,
+		Date:      buildDate,
+		GoVersion: runtime.Version(),
+		OS:        runtime.GOOS,
+		Arch:      runtime.GOARCH,
+	}
+	if build, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range build.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && info.Commit == "":
+				info.Commit = setting.Value
+			case setting.Key == "vcs.time" && info.Date == "":
+				info.Date = setting.Value
+			}
 		}
-	} else {
-		// Direct conversion ALAC to FLAC without quality changes
-		if config.UseDocker {
-			dockerSource := getDockerPath(sourcePath)
-			dockerTemp := getDockerTargetPath(tempPath)
+	}
+	return info
+}
 
-			args := []string{"run", "--rm", "--entrypoint", "ffmpeg",
-				"-v", fmt.Sprintf("%s:/source", config.SourceDir),
-				"-v", fmt.Sprintf("%s:/target", config.TargetDir),
-				config.DockerImage,
-				"-i", dockerSource,
-				"-c:a", "flac",
-				dockerTemp}
+func (b BuildInfo) String() string {
+	text := "lilt " + b.Version
+	if b.Commit != "" {
+		text += " (commit " + b.Commit
+		if b.Date != "" {
+			text += ", built " + b.Date
+		}
+		text += ")"
+	}
+	return fmt.Sprintf("%s %s %s/%s", text, b.GoVersion, b.OS, b.Arch)
+}
+
+var versionCmd = &cobra.Command{
+	Use:   "version",
+	Short: "Print version and build information",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		info := buildInfo()
+		if versionJSON {
+			return json.NewEncoder(os.Stdout).Encode(info)
+		}
+		fmt.Println(info)
+		return nil
+	},
+}
+
+var probeCmd = &cobra.Command{
+	Use:   "probe <source_directory>",
+	Short: "Print the audio properties and tags of every source audio file",
+	Long: `Probe every audio file of the source directory with ffprobe and print its
+size, modification time, codec, bit depth, sample rate, channels, duration and
+tags. Nothing is converted and no target directory is needed.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return probeLibrary(args[0], os.Stdout)
+	},
+}
+
+var rootCmd = &cobra.Command{
+	Use:   "lilt <source_directory>",
+	Short: "Convert Hi-Res FLAC/ALAC files to 16-bit FLAC files",
+	Long: `Lilt - FLAC/ALAC Audio Converter
+
+This tool converts Hi-Res FLAC and ALAC files to 16-bit FLAC files with a sample rate of 44.1kHz or 48kHz.
+Use --target-bit-depth 24 to keep up to 24 bits instead.
+It also copies MP3 files and image files (JPG, PNG) to the target directory.
+
+With the --enforce-output-format flag, you can convert all audio files to a specific format:
+- flac: Convert all files to 16-bit FLAC
+- mp3: Convert all files to MP3 (320kbps CBR by default, see --mp3-mode)
+- alac: Convert all files to 16-bit ALAC (M4A)
+
+With --metrics-textfile, these metrics of the last run are written in the
+node_exporter textfile format when the run ends:
+- lilt_last_run_files{result="converted|copied|skipped|failed"}
+- lilt_last_run_bytes_read, lilt_last_run_bytes_written
+- lilt_last_run_duration_seconds, lilt_last_run_timestamp_seconds
+- lilt_last_run_exit_status (the exit code below)
+
+Exit codes:
+  0  success
+  1  usage or configuration error
+  2  environment error (SoX, FFmpeg or Docker missing)
+  3  completed, but some files could not be read or converted
+  4  interrupted by a signal
+  5  self-update failed
+
+Copyright (C) 2025 Arda Kilicdagi
+Licensed under MIT License`,
+	Args:    cobra.MaximumNArgs(1),
+	RunE:    runConverter,
+	Version: version,
+}
+
+func init() {
+	rootCmd.Flags().StringVar(&config.TargetDir, "target-dir", "./transcoded", "Specify target directory")
+	rootCmd.Flags().BoolVar(&config.CopyImages, "copy-images", false, "Copy JPG and PNG files")
+	rootCmd.Flags().BoolVar(&config.UseDocker, "use-docker", false, "Use Docker to run Sox instead of local installation")
+	rootCmd.Flags().StringVar(&config.DockerImage, "docker-image", "ardakilic/sox_ng:latest", "Specify Docker image")
+	rootCmd.Flags().BoolVar(&config.NoPreserveMetadata, "no-preserve-metadata", false, "Do not preserve ID3 tags and cover art using FFmpeg (metadata is preserved by default)")
+	rootCmd.Flags().Var(&formatListValue{&config.EnforceOutputFormat}, "enforce-output-format", "Enforce output format for all files: flac, mp3, alac, vorbis (ogg) or opus. Repeat the flag or separate formats with commas to produce several formats, each under <target>/<format>/")
+	rootCmd.Flags().BoolVar(&config.FormatSubdir, "format-subdir", false, "Place outputs under a subdirectory named after the output format (e.g. <target>/flac/...)")
+	rootCmd.Flags().BoolVar(&config.ReportOrphans, "report-orphans", false, "List target files that no longer correspond to any source file (nothing is deleted)")
+	rootCmd.Flags().StringVar(&config.ReportPath, "report", "", "Write a JSON report of the run to this file")
+	rootCmd.Flags().BoolVar(&config.ReportAppend, "report-append", false, "Append the report to the --report file as one JSON line per run (NDJSON), tagged with a run ID, instead of replacing it")
+	rootCmd.Flags().StringVar(&config.BucketBy, "bucket-by", "", "Place outputs in date buckets instead of the source structure: added (YYYY/MM from source modification time)")
+	rootCmd.Flags().StringVar(&config.CompareWith, "compare-with", "", "Produce outputs in a temporary directory and compare them against this existing tree instead of writing to the target")
+	rootCmd.Flags().BoolVar(&config.SanitizeFilenames, "sanitize-filenames", false, "Rewrite target file and directory names to be safe for FAT32/exFAT filesystems")
+	rootCmd.Flags().BoolVar(&config.AlwaysMerge, "always-merge", false, "Always run the FFmpeg metadata merge, even when SoX already preserved the tags")
+	rootCmd.Flags().StringVar(&config.RenameMapPath, "rename-map", "", "CSV file of source-relative-path,target-relative-path pairs overriding output names")
+	rootCmd.Flags().StringVar(&config.SpecFile, "spec-file", "", "JSON file mapping source relative paths to {format, bits, rate, channels} output specs that override the automatic decision")
+	rootCmd.Flags().BoolVar(&config.ConvertToMatch, "convert-to-match-existing", false, "Convert sources to the format, bit depth, sample rate and channels of an audio file already in their target directory, using the regular settings where there is none")
+	rootCmd.Flags().BoolVar(&config.VerifyCopies, "verify-copies", false, "Verify copied files by comparing SHA-256 digests of source and destination")
+	rootCmd.Flags().IntVar(&config.ProgressFD, "progress-fd", 0, "Write NDJSON progress events to this file descriptor (e.g. 3)")
+	rootCmd.Flags().BoolVar(&config.Strict, "strict", false, "Abort the run when a source file or directory cannot be read")
+	rootCmd.Flags().BoolVar(&config.FlatOutput, "flat-output", false, "Print per-file output without grouping it by album directory")
+	rootCmd.Flags().BoolVar(&config.Progress, "progress", false, "Show the progress of the run and its ETA, redrawn in place on a terminal and printed periodically otherwise")
+	rootCmd.Flags().BoolVar(&config.Quiet, "quiet", false, "Print only warnings, errors and the progress line while files are processed (implies --progress)")
+	rootCmd.Flags().BoolVar(&config.SummaryJSON, "summary-json", false, "Print only the final summary as a JSON object on stdout and write all other output to stderr")
+	rootCmd.Flags().IntVarP(&config.Jobs, "jobs", "j", runtime.NumCPU(), "Number of files converted at a time")
+	rootCmd.Flags().BoolVar(&config.FixPermissions, "fix-permissions", false, "Make produced files at least 0644 and their directories at least 0755, whatever the source modes are")
+	rootCmd.Flags().BoolVar(&config.IncludeHidden, "include-hidden", false, "Process dot-files and dot-directories of the source, such as ._song.flac AppleDouble files, which are skipped by default")
+	rootCmd.Flags().BoolVar(&config.NiceOutput, "per-file-nice-output", false, "Print one line per track under each album header instead of the detailed log, keeping warnings and errors")
+	rootCmd.Flags().StringVar(&config.MP3Mode, "mp3-mode", "cbr", "MP3 rate control: cbr, vbr or abr")
+	rootCmd.Flags().Var(&mp3BitrateValue{&config.MP3Bitrate, &config.MP3Preset}, "mp3-bitrate", "MP3 bitrate in kbps for cbr and abr modes (default 320), or a VBR preset V0 (best) to V9")
+	rootCmd.Flags().IntVar(&config.MP3Quality, "mp3-quality", 0, "MP3 VBR quality from 0 (best) to 9 for vbr mode")
+	rootCmd.Flags().IntVar(&config.VorbisQuality, "vorbis-quality", 0, "Ogg Vorbis quality from 1 to 10 (default 6)")
+	rootCmd.Flags().IntVar(&config.OpusBitrate, "opus-bitrate", 0, "Opus bitrate in kbps from 6 to 510 (default 160)")
+	rootCmd.Flags().IntVar(&config.MP3Rate, "mp3-rate", 0, "Resample every MP3 output to this rate: 32000, 44100 or 48000 (default: keep the source's 44.1/48 kHz family)")
+	rootCmd.Flags().BoolVar(&config.VerifyRoundtrip, "verify-roundtrip", false, "Verify that lossless conversions without resampling keep the decoded audio samples unchanged")
+	rootCmd.Flags().BoolVar(&config.NoPostcheck, "no-postcheck", false, "Do not check that SoX output has the intended bit depth and sample rate")
+	rootCmd.Flags().StringVar(&config.Sort, "sort", "path", "Order in which files are processed: path or size-desc (largest first)")
+	rootCmd.Flags().MarkDeprecated("sort", "use --order instead")
+	rootCmd.Flags().StringVar(&config.Order, "order", "name", "Order in which files are processed: name, newest, oldest, largest or smallest")
+	rootCmd.Flags().StringVar(&config.NameTemplate, "name-template", "", "Name outputs from tags, e.g. \"{artist}/{album}/{track:00} - {title|Unknown}\"")
+	rootCmd.Flags().BoolVar(&config.PadTracks, "pad-tracks", false, "Zero-pad leading track numbers in file names (e.g. \"2 Song\" becomes \"02 Song\")")
+	rootCmd.Flags().IntVar(&config.TrackWidth, "track-width", 0, "Pad track numbers to this many digits for {track} in --name-template and for --pad-tracks, instead of the width of the track total")
+	rootCmd.Flags().BoolVar(&config.DownsampleOnly, "downsample-only", false, "Only resample high sample rate files and keep their bit depth (no 16-bit reduction or dither)")
+	rootCmd.Flags().BoolVar(&config.NormalizeTags, "normalize-tags", false, "Trim and collapse whitespace and normalize Unicode (NFC) in output tags")
+	rootCmd.Flags().StringVar(&config.TitleCaseTags, "title-case-tags", "", "Comma separated tags to title-case when normalizing, e.g. genre,artist")
+	rootCmd.Flags().StringVar(&config.TagRulesPath, "tag-rules", "", "CSV file of find,replace pairs applied to output tag values (e.g. \" ft. \", \" feat. \")")
+	rootCmd.Flags().StringVar(&config.SourceRoot, "source-root", "", "Directory that target paths are computed relative to (default: the source directory)")
+	rootCmd.Flags().StringVar(&config.DropTags, "drop-tags", "", "Comma separated tags to remove from outputs, globs allowed (e.g. encoder,comment,itunes*); @default for a built-in list")
+	rootCmd.Flags().BoolVar(&config.EstimateOnly, "estimate-only", false, "Print an estimate of the processing time and exit without converting")
+	rootCmd.Flags().BoolVar(&config.Tree, "tree", false, "Print the target directory tree the run would produce and exit without converting")
+	rootCmd.Flags().BoolVar(&config.DryRun, "dry-run", false, "Print what would be done with every source file, with counts per action and output format, and exit without converting")
+	rootCmd.Flags().BoolVar(&config.ComparePlan, "compare-plan", false, "Print the files whose planned action, target or reason --alt-flags changes, and exit without converting")
+	rootCmd.Flags().StringVar(&config.AltFlags, "alt-flags", "", "Flags to compare the current plan with, applied on top of the current ones (e.g. \"--target-sample-rate 44100\")")
+	rootCmd.Flags().BoolVar(&config.Diff, "diff", false, "Print which target files a run would add or update and which are orphaned, then exit without converting")
+	rootCmd.Flags().BoolVar(&config.Calibrate, "calibrate", false, "With --estimate-only, convert one representative file to measure this machine's throughput")
+	rootCmd.Flags().StringVar(&config.PassthroughSubdir, "passthrough-subdir", "", "Place files that are copied because they already meet the output rules under this subdirectory of the target")
+	rootCmd.Flags().IntVar(&config.ResampleAbove, "resample-above", 0, "Only resample sources above this sample rate, to the highest rate of their family not above it (e.g. 48000)")
+	rootCmd.Flags().IntVar(&config.ReduceBitsAbove, "reduce-bits-above", 0, "Only reduce the bit depth of sources deeper than this, to this depth: 16 or 24")
+	rootCmd.Flags().IntVar(&config.TargetBitDepth, "target-bit-depth", 16, "Bit depth deeper sources are reduced to: 16 or 24 (sources at or below it keep their depth)")
+	rootCmd.Flags().StringVar(&config.TargetSampleRate, "target-sample-rate", "auto", "Rate high sample rate sources are resampled to: 44100, 48000 or auto to stay in their rate family (96 kHz to 48 kHz, 88.2 kHz to 44.1 kHz)")
+	rootCmd.Flags().IntVar(&config.ResampleAll, "resample-all", 0, "Convert every output to this sample rate, upsampling lower rates if needed (e.g. 48000)")
+	rootCmd.Flags().BoolVar(&config.NoUpsample, "no-upsample", false, "Never upsample to --resample-all or --mp3-rate; lower rate sources keep their rate")
+	rootCmd.Flags().BoolVar(&config.StrictUpsample, "strict-upsample", false, "Fail files that --resample-all or --mp3-rate would upsample")
+	rootCmd.Flags().BoolVar(&config.JSONLogs, "json-logs", false, "Write log lines to stderr as JSON objects (level, time, message, stage, file) instead of text")
+	rootCmd.Flags().StringVar(&config.StatusAddr, "status-addr", "", "Serve run status as JSON on http://<addr>/status (and /healthz), e.g. 127.0.0.1:9180")
+	rootCmd.Flags().StringVar(&config.DedupeArt, "dedupe-art", "", "When all tracks of a directory embed the same picture, keep it once: folder (one folder image, embeds stripped) or embedded (matching folder images removed)")
+	rootCmd.Flags().StringVar(&config.ArtSource, "art-source", "embedded", "Cover art to keep when a file has embedded art and its folder has a cover image: embedded, folder or largest")
+	rootCmd.Flags().BoolVar(&config.ArtOnly, "art-only", false, "Embed the folder cover into files that need no conversion, copying their audio stream without SoX")
+	rootCmd.Flags().StringVar(&config.ErrorLogDir, "error-log-dir", "", "Write the commands and output of each failed conversion to a log file in this directory")
+	rootCmd.Flags().BoolVar(&config.NoScannerMarkers, "no-scanner-markers", false, "Do not write .nomedia and .plexignore files telling media scanners to skip the working and error log directories")
+	rootCmd.Flags().BoolVar(&config.SkipMultichannel, "skip-multichannel", false, "Skip audio files with more than two channels and list them, instead of converting them")
+	rootCmd.Flags().StringVar(&config.MinDuration, "min-duration", "", "Skip and list audio files shorter than this, in seconds or mm:ss (e.g. 10 or 0:10)")
+	rootCmd.Flags().StringVar(&config.MaxDuration, "max-duration", "", "Skip and list audio files longer than this, in seconds or mm:ss (e.g. 20:00)")
+	rootCmd.Flags().Int64Var(&config.ProbeDuration, "probe-analyzeduration", 0, "Microseconds of media ffprobe analyzes to detect stream parameters (default: FFmpeg's)")
+	rootCmd.Flags().Int64Var(&config.ProbeSize, "probe-size", 0, "Bytes ffprobe reads to detect stream parameters, at least 32 (default: FFmpeg's)")
+	rootCmd.Flags().BoolVar(&config.Downmix, "downmix", false, "Downmix sources with more than two channels to stereo in ALAC output")
+	rootCmd.Flags().BoolVar(&config.FromStdin, "from-stdin", false, "Process only the audio files listed on stdin, one per line, instead of every file in the source directory")
+	rootCmd.Flags().BoolVarP(&config.NullSeparated, "null", "0", false, "Split the --from-stdin list on NUL bytes instead of newlines, as written by find -print0")
+	rootCmd.Flags().BoolVar(&config.CopyOnly, "copy-only", false, "Copy audio files and images unchanged, without converting or probing them; SoX and FFmpeg are not needed")
+	rootCmd.Flags().BoolVar(&config.Verbose, "verbose", false, "Print the pipeline of tools each file went through, e.g. ffprobe→sox→ffmpeg-merge")
+	rootCmd.Flags().BoolVar(&config.Benchmark, "benchmark", false, "Time conversions of a sample file across output formats and concurrency levels and print the throughput")
+	rootCmd.Flags().StringVar(&config.BenchSample, "benchmark-sample", "", "FLAC or ALAC file used by --benchmark (default: a synthesized 24-bit 96 kHz file)")
+	rootCmd.Flags().IntSliceVar(&config.BenchJobs, "benchmark-jobs", nil, "Comma separated concurrency levels for --benchmark (default: 1 and the number of CPUs)")
+	rootCmd.Flags().BoolVar(&config.KeepOriginal, "keep-original-on-format-mismatch", false, "When a conversion to the enforced output format fails, copy the original file in its own format instead")
+	rootCmd.Flags().BoolVar(&config.ReencodeLossy, "reencode-lossy", false, "In MP3 mode, transcode AAC sources (.aac, .mp4, .m4r) to MP3 instead of copying them")
+	rootCmd.Flags().IntVar(&config.CopyBufferSize, "copy-buffer-size", defaultCopyBufferKiB, "Buffer size in KiB used when copying files")
+	rootCmd.Flags().StringVar(&config.MetricsTextfile, "metrics-textfile", "", "Write Prometheus metrics of the run to this file for the node_exporter textfile collector")
+	rootCmd.Flags().BoolVar(&config.DumpConfig, "dump-config", false, "Print the effective configuration as JSON and exit")
+	rootCmd.Flags().StringVar(&config.TempDir, "temp-dir", "", "Directory for the run's working directory of intermediate files (default: the target directory)")
+	rootCmd.Flags().IntVar(&config.ALACCompression, "alac-compression-level", -1, "FFmpeg ALAC compression level from 0 (fastest) to 2 (smallest), default keeps FFmpeg's setting")
+	rootCmd.Flags().IntVar(&config.MP3MinCopyBitrate, "mp3-min-copy-bitrate", 0, "With --enforce-output-format mp3, re-encode MP3 sources below this bitrate in kbps instead of copying them")
+	rootCmd.Flags().BoolVar(&config.NoProbeCopy, "no-probe-copy", false, "Copy files a format rule copies (e.g. MP3 in the default mode) without probing them; --mp3-min-copy-bitrate, --min/--max-duration, --name-template and --pad-tracks leave them alone")
+	rootCmd.Flags().StringVar(&config.ProbeOnlyExtensions, "probe-only-extensions", "", "Comma separated extensions whose copies are still probed, copying the others like --no-probe-copy (e.g. mp3)")
+	rootCmd.Flags().BoolVar(&config.Prune, "prune", false, "Delete target files that no longer correspond to any source file, after confirmation")
+	rootCmd.Flags().BoolVar(&config.Yes, "yes", false, "Do not ask for confirmation before destructive operations such as --prune")
+	rootCmd.Flags().BoolVar(&config.SkipExisting, "skip-existing", false, "Skip source files whose output already exists in the target directory and is not older than the source, to resume an interrupted run")
+	rootCmd.Flags().BoolVar(&config.ChangedOnly, "changed-only", false, "Skip source files not modified since the last successful --changed-only run into the target directory")
+	rootCmd.Flags().BoolVar(&config.SourceChecksumCache, "source-checksum-cache", false, "With --changed-only, skip sources whose content is unchanged, caching their SHA-256 by path, size and modification time in the state file")
+	rootCmd.Flags().IntVar(&config.Retries, "retries", 0, "Retry a file up to this many times when an external tool fails")
+	rootCmd.Flags().IntSliceVar(&config.RetryExitCodes, "retry-exit-codes", nil, "Only retry tool failures with these exit codes, e.g. 125,137 (default: any)")
+	rootCmd.Flags().BoolVar(&config.CopyPlaylists, "copy-playlists-rewritten", false, "Copy .m3u/.m3u8 playlists, rewriting their entries to point at the converted files")
+	rootCmd.Flags().BoolVar(&config.AbortIfNoFiles, "abort-if-no-files", false, "Exit with an error when no audio files were found to process")
+	rootCmd.Flags().StringVar(&config.NormalizeUnicode, "normalize-unicode", "", "Normalize target file and directory names to Unicode nfc or nfd")
+	rootCmd.Flags().IntVar(&config.MaxPathLength, "max-path-length", 0, "Shorten target paths longer than this many bytes, deepest names first, and report them (e.g. 255)")
+	rootCmd.Flags().BoolVar(&selfUpdateFlag, "self-update", false, "Check for updates and self-update if newer version available")
+
+	versionCmd.Flags().BoolVar(&versionJSON, "json", false, "Print the build information as JSON")
+	rootCmd.AddCommand(versionCmd)
+
+	probeCmd.Flags().BoolVar(&probeJSON, "json", false, "Print one JSON object per audio file")
+	probeCmd.Flags().IntVarP(&config.Jobs, "jobs", "j", runtime.NumCPU(), "Number of files probed at a time")
+	probeCmd.Flags().BoolVar(&config.IncludeHidden, "include-hidden", false, "Probe dot-files and dot-directories of the source, which are skipped by default")
+	probeCmd.Flags().StringVar(&config.MinDuration, "min-duration", "", "Leave out audio files shorter than this, in seconds or mm:ss (e.g. 10 or 0:10)")
+	probeCmd.Flags().StringVar(&config.MaxDuration, "max-duration", "", "Leave out audio files longer than this, in seconds or mm:ss (e.g. 20:00)")
+	probeCmd.Flags().Int64Var(&config.ProbeDuration, "probe-analyzeduration", 0, "Microseconds of media ffprobe analyzes to detect stream parameters (default: FFmpeg's)")
+	probeCmd.Flags().Int64Var(&config.ProbeSize, "probe-size", 0, "Bytes ffprobe reads to detect stream parameters, at least 32 (default: FFmpeg's)")
+	rootCmd.AddCommand(probeCmd)
+	altFlagsCmd = rootCmd
+	rootCmd.CompletionOptions.DisableDefaultCmd = true
+
+	// Set default values
+	config.SoxCommand = "sox"
+}
+
+func main() {
+	if err := rootCmd.Execute(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(exitCode(err))
+	}
+}
+
+func runConverter(cmd *cobra.Command, args []string) error {
+	if selfUpdateFlag {
+		if len(args) > 0 {
+			return fmt.Errorf("--self-update does not take arguments")
+		}
+		if err := selfUpdate(http.DefaultClient); err != nil {
+			return &exitError{code: exitUpdate, err: err}
+		}
+		return nil
+	}
+
+	if config.Benchmark {
+		if len(args) > 0 {
+			return fmt.Errorf("--benchmark does not take a source directory, use --benchmark-sample to benchmark a file")
+		}
+		return runBenchmark()
+	}
+
+	// Several output formats go to their own subdirectories unless
+	// --format-subdir=false was given
+	if len(enforcedFormats()) > 1 && (cmd == nil || !cmd.Flags().Changed("format-subdir")) {
+		config.FormatSubdir = true
+	}
+
+	start := time.Now()
+	err := convertLibrary(args)
+	if config.MetricsTextfile != "" {
+		if metricsErr := writeMetricsTextfile(config.MetricsTextfile, start, err); metricsErr != nil {
+			logf("Warning: Failed to write metrics: %v\n", metricsErr)
+		}
+	}
+	return err
+}
+
+// convertLibrary runs the conversion of the source directory in args
+func convertLibrary(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("source directory required")
+	}
+
+	config.SourceDir = args[0]
+	runID = newRunID()
+	resetAssignedPaths()
+	resetFailures()
+	resetConversionFailures()
+	resetMultichannelSkips()
+	resetDurationSkips()
+	resetExistingSpecs()
+	resetUpsampleDecisions()
+	resetProducedFiles()
+	resetDirectoryBarrier()
+	resetPipelines()
+
+	// Validate enforce-output-format flag
+	if err := validateOutputFormats(); err != nil {
+		return err
+	}
+
+	// Validate MP3 rate control flags
+	if err := validateMP3Options(); err != nil {
+		return err
+	}
+	if config.VorbisQuality < 0 || config.VorbisQuality > 10 {
+		return fmt.Errorf("invalid vorbis-quality: %d. It must be between 1 and 10", config.VorbisQuality)
+	}
+	if config.OpusBitrate != 0 && (config.OpusBitrate < 6 || config.OpusBitrate > 510) {
+		return fmt.Errorf("invalid opus-bitrate: %d. It must be between 6 and 510", config.OpusBitrate)
+	}
+	if config.ALACCompression > maxALACCompressionLevel {
+		return fmt.Errorf("invalid alac-compression-level: %d. It must be between 0 and %d", config.ALACCompression, maxALACCompressionLevel)
+	}
+
+	// Validate art source
+	if !slices.Contains([]string{"", "embedded", "folder", "largest"}, config.ArtSource) {
+		return fmt.Errorf("invalid art-source: %s. Valid options are: embedded, folder, largest", config.ArtSource)
+	}
+	if config.ArtOnly {
+		if config.NoPreserveMetadata {
+			return fmt.Errorf("--art-only cannot be used with --no-preserve-metadata")
+		}
+		// Embedding the folder cover is the point of --art-only
+		if config.ArtSource == "" || config.ArtSource == "embedded" {
+			config.ArtSource = "folder"
+		}
+	}
+	if !slices.Contains([]string{"", "folder", "embedded"}, config.DedupeArt) {
+		return fmt.Errorf("invalid dedupe-art: %s. Valid options are: folder, embedded", config.DedupeArt)
+	}
+	if !slices.Contains([]string{"", "nfc", "nfd"}, config.NormalizeUnicode) {
+		return fmt.Errorf("invalid normalize-unicode: %s. Valid options are: nfc, nfd", config.NormalizeUnicode)
+	}
+	if config.MaxPathLength < 0 {
+		return fmt.Errorf("invalid max-path-length: %d", config.MaxPathLength)
+	}
+	if config.MaxPathLength > 0 && targetPathBudget() < maxPathNameReserve {
+		return fmt.Errorf("max-path-length %d leaves too little room for names below %s", config.MaxPathLength, config.TargetDir)
+	}
+	if config.Prune && config.CompareWith != "" {
+		return fmt.Errorf("--prune cannot be used with --compare-with")
+	}
+	if config.ProbeDuration < 0 {
+		return fmt.Errorf("invalid probe-analyzeduration: %d", config.ProbeDuration)
+	}
+	if config.ProbeSize != 0 && config.ProbeSize < 32 {
+		return fmt.Errorf("invalid probe-size: %d. It must be at least 32 bytes", config.ProbeSize)
+	}
+	if config.Retries < 0 {
+		return fmt.Errorf("invalid retries: %d", config.Retries)
+	}
+	if config.Jobs < 0 {
+		return fmt.Errorf("invalid jobs: %d", config.Jobs)
+	}
+	for _, code := range config.RetryExitCodes {
+		if code < 1 || code > 255 {
+			return fmt.Errorf("invalid retry-exit-codes: %d. Exit codes are between 1 and 255", code)
+		}
+	}
+	if config.ChangedOnly && config.CompareWith != "" {
+		return fmt.Errorf("--changed-only cannot be used with --compare-with")
+	}
+	if config.ReportAppend && config.ReportPath == "" {
+		return fmt.Errorf("--report-append can only be used with --report")
+	}
+	if config.NoProbeCopy && config.ProbeOnlyExtensions != "" {
+		return fmt.Errorf("--no-probe-copy cannot be used with --probe-only-extensions")
+	}
+	if config.SourceChecksumCache && !config.ChangedOnly {
+		return fmt.Errorf("--source-checksum-cache can only be used with --changed-only")
+	}
+	if config.TrackWidth < 0 {
+		return fmt.Errorf("invalid track-width: %d", config.TrackWidth)
+	}
+	if config.TrackWidth > 0 && config.NameTemplate == "" && !config.PadTracks {
+		return fmt.Errorf("--track-width can only be used with --name-template or --pad-tracks")
+	}
+	if config.TempDir != "" && config.UseDocker && !isWithin(config.TargetDir, config.TempDir) {
+		return fmt.Errorf("--temp-dir must be inside the target directory when using Docker")
+	}
+	if config.CopyBufferSize != 0 && config.CopyBufferSize < minCopyBufferKiB {
+		return fmt.Errorf("invalid copy-buffer-size: %d. It must be at least %d KiB", config.CopyBufferSize, minCopyBufferKiB)
+	}
+
+	// Validate sort flag
+	if config.Sort != "" && config.Sort != "path" && config.Sort != "size-desc" {
+		return fmt.Errorf("invalid sort: %s. Valid options are: path, size-desc", config.Sort)
+	}
+	if !slices.Contains([]string{"", "name", "newest", "oldest", "largest", "smallest"}, config.Order) {
+		return fmt.Errorf("invalid order: %s. Valid options are: name, newest, oldest, largest, smallest", config.Order)
+	}
+
+	// Parse the name template
+	nameTemplate = nil
+	if config.NameTemplate != "" {
+		tmpl, err := parseNameTemplate(config.NameTemplate)
+		if err != nil {
+			return fmt.Errorf("invalid name-template: %w", err)
+		}
+		nameTemplate = tmpl
+	}
+
+	// Validate resample-all flag
+	if config.ResampleAll != 0 {
+		if !slices.Contains([]int{32000, 44100, 48000, 88200, 96000, 176400, 192000}, config.ResampleAll) {
+			return fmt.Errorf("invalid resample-all: %d. Valid options are: 32000, 44100, 48000, 88200, 96000, 176400, 192000", config.ResampleAll)
+		}
+		if config.MP3Rate != 0 && config.MP3Rate != config.ResampleAll {
+			return fmt.Errorf("mp3-rate %d conflicts with resample-all %d", config.MP3Rate, config.ResampleAll)
+		}
+	}
+	if config.NoUpsample && config.StrictUpsample {
+		return fmt.Errorf("--no-upsample cannot be used with --strict-upsample")
+	}
+	minDuration, maxDuration, err := durationRange()
+	if err != nil {
+		return err
+	}
+	if maxDuration != 0 && minDuration > maxDuration {
+		return fmt.Errorf("--min-duration %s is longer than --max-duration %s", config.MinDuration, config.MaxDuration)
+	}
+	if !slices.Contains([]string{"", "auto", "44100", "48000"}, config.TargetSampleRate) {
+		return fmt.Errorf("invalid target-sample-rate: %s. Valid options are: 44100, 48000, auto", config.TargetSampleRate)
+	}
+	if highSampleRate() != 0 {
+		if config.ResampleAll != 0 {
+			return fmt.Errorf("--target-sample-rate cannot be used with --resample-all")
+		}
+		if config.ResampleAbove != 0 {
+			return fmt.Errorf("--target-sample-rate cannot be used with --resample-above")
+		}
+	}
+	if config.ResampleAbove != 0 {
+		if config.ResampleAbove < 8000 {
+			return fmt.Errorf("invalid resample-above: %d. It must be at least 8000", config.ResampleAbove)
+		}
+		if config.ResampleAll != 0 {
+			return fmt.Errorf("--resample-above cannot be used with --resample-all")
+		}
+	}
+	if config.ReduceBitsAbove != 0 {
+		if config.ReduceBitsAbove != 16 && config.ReduceBitsAbove != 24 {
+			return fmt.Errorf("invalid reduce-bits-above: %d. Valid options are: 16, 24", config.ReduceBitsAbove)
+		}
+		if config.DownsampleOnly {
+			return fmt.Errorf("--reduce-bits-above cannot be used with --downsample-only")
+		}
+	}
+	if config.TargetBitDepth != 0 && config.TargetBitDepth != 16 {
+		if config.TargetBitDepth != 24 {
+			return fmt.Errorf("invalid target-bit-depth: %d. Valid options are: 16, 24", config.TargetBitDepth)
+		}
+		if config.ReduceBitsAbove != 0 {
+			return fmt.Errorf("--target-bit-depth cannot be used with --reduce-bits-above")
+		}
+		if config.DownsampleOnly {
+			return fmt.Errorf("--target-bit-depth cannot be used with --downsample-only")
+		}
+	}
+	if config.AltFlags != "" && !config.ComparePlan {
+		return fmt.Errorf("--alt-flags can only be used with --compare-plan")
+	}
+	if config.ComparePlan {
+		if config.AltFlags == "" {
+			return fmt.Errorf("--compare-plan requires --alt-flags")
+		}
+		// The alternative plan runs through the setup again, these
+		// would print, read stdin or listen a second time
+		conflicts := []struct {
+			flag string
+			set  bool
+		}{
+			{"dry-run", config.DryRun},
+			{"tree", config.Tree},
+			{"diff", config.Diff},
+			{"estimate-only", config.EstimateOnly},
+			{"dump-config", config.DumpConfig},
+			{"compare-with", config.CompareWith != ""},
+			{"from-stdin", config.FromStdin},
+			{"status-addr", config.StatusAddr != ""},
+			{"progress-fd", config.ProgressFD != 0},
+		}
+		for _, conflict := range conflicts {
+			if conflict.set {
+				return fmt.Errorf("--compare-plan cannot be used with --%s", conflict.flag)
+			}
+		}
+	}
+	if config.NiceOutput && (config.FlatOutput || config.JSONLogs) {
+		return fmt.Errorf("--per-file-nice-output cannot be used with --flat-output or --json-logs")
+	}
+	if config.Quiet {
+		// These print per-file output of their own
+		conflicts := []struct {
+			flag string
+			set  bool
+		}{
+			{"verbose", config.Verbose},
+			{"per-file-nice-output", config.NiceOutput},
+			{"json-logs", config.JSONLogs},
+		}
+		for _, conflict := range conflicts {
+			if conflict.set {
+				return fmt.Errorf("--quiet cannot be used with --%s", conflict.flag)
+			}
+		}
+	}
+	if config.Progress && config.JSONLogs {
+		return fmt.Errorf("--progress cannot be used with --json-logs")
+	}
+	if config.SummaryJSON {
+		// These print to stdout themselves
+		conflicts := []struct {
+			flag string
+			set  bool
+		}{
+			{"dump-config", config.DumpConfig},
+			{"estimate-only", config.EstimateOnly},
+			{"tree", config.Tree},
+			{"diff", config.Diff},
+			{"dry-run", config.DryRun},
+			{"compare-plan", config.ComparePlan},
+			{"progress-fd 1", config.ProgressFD == 1},
+		}
+		for _, conflict := range conflicts {
+			if conflict.set {
+				return fmt.Errorf("--summary-json cannot be used with --%s", conflict.flag)
+			}
+		}
+	}
+	if config.CopyOnly {
+		// These need SoX or FFmpeg to read or rewrite the files
+		conflicts := []struct {
+			flag string
+			set  bool
+		}{
+			{"enforce-output-format", config.EnforceOutputFormat != ""},
+			{"spec-file", config.SpecFile != ""},
+			{"name-template", config.NameTemplate != ""},
+			{"dedupe-art", config.DedupeArt != ""},
+			{"skip-multichannel", config.SkipMultichannel},
+			{"min-duration", config.MinDuration != ""},
+			{"max-duration", config.MaxDuration != ""},
+			{"resample-all", config.ResampleAll != 0},
+			{"verify-roundtrip", config.VerifyRoundtrip},
+			{"art-only", config.ArtOnly},
+		}
+		for _, conflict := range conflicts {
+			if conflict.set {
+				return fmt.Errorf("--copy-only cannot be used with --%s", conflict.flag)
+			}
+		}
+		// A mirror includes the images
+		config.CopyImages = true
+	}
+	if config.ConvertToMatch {
+		// Existing files are looked up in a single target tree
+		conflicts := []struct {
+			flag string
+			set  bool
+		}{
+			{"copy-only", config.CopyOnly},
+			{"format-subdir", config.FormatSubdir},
+			{"enforce-output-format with several formats", len(enforcedFormats()) > 1},
+		}
+		for _, conflict := range conflicts {
+			if conflict.set {
+				return fmt.Errorf("--convert-to-match-existing cannot be used with --%s", conflict.flag)
+			}
+		}
+	}
+
+	// Validate passthrough-subdir flag
+	if config.PassthroughSubdir != "" && (config.PassthroughSubdir != filepath.Base(config.PassthroughSubdir) || config.PassthroughSubdir == "." || config.PassthroughSubdir == "..") {
+		return fmt.Errorf("invalid passthrough-subdir: %s. It must be a single directory name", config.PassthroughSubdir)
+	}
+
+	// Validate drop-tags patterns
+	if err := validateDropTags(); err != nil {
+		return err
+	}
+
+	// Validate bucket-by flag
+	if config.BucketBy != "" && config.BucketBy != "added" {
+		return fmt.Errorf("invalid bucket-by: %s. Valid options are: added", config.BucketBy)
+	}
+
+	// Validate source directory
+	if _, err := os.Stat(config.SourceDir); os.IsNotExist(err) {
+		return fmt.Errorf("source directory does not exist: %s", config.SourceDir)
+	}
+
+	// Validate source root
+	if config.SourceRoot != "" {
+		if _, err := os.Stat(config.SourceRoot); err != nil {
+			return fmt.Errorf("source root does not exist: %s", config.SourceRoot)
+		}
+		if !isWithin(config.SourceRoot, config.SourceDir) {
+			return fmt.Errorf("source directory %s is not inside source root %s", config.SourceDir, config.SourceRoot)
+		}
+	}
+
+	if config.DumpConfig {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(config)
+	}
+
+	// Set up machine-readable progress output
+	progress = &progressReporter{}
+	if config.ProgressFD < 0 {
+		return fmt.Errorf("invalid progress-fd: %d", config.ProgressFD)
+	}
+	if config.ProgressFD > 0 {
+		file, err := openProgressFD(config.ProgressFD)
+		if err != nil {
+			return err
+		}
+		progress.encoder = json.NewEncoder(file)
+	}
+
+	if config.StatusAddr != "" {
+		stop, err := startStatusServer(config.StatusAddr)
+		if err != nil {
+			return err
+		}
+		defer stop()
+	}
+
+	console = &consoleWriter{group: !config.FlatOutput && !config.JSONLogs && !config.Quiet, json: config.JSONLogs, nice: config.NiceOutput, quiet: config.Quiet, concurrent: fileJobs() > 1}
+	if config.SummaryJSON {
+		// Keep stdout for the summary object
+		console.out = os.Stderr
+		console.summary = true
+	}
+	if config.Progress || config.Quiet {
+		console.progress = true
+		console.terminal = isTerminal(console.writer())
+	}
+
+	// Drain on the first interrupt, stop immediately on the second
+	control = newRunControl()
+	stopWatching := watchInterrupts()
+	defer stopWatching()
+	stopPauseSignals := watchPauseSignals()
+	defer stopPauseSignals()
+
+	// Read the file list
+	inputList = nil
+	if config.NullSeparated && !config.FromStdin {
+		return fmt.Errorf("--null can only be used with --from-stdin")
+	}
+	if config.FromStdin {
+		list, err := readInputList(fileListInput, config.NullSeparated)
+		if err != nil {
+			return fmt.Errorf("failed to read the file list: %w", err)
+		}
+		inputList = list
+	}
+
+	// Load the rename map
+	renameMap = nil
+	if config.RenameMapPath != "" {
+		mapping, err := loadRenameMap(config.RenameMapPath, sourceRoot())
+		if err != nil {
+			return err
+		}
+		renameMap = mapping
+	}
+
+	// Load the per-file output specs
+	fileSpecs = nil
+	if config.SpecFile != "" {
+		specs, err := loadFileSpecs(config.SpecFile, sourceRoot())
+		if err != nil {
+			return err
+		}
+		fileSpecs = specs
+	}
+
+	// Load the tag rules
+	tagRules = nil
+	if config.TagRulesPath != "" {
+		rules, err := loadTagRules(config.TagRulesPath)
+		if err != nil {
+			return err
+		}
+		tagRules = rules
+	}
+
+	// When comparing, outputs are produced in a scratch directory instead of the target
+	if config.CompareWith != "" {
+		if _, err := os.Stat(config.CompareWith); err != nil {
+			return fmt.Errorf("compare-with directory does not exist: %s", config.CompareWith)
+		}
+		scratchDir, err := os.MkdirTemp("", "lilt-compare-*")
+		if err != nil {
+			return fmt.Errorf("failed to create comparison directory: %w", err)
+		}
+		defer os.RemoveAll(scratchDir)
+		config.TargetDir = scratchDir
+	}
+
+	// Skip sources older than the last successful run, less a margin for
+	// files written while it was running
+	changedSince = time.Time{}
+	resetSourceHashes(nil)
+	resetCompletedSources(nil)
+	if config.ChangedOnly {
+		state, err := readRunState(config.TargetDir)
+		if err != nil {
+			return err
+		}
+		resetCompletedSources(state.Completed)
+		if len(state.Completed) > 0 {
+			logf("Resuming an interrupted run, %d file(s) were already finished\n", len(state.Completed))
+		}
+		if config.SourceChecksumCache {
+			resetSourceHashes(state.SourceHashes)
+		}
+		if !state.LastSuccess.IsZero() {
+			changedSince = state.LastSuccess.Add(-changedOnlySkew)
+			logf("Only processing files modified since %s\n", changedSince.Format(time.RFC3339))
+		}
+	}
+
+	if config.Tree {
+		return printTargetTree()
+	}
+	if config.Diff {
+		return printTargetDiff()
+	}
+	// Audio info is read with sox --i or ffprobe, a plan needs no encoders
+	if config.DryRun {
+		return printDryRun()
+	}
+	if config.ComparePlan {
+		return comparePlans(args)
+	}
+
+	// Setup Sox command, which a copy-only run does not use
+	if !config.CopyOnly {
+		if err := setupSoxCommand(); err != nil {
+			return &exitError{code: exitEnvironment, err: err}
+		}
+	}
+
+	if config.EstimateOnly {
+		return printEstimate()
+	}
+
+	// Create target directory
+	if err := os.MkdirAll(config.TargetDir, 0755); err != nil {
+		return fmt.Errorf("failed to create target directory: %w", err)
+	}
+	if err := checkWritable("target", config.TargetDir); err != nil {
+		return &exitError{code: exitEnvironment, err: err}
+	}
+
+	// Intermediate files go to one working directory for the whole run
+	workParent := config.TargetDir
+	if config.TempDir != "" {
+		workParent = config.TempDir
+		if err := os.MkdirAll(config.TempDir, 0755); err != nil {
+			return fmt.Errorf("failed to create temp directory: %w", err)
+		}
+		if err := checkWritable("temp", config.TempDir); err != nil {
+			return &exitError{code: exitEnvironment, err: err}
+		}
+	}
+	if err := control.createWorkDir(workParent); err != nil {
+		return err
+	}
+	defer control.removeWorkDir()
+
+	// Process audio files
+	if err := processAudioFiles(); err != nil {
+		return err
+	}
+	control.removeWorkDir()
+
+	if config.AbortIfNoFiles && progress.snapshot().Total == 0 && progress.unchangedCount() == 0 {
+		return fmt.Errorf("%w in %s", errNoFiles, config.SourceDir)
+	}
+
+	if control.isDraining() {
+		return finishInterrupted()
+	}
+
+	// Copy image files if requested
+	if config.CopyImages {
+		if err := forEachOutputFormat(copyImageFiles); err != nil {
+			return err
+		}
+	}
+
+	if config.CopyPlaylists {
+		if err := forEachOutputFormat(copyPlaylists); err != nil {
+			return err
+		}
+	}
+
+	if config.DedupeArt != "" {
+		dedupeArt()
+	}
+
+	if config.FixPermissions {
+		fixPermissions()
+	}
+
+	if config.CompareWith != "" {
+		comparison, err := compareTrees(config.TargetDir, config.CompareWith)
+		if err != nil {
+			return fmt.Errorf("failed to compare against %s: %w", config.CompareWith, err)
+		}
+		printComparison(comparison)
+	}
+
+	var report RunReport
+
+	if unreadable := recordedFailures(); len(unreadable) > 0 {
+		logf("Could not read %d file(s) or director(ies):\n", len(unreadable))
+		for _, failure := range unreadable {
+			logf("  %s: %s\n", failure.Path, failure.Error)
+		}
+		report.Failures = unreadable
+	}
+
+	if config.ReportOrphans || config.Prune {
+		orphans, err := findOrphans()
+		if err != nil {
+			return fmt.Errorf("failed to look for orphaned files: %w", err)
+		}
+		if len(orphans) == 0 {
+			logf("No orphaned files found in target directory.\n")
+		} else if config.Prune {
+			logf("Found %d orphaned file(s) in target directory:\n", len(orphans))
+			for _, orphan := range orphans {
+				logf("  %s\n", orphan)
+			}
+			if err := confirmDestructive("prune the target directory", len(orphans), 0); err != nil {
+				return err
+			}
+			if err := pruneOrphans(orphans); err != nil {
+				return err
+			}
+		} else {
+			logf("Found %d orphaned file(s) in target directory (not removed):\n", len(orphans))
+			for _, orphan := range orphans {
+				logf("  %s\n", orphan)
+			}
+		}
+		report.Orphans = orphans
+	}
+
+	report.ConversionFailures = recordedConversionFailures()
+
+	if skipped := recordedMultichannelSkips(); len(skipped) > 0 {
+		logf("Skipped %d multichannel file(s):\n", len(skipped))
+		for _, path := range skipped {
+			logf("  %s\n", path)
+		}
+		report.SkippedMultichannel = skipped
+	}
+
+	if skipped := recordedDurationSkips(); len(skipped) > 0 {
+		logf("Skipped %d file(s) outside the duration range:\n", len(skipped))
+		for _, path := range skipped {
+			logf("  %s\n", path)
+		}
+		report.SkippedDuration = skipped
+	}
+
+	if shortened := recordedShortenedPaths(); len(shortened) > 0 {
+		logf("Shortened %d target path(s) to fit --max-path-length %d:\n", len(shortened), config.MaxPathLength)
+		for _, source := range slices.Sorted(maps.Keys(shortened)) {
+			logf("  %s → %s\n", source, shortened[source])
+		}
+		report.ShortenedPaths = shortened
+	}
+
+	if decisions := recordedUpsampleDecisions(); len(decisions) > 0 {
+		counts := make(map[string]int)
+		for _, decision := range decisions {
+			counts[decision.Decision]++
+		}
+		logf("Upsampling: %d upsampled, %d kept at their rate, %d failed\n", counts["upsampled"], counts["kept_rate"], counts["failed"])
+		report.Upsampling = decisions
+	}
+
+	report.Pipelines = recordedPipelines()
+	report.Audio = audioTotals(progress.summary())
+
+	if config.ReportPath != "" {
+		if err := writeReport(config.ReportPath, &report); err != nil {
+			return err
+		}
+	}
+
+	progress.runCompleted()
+	if failed := len(report.Failures) + len(report.ConversionFailures); failed > 0 {
+		return &exitError{code: exitFileFailures, err: fmt.Errorf("%d file(s) could not be read or converted", failed)}
+	}
+	if config.ChangedOnly {
+		return writeRunState(config.TargetDir, RunState{LastSuccess: time.Now().UTC(), SourceHashes: sourceHashes.current})
+	}
+	return nil
+}
+
+// compareTrees compares the files produced in outputDir with the files in
+// referenceDir, first by size and then by SHA-256 hash.
+func compareTrees(outputDir, referenceDir string) (*TreeComparison, error) {
+	comparison := &TreeComparison{}
+	seen := make(map[string]bool)
+
+	err := filepath.Walk(outputDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || isBookkeepingFile(info.Name()) || isPartialFile(info.Name()) {
+			return nil
+		}
+		relPath, err := filepath.Rel(outputDir, path)
+		if err != nil {
+			return err
+		}
+		seen[relPath] = true
+
+		refInfo, err := os.Stat(filepath.Join(referenceDir, relPath))
+		if err != nil {
+			comparison.Added = append(comparison.Added, relPath)
+			return nil
+		}
+		if refInfo.Size() != info.Size() {
+			comparison.Changed = append(comparison.Changed, relPath)
+			return nil
+		}
+
+		outputHash, err := fileSHA256(path)
+		if err != nil {
+			return err
+		}
+		refHash, err := fileSHA256(filepath.Join(referenceDir, relPath))
+		if err != nil {
+			return err
+		}
+		if outputHash == refHash {
+			comparison.Identical = append(comparison.Identical, relPath)
+		} else {
+			comparison.Changed = append(comparison.Changed, relPath)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = filepath.Walk(referenceDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || isBookkeepingFile(info.Name()) || isPartialFile(info.Name()) {
+			return nil
+		}
+		relPath, err := filepath.Rel(referenceDir, path)
+		if err != nil {
+			return err
+		}
+		if !seen[relPath] {
+			comparison.Removed = append(comparison.Removed, relPath)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return comparison, nil
+}
+
+func printComparison(comparison *TreeComparison) {
+	logf("Comparison: %d added, %d changed, %d identical, %d removed\n",
+		len(comparison.Added), len(comparison.Changed), len(comparison.Identical), len(comparison.Removed))
+	for _, path := range comparison.Added {
+		logf("  added:     %s\n", path)
+	}
+	for _, path := range comparison.Changed {
+		logf("  changed:   %s\n", path)
+	}
+	for _, path := range comparison.Removed {
+		logf("  removed:   %s\n", path)
+	}
+}
+
+// fileSHA256 returns the hex encoded SHA-256 digest of a file
+func fileSHA256(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// stateFileName is the file in the target directory remembering the last
+// successful --changed-only run and what interrupted runs finished since
+const stateFileName = ".lilt-state.json"
+
+// changedOnlySkew is subtracted from the last run's completion time, so files
+// written while that run was going are not missed
+const changedOnlySkew = 2 * time.Minute
+
+// changedSince is the modification time below which --changed-only skips
+// sources, zero when every source is processed
+var changedSince time.Time
+
+// RunState is what lilt remembers about a target directory between runs
+type RunState struct {
+	LastSuccess  time.Time             `json:"last_success"`
+	SourceHashes map[string]SourceHash `json:"source_hashes,omitempty"`
+	// Completed lists the sources interrupted runs finished since the last
+	// successful one, which the run resuming them skips while unchanged
+	Completed map[string]SourceHash `json:"completed,omitempty"`
+}
+
+// SourceHash is the cached SHA-256 digest of a source file, valid while the
+// file keeps the size and modification time it had when it was hashed
+type SourceHash struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	SHA256  string    `json:"sha256"`
+}
+
+// sourceDigest hashes a source file for --source-checksum-cache
+var sourceDigest = fileSHA256
+
+// sourceHashes holds the digests from the last successful run and the ones
+// for this run, keyed by path relative to the source directory. The current
+// digests replace the previous ones in the state file when the run succeeds.
+var sourceHashes struct {
+	previous map[string]SourceHash
+	current  map[string]SourceHash
+}
+
+// resetSourceHashes starts a run from the digests of the last one. Listed
+// sources with --from-stdin are only part of the tree, so the digests of the
+// others are carried over.
+func resetSourceHashes(previous map[string]SourceHash) {
+	sourceHashes.previous = previous
+	sourceHashes.current = nil
+	if config.SourceChecksumCache {
+		sourceHashes.current = make(map[string]SourceHash)
+		if inputList != nil {
+			maps.Copy(sourceHashes.current, previous)
+		}
+	}
+}
+
+// completedSources holds the sources finished by the interrupted runs since
+// the last successful one, and the ones this run finished, keyed like
+// sourceHashes. A drained run records them in the state file.
+var completedSources struct {
+	sync.Mutex
+	previous map[string]SourceHash
+	current  map[string]SourceHash
+}
+
+// resetCompletedSources starts a run from the sources interrupted runs
+// finished before
+func resetCompletedSources(previous map[string]SourceHash) {
+	completedSources.Lock()
+	defer completedSources.Unlock()
+	completedSources.previous = previous
+	completedSources.current = maps.Clone(previous)
+}
+
+// recordCompletedSource remembers that a source was finished, with the size
+// and modification time it was queued with
+func recordCompletedSource(item audioWork) {
+	key := sourceKey(item.path)
+	completed := SourceHash{Size: item.size, ModTime: item.modTime, SHA256: sourceHashes.current[key].SHA256}
+	completedSources.Lock()
+	defer completedSources.Unlock()
+	if completedSources.current == nil {
+		completedSources.current = make(map[string]SourceHash)
+	}
+	completedSources.current[key] = completed
+}
+
+// sourceKey returns the key of a source in the state file: its path relative
+// to the source directory
+func sourceKey(path string) string {
+	if rel, err := filepath.Rel(config.SourceDir, path); err == nil {
+		return filepath.ToSlash(rel)
+	}
+	return path
+}
+
+// unchangedSource reports whether --changed-only can skip a source. A file an
+// interrupted run finished is skipped while it keeps its size and
+// modification time. Without --source-checksum-cache the others are decided
+// by modification time alone. With it, a file keeping its cached size and
+// modification time is unchanged without being read, and any other file is
+// hashed and compared with its cached digest. Files without a digest yet fall
+// back to their modification time.
+func unchangedSource(path string, info os.FileInfo) bool {
+	key := sourceKey(path)
+	if done, ok := completedSources.previous[key]; ok && done.Size == info.Size() && done.ModTime.Equal(info.ModTime()) {
+		if config.SourceChecksumCache && done.SHA256 != "" {
+			sourceHashes.current[key] = done
+		}
+		return true
+	}
+	if !config.SourceChecksumCache {
+		return info.ModTime().Before(changedSince)
+	}
+	cached, ok := sourceHashes.previous[key]
+	if ok && cached.Size == info.Size() && cached.ModTime.Equal(info.ModTime()) {
+		sourceHashes.current[key] = cached
+		return true
+	}
+	digest, err := sourceDigest(path)
+	if err != nil {
+		// Processing the file reports the error
+		return false
+	}
+	sourceHashes.current[key] = SourceHash{Size: info.Size(), ModTime: info.ModTime(), SHA256: digest}
+	if ok {
+		return cached.SHA256 == digest
+	}
+	return info.ModTime().Before(changedSince)
+}
+
+// readRunState reads the state file of targetDir. A missing file is an
+// empty state.
+func readRunState(targetDir string) (RunState, error) {
+	var state RunState
+	path := filepath.Join(targetDir, stateFileName)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return state, fmt.Errorf("failed to read state file: %w", err)
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return state, fmt.Errorf("invalid state file %s: %w", path, err)
+	}
+	return state, nil
+}
+
+// writeRunState replaces the state file of targetDir atomically
+func writeRunState(targetDir string, state RunState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	temp, err := os.CreateTemp(targetDir, stateFileName+".*")
+	if err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	if _, err := temp.Write(append(data, '\n')); err != nil {
+		temp.Close()
+		os.Remove(temp.Name())
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	if err := temp.Close(); err != nil {
+		os.Remove(temp.Name())
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	return os.Rename(temp.Name(), filepath.Join(targetDir, stateFileName))
+}
+
+// finishInterrupted summarizes a drained run. Files that were in flight are
+// finished by then; the report lists the ones that were never started so a
+// later run can pick them up. With --changed-only the state file records the
+// finished ones, so the next run resumes where this one stopped.
+func finishInterrupted() error {
+	progress.runCompleted()
+	if config.ReportPath != "" {
+		report := RunReport{Failures: recordedFailures(), ConversionFailures: recordedConversionFailures(), Interrupted: true, Unprocessed: progress.summary().Unprocessed}
+		if err := writeReport(config.ReportPath, &report); err != nil {
+			return err
+		}
+	}
+	if config.ChangedOnly {
+		if err := recordInterruptedRun(); err != nil {
+			return err
+		}
+	}
+	return errInterrupted
+}
+
+// recordInterruptedRun adds the sources finished by a drained run to the
+// state file, keeping the last successful run as it was
+func recordInterruptedRun() error {
+	state, err := readRunState(config.TargetDir)
+	if err != nil {
+		return err
+	}
+	completedSources.Lock()
+	state.Completed = maps.Clone(completedSources.current)
+	completedSources.Unlock()
+	return writeRunState(config.TargetDir, state)
+}
+
+// writeMetricsTextfile writes the run's metrics in the node_exporter
+// textfile collector format. The file is replaced atomically so the
+// collector never reads a partial file.
+func writeMetricsTextfile(path string, start time.Time, runErr error) error {
+	progress.mu.Lock()
+	results := maps.Clone(progress.results)
+	bytesIn, bytesOut := progress.bytesIn, progress.bytesOut
+	progress.mu.Unlock()
+
+	exitStatus := exitCode(runErr)
+
+	var buf bytes.Buffer
+	buf.WriteString("# HELP lilt_last_run_files Audio files handled by the last run, by result.\n")
+	buf.WriteString("# TYPE lilt_last_run_files gauge\n")
+	for _, result := range []string{actionConverted, actionCopied, actionSkipped, actionFailed} {
+		fmt.Fprintf(&buf, "lilt_last_run_files{result=%q} %d\n", result, results[result])
+	}
+	metric := func(name, help string, value any) {
+		fmt.Fprintf(&buf, "# HELP %s %s\n# TYPE %s gauge\n%s %v\n", name, help, name, name, value)
+	}
+	metric("lilt_last_run_bytes_read", "Bytes of audio files read by the last run.", bytesIn)
+	metric("lilt_last_run_bytes_written", "Bytes of audio files written by the last run.", bytesOut)
+	metric("lilt_last_run_duration_seconds", "Duration of the last run in seconds.", strconv.FormatFloat(time.Since(start).Seconds(), 'f', 3, 64))
+	metric("lilt_last_run_timestamp_seconds", "Unix time the last run finished.", time.Now().Unix())
+	metric("lilt_last_run_exit_status", "Exit code of the last run, 0 on success.", exitStatus)
+
+	temp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	if _, err := temp.Write(buf.Bytes()); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	// CreateTemp uses 0600, the collector usually runs as another user
+	if err := os.Chmod(temp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), path)
+}
+
+// runID identifies the current run in its report
+var runID string
+
+// newRunID returns an ID for a run: its start time and a random suffix, so
+// runs sort by time and two runs started in the same second stay apart
+func newRunID() string {
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	return time.Now().UTC().Format("20060102T150405Z") + "-" + hex.EncodeToString(suffix)
+}
+
+// writeReport writes the run report as indented JSON or, with
+// --report-append, appends it to the file as a single line
+func writeReport(path string, report *RunReport) error {
+	report.RunID = runID
+	report.Finished = time.Now().UTC()
+	report.Build = buildInfo()
+	if config.ReportAppend {
+		return appendReport(path, report)
+	}
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode report: %w", err)
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write report: %w", err)
+	}
+	return nil
+}
+
+// appendReport adds the report to path as one line of JSON, keeping the
+// reports of earlier runs. The line is written in a single call so a
+// concurrent reader never sees half of it.
+func appendReport(path string, report *RunReport) error {
+	data, err := json.Marshal(report)
+	if err != nil {
+		return fmt.Errorf("failed to encode report: %w", err)
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write report: %w", err)
+	}
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write report: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to write report: %w", err)
+	}
+	return nil
+}
+
+func setupSoxCommand() error {
+	if config.UseDocker {
+		// Check if docker is installed
+		if _, err := exec.LookPath("docker"); err != nil {
+			return fmt.Errorf("docker is not installed. Please install Docker to use this option")
+		}
+
+		// Get absolute paths
+		sourceAbs, err := filepath.Abs(config.SourceDir)
+		if err != nil {
+			return fmt.Errorf("failed to get absolute path for source directory: %w", err)
+		}
+
+		targetAbs, err := filepath.Abs(config.TargetDir)
+		if err != nil {
+			return fmt.Errorf("failed to get absolute path for target directory: %w", err)
+		}
+
+		config.SourceDir = sourceAbs
+		config.TargetDir = targetAbs
+		if config.SourceRoot != "" {
+			rootAbs, err := filepath.Abs(config.SourceRoot)
+			if err != nil {
+				return fmt.Errorf("failed to get absolute path for source root: %w", err)
+			}
+			config.SourceRoot = rootAbs
+		}
+	} else {
+		// Check if sox is installed locally
+		if _, err := exec.LookPath(config.SoxCommand); err != nil {
+			return fmt.Errorf("sox is not installed. Please install sox or use --use-docker option")
+		}
+
+		// Check for FFmpeg only when needed. AAC sources are decoded with
+		// FFmpeg since SoX cannot read them, ALAC and Opus output and ABR
+		// MP3s are encoded with it.
+		needsFFmpeg := !config.NoPreserveMetadata || config.ReencodeLossy || mp3Mode() == "abr" || slices.Contains(enforcedFormats(), "alac") || slices.Contains(enforcedFormats(), "opus")
+
+		// Quick check if directory contains ALAC files (if metadata preservation is disabled)
+		if !needsFFmpeg {
+			hasALAC, _ := hasALACFiles(config.SourceDir)
+			needsFFmpeg = hasALAC
+		}
+
+		if needsFFmpeg {
+			if _, err := exec.LookPath("ffmpeg"); err != nil {
+				return fmt.Errorf("ffmpeg is not installed. Please install FFmpeg for ALAC support and metadata preservation, or use --use-docker option")
+			}
+		}
+	}
+	return checkEncoders()
+}
+
+// ffmpegEncoders returns the output of ffmpeg -encoders, run in the Docker
+// image with --use-docker
+func ffmpegEncoders() (string, error) {
+	var cmd *exec.Cmd
+	if config.UseDocker {
+		cmd = newCommand("docker", "run", "--rm", "--entrypoint", "ffmpeg", config.DockerImage, "-hide_banner", "-encoders")
+	} else {
+		cmd = newCommand("ffmpeg", "-hide_banner", "-encoders")
+	}
+	output, err := commandOutput(cmd)
+	return string(output), err
+}
+
+// hasAudioEncoder reports whether ffmpeg -encoders output lists the named
+// audio encoder. Lines look like " A....D alac    ALAC (Apple Lossless Audio Codec)".
+func hasAudioEncoder(encoders, name string) bool {
+	for _, line := range strings.Split(encoders, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && strings.HasPrefix(fields[0], "A") && fields[1] == name {
+			return true
+		}
+	}
+	return false
+}
+
+// ffmpegOutputEncoders are the FFmpeg encoders output formats are written
+// with, by format
+var ffmpegOutputEncoders = []struct{ format, encoder, name string }{
+	{"alac", "alac", "ALAC"},
+	{"opus", "libopus", "Opus"},
+}
+
+// checkEncoders fails an ALAC or Opus output run up front when FFmpeg was
+// built without the encoder it needs, instead of failing every file
+func checkEncoders() error {
+	where := "ffmpeg"
+	if config.UseDocker {
+		where = fmt.Sprintf("ffmpeg in Docker image %s", config.DockerImage)
+	}
+	encoders, listed := "", false
+	for _, output := range ffmpegOutputEncoders {
+		if !slices.Contains(enforcedFormats(), output.format) {
+			continue
+		}
+		if !listed {
+			list, err := ffmpegEncoders()
+			if err != nil {
+				return fmt.Errorf("failed to list the encoders of %s: %w", where, err)
+			}
+			encoders, listed = list, true
+		}
+		if !hasAudioEncoder(encoders, output.encoder) {
+			return fmt.Errorf("%s was built without the %s encoder, which --enforce-output-format %s needs. Install an FFmpeg build that lists %s in ffmpeg -hide_banner -encoders, or use another --docker-image", where, output.name, output.format, output.encoder)
+		}
+	}
+	return nil
+}
+
+func hasALACFiles(dir string) (bool, error) {
+	hasALAC := false
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if isHidden(dir, path) {
+			return skipEntry(info)
+		}
+		if err != nil {
+			return nil // Continue walking even if there's an error with a specific file
+		}
+
+		if !info.IsDir() && strings.ToLower(filepath.Ext(path)) == ".m4a" {
+			hasALAC = true
+			return filepath.SkipAll // Found ALAC file, no need to continue
+		}
+		return nil
+	})
+	return hasALAC, err
+}
+
+// isHidden reports whether a walked path below root is a dot-file or
+// dot-directory, such as a macOS ._ AppleDouble file or .Trash, which source
+// walks skip unless --include-hidden is given
+func isHidden(root, path string) bool {
+	return !config.IncludeHidden && path != root && strings.HasPrefix(filepath.Base(path), ".")
+}
+
+// skipEntry skips a walked entry: the whole tree of a directory, or the file
+func skipEntry(info os.FileInfo) error {
+	if info != nil && info.IsDir() {
+		return filepath.SkipDir
+	}
+	return nil
+}
+
+// audioWork is a source audio file queued for processing
+type audioWork struct {
+	path    string
+	ext     string
+	size    int64
+	modTime time.Time
+}
+
+// fileListInput is where --from-stdin reads the file list from
+var fileListInput io.Reader = os.Stdin
+
+// inputList holds the files given with --from-stdin, nil when the source
+// directory is walked
+var inputList []string
+
+// readInputList reads a list of paths, one per line or separated by NUL
+// bytes. Empty entries are ignored, and so is the carriage return of a
+// CRLF line ending.
+func readInputList(r io.Reader, null bool) ([]string, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1<<20)
+	if null {
+		scanner.Split(scanNull)
+	}
+	list := []string{}
+	for scanner.Scan() {
+		entry := scanner.Text()
+		if !null {
+			entry = strings.TrimSuffix(entry, "\r")
+		}
+		if entry != "" {
+			list = append(list, entry)
+		}
+	}
+	return list, scanner.Err()
+}
+
+// scanNull is a bufio.SplitFunc returning NUL terminated tokens
+func scanNull(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+	if i := bytes.IndexByte(data, 0); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// collectListedFiles returns the audio files of the --from-stdin list in
+// path order, each once. Paths are taken relative to the working directory
+// and rewritten under the source directory, the way the walk would have
+// found them; files outside it are skipped with a warning.
+func collectListedFiles() ([]audioWork, error) {
+	sourceAbs, err := filepath.Abs(config.SourceDir)
+	if err != nil {
+		return nil, err
+	}
+	var work []audioWork
+	for _, entry := range inputList {
+		abs, err := filepath.Abs(entry)
+		if err != nil {
+			return nil, err
+		}
+		rel, err := filepath.Rel(sourceAbs, abs)
+		if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			logf("Warning: Skipping %s, it is not inside the source directory\n", entry)
+			continue
+		}
+		path := filepath.Join(config.SourceDir, rel)
+		ext := strings.ToLower(filepath.Ext(path))
+		if !isAudioExtension(ext) {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			if err := handleAccessError(path, err); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if info.IsDir() {
+			continue
+		}
+		if unchangedSource(path, info) {
+			progress.skippedUnchanged()
+			continue
+		}
+		work = append(work, audioWork{path: path, ext: ext, size: info.Size(), modTime: info.ModTime()})
+	}
+	slices.SortFunc(work, func(a, b audioWork) int { return strings.Compare(a.path, b.path) })
+	return slices.CompactFunc(work, func(a, b audioWork) bool { return a.path == b.path }), nil
+}
+
+// collectAudioFiles walks the source tree and returns the audio files to
+// process in path order, or the listed ones with --from-stdin
+func collectAudioFiles() ([]audioWork, error) {
+	if inputList != nil {
+		return collectListedFiles()
+	}
+	var work []audioWork
+	err := filepath.Walk(config.SourceDir, func(path string, info os.FileInfo, err error) error {
+		if isHidden(config.SourceDir, path) {
+			return skipEntry(info)
+		}
+		if err != nil {
+			return handleAccessError(path, err)
+		}
+
+		if info.IsDir() {
+			return nil
+		}
+
+		ext := strings.ToLower(filepath.Ext(path))
+		if !isAudioExtension(ext) {
+			return nil
+		}
+		if unchangedSource(path, info) {
+			progress.skippedUnchanged()
+			return nil
+		}
+		work = append(work, audioWork{path: path, ext: ext, size: info.Size(), modTime: info.ModTime()})
+		return nil
+	})
+	return work, err
+}
+
+// workOrder returns the requested --order, taking the deprecated --sort
+// size-desc as largest
+func workOrder() string {
+	if (config.Order == "" || config.Order == "name") && config.Sort == "size-desc" {
+		return "largest"
+	}
+	return config.Order
+}
+
+// sortWork orders the work queue, which is collected in path order. largest
+// starts the longest conversions first so they do not end up last, newest
+// makes recent additions appear quickly. Ties keep path order.
+func sortWork(work []audioWork) {
+	var compare func(a, b audioWork) int
+	switch workOrder() {
+	case "largest":
+		compare = func(a, b audioWork) int { return cmp.Compare(b.size, a.size) }
+	case "smallest":
+		compare = func(a, b audioWork) int { return cmp.Compare(a.size, b.size) }
+	case "newest":
+		compare = func(a, b audioWork) int { return b.modTime.Compare(a.modTime) }
+	case "oldest":
+		compare = func(a, b audioWork) int { return a.modTime.Compare(b.modTime) }
+	default:
+		return
+	}
+	slices.SortStableFunc(work, compare)
+}
+
+// previewWork returns the sources a preview looks at: the audio files and,
+// with --copy-images, the images
+func previewWork() ([]audioWork, error) {
+	work, err := collectAudioFiles()
+	if err != nil {
+		return nil, err
+	}
+	if config.CopyImages {
+		err := filepath.Walk(config.SourceDir, func(path string, info os.FileInfo, err error) error {
+			if isHidden(config.SourceDir, path) {
+				return skipEntry(info)
+			}
+			if err != nil {
+				return handleAccessError(path, err)
+			}
+			if ext := strings.ToLower(filepath.Ext(path)); !info.IsDir() && isImageExtension(ext) {
+				work = append(work, audioWork{path: path, ext: ext})
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return work, nil
+}
+
+// ProbedFile is what the probe command reports for a source audio file. Path
+// is the source path the way run reports record it.
+type ProbedFile struct {
+	Path     string            `json:"path"`
+	Size     int64             `json:"size"`
+	ModTime  time.Time         `json:"mtime"`
+	Codec    string            `json:"codec,omitempty"`
+	Bits     int               `json:"bits,omitempty"` // 0 when ffprobe does not tell the depth
+	Rate     int               `json:"rate,omitempty"`
+	Channels int               `json:"channels,omitempty"`
+	Duration float64           `json:"duration,omitempty"` // In seconds
+	Tags     map[string]string `json:"tags,omitempty"`
+	Error    string            `json:"error,omitempty"`
+}
+
+// probeLibrary probes every audio file of sourceDir, --jobs at a time, and
+// prints them in path order, as JSON lines with --json. Files outside
+// --min-duration and --max-duration are left out.
+func probeLibrary(sourceDir string, w io.Writer) error {
+	config.SourceDir = sourceDir
+	if info, err := os.Stat(sourceDir); err != nil || !info.IsDir() {
+		return fmt.Errorf("source directory does not exist: %s", sourceDir)
+	}
+	if config.Jobs < 0 {
+		return fmt.Errorf("invalid jobs: %d", config.Jobs)
+	}
+	if config.ProbeDuration < 0 {
+		return fmt.Errorf("invalid probe-analyzeduration: %d", config.ProbeDuration)
+	}
+	if config.ProbeSize != 0 && config.ProbeSize < 32 {
+		return fmt.Errorf("invalid probe-size: %d. It must be at least 32 bytes", config.ProbeSize)
+	}
+	if _, _, err := durationRange(); err != nil {
+		return err
+	}
+	if _, err := exec.LookPath("ffprobe"); err != nil {
+		return fmt.Errorf("ffprobe is not installed. Please install FFmpeg to probe audio files")
+	}
+
+	work, err := collectAudioFiles()
+	if err != nil {
+		return err
+	}
+	files := make([]ProbedFile, len(work))
+	queue := make(chan int)
+	var wg sync.WaitGroup
+	for range min(max(config.Jobs, 1), max(len(work), 1)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				files[i] = probeSource(work[i])
+			}
+		}()
+	}
+	for i := range work {
+		queue <- i
+	}
+	close(queue)
+	wg.Wait()
+
+	encoder := json.NewEncoder(w)
+	for _, file := range files {
+		if durationOutOfRange(time.Duration(file.Duration*float64(time.Second))) != "" {
+			continue
+		}
+		if probeJSON {
+			if err := encoder.Encode(file); err != nil {
+				return err
+			}
+			continue
+		}
+		fmt.Fprintf(w, "%s: %s\n", file.Path, file.describe())
+	}
+	return nil
+}
+
+// probeSource probes one source file, sharing the probe cache with
+// everything else reading it
+func probeSource(work audioWork) ProbedFile {
+	defer forgetProbe(work.path)
+	file := ProbedFile{Path: work.path, Size: work.size, ModTime: work.modTime}
+	probe, err := probeFile(nil, work.path)
+	if err != nil {
+		file.Error = err.Error()
+		return file
+	}
+	info, err := audioInfoFromProbe(probe)
+	if err != nil {
+		file.Error = err.Error()
+		return file
+	}
+	for _, stream := range probe.Streams {
+		if stream.CodecType == "audio" {
+			file.Codec = stream.CodecName
+			break
+		}
+	}
+	file.Bits, file.Rate, file.Channels = info.Bits, info.Rate, info.Channels
+	if seconds, err := strconv.ParseFloat(probe.Format.Duration, 64); err == nil {
+		file.Duration = seconds
+	}
+	file.Tags = probeTags(probe)
+	return file
+}
+
+// describe formats a probed file for the console, e.g.
+// "flac, 24-bit 96000 Hz, 2 channels, 3:45"
+func (f ProbedFile) describe() string {
+	if f.Error != "" {
+		return "error: " + f.Error
+	}
+	parts := []string{cmp.Or(f.Codec, "unknown codec"), describeDepth(f.Bits, f.Rate)}
+	if f.Channels != 0 {
+		parts = append(parts, fmt.Sprintf("%d channels", f.Channels))
+	}
+	if f.Duration > 0 {
+		seconds := int(f.Duration + 0.5)
+		parts = append(parts, fmt.Sprintf("%d:%02d", seconds/60, seconds%60))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// plannedTargetPath returns the path a run would write for a source in an
+// output format, with the extension of the format it is converted to
+func plannedTargetPath(format, relPath, ext string) string {
+	targetPath := targetPathFor(format, relPath)
+	return strings.TrimSuffix(targetPath, filepath.Ext(targetPath)) + outputExtension(specFormat(relPath, format), ext)
+}
+
+// printTargetTree prints the directory tree the run would produce, built from
+// the computed target paths of the audio files and, with --copy-images, the
+// images. Nothing is written.
+func printTargetTree() error {
+	work, err := previewWork()
+	if err != nil {
+		return err
+	}
+
+	var paths []string
+	err = forEachOutputFormat(func(format string) error {
+		for _, item := range work {
+			relPath, err := filepath.Rel(sourceRoot(), item.path)
+			if err != nil {
+				return err
+			}
+			if relTarget, err := filepath.Rel(config.TargetDir, plannedTargetPath(format, relPath, item.ext)); err == nil {
+				paths = append(paths, filepath.ToSlash(relTarget))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	logf("%s/\n%s", filepath.Clean(config.TargetDir), formatTree(paths))
+	return nil
+}
+
+// TargetDiff classifies target paths, relative to the target directory, by
+// what a run would do to them
+type TargetDiff struct {
+	New       []string
+	Modified  []string
+	Unchanged []string
+	Orphaned  []string
+}
+
+// diffTarget compares an existing target with what the run would produce. A
+// source is new when none of the files it could have been written as exists,
+// modified when it is newer than the one that does, and unchanged otherwise.
+// Target files no source maps to are orphaned. Nothing is written.
+func diffTarget() (*TargetDiff, error) {
+	work, err := previewWork()
+	if err != nil {
+		return nil, err
+	}
+
+	diff := &TargetDiff{}
+	err = forEachOutputFormat(func(format string) error {
+		for _, item := range work {
+			relPath, err := filepath.Rel(sourceRoot(), item.path)
+			if err != nil {
+				return err
+			}
+			sourceInfo, err := os.Stat(item.path)
+			if err != nil {
+				return err
+			}
+			relTarget, err := filepath.Rel(config.TargetDir, plannedTargetPath(format, relPath, item.ext))
+			if err != nil {
+				return err
+			}
+			relTarget = filepath.ToSlash(relTarget)
+
+			existing := existingTarget(format, relPath)
+			switch {
+			case existing == nil:
+				diff.New = append(diff.New, relTarget)
+			case sourceInfo.ModTime().After(existing.ModTime()):
+				diff.Modified = append(diff.Modified, relTarget)
+			default:
+				diff.Unchanged = append(diff.Unchanged, relTarget)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	orphans, err := findOrphans()
+	if err != nil {
+		return nil, fmt.Errorf("failed to look for orphaned files: %w", err)
+	}
+	for _, orphan := range orphans {
+		if relTarget, err := filepath.Rel(config.TargetDir, orphan); err == nil {
+			diff.Orphaned = append(diff.Orphaned, filepath.ToSlash(relTarget))
+		}
+	}
+	for _, paths := range [][]string{diff.New, diff.Modified, diff.Unchanged, diff.Orphaned} {
+		slices.Sort(paths)
+	}
+	return diff, nil
+}
+
+// PlannedFile is what a run would do with a source file for one output format
+type PlannedFile struct {
+	Action string // actionConverted, actionCopied or actionSkipped
+	Target string
+	Reason string
+}
+
+// planFile works out what processSourceFile would do with a source for an
+// output format, reading its audio info but writing nothing
+func planFile(format, path, ext string) PlannedFile {
+	defer forgetProbe(path)
+
+	relPath, _ := filepath.Rel(sourceRoot(), path)
+	plan := PlannedFile{Action: actionCopied, Target: plannedTargetPath(format, relPath, ext)}
+	lossy := ext == ".mp3" || isLossyPassthroughExtension(ext)
+	switch {
+	case config.SkipExisting && targetUpToDate(format, path, relPath):
+		plan.Action = actionSkipped
+		plan.Reason = "up to date"
+		return plan
+	case config.CopyOnly:
+		plan.Reason = "--copy-only"
+		return plan
+	case lossy && format == "vorbis":
+		plan.Reason = "lossy files are not re-encoded to Vorbis"
+		return plan
+	case lossy && format == "opus":
+		plan.Reason = "lossy files are not re-encoded to Opus"
+		return plan
+	case lossy && format == "mp3":
+		if ext == ".mp3" && !mp3NeedsReencode(nil, path) {
+			plan.Reason = "already in target format"
+		} else if ext != ".mp3" && !config.ReencodeLossy {
+			plan.Reason = "use --reencode-lossy to convert it to MP3"
+		} else {
+			plan.Action = actionConverted
+			plan.Reason = "re-encoded to MP3, lossy to lossy"
+		}
+		return plan
+	case lossy:
+		plan.Reason = "lossy files are not converted to lossless formats"
+		return plan
+	}
+
+	info, err := getAudioInfo(nil, path)
+	if err != nil {
+		plan.Target = targetPathFor(format, relPath)
+		plan.Reason = "audio info unreadable, the original would be copied"
+		return plan
+	}
+	if config.SkipMultichannel && info.Channels > 2 {
+		return PlannedFile{Action: actionSkipped, Reason: fmt.Sprintf("%d channels, --skip-multichannel", info.Channels)}
+	}
+	if reason := durationOutOfRange(info.Duration); reason != "" {
+		return PlannedFile{Action: actionSkipped, Reason: reason}
+	}
+	decision := sourcePolicy(relPath, format).Decide(info)
+	if decision.Action == decisionConvert {
+		plan.Action = actionConverted
+	}
+	plan.Reason = decision.Reason
+	return plan
+}
+
+// unsupportedFiles lists the source files a run leaves alone: anything that is
+// not audio, an image or a playlist
+func unsupportedFiles() ([]string, error) {
+	var files []string
+	err := filepath.Walk(config.SourceDir, func(path string, info os.FileInfo, err error) error {
+		if isHidden(config.SourceDir, path) {
+			return skipEntry(info)
+		}
+		if err != nil {
+			return handleAccessError(path, err)
+		}
+		ext := strings.ToLower(filepath.Ext(path))
+		if !info.IsDir() && !isAudioExtension(ext) && !isImageExtension(ext) && !isPlaylistExtension(ext) {
+			files = append(files, path)
+		}
+		return nil
+	})
+	return files, err
+}
+
+// printDryRun prints what a run would do with every source file in every
+// requested format, followed by the number of files per action and the
+// number of outputs per file type. SoX and FFmpeg are only used to read audio
+// info, and nothing is written.
+func printDryRun() error {
+	counts := map[string]int{}
+	outputs := map[string]int{}
+	err := planSources(func(source, _ string, plan PlannedFile) {
+		counts[plan.Action]++
+		if plan.Action == actionSkipped {
+			logf("Would skip %s (%s)\n", source, plan.Reason)
+			return
+		}
+		logf("Would %s %s → %s (%s)\n", planVerb(plan.Action), source, slashRelative(config.TargetDir, plan.Target), plan.Reason)
+		outputs[strings.ToUpper(strings.TrimPrefix(filepath.Ext(plan.Target), "."))]++
+	})
+	if err == nil {
+		err = planCopies(func(source string, plan PlannedFile) {
+			counts[plan.Action]++
+			logf("Would copy %s → %s (%s)\n", source, slashRelative(config.TargetDir, plan.Target), plan.Reason)
+			outputs[strings.ToUpper(strings.TrimPrefix(filepath.Ext(plan.Target), "."))]++
+		})
+	}
+	if err != nil {
+		return err
+	}
+
+	unsupported, err := unsupportedFiles()
+	if err != nil {
+		return err
+	}
+	for _, path := range unsupported {
+		logf("Would skip %s (unsupported file type)\n", slashRelative(config.SourceDir, path))
+	}
+	counts[actionSkipped] += len(unsupported)
+
+	logf("Dry run: %d to convert, %d to copy, %d to skip\n", counts[actionConverted], counts[actionCopied], counts[actionSkipped])
+	if len(outputs) > 0 {
+		types := slices.Sorted(maps.Keys(outputs))
+		parts := make([]string, len(types))
+		for i, name := range types {
+			parts[i] = fmt.Sprintf("%d %s", outputs[name], name)
+		}
+		logf("Outputs: %s\n", strings.Join(parts, ", "))
+	}
+	return nil
+}
+
+// planSources calls fn with the plan of every source audio file for every
+// output format, in processing order. source is the slash separated path
+// relative to the source root.
+func planSources(fn func(source, format string, plan PlannedFile)) error {
+	work, err := collectAudioFiles()
+	if err != nil {
+		return err
+	}
+	sortWork(work)
+	for _, item := range work {
+		relPath, _ := filepath.Rel(sourceRoot(), item.path)
+		for _, format := range sourceFormats(relPath) {
+			fn(slashRelative(sourceRoot(), item.path), format, planFile(format, item.path, item.ext))
+		}
+	}
+	return nil
+}
+
+// planCopies calls fn with the plan of every image --copy-images copies and
+// every playlist --copy-playlists-rewritten copies, for every output format,
+// in path order. They are copied after the audio files.
+func planCopies(fn func(source string, plan PlannedFile)) error {
+	if !config.CopyImages && !config.CopyPlaylists {
+		return nil
+	}
+	return filepath.Walk(config.SourceDir, func(path string, info os.FileInfo, err error) error {
+		if isHidden(config.SourceDir, path) {
+			return skipEntry(info)
+		}
+		if err != nil {
+			return handleAccessError(path, err)
+		}
+		ext := strings.ToLower(filepath.Ext(path))
+		reason := ""
+		switch {
+		case info.IsDir():
+		case config.CopyImages && isImageExtension(ext):
+			reason = "--copy-images"
+		case config.CopyPlaylists && isPlaylistExtension(ext):
+			reason = "playlist entries rewritten to the outputs"
+		}
+		if reason == "" {
+			return nil
+		}
+		relPath, err := filepath.Rel(sourceRoot(), path)
+		if err != nil {
+			return err
+		}
+		return forEachOutputFormat(func(format string) error {
+			fn(slashRelative(sourceRoot(), path), PlannedFile{Action: actionCopied, Target: targetPathFor(format, relPath), Reason: reason})
+			return nil
+		})
+	})
+}
+
+// slashRelative returns path relative to root with forward slashes, or path
+// itself when it has no relative form
+func slashRelative(root, path string) string {
+	if rel, err := filepath.Rel(root, path); err == nil {
+		return filepath.ToSlash(rel)
+	}
+	return path
+}
+
+// planVerb returns the verb a plan describes its action with
+func planVerb(action string) string {
+	switch action {
+	case actionConverted:
+		return "convert"
+	case actionSkipped:
+		return "skip"
+	}
+	return "copy"
+}
+
+// alternatePlan receives the plan of the --alt-flags pass of --compare-plan
+// while that pass runs, nil otherwise
+var alternatePlan *[]plannedSource
+
+// plannedSource is the plan of a source for one output format
+type plannedSource struct {
+	Source string
+	Format string
+	Plan   PlannedFile
+}
+
+// collectPlan returns the plans of every source and output format
+func collectPlan() ([]plannedSource, error) {
+	var plans []plannedSource
+	err := planSources(func(source, format string, plan PlannedFile) {
+		plans = append(plans, plannedSource{Source: source, Format: outputFormatName(format), Plan: plan})
+	})
+	return plans, err
+}
+
+// comparePlans prints the files whose plan changes with --alt-flags. The
+// alternative goes through convertLibrary again with the alternate
+// configuration, so it is validated and set up like a run of its own, and
+// that pass only hands back its plan.
+func comparePlans(args []string) error {
+	plans, err := collectPlan()
+	if err != nil {
+		return err
+	}
+	if alternatePlan != nil {
+		*alternatePlan = plans
+		return nil
+	}
+
+	alternate, err := alternateConfig()
+	if err != nil {
+		return err
+	}
+	var alternatives []plannedSource
+	saved := config
+	func() {
+		defer func() { config = saved; alternatePlan = nil }()
+		config = alternate
+		alternatePlan = &alternatives
+		err = convertLibrary(args)
+	}()
+	if err != nil {
+		return fmt.Errorf("alt-flags: %w", err)
+	}
+
+	key := func(p plannedSource) string { return p.Source + "\x00" + p.Format }
+	byKey := make(map[string]PlannedFile, len(alternatives))
+	for _, alternative := range alternatives {
+		byKey[key(alternative)] = alternative.Plan
+	}
+	describe := func(plan PlannedFile, ok bool) string {
+		switch {
+		case !ok:
+			return "not planned"
+		case plan.Action == actionSkipped:
+			return fmt.Sprintf("skip (%s)", plan.Reason)
+		}
+		return fmt.Sprintf("%s → %s (%s)", planVerb(plan.Action), slashRelative(config.TargetDir, plan.Target), plan.Reason)
+	}
+	differing := 0
+	report := func(source, format string, current PlannedFile, inCurrent bool, alternative PlannedFile, inAlternative bool) {
+		differing++
+		logf("%s (%s):\n  current:   %s\n  alternate: %s\n", source, format, describe(current, inCurrent), describe(alternative, inAlternative))
+	}
+	for _, current := range plans {
+		alternative, ok := byKey[key(current)]
+		delete(byKey, key(current))
+		if !ok || alternative != current.Plan {
+			report(current.Source, current.Format, current.Plan, true, alternative, ok)
+		}
+	}
+	// Formats only the alternative produces
+	for _, alternative := range alternatives {
+		if _, ok := byKey[key(alternative)]; ok {
+			report(alternative.Source, alternative.Format, PlannedFile{}, false, alternative.Plan, true)
+		}
+	}
+	logf("Compared plans: %d of %d planned outputs differ with %s\n", differing, len(plans)+len(byKey), config.AltFlags)
+	return nil
+}
+
+// altFlagsCmd is the command --alt-flags are parsed with, rootCmd. It is set
+// in init because rootCmd itself leads to convertLibrary.
+var altFlagsCmd *cobra.Command
+
+// alternateConfig returns the configuration with --alt-flags parsed on top
+// of it. A repeatable flag given there replaces its current values instead
+// of adding to them.
+func alternateConfig() (Config, error) {
+	saved := config
+	defer func() { config = saved }()
+
+	flags := altFlagsCmd.Flags()
+	fields := strings.Fields(config.AltFlags)
+	for _, field := range fields {
+		name, _, _ := strings.Cut(strings.TrimPrefix(field, "--"), "=")
+		if flag := flags.Lookup(name); flag != nil && strings.HasPrefix(field, "--") {
+			if list, ok := flag.Value.(*formatListValue); ok {
+				*list.target = ""
+			}
+		}
+	}
+	if err := flags.Parse(fields); err != nil {
+		return Config{}, fmt.Errorf("invalid alt-flags: %w", err)
+	}
+	if rest := flags.Args(); len(rest) > 0 {
+		return Config{}, fmt.Errorf("invalid alt-flags: %q is not a flag", rest[0])
+	}
+	// Several output formats go to their own subdirectories, as in runConverter
+	if len(enforcedFormats()) > 1 && !flags.Changed("format-subdir") {
+		config.FormatSubdir = true
+	}
+	return config, nil
+}
+
+// existingTarget returns the first file a source may have been written as in
+// an output format that exists in the target, or nil. The candidates are
+// mapped to the output extension of the format, so an ALAC source finds its
+// FLAC output.
+func existingTarget(format, relPath string) os.FileInfo {
+	for _, candidate := range targetCandidates(format, relPath) {
+		if info, err := os.Stat(candidate); err == nil && !info.IsDir() {
+			return info
+		}
+	}
+	return nil
+}
+
+// targetUpToDate reports whether a source already has an output that is not
+// older than it, for --skip-existing. Outputs only appear under their final
+// name once complete, so an interrupted run leaves nothing that passes.
+func targetUpToDate(format, sourcePath, relPath string) bool {
+	existing := existingTarget(format, relPath)
+	if existing == nil {
+		return false
+	}
+	source, err := os.Stat(sourcePath)
+	return err == nil && !source.ModTime().After(existing.ModTime())
+}
+
+// printTargetDiff prints the target files a run would add (A) or update (M)
+// and the orphaned ones (D) in the style of git diff --name-status, followed
+// by the counts
+func printTargetDiff() error {
+	diff, err := diffTarget()
+	if err != nil {
+		return err
+	}
+	lines := make([]string, 0, len(diff.New)+len(diff.Modified)+len(diff.Orphaned))
+	for _, group := range []struct {
+		status string
+		paths  []string
+	}{{"A", diff.New}, {"M", diff.Modified}, {"D", diff.Orphaned}} {
+		for _, path := range group.paths {
+			lines = append(lines, group.status+"\t"+path)
+		}
+	}
+	// Sort by path, like git
+	slices.SortStableFunc(lines, func(a, b string) int { return strings.Compare(a[2:], b[2:]) })
+	for _, line := range lines {
+		logf("%s\n", line)
+	}
+	logf("Diff: %d new, %d modified, %d unchanged, %d orphaned\n",
+		len(diff.New), len(diff.Modified), len(diff.Unchanged), len(diff.Orphaned))
+	return nil
+}
+
+// formatTree renders slash separated paths as an indented tree, directories
+// first and followed by a slash
+func formatTree(paths []string) string {
+	type node struct {
+		children map[string]*node
+	}
+	root := &node{children: map[string]*node{}}
+	for _, path := range paths {
+		current := root
+		for _, part := range strings.Split(path, "/") {
+			child, ok := current.children[part]
+			if !ok {
+				child = &node{children: map[string]*node{}}
+				current.children[part] = child
+			}
+			current = child
+		}
+	}
+
+	var b strings.Builder
+	var write func(n *node, depth int)
+	write = func(n *node, depth int) {
+		names := slices.Collect(maps.Keys(n.children))
+		slices.SortFunc(names, func(a, b string) int {
+			// Directories before files
+			aDir, bDir := len(n.children[a].children) > 0, len(n.children[b].children) > 0
+			if aDir != bDir {
+				if aDir {
+					return -1
+				}
+				return 1
+			}
+			return strings.Compare(a, b)
+		})
+		for _, name := range names {
+			child := n.children[name]
+			if len(child.children) > 0 {
+				fmt.Fprintf(&b, "%s%s/\n", strings.Repeat("  ", depth+1), name)
+				write(child, depth+1)
+			} else {
+				fmt.Fprintf(&b, "%s%s\n", strings.Repeat("  ", depth+1), name)
+			}
+		}
+	}
+	write(root, 0)
+	return b.String()
+}
+
+// defaultThroughput is the assumed processing speed in source bytes per
+// second when the estimate is not calibrated
+const defaultThroughput = 8 << 20
+
+// estimateDuration estimates how long processing the work list takes at the
+// given throughput in source bytes per second
+func estimateDuration(work []audioWork, throughput float64) time.Duration {
+	var total int64
+	for _, item := range work {
+		total += item.size
+	}
+	if throughput <= 0 {
+		throughput = defaultThroughput
+	}
+	return time.Duration(float64(total) / throughput * float64(time.Second))
+}
+
+// representativeWork picks the median sized lossless file, which is the kind
+// of file conversions spend their time on, or nil if there is none
+func representativeWork(work []audioWork) *audioWork {
+	var lossless []audioWork
+	for _, item := range work {
+		if isLosslessExtension(item.ext) {
+			lossless = append(lossless, item)
+		}
+	}
+	if len(lossless) == 0 {
+		return nil
+	}
+	slices.SortStableFunc(lossless, func(a, b audioWork) int {
+		return cmp.Compare(a.size, b.size)
+	})
+	return &lossless[len(lossless)/2]
+}
+
+// calibrateThroughput processes one representative file into a scratch
+// directory and returns the measured throughput in source bytes per second
+func calibrateThroughput(work []audioWork) (float64, error) {
+	item := representativeWork(work)
+	if item == nil {
+		return 0, fmt.Errorf("no FLAC or ALAC file to calibrate with")
+	}
+
+	scratch, err := os.MkdirTemp("", "lilt-calibrate-")
+	if err != nil {
+		return 0, fmt.Errorf("failed to create calibration directory: %w", err)
+	}
+	defer os.RemoveAll(scratch)
+
+	originalTarget := config.TargetDir
+	config.TargetDir = scratch
+	defer func() {
+		config.TargetDir = originalTarget
+		resetAssignedPaths()
+	}()
+
+	logf("Calibrating with %s\n", item.path)
+	start := time.Now()
+	if err := processSourceFormats(newFileTask(item.path), item.ext); err != nil {
+		return 0, fmt.Errorf("calibration failed: %w", err)
+	}
+	elapsed := time.Since(start).Seconds()
+	if elapsed <= 0 {
+		return defaultThroughput, nil
+	}
+	return float64(item.size) / elapsed, nil
+}
+
+// printEstimate prints how long processing the source would take
+func printEstimate() error {
+	work, err := collectAudioFiles()
+	if err != nil {
+		return err
+	}
+
+	throughput := float64(defaultThroughput)
+	basis := "default throughput"
+	if config.Calibrate {
+		measured, err := calibrateThroughput(work)
+		if err != nil {
+			logf("Warning: %v, using the default throughput\n", err)
+		} else {
+			throughput = measured
+			basis = "calibrated throughput"
+		}
+	}
+
+	var total int64
+	for _, item := range work {
+		total += item.size
+	}
+	logf("Estimated processing time for %d files (%.1f MB): %s (%s of %.1f MB/s)\n",
+		len(work), float64(total)/(1<<20), estimateDuration(work, throughput).Round(time.Second), basis, throughput/(1<<20))
+	return nil
+}
+
+// benchmarkSeconds is the length of the sample --benchmark synthesizes
+const benchmarkSeconds = 30
+
+// BenchmarkResult is the timing of one --benchmark configuration
+type BenchmarkResult struct {
+	Format  string
+	Jobs    int
+	Files   int
+	Bytes   int64
+	Elapsed time.Duration
+}
+
+// benchmarkJobs returns the concurrency levels to benchmark
+func benchmarkJobs() []int {
+	if len(config.BenchJobs) > 0 {
+		return config.BenchJobs
+	}
+	if runtime.NumCPU() == 1 {
+		return []int{1}
+	}
+	return []int{1, runtime.NumCPU()}
+}
+
+// runBenchmark converts copies of a sample file in a scratch directory to
+// each output format at each concurrency level, and prints the throughput.
+// The output formats default to all of them.
+func runBenchmark() error {
+	if err := validateOutputFormats(); err != nil {
+		return err
+	}
+	if err := validateMP3Options(); err != nil {
+		return err
+	}
+	jobs := benchmarkJobs()
+	for _, n := range jobs {
+		if n < 1 {
+			return fmt.Errorf("invalid benchmark-jobs: %d. It must be at least 1", n)
+		}
+	}
+	formats := enforcedFormats()
+	if len(formats) == 0 {
+		formats = []string{"flac", "mp3", "alac"}
+	}
+	if config.BenchSample != "" {
+		ext := strings.ToLower(filepath.Ext(config.BenchSample))
+		if ext != ".flac" && ext != ".m4a" {
+			return fmt.Errorf("benchmark sample must be a FLAC or ALAC file: %s", config.BenchSample)
+		}
+		if _, err := os.Stat(config.BenchSample); err != nil {
+			return fmt.Errorf("benchmark sample does not exist: %s", config.BenchSample)
+		}
+	}
+
+	scratch, err := os.MkdirTemp("", "lilt-benchmark-")
+	if err != nil {
+		return fmt.Errorf("failed to create benchmark directory: %w", err)
+	}
+	defer os.RemoveAll(scratch)
+
+	config.SourceDir = filepath.Join(scratch, "source")
+	config.SourceRoot = ""
+	config.TargetDir = filepath.Join(scratch, "target")
+	for _, dir := range []string{config.SourceDir, config.TargetDir} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("failed to create benchmark directory: %w", err)
+		}
+	}
+
+	progress = &progressReporter{}
+	console = &consoleWriter{json: config.JSONLogs}
+	control = newRunControl()
+	resetAssignedPaths()
+	if err := setupSoxCommand(); err != nil {
+		return &exitError{code: exitEnvironment, err: err}
+	}
+
+	ext := ".flac"
+	if config.BenchSample != "" {
+		ext = strings.ToLower(filepath.Ext(config.BenchSample))
+	}
+	sample := filepath.Join(config.SourceDir, "sample"+ext)
+	if config.BenchSample != "" {
+		if err := copyFile(nil, config.BenchSample, sample); err != nil {
+			return fmt.Errorf("failed to copy benchmark sample: %w", err)
+		}
+	} else if err := synthesizeSample(sample); err != nil {
+		return err
+	}
+
+	// Enough copies to keep the highest concurrency level busy twice over
+	count := max(8, 2*slices.Max(jobs))
+	var files []string
+	for i := 1; i <= count; i++ {
+		path := filepath.Join(config.SourceDir, fmt.Sprintf("sample-%02d%s", i, ext))
+		if err := copyFile(nil, sample, path); err != nil {
+			return fmt.Errorf("failed to prepare benchmark files: %w", err)
+		}
+		files = append(files, path)
+	}
+	info, err := os.Stat(sample)
+	if err != nil {
+		return err
+	}
+
+	var results []BenchmarkResult
+	for _, format := range formats {
+		for _, n := range jobs {
+			config.EnforceOutputFormat = format
+			config.TargetDir = filepath.Join(scratch, "target", fmt.Sprintf("%s-%d", format, n))
+			logf("Benchmarking %s with %d job(s)\n", format, n)
+			elapsed, err := benchmarkRun(files, ext, n)
+			if err != nil {
+				return fmt.Errorf("benchmark of %s with %d job(s) failed: %w", format, n, err)
+			}
+			results = append(results, BenchmarkResult{Format: format, Jobs: n, Files: len(files), Bytes: info.Size() * int64(len(files)), Elapsed: elapsed})
+		}
+	}
+	logf("%s", formatBenchmark(results))
+	return nil
+}
+
+// synthesizeSample writes a 24-bit 96 kHz stereo FLAC sine sweep to path
+func synthesizeSample(path string) error {
+	synth := []string{"-n", "-r", "96000", "-b", "24", "-c", "2"}
+	effects := []string{"synth", strconv.Itoa(benchmarkSeconds), "sine", "20-20000"}
+	var cmd *exec.Cmd
+	if config.UseDocker {
+		args := []string{"run", "--rm",
+			"-v", fmt.Sprintf("%s:/source", sourceRoot()),
+			config.DockerImage}
+		args = append(args, synth...)
+		args = append(args, getDockerPath(path))
+		args = append(args, effects...)
+		cmd = newCommand("docker", args...)
+	} else {
+		args := append(synth, path)
+		args = append(args, effects...)
+		cmd = newCommand(config.SoxCommand, args...)
+	}
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to synthesize benchmark sample: %w", err)
+	}
+	return nil
+}
+
+// benchmarkRun processes files with n of them in flight at a time and
+// returns the wall clock time it took
+func benchmarkRun(files []string, ext string, n int) (time.Duration, error) {
+	queue := make(chan string)
+	errs := make(chan error, len(files))
+	var wg sync.WaitGroup
+	start := time.Now()
+	for worker := 1; worker <= n; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer control.removeWorkerScratch(worker)
+			for path := range queue {
+				task := newFileTask(path)
+				task.worker = worker
+				err := processSourceFile(task, ext)
+				resultAction(path, err)
+				errs <- err
+			}
+		}()
+	}
+	for _, path := range files {
+		queue <- path
+	}
+	close(queue)
+	wg.Wait()
+	elapsed := time.Since(start)
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			return 0, err
+		}
+	}
+	return elapsed, nil
+}
+
+// formatBenchmark renders benchmark results as a table of files and
+// megabytes per second
+func formatBenchmark(results []BenchmarkResult) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%-8s %6s %6s %10s %9s %9s\n", "Format", "Jobs", "Files", "Seconds", "Files/s", "MB/s")
+	for _, result := range results {
+		seconds := result.Elapsed.Seconds()
+		var filesPerSecond, mbPerSecond float64
+		if seconds > 0 {
+			filesPerSecond = float64(result.Files) / seconds
+			mbPerSecond = float64(result.Bytes) / (1 << 20) / seconds
+		}
+		fmt.Fprintf(&b, "%-8s %6d %6d %10.2f %9.2f %9.2f\n", result.Format, result.Jobs, result.Files, seconds, filesPerSecond, mbPerSecond)
+	}
+	return b.String()
+}
+
+func processAudioFiles() error {
+	console.setStage("audio")
+	defer console.setStage("")
+	defer console.closeDir()
+
+	work, err := collectAudioFiles()
+	if err != nil {
+		return err
+	}
+	sortWork(work)
+	expectDirectories(work)
+	console.expectFiles(work)
+	if unchanged := progress.unchangedCount(); unchanged > 0 {
+		logf("Skipping %d file(s) unchanged since the last run\n", unchanged)
+	}
+	if rate := highSampleRate(); rate != 0 {
+		logf("Resampling high sample rate files to %d Hz\n", rate)
+	}
+	if config.TargetBitDepth > 16 {
+		logf("Reducing the bit depth of deeper files to %d bits\n", config.TargetBitDepth)
+	}
+	jobs := fileJobs()
+	if jobs > 1 {
+		logf("Processing up to %d files at a time\n", jobs)
+	}
+	progress.runStarted(len(work))
+
+	// A worker is taken before the next file is dispatched, so with one job a
+	// file only starts once the previous one finished. Each worker keeps its
+	// scratch directory until the run is done with the files.
+	workers := make(chan int, jobs)
+	for worker := 1; worker <= jobs; worker++ {
+		workers <- worker
+		defer control.removeWorkerScratch(worker)
+	}
+	var wg sync.WaitGroup
+	var fatal struct {
+		sync.Mutex
+		err error
+	}
+	failed := func() error {
+		fatal.Lock()
+		defer fatal.Unlock()
+		return fatal.err
+	}
+	for i, item := range work {
+		worker := <-workers
+		// Hold back new files while paused, stop dispatching them once a
+		// drain was requested or a file ended the run
+		control.waitIfPaused()
+		if control.isDraining() {
+			remaining := make([]string, 0, len(work)-i)
+			for _, rest := range work[i:] {
+				remaining = append(remaining, rest.path)
+			}
+			progress.interrupted(remaining)
+			break
+		}
+		if failed() != nil {
+			break
+		}
+		if jobs > 1 {
+			// Claim the target name in work order, concurrent files would
+			// claim colliding names in a random order
+			if relPath, err := filepath.Rel(sourceRoot(), item.path); err == nil {
+				targetPathFor("", relPath)
+			}
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { workers <- worker }()
+			// With one job the output streams as it is logged
+			var out *fileOutput
+			if jobs > 1 {
+				out = console.beginFile(item.path)
+			}
+			if err := processWork(item, worker, out); err != nil {
+				fatal.Lock()
+				fatal.err = cmp.Or(fatal.err, err)
+				fatal.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return failed()
+}
+
+// processWork processes a queued source file in the scratch directory of a
+// worker, logging through out when given, and reports how it went. Its failure is recorded and only returned
+// when it ends the run: with --strict, or for an unreadable file
+// handleAccessError does not skip.
+func processWork(item audioWork, worker int, out *fileOutput) error {
+	progress.fileStarted(item.path)
+	task := newFileTask(item.path)
+	task.out = out
+	task.worker = worker
+	err := withRetries(task, func() error {
+		return processSourceFormats(task, item.ext)
+	})
+	action := resultAction(item.path, err)
+	var outputs []string
+	if action == actionConverted || action == actionCopied {
+		outputs = outputPaths(item.path)
+		for _, output := range outputs {
+			recordProduced(output)
+		}
+	}
+	finishInDirectory(item.path, outputs)
+	if err == nil && action != actionFailed && config.ChangedOnly {
+		recordCompletedSource(item)
+	}
+	var fatal error
+	if err != nil && !isSourceAccessError(err) {
+		recordConversionFailure(task, err)
+		if config.Strict {
+			fatal = err
+		}
+	} else if err != nil {
+		fatal = handleAccessError(item.path, err)
+	}
+	// The lines of the file come before the summary of its directory
+	console.endFile(out)
+	progress.fileCompleted(FileCompleted{Path: item.path, Action: action, BytesIn: item.size, BytesOut: outputSize(item.path, action), Duration: takeDuration(item.path), Err: err})
+	return fatal
+}
+
+// fileJobs returns how many files are processed at a time
+func fileJobs() int {
+	return max(config.Jobs, 1)
+}
+
+// withRetries runs fn for a source file and runs it again, up to --retries
+// times, while it fails with a retryable tool exit code
+func withRetries(t *fileTask, fn func() error) error {
+	err := fn()
+	for attempt := 1; attempt <= config.Retries && retryableError(err) && !control.isDraining(); attempt++ {
+		t.logf("Warning: %v, retrying %s (%d/%d)\n", err, t.path, attempt, config.Retries)
+		err = fn()
+	}
+	return err
+}
+
+// retryableError reports whether err comes from an external tool that exited
+// with one of the --retry-exit-codes, or with any code when none are given.
+// Deterministic failures such as unsupported formats are better left out.
+func retryableError(err error) bool {
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() < 0 {
+		return false
+	}
+	return len(config.RetryExitCodes) == 0 || slices.Contains(config.RetryExitCodes, exitErr.ExitCode())
+}
+
+// processSourceFile converts or copies a single audio file to the target
+func processSourceFile(t *fileTask, ext string) error {
+	path := t.path
+	t.logf("Processing: %s\n", path)
+	defer forgetProbe(path)
+	defer recordPipeline(t)
+
+	if multichannelSkipped(t, path, ext) || durationSkipped(t, path, ext) {
+		return nil
+	}
+
+	// Create target directory structure
+	relPath, err := filepath.Rel(sourceRoot(), path)
+	if err != nil {
+		return err
+	}
+
+	if config.SkipExisting && targetUpToDate(t.format, path, relPath) {
+		t.logf("Skipping (up to date): %s\n", path)
+		markAction(path, actionSkipped)
+		return nil
+	}
+
+	targetPath := targetPathFor(t.format, relPath)
+	targetDir := filepath.Dir(targetPath)
+
+	if err := os.MkdirAll(targetDir, 0755); err != nil {
+		return fmt.Errorf("failed to create target directory: %w", err)
+	}
+
+	if config.CopyOnly {
+		t.logf("Copying: %s\n", path)
+		return copyFile(t, path, targetPath)
+	}
+
+	// Handle enforce-output-format mode
+	if t.format != "" {
+		return processAudioFileWithEnforcedFormat(t, path, targetPath, ext)
+	}
+
+	// Original processing logic when no format enforcement
+	// Handle MP3 and AAC files - just copy them
+	if ext == ".mp3" || isLossyPassthroughExtension(ext) {
+		t.logf("Copying %s file: %s\n", lossyName(ext), path)
+		return copyFile(t, path, targetPath)
+	}
+
+	// Process FLAC, ALAC and WAV files
+	audioInfo, err := getAudioInfo(t, path)
+	if err != nil {
+		t.logf("Warning: Could not get audio info for %s, copying original\n", path)
+		return copyFile(t, path, targetPath)
+	}
+
+	t.logf("Detected: %s, %d Hz, %s format\n", bitsLabel(audioInfo.Bits), audioInfo.Rate, audioInfo.Format)
+	if err := checkUpsampling(t, path, audioInfo); err != nil {
+		return err
+	}
+
+	decision := t.decide(audioInfo)
+	needsConversion, bitrateArgs, sampleRateArgs := decision.soxArgs()
+
+	if decision.Action == decisionConvert {
+		if audioInfo.Format == "alac" || audioInfo.Format == "wav" {
+			t.logf("Converting %s to FLAC: %s (%s)\n", strings.ToUpper(audioInfo.Format), path, decision.Reason)
+			// Always convert ALAC and WAV to FLAC, even if bit depth and sample rate are acceptable
+			targetPath = changeExtensionToFlac(targetPath)
+		} else {
+			t.logf("Converting FLAC: %s (%s)\n", path, decision.Reason)
+		}
+
+		if err := processAudioFile(t, path, targetPath, audioInfo, needsConversion, bitrateArgs, sampleRateArgs); err != nil {
+			t.logf("Error: Audio conversion failed. Copying original file instead. Error: %v\n", err)
+			recordConversionFailure(t, err)
+			return copyFile(t, path, targetPath)
+		}
+	} else {
+		t.logf("Copying FLAC: %s (%s)\n", path, decision.Reason)
+		return copyCompliant(t, path, targetPath)
+	}
+
+	return nil
+}
+
+// skippedMultichannel collects the sources skipped by --skip-multichannel
+var skippedMultichannel = struct {
+	sync.Mutex
+	list []string
+}{}
+
+// multichannelSkipped reports whether --skip-multichannel skips path, and
+// records it if so. MP3 and AAC sources are never skipped, and neither are files
+// whose channel count cannot be read.
+func multichannelSkipped(t *fileTask, path, ext string) bool {
+	if !config.SkipMultichannel || ext == ".mp3" || isLossyPassthroughExtension(ext) {
+		return false
+	}
+	info, err := getAudioInfo(t, path)
+	if err != nil || info.Channels <= 2 {
+		return false
+	}
+	t.logf("Skipping multichannel file: %s (%d channels)\n", path, info.Channels)
+	markAction(path, actionSkipped)
+	skippedMultichannel.Lock()
+	skippedMultichannel.list = append(skippedMultichannel.list, path)
+	skippedMultichannel.Unlock()
+	return true
+}
+
+func recordedMultichannelSkips() []string {
+	skippedMultichannel.Lock()
+	defer skippedMultichannel.Unlock()
+	list := slices.Clone(skippedMultichannel.list)
+	slices.Sort(list)
+	return list
+}
+
+func resetMultichannelSkips() {
+	skippedMultichannel.Lock()
+	skippedMultichannel.list = nil
+	skippedMultichannel.Unlock()
+}
+
+// skippedDuration collects the sources skipped by --min-duration and
+// --max-duration
+var skippedDuration = struct {
+	sync.Mutex
+	list []string
+}{}
+
+// durationSkipped reports whether path is outside --min-duration and
+// --max-duration, and records it if so. Files whose duration cannot be read
+// are not skipped.
+func durationSkipped(t *fileTask, path, ext string) bool {
+	if config.MinDuration == "" && config.MaxDuration == "" || copiedUnprobed(t.format, ext) {
+		return false
+	}
+	duration, ok := sourceDuration(t, path, ext)
+	if !ok {
+		return false
+	}
+	reason := durationOutOfRange(duration)
+	if reason == "" {
+		return false
+	}
+	t.logf("Skipping %s (%s)\n", path, reason)
+	markAction(path, actionSkipped)
+	skippedDuration.Lock()
+	skippedDuration.list = append(skippedDuration.list, path)
+	skippedDuration.Unlock()
+	return true
+}
+
+// sourceDuration returns the duration of a source: from SoX or ffprobe for
+// lossless files, from ffprobe's container duration for lossy ones
+func sourceDuration(t *fileTask, path, ext string) (time.Duration, bool) {
+	if isLosslessExtension(ext) {
+		info, err := getAudioInfo(t, path)
+		return info.Duration, err == nil && info.Duration > 0
+	}
+	probe, err := probeFile(t, path)
+	if err != nil {
+		return 0, false
+	}
+	seconds, err := strconv.ParseFloat(probe.Format.Duration, 64)
+	return time.Duration(seconds * float64(time.Second)), err == nil && seconds > 0
+}
+
+// durationOutOfRange describes why a duration is outside --min-duration and
+// --max-duration, or returns an empty string when it is in range or unknown
+func durationOutOfRange(duration time.Duration) string {
+	minDuration, maxDuration, err := durationRange()
+	switch {
+	case duration <= 0 || err != nil:
+		return ""
+	case minDuration != 0 && duration < minDuration:
+		return fmt.Sprintf("%s is shorter than --min-duration %s", duration.Round(time.Second), config.MinDuration)
+	case maxDuration != 0 && duration > maxDuration:
+		return fmt.Sprintf("%s is longer than --max-duration %s", duration.Round(time.Second), config.MaxDuration)
+	}
+	return ""
+}
+
+// durationRange parses --min-duration and --max-duration, 0 when unset
+func durationRange() (time.Duration, time.Duration, error) {
+	var limits [2]time.Duration
+	for i, flag := range []struct{ name, value string }{{"min-duration", config.MinDuration}, {"max-duration", config.MaxDuration}} {
+		if flag.value == "" {
+			continue
+		}
+		duration, err := parseClockDuration(flag.value)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid %s: %w", flag.name, err)
+		}
+		limits[i] = duration
+	}
+	return limits[0], limits[1], nil
+}
+
+func recordedDurationSkips() []string {
+	skippedDuration.Lock()
+	defer skippedDuration.Unlock()
+	list := slices.Clone(skippedDuration.list)
+	slices.Sort(list)
+	return list
+}
+
+func resetDurationSkips() {
+	skippedDuration.Lock()
+	skippedDuration.list = nil
+	skippedDuration.Unlock()
+}
+
+// parseClockDuration parses seconds ("90", "90.5") or a clock time ("1:30",
+// "1:02:30"), the way SoX prints durations
+func parseClockDuration(value string) (time.Duration, error) {
+	invalid := fmt.Errorf("%q is not in seconds or mm:ss", value)
+	parts := strings.Split(strings.TrimSpace(value), ":")
+	if len(parts) > 3 {
+		return 0, invalid
+	}
+	seconds, err := strconv.ParseFloat(parts[len(parts)-1], 64)
+	if err != nil || !(seconds >= 0 && seconds < 1<<31) || (len(parts) > 1 && seconds >= 60) {
+		return 0, invalid
+	}
+	duration := time.Duration(seconds * float64(time.Second))
+	for i, unit := range []time.Duration{time.Minute, time.Hour}[:len(parts)-1] {
+		n, err := strconv.Atoi(parts[len(parts)-2-i])
+		if err != nil || n < 0 || (unit == time.Minute && len(parts) == 3 && n >= 60) {
+			return 0, invalid
+		}
+		duration += time.Duration(n) * unit
+	}
+	return duration, nil
+}
+
+// mp3BitrateValue is the --mp3-bitrate flag, taking a bitrate in kbps or a
+// LAME VBR preset such as V2. Presets are checked by validateMP3Options.
+type mp3BitrateValue struct {
+	bitrate *int
+	preset  *string
+}
+
+func (v *mp3BitrateValue) String() string {
+	switch {
+	case v == nil || v.bitrate == nil:
+		return ""
+	case *v.preset != "":
+		return *v.preset
+	case *v.bitrate != 0:
+		return strconv.Itoa(*v.bitrate)
+	}
+	return ""
+}
+
+func (v *mp3BitrateValue) Set(value string) error {
+	*v.bitrate, *v.preset = 0, ""
+	if bitrate, err := strconv.Atoi(value); err == nil {
+		*v.bitrate = bitrate
+	} else {
+		*v.preset = value
+	}
+	return nil
+}
+
+func (v *mp3BitrateValue) Type() string {
+	return "string"
+}
+
+// formatListValue is the --enforce-output-format flag. Repeating the flag
+// appends to the comma separated list instead of replacing it.
+type formatListValue struct {
+	target *string
+}
+
+func (v *formatListValue) String() string {
+	if v == nil || v.target == nil {
+		return ""
+	}
+	return *v.target
+}
+
+func (v *formatListValue) Set(value string) error {
+	if *v.target != "" {
+		value = *v.target + "," + value
+	}
+	*v.target = value
+	return nil
+}
+
+func (v *formatListValue) Type() string {
+	return "string"
+}
+
+// validateOutputFormats checks the requested output formats and normalizes
+// config.EnforceOutputFormat to a lower case comma separated list, with ogg
+// spelled vorbis
+func validateOutputFormats() error {
+	formats := enforcedFormats()
+	for i, format := range formats {
+		if format == "ogg" {
+			format = "vorbis"
+			formats[i] = format
+		}
+		validFormats := []string{"flac", "mp3", "alac", "vorbis", "opus"}
+		if !slices.Contains(validFormats, format) {
+			return fmt.Errorf("invalid enforce-output-format: %s. Valid options are: flac, mp3, alac, vorbis, opus", format)
+		}
+		if slices.Contains(formats[:i], format) {
+			return fmt.Errorf("enforce-output-format %s was given more than once", format)
+		}
+	}
+	config.EnforceOutputFormat = strings.Join(formats, ",")
+	return nil
+}
+
+// enforcedFormats returns the requested output formats, none in the default mode
+func enforcedFormats() []string {
+	var formats []string
+	for _, format := range strings.Split(config.EnforceOutputFormat, ",") {
+		if format = strings.ToLower(strings.TrimSpace(format)); format != "" {
+			formats = append(formats, format)
+		}
+	}
+	return formats
+}
+
+// outputFormats returns the requested output formats, or "" alone for the
+// default mode
+func outputFormats() []string {
+	if formats := enforcedFormats(); len(formats) > 0 {
+		return formats
+	}
+	return []string{""}
+}
+
+// forEachOutputFormat calls fn once per requested output format, with "" in
+// the default mode
+func forEachOutputFormat(fn func(format string) error) error {
+	for _, format := range outputFormats() {
+		if err := fn(format); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sourceFormats returns the output formats of a source file, which is the
+// format its spec asks for or every requested format
+func sourceFormats(relPath string) []string {
+	if spec, ok := fileSpecFor(relPath); ok && spec.Format != "" {
+		return []string{spec.Format}
+	}
+	return outputFormats()
+}
+
+// specFormat returns the format a source file is written in for a requested
+// output format, which its spec may override
+func specFormat(relPath, format string) string {
+	if spec, ok := fileSpecFor(relPath); ok && spec.Format != "" {
+		return spec.Format
+	}
+	return format
+}
+
+// processSourceFormats processes a source file into every requested format,
+// or the one its --spec-file entry asks for
+func processSourceFormats(t *fileTask, ext string) error {
+	relPath, _ := filepath.Rel(sourceRoot(), t.path)
+	for _, format := range sourceFormats(relPath) {
+		t.start(format, sourcePolicy(relPath, format))
+		if err := processSourceFile(t, ext); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// outputFormatName returns the name of an output format, which is FLAC in
+// the default mode
+func outputFormatName(format string) string {
+	if format != "" {
+		return format
+	}
+	return "flac"
+}
+
+// targetPathFor maps a path relative to the source directory to its location
+// under the target directory for an output format. All target path
+// computation goes through here.
+func targetPathFor(format, relPath string) string {
+	sourceRel := relPath
+	renamed := false
+	// Sources copied unprobed have no tags to name them by
+	unprobed := copiedUnprobed(format, strings.ToLower(filepath.Ext(relPath)))
+	if assigned, ok := assignedTargetPath(sourceRel); ok {
+		// Claimed before, rendering it again would probe the source again
+		relPath = assigned
+	} else if mapped, ok := renameMap[relPath]; ok {
+		relPath = mapped
+	} else if nameTemplate != nil && relPath != "" && !unprobed {
+		relPath = templatedPath(relPath)
+		renamed = true
+	} else {
+		if config.BucketBy == "added" && relPath != "" {
+			// Tracks of different albums share a bucket
+			relPath = bucketByModTime(relPath)
+			renamed = true
+		}
+		if config.PadTracks && relPath != "" && !unprobed {
+			relPath = padTrackPrefix(sourceRel, relPath)
+			renamed = true
+		}
+	}
+	if (renamed || config.SanitizeFilenames || config.NormalizeUnicode != "" || config.MaxPathLength > 0) && relPath != "" {
+		relPath = uniqueTargetPath(sourceRel, relPath)
+	}
+	if config.FormatSubdir {
+		return filepath.Join(config.TargetDir, outputFormatName(format), relPath)
+	}
+	return filepath.Join(config.TargetDir, relPath)
+}
+
+// nameTemplate is the parsed --name-template, nil when outputs mirror the source
+var nameTemplate *templateFormat
+
+// templateFormat is a target path template made of literal text and tag
+// placeholders. Placeholders are written {tag}, {tag:00} to zero-pad numbers
+// to the width of the zeros and {tag|default} for a value to use when the tag
+// is missing; both can be combined as {tag:00|default}. {track} without a
+// format is padded to --track-width or the width of the track total, at
+// least two digits. Leading zeros of track numbers are dropped before
+// padding, so "1", "01" and "1/12" all render as "01".
+type templateFormat struct {
+	parts []templatePart
+}
+
+type templatePart struct {
+	literal  string
+	tag      string
+	pad      int
+	fallback string
+}
+
+func parseNameTemplate(text string) (*templateFormat, error) {
+	tmpl := &templateFormat{}
+	for text != "" {
+		start := strings.IndexByte(text, '{')
+		if start < 0 {
+			start = len(text)
+		}
+		if literal := text[:start]; literal != "" {
+			if strings.Contains(literal, "}") {
+				return nil, fmt.Errorf("unexpected '}' in %q", literal)
+			}
+			tmpl.parts = append(tmpl.parts, templatePart{literal: literal})
+		}
+		if start == len(text) {
+			break
+		}
+
+		end := strings.IndexByte(text[start:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("unclosed placeholder %q", text[start:])
+		}
+		part, err := parsePlaceholder(text[start+1 : start+end])
+		if err != nil {
+			return nil, err
+		}
+		tmpl.parts = append(tmpl.parts, part)
+		text = text[start+end+1:]
+	}
+	return tmpl, nil
+}
+
+func parsePlaceholder(spec string) (templatePart, error) {
+	var part templatePart
+	spec, part.fallback, _ = strings.Cut(spec, "|")
+	name, format, hasFormat := strings.Cut(spec, ":")
+
+	part.tag = strings.ToLower(strings.TrimSpace(name))
+	if alias, ok := map[string]string{"tracknumber": "track", "discnumber": "disc", "albumartist": "album_artist"}[part.tag]; ok {
+		part.tag = alias
+	}
+	if part.tag == "" || strings.ContainsAny(part.tag, "{") {
+		return part, fmt.Errorf("invalid placeholder {%s}", spec)
+	}
+	if hasFormat {
+		if format == "" || strings.Trim(format, "0") != "" {
+			return part, fmt.Errorf("invalid format %q in {%s}, only zero padding like :00 is supported", format, spec)
+		}
+		part.pad = len(format)
+	}
+	return part, nil
+}
+
+// render fills the template from the given tags. Tag values cannot introduce
+// directories, and path components left empty by missing tags are dropped.
+func (t *templateFormat) render(tags map[string]string) string {
+	var b strings.Builder
+	for _, part := range t.parts {
+		if part.tag == "" {
+			b.WriteString(part.literal)
+			continue
+		}
+
+		value := strings.TrimSpace(tags[part.tag])
+		if part.tag == "track" || part.tag == "disc" {
+			// "3/12" style values carry the total
+			value, _, _ = strings.Cut(value, "/")
+			value = strings.TrimSpace(value)
+		}
+		if part.tag == "track" && value != "" && strings.Trim(value, "0123456789") == "" {
+			if value = strings.TrimLeft(value, "0"); value == "" {
+				value = "0"
+			}
+		}
+		if value == "" {
+			value = part.fallback
+		}
+		if part.tag == "track" && part.pad == 0 {
+			part.pad = trackPadWidth(tags)
+		}
+		if part.pad > 0 && value != "" && strings.Trim(value, "0123456789") == "" && len(value) < part.pad {
+			value = strings.Repeat("0", part.pad-len(value)) + value
+		}
+		b.WriteString(strings.NewReplacer("/", "-", "\\", "-").Replace(value))
+	}
+
+	var components []string
+	for _, component := range strings.Split(b.String(), "/") {
+		if component = strings.TrimSpace(component); component != "" {
+			components = append(components, component)
+		}
+	}
+	return filepath.Join(components...)
+}
+
+// templatedPath names a source file from its tags using --name-template,
+// keeping the source extension. Files that cannot be probed use the
+// template fallbacks.
+func templatedPath(relPath string) string {
+	tags := map[string]string{}
+	if probe, err := probeFile(nil, filepath.Join(sourceRoot(), relPath)); err == nil {
+		tags = probeTags(probe)
+	}
+	rendered := nameTemplate.render(tags)
+	if rendered == "" {
+		return relPath
+	}
+	return rendered + filepath.Ext(relPath)
+}
+
+// outputExtension returns the extension a source file with the given extension
+// is written with in an output format. Copy-only runs keep every extension.
+func outputExtension(format, sourceExt string) string {
+	if config.CopyOnly {
+		return sourceExt
+	}
+	switch sourceExt {
+	case ".mp3":
+		return ".mp3"
+	case ".aac", ".mp4", ".m4r":
+		if format == "mp3" && config.ReencodeLossy {
+			return ".mp3"
+		}
+		return sourceExt
+	case ".flac", ".m4a", ".wav":
+		switch format {
+		case "mp3":
+			return ".mp3"
+		case "alac":
+			return ".m4a"
+		case "vorbis":
+			return ".ogg"
+		case "opus":
+			return ".opus"
+		default:
+			return ".flac"
+		}
+	}
+	return sourceExt
+}
+
+// targetCandidates returns every target path a source file may have produced
+// in an output format.
+// Besides the regular output this includes the original extension, which is
+// used when a file is copied because it could not be probed or converted.
+func targetCandidates(format, relPath string) []string {
+	targetPath := targetPathFor(format, relPath)
+	ext := strings.ToLower(filepath.Ext(relPath))
+	candidates := []string{targetPath}
+	if outExt := outputExtension(specFormat(relPath, format), ext); outExt != ext {
+		candidates = append(candidates, strings.TrimSuffix(targetPath, filepath.Ext(targetPath))+outExt)
+	}
+	if config.PassthroughSubdir != "" {
+		candidates = append(candidates, passthroughPath(format, targetPath))
+	}
+	return candidates
+}
+
+// outputSize returns the size of the files produced for a source in all
+// requested formats, or 0 when it was skipped, failed or cannot be found
+func outputSize(sourcePath, action string) int64 {
+	if action == actionFailed || action == actionSkipped {
+		return 0
+	}
+	var size int64
+	for _, output := range outputPaths(sourcePath) {
+		if info, err := os.Stat(output); err == nil {
+			size += info.Size()
+		}
+	}
+	return size
+}
+
+// outputPaths returns the existing target files of a source, one per
+// requested format
+func outputPaths(sourcePath string) []string {
+	relPath, err := filepath.Rel(sourceRoot(), sourcePath)
+	if err != nil {
+		return nil
+	}
+	var paths []string
+	forEachOutputFormat(func(format string) error {
+		for _, candidate := range targetCandidates(format, relPath) {
+			if _, err := os.Stat(candidate); err == nil {
+				paths = append(paths, candidate)
+				break
+			}
+		}
+		return nil
+	})
+	return paths
+}
+
+// passthroughPath moves a target path under the --passthrough-subdir
+// directory of the output root of a format
+func passthroughPath(format, targetPath string) string {
+	root := targetPathFor(format, "")
+	rel, err := filepath.Rel(root, targetPath)
+	if err != nil {
+		return targetPath
+	}
+	return filepath.Join(root, config.PassthroughSubdir, rel)
+}
+
+// copyCompliant copies a file that already meets the output rules, placing it
+// under --passthrough-subdir when set so untouched files are kept apart. With
+// --art-only a folder cover is embedded instead of copying the file as is.
+func copyCompliant(t *fileTask, sourcePath, targetPath string) error {
+	if config.PassthroughSubdir != "" {
+		targetPath = passthroughPath(t.format, targetPath)
+		if err := os.MkdirAll(filepath.Dir(targetPath), 0755); err != nil {
+			return fmt.Errorf("failed to create passthrough directory: %w", err)
+		}
+	}
+	if config.ArtOnly {
+		if folderArt := coverArtFor(t, sourcePath); folderArt != "" {
+			err := embedCoverArt(t, sourcePath, targetPath, folderArt)
+			if err == nil {
+				return nil
+			}
+			t.logf("Warning: Cover art embedding failed for %s, copying it unchanged: %v\n", targetPath, err)
+		}
+	}
+	return copyFile(t, sourcePath, targetPath)
+}
+
+// embedCoverArt writes sourcePath to targetPath with folderArt as its cover,
+// copying the audio stream and tags without re-encoding
+func embedCoverArt(t *fileTask, sourcePath, targetPath, folderArt string) error {
+	t.logf("Embedding cover art: %s → %s\n", folderArt, targetPath)
+
+	// The output is incomplete until FFmpeg exits
+	control.trackTemp(targetPath)
+	defer control.releaseTemp(targetPath)
+
+	mapArgs := []string{"-map", "0:a", "-map", "1:v", "-disposition:v", "attached_pic", "-map_metadata", "0"}
+	var cmd *exec.Cmd
+	if config.UseDocker {
+		args := []string{"run", "--rm", "--entrypoint", "ffmpeg",
+			"-v", fmt.Sprintf("%s:/source", sourceRoot()),
+			"-v", fmt.Sprintf("%s:/target", config.TargetDir),
+			config.DockerImage,
+			"-y", "-i", getDockerPath(sourcePath), "-i", getDockerPath(folderArt)}
+		args = append(args, mapArgs...)
+		args = append(args, metadataOverrides(t, sourcePath)...)
+		args = append(args, "-c", "copy", getDockerTargetPath(targetPath))
+		cmd = t.command("docker", args...)
+	} else {
+		args := []string{"-y", "-i", sourcePath, "-i", folderArt}
+		args = append(args, mapArgs...)
+		args = append(args, metadataOverrides(t, sourcePath)...)
+		args = append(args, "-c", "copy", targetPath)
+		cmd = t.command("ffmpeg", args...)
+	}
+
+	if err := cmd.Run(); err != nil {
+		os.Remove(targetPath)
+		return fmt.Errorf("FFmpeg cover art embedding failed: %w", err)
+	}
+	return nil
+}
+
+// findOrphans lists files in the target directory that do not correspond to
+// any source file, looking at the tree of every requested format. Nothing is
+// removed.
+func findOrphans() ([]string, error) {
+	var orphans []string
+	err := forEachOutputFormat(func(format string) error {
+		found, err := findFormatOrphans(format)
+		orphans = append(orphans, found...)
+		return err
+	})
+	return orphans, err
+}
+
+func findFormatOrphans(format string) ([]string, error) {
+	expected := make(map[string]bool)
+	err := filepath.Walk(config.SourceDir, func(path string, info os.FileInfo, err error) error {
+		if isHidden(config.SourceDir, path) {
+			return skipEntry(info)
+		}
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		ext := strings.ToLower(filepath.Ext(path))
+		if !isAudioExtension(ext) && !isImageExtension(ext) && !(config.CopyPlaylists && isPlaylistExtension(ext)) {
+			return nil
+		}
+		relPath, err := filepath.Rel(sourceRoot(), path)
+		if err != nil {
+			return err
+		}
+		for _, candidate := range targetCandidates(format, relPath) {
+			expected[candidate] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Files this run wrote without a source of their own, such as the folder
+	// image of --dedupe-art folder, are outputs too
+	producedFiles.Lock()
+	for path := range producedFiles.paths {
+		expected[path] = true
+	}
+	producedFiles.Unlock()
+
+	// With --format-subdir only the current format's tree belongs to this run
+	targetRoot := targetPathFor(format, "")
+	var orphans []string
+	err = filepath.Walk(targetRoot, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == targetRoot {
+				return filepath.SkipAll
+			}
+			return err
+		}
+		if !info.IsDir() && !expected[path] && !isBookkeepingFile(info.Name()) {
+			orphans = append(orphans, path)
+		}
+		return nil
+	})
+	return orphans, err
+}
+
+// pruneOrphans deletes orphaned target files
+func pruneOrphans(orphans []string) error {
+	for _, orphan := range orphans {
+		if err := os.Remove(orphan); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove orphaned file: %w", err)
+		}
+	}
+	logf("Removed %d orphaned file(s).\n", len(orphans))
+	return nil
+}
+
+// errNotConfirmed is returned when a destructive operation was declined
+var errNotConfirmed = errors.New("operation not confirmed")
+
+// Confirmation prompts read from confirmInput when stdinIsTerminal reports
+// an interactive session
+var (
+	confirmInput    io.Reader = os.Stdin
+	stdinIsTerminal           = func() bool {
+		info, err := os.Stdin.Stat()
+		return err == nil && info.Mode()&os.ModeCharDevice != 0
+	}
+)
+
+// confirmDestructive shows what an operation will delete and overwrite and
+// asks for confirmation. All destructive features go through here. --yes
+// skips the prompt; without it, non-interactive runs are aborted.
+func confirmDestructive(operation string, deletes, overwrites int) error {
+	var plan []string
+	if deletes > 0 {
+		plan = append(plan, fmt.Sprintf("delete %s file(s)", formatCount(deletes)))
+	}
+	if overwrites > 0 {
+		plan = append(plan, fmt.Sprintf("overwrite %s file(s)", formatCount(overwrites)))
+	}
+	if len(plan) == 0 || config.Yes {
+		return nil
+	}
+	summary := fmt.Sprintf("About to %s: will %s.", operation, strings.Join(plan, ", "))
+	if !stdinIsTerminal() {
+		return fmt.Errorf("%s Refusing to continue without --yes when stdin is not a terminal: %w", summary, errNotConfirmed)
+	}
+
+	logf("%s Continue? [y/N] ", summary)
+	answer, _ := bufio.NewReader(confirmInput).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return nil
+	}
+	return fmt.Errorf("%s: %w", operation, errNotConfirmed)
+}
+
+// formatCount formats n with thousands separators, e.g. 3,020
+func formatCount(n int) string {
+	digits := strconv.Itoa(n)
+	for i := len(digits) - 3; i > 0; i -= 3 {
+		digits = digits[:i] + "," + digits[i:]
+	}
+	return digits
+}
+
+func isAudioExtension(ext string) bool {
+	return isLosslessExtension(ext) || ext == ".mp3" || isLossyPassthroughExtension(ext)
+}
+
+// isLosslessExtension reports whether ext is a lossless source lilt converts:
+// FLAC, ALAC or PCM WAV
+func isLosslessExtension(ext string) bool {
+	return ext == ".flac" || ext == ".m4a" || ext == ".wav"
+}
+
+// isLossyPassthroughExtension reports whether ext is an AAC container that,
+// like MP3, is copied instead of being converted to a lossless format
+func isLossyPassthroughExtension(ext string) bool {
+	return ext == ".aac" || ext == ".mp4" || ext == ".m4r"
+}
+
+// copiedByRule reports whether a format rule copies a source with the given
+// extension in an output format, before anything is read from it
+func copiedByRule(format, ext string) bool {
+	if config.CopyOnly {
+		return true
+	}
+	if ext != ".mp3" && !isLossyPassthroughExtension(ext) {
+		return false
+	}
+	return format != "mp3" || ext == ".mp3" || !config.ReencodeLossy
+}
+
+// copiedUnprobed reports whether a source a format rule copies is copied
+// without probing it, by --no-probe-copy or for an extension missing from
+// --probe-only-extensions. The options that need its tags, duration or
+// bitrate leave it alone.
+func copiedUnprobed(format, ext string) bool {
+	if !config.NoProbeCopy && config.ProbeOnlyExtensions == "" || !copiedByRule(format, ext) {
+		return false
+	}
+	if config.NoProbeCopy {
+		return true
+	}
+	for _, probed := range strings.Split(config.ProbeOnlyExtensions, ",") {
+		probed = strings.ToLower(strings.TrimSpace(probed))
+		if "."+strings.TrimPrefix(probed, ".") == ext {
+			return false
+		}
+	}
+	return true
+}
+
+// lossyName names a lossy source format in log lines
+func lossyName(ext string) string {
+	if isLossyPassthroughExtension(ext) {
+		return "AAC"
+	}
+	return "MP3"
+}
+
+func isImageExtension(ext string) bool {
+	return ext == ".jpg" || ext == ".png"
+}
+
+// loadRenameMap reads a CSV file of source-relative-path,target-relative-path
+// pairs. Lines starting with # are ignored. Entries whose source does not
+// exist are kept but reported.
+func loadRenameMap(path, sourceDir string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open rename map: %w", err)
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = 2
+	reader.TrimLeadingSpace = true
+
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("invalid rename map %s: %w", path, err)
+	}
+
+	mapping := make(map[string]string, len(records))
+	for i, record := range records {
+		source := filepath.Clean(filepath.FromSlash(strings.TrimSpace(record[0])))
+		target := filepath.Clean(filepath.FromSlash(strings.TrimSpace(record[1])))
+		if record[0] == "" || record[1] == "" {
+			return nil, fmt.Errorf("invalid rename map %s: line %d has an empty path", path, i+1)
+		}
+		if filepath.IsAbs(target) || target == ".." || strings.HasPrefix(target, ".."+string(filepath.Separator)) {
+			return nil, fmt.Errorf("invalid rename map %s: target %q must be relative to the target directory", path, record[1])
+		}
+		if _, exists := mapping[source]; exists {
+			return nil, fmt.Errorf("invalid rename map %s: duplicate entry for %q", path, record[0])
+		}
+		if _, err := os.Stat(filepath.Join(sourceDir, source)); err != nil {
+			logf("Warning: rename map entry %q does not match any source file\n", record[0])
+		}
+		mapping[source] = target
+	}
+	return mapping, nil
+}
+
+// FileSpec is a --spec-file entry giving the output of one source file. Zero
+// fields keep the automatic decision.
+type FileSpec struct {
+	Format   string `json:"format"`   // flac, mp3, alac, vorbis or opus
+	Bits     int    `json:"bits"`     // 16 or 24, deeper sources are reduced to it
+	Rate     int    `json:"rate"`     // Sample rate every output of the file is converted to
+	Channels int    `json:"channels"` // Output channel count
+}
+
+// fileSpecs holds the --spec-file entries by source relative path
+var fileSpecs map[string]FileSpec
+
+// loadFileSpecs reads a JSON object mapping source relative paths to output
+// specs and validates every entry
+func loadFileSpecs(path, sourceDir string) (map[string]FileSpec, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open spec file: %w", err)
+	}
+	defer file.Close()
+
+	var entries map[string]FileSpec
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&entries); err != nil {
+		return nil, fmt.Errorf("invalid spec file %s: %w", path, err)
+	}
+
+	specs := make(map[string]FileSpec, len(entries))
+	for name, spec := range entries {
+		source := filepath.Clean(filepath.FromSlash(strings.TrimSpace(name)))
+		if name == "" || filepath.IsAbs(source) || source == ".." || strings.HasPrefix(source, ".."+string(filepath.Separator)) {
+			return nil, fmt.Errorf("invalid spec file %s: %q must be relative to the source directory", path, name)
+		}
+		spec.Format = strings.ToLower(spec.Format)
+		switch {
+		case !slices.Contains([]string{"", "flac", "mp3", "alac", "vorbis", "opus"}, spec.Format):
+			return nil, fmt.Errorf("invalid spec file %s: %q has format %s. Valid options are: flac, mp3, alac, vorbis, opus", path, name, spec.Format)
+		case spec.Bits != 0 && spec.Bits != 16 && spec.Bits != 24:
+			return nil, fmt.Errorf("invalid spec file %s: %q has bits %d. Valid options are: 16, 24", path, name, spec.Bits)
+		case spec.Rate != 0 && !slices.Contains([]int{32000, 44100, 48000, 88200, 96000, 176400, 192000}, spec.Rate):
+			return nil, fmt.Errorf("invalid spec file %s: %q has rate %d. Valid options are: 32000, 44100, 48000, 88200, 96000, 176400, 192000", path, name, spec.Rate)
+		case spec.Channels < 0 || spec.Channels > 8:
+			return nil, fmt.Errorf("invalid spec file %s: %q has %d channels, it must be between 1 and 8", path, name, spec.Channels)
+		}
+		if _, exists := specs[source]; exists {
+			return nil, fmt.Errorf("invalid spec file %s: duplicate entry for %q", path, name)
+		}
+		if _, err := os.Stat(filepath.Join(sourceDir, source)); err != nil {
+			logf("Warning: spec file entry %q does not match any source file\n", name)
+		}
+		specs[source] = spec
+	}
+	return specs, nil
+}
+
+// fileSpecFor returns the --spec-file entry of relPath or, with
+// --convert-to-match-existing, the spec of the audio already in its target
+// directory, if any
+func fileSpecFor(relPath string) (FileSpec, bool) {
+	spec, ok := fileSpecs[relPath]
+	if !ok && config.ConvertToMatch {
+		spec, ok = existingSpecFor(relPath)
+	}
+	return spec, ok
+}
+
+// sourcePolicy returns the policy a source file is converted with in an
+// output format, narrowed to its spec, if it has one
+func sourcePolicy(relPath, format string) ConversionPolicy {
+	policy := policyFor(format)
+	spec, ok := fileSpecFor(relPath)
+	if !ok {
+		return policy
+	}
+	if spec.Bits != 0 {
+		policy.ReduceBitsAbove = spec.Bits
+		policy.DownsampleOnly = false
+	}
+	if spec.Rate != 0 {
+		policy.ResampleAll = spec.Rate
+		policy.ResampleAbove = 0
+	}
+	if spec.Channels != 0 {
+		policy.Channels = spec.Channels
+	}
+	return policy
+}
+
+// existingSpecs caches the spec --convert-to-match-existing found in each
+// target directory, nil for directories without audio. A directory is read
+// before this run writes to it, so later files match the same spec.
+var existingSpecs = struct {
+	sync.Mutex
+	byDir map[string]*FileSpec
+}{byDir: make(map[string]*FileSpec)}
+
+func resetExistingSpecs() {
+	existingSpecs.Lock()
+	existingSpecs.byDir = make(map[string]*FileSpec)
+	existingSpecs.Unlock()
+}
+
+// existingSpecFor returns the spec of the audio files already in the target
+// directory of relPath, taken from the first one in name order that can be
+// read
+func existingSpecFor(relPath string) (FileSpec, bool) {
+	dir := filepath.Dir(targetPathFor(config.EnforceOutputFormat, relPath))
+	existingSpecs.Lock()
+	defer existingSpecs.Unlock()
+	spec, ok := existingSpecs.byDir[dir]
+	if !ok {
+		spec = directorySpec(dir)
+		existingSpecs.byDir[dir] = spec
+		if spec != nil {
+			logf("Matching existing %s files in %s (%s)\n", strings.ToUpper(spec.Format), dir, describeSpec(*spec))
+		}
+	}
+	if spec == nil {
+		return FileSpec{}, false
+	}
+	return *spec, true
+}
+
+// directorySpec reads the spec of the first audio file in dir
+func directorySpec(dir string) *FileSpec {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		if spec, ok := outputSpec(filepath.Join(dir, entry.Name())); ok {
+			return &spec
+		}
+	}
+	return nil
+}
+
+// outputSpec returns the format, bit depth, sample rate and channels of an
+// existing FLAC, MP3, ALAC, Vorbis or Opus output. AAC files are not a format lilt
+// produces and are passed over.
+func outputSpec(path string) (FileSpec, bool) {
+	ext := strings.ToLower(filepath.Ext(path))
+	switch ext {
+	case ".flac":
+		info, err := readFLACStreamInfo(path)
+		if err != nil {
+			return FileSpec{}, false
+		}
+		return FileSpec{Format: "flac", Bits: info.Bits, Rate: info.Rate, Channels: info.Channels}, true
+	case ".mp3", ".m4a", ".ogg", ".opus":
+		probe, err := probeFile(nil, path)
+		forgetProbe(path)
+		if err != nil {
+			return FileSpec{}, false
+		}
+		if ext != ".m4a" {
+			// mp3AudioInfo reads the rate and channels of any lossy stream
+			info := mp3AudioInfo(probe)
+			if info == nil {
+				return FileSpec{}, false
+			}
+			format := "mp3"
+			switch ext {
+			case ".ogg":
+				// Ogg also holds Opus and FLAC, which lilt does not write as .ogg
+				if !slices.ContainsFunc(probe.Streams, func(stream ProbeStream) bool { return stream.CodecName == "vorbis" }) {
+					return FileSpec{}, false
+				}
+				format = "vorbis"
+			case ".opus":
+				format = "opus"
+			}
+			return FileSpec{Format: format, Rate: info.Rate, Channels: info.Channels}, true
+		}
+		info, err := audioInfoFromProbe(probe)
+		if err != nil || info.Format != "alac" {
+			return FileSpec{}, false
+		}
+		return FileSpec{Format: "alac", Bits: info.Bits, Rate: info.Rate, Channels: info.Channels}, true
+	}
+	return FileSpec{}, false
+}
+
+// describeSpec summarizes the parts of a spec that are set
+func describeSpec(spec FileSpec) string {
+	var parts []string
+	if spec.Bits != 0 {
+		parts = append(parts, fmt.Sprintf("%d-bit", spec.Bits))
+	}
+	if spec.Rate != 0 {
+		parts = append(parts, fmt.Sprintf("%d Hz", spec.Rate))
+	}
+	if spec.Channels != 0 {
+		parts = append(parts, fmt.Sprintf("%d channels", spec.Channels))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// bucketByModTime replaces the directory part of relPath with a YYYY/MM bucket
+// derived from the source file's modification time.
+func bucketByModTime(relPath string) string {
+	info, err := os.Stat(filepath.Join(sourceRoot(), relPath))
+	if err != nil {
+		return relPath
+	}
+	modTime := info.ModTime()
+	return filepath.Join(fmt.Sprintf("%04d", modTime.Year()), fmt.Sprintf("%02d", int(modTime.Month())), filepath.Base(relPath))
+}
+
+// assignedPaths remembers which renamed or sanitized target path was assigned
+// to which source path, so names that collide after renaming get distinct
+// suffixes and repeated lookups for the same file stay stable.
+var assignedPaths = struct {
+	sync.Mutex
+	bySource  map[string]string
+	owners    map[string]string
+	shortened map[string]string
+}{bySource: make(map[string]string), owners: make(map[string]string), shortened: make(map[string]string)}
+
+func resetAssignedPaths() {
+	assignedPaths.Lock()
+	defer assignedPaths.Unlock()
+	assignedPaths.bySource = make(map[string]string)
+	assignedPaths.owners = make(map[string]string)
+	assignedPaths.shortened = make(map[string]string)
+}
+
+// sanitizeComponent makes a single file or directory name FAT32/exFAT safe by
+// replacing illegal characters with underscores and trimming trailing dots and
+// spaces.
+func sanitizeComponent(name string) string {
+	var builder strings.Builder
+	for _, r := range name {
+		if r < 0x20 || strings.ContainsRune(`<>:"/\|?*`, r) {
+			builder.WriteRune('_')
+		} else {
+			builder.WriteRune(r)
+		}
+	}
+	sanitized := strings.TrimRight(builder.String(), ". ")
+	if sanitized == "" {
+		return "_"
+	}
+	return sanitized
+}
+
+func sanitizeRelPath(relPath string) string {
+	components := strings.Split(relPath, string(filepath.Separator))
+	for i, component := range components {
+		components[i] = sanitizeComponent(component)
+	}
+	return filepath.Join(components...)
+}
+
+// normalizeUnicodeName applies --normalize-unicode to a target path, so
+// names from macOS (NFD) and Linux (NFC) sources end up in one form
+func normalizeUnicodeName(relPath string) string {
+	switch config.NormalizeUnicode {
+	case "nfc":
+		return norm.NFC.String(relPath)
+	case "nfd":
+		return norm.NFD.String(relPath)
+	}
+	return relPath
+}
+
+// uniqueTargetPath claims relPath, sanitized with --sanitize-filenames and
+// normalized with --normalize-unicode, for the source file sourceRel and
+// appends " (N)" to the file name, with a warning, when another source
+// already claimed the same name. FAT filesystems are case-insensitive, so
+// names are compared case-insensitively.
+func uniqueTargetPath(sourceRel, relPath string) string {
+	assignedPaths.Lock()
+	defer assignedPaths.Unlock()
+
+	if assigned, ok := assignedPaths.bySource[sourceRel]; ok {
+		return assigned
+	}
+
+	if config.SanitizeFilenames {
+		relPath = sanitizeRelPath(relPath)
+	}
+	relPath = normalizeUnicodeName(relPath)
+	// Collisions are checked on the shortened names
+	candidate, shortened := fitTargetPath(relPath, "")
+	for n := 2; ; n++ {
+		owner, taken := assignedPaths.owners[strings.ToLower(candidate)]
+		if !taken || owner == sourceRel {
+			break
+		}
+		if n == 2 {
+			logf("Warning: %s and %s both map to %s, numbering the later one\n", owner, sourceRel, candidate)
+		}
+		candidate, shortened = fitTargetPath(relPath, fmt.Sprintf(" (%d)", n))
+	}
+
+	assignedPaths.owners[strings.ToLower(candidate)] = sourceRel
+	assignedPaths.bySource[sourceRel] = candidate
+	if shortened {
+		assignedPaths.shortened[sourceRel] = candidate
+	}
+	return candidate
+}
+
+// assignedTargetPath returns the target path uniqueTargetPath gave a source
+func assignedTargetPath(sourceRel string) (string, bool) {
+	assignedPaths.Lock()
+	defer assignedPaths.Unlock()
+	assigned, ok := assignedPaths.bySource[sourceRel]
+	return assigned, ok
+}
+
+// pathEllipsis marks a name shortened for --max-path-length
+const pathEllipsis = "…"
+
+// maxPathNameReserve is the room in bytes kept for the file name when
+// directories are shortened for --max-path-length
+const maxPathNameReserve = 64
+
+// targetPathBudget returns how many bytes a path relative to the target
+// directory may take with --max-path-length, leaving room for a format or
+// passthrough subdirectory
+func targetPathBudget() int {
+	budget := config.MaxPathLength - len(filepath.Clean(config.TargetDir)) - 1
+	if config.FormatSubdir {
+		budget -= len("vorbis") + 1
+	}
+	if config.PassthroughSubdir != "" {
+		budget -= len(config.PassthroughSubdir) + 1
+	}
+	return budget
+}
+
+// fitTargetPath inserts suffix before the extension of relPath and, with
+// --max-path-length, shortens the result to fit. Directories longer than the
+// budget less maxPathNameReserve are shortened first, each one depending only
+// on the directories above it so every file of an album shares them. The file
+// name then takes what is left, keeping its extension. Room is kept for the
+// extension of a converted file, which can be longer than the source's.
+func fitTargetPath(relPath, suffix string) (string, bool) {
+	ext := filepath.Ext(relPath)
+	dir, name := filepath.Split(relPath)
+	stem := strings.TrimSuffix(name, ext) + suffix
+	if config.MaxPathLength <= 0 {
+		return dir + stem + ext, false
+	}
+
+	budget := targetPathBudget() - max(0, len(".flac")-len(ext))
+	shortened := false
+	var parts []string
+	if dir != "" {
+		parts = strings.Split(filepath.Clean(dir), string(filepath.Separator))
+	}
+	length := 0
+	for i, part := range parts {
+		if room := budget - maxPathNameReserve - length - 1; len(part) > room {
+			parts[i] = truncateName(part, room)
+			shortened = true
+		}
+		length += len(parts[i]) + 1
+	}
+	if room := budget - length - len(suffix) - len(ext); len(stem) > room {
+		stem = truncateName(strings.TrimSuffix(name, ext), room-len(suffix)) + suffix
+		shortened = true
+	}
+	return filepath.Join(append(parts, stem+ext)...), shortened
+}
+
+// truncateName cuts a file or directory name to at most maxBytes, ending it
+// with an ellipsis. A UTF-8 sequence is never split and at least one
+// character of the name is kept.
+func truncateName(name string, maxBytes int) string {
+	if len(name) <= maxBytes {
+		return name
+	}
+	cut := max(0, maxBytes-len(pathEllipsis))
+	for cut > 0 && !utf8.RuneStart(name[cut]) {
+		cut--
+	}
+	kept := strings.TrimRight(name[:cut], " .")
+	if kept == "" {
+		_, size := utf8.DecodeRuneInString(name)
+		kept = name[:size]
+	}
+	return kept + pathEllipsis
+}
+
+// recordedShortenedPaths returns the sources whose target path was shortened
+// for --max-path-length, mapped to the shortened path
+func recordedShortenedPaths() map[string]string {
+	assignedPaths.Lock()
+	defer assignedPaths.Unlock()
+	if len(assignedPaths.shortened) == 0 {
+		return nil
+	}
+	return maps.Clone(assignedPaths.shortened)
+}
+
+// trackPadWidth returns the width track numbers are padded to: --track-width
+// when set, otherwise the width of the track total, at least two digits
+func trackPadWidth(tags map[string]string) int {
+	if config.TrackWidth > 0 {
+		return config.TrackWidth
+	}
+	_, total, _ := strings.Cut(tags["track"], "/")
+	for _, key := range []string{"tracktotal", "totaltracks", "track_total"} {
+		if total != "" {
+			break
+		}
+		total = tags[key]
+	}
+	return max(2, len(strings.TrimSpace(total)))
+}
+
+// padTrackPrefix zero-pads the leading track number of the file name in
+// relPath, e.g. "2 Song.flac" to "02 Song.flac"
+func padTrackPrefix(sourceRel, relPath string) string {
+	dir, base := filepath.Split(relPath)
+	digits := len(base) - len(strings.TrimLeft(base, "0123456789"))
+	if digits == 0 || digits == len(base) {
+		return relPath
+	}
+
+	tags := map[string]string{}
+	if probe, err := probeFile(nil, filepath.Join(sourceRoot(), sourceRel)); err == nil {
+		tags = probeTags(probe)
+	}
+	width := trackPadWidth(tags)
+	if digits >= width {
+		return relPath
+	}
+	return dir + strings.Repeat("0", width-digits) + base
+}
+
+func processAudioFileWithEnforcedFormat(t *fileTask, sourcePath, targetPath, sourceExt string) error {
+	// Get audio info for source file
+	var audioInfo *AudioInfo
+	var err error
+
+	// Skip MP3 files if they don't need processing
+	if sourceExt == ".mp3" && t.format == "mp3" && !mp3NeedsReencode(t, sourcePath) {
+		t.logf("Copying MP3 file: %s (already in target format)\n", sourcePath)
+		return copyFile(t, sourcePath, targetPath)
+	}
+
+	// Get audio info for FLAC, ALAC and WAV files
+	if isLosslessExtension(sourceExt) {
+		audioInfo, err = getAudioInfo(t, sourcePath)
+		if err != nil {
+			t.logf("Warning: Could not get audio info for %s, copying original\n", sourcePath)
+			return copyFile(t, sourcePath, targetPath)
+		}
+		t.logf("Detected: %s, %d Hz, %s format\n", bitsLabel(audioInfo.Bits), audioInfo.Rate, audioInfo.Format)
+		if err := checkUpsampling(t, sourcePath, audioInfo); err != nil {
+			return err
+		}
+	}
+
+	// Determine target file extension and process accordingly
+	switch t.format {
+	case "flac":
+		err = processToFLAC(t, sourcePath, targetPath, sourceExt, audioInfo)
+	case "mp3":
+		err = processToMP3(t, sourcePath, targetPath, sourceExt, audioInfo)
+	case "alac":
+		err = processToALAC(t, sourcePath, targetPath, sourceExt, audioInfo)
+	case "vorbis":
+		err = processToVorbis(t, sourcePath, targetPath, sourceExt, audioInfo)
+	case "opus":
+		err = processToOpus(t, sourcePath, targetPath, sourceExt, audioInfo)
+	default:
+		return fmt.Errorf("unsupported enforce-output-format: %s", t.format)
+	}
+	if err != nil && config.KeepOriginal {
+		return keepOriginal(t, sourcePath, targetPath, sourceExt, err)
+	}
+	return err
+}
+
+// keepOriginal replaces a failed enforced conversion with a copy of the
+// source in its own format for --keep-original-on-format-mismatch, so a
+// broken or untagged output never takes the place of the original.
+func keepOriginal(t *fileTask, sourcePath, targetPath, sourceExt string, convErr error) error {
+	if errors.Is(convErr, errUpsample) {
+		return convErr
+	}
+	t.logf("Error: Conversion of %s to %s failed, keeping the original %s file instead (format mismatch): %v\n",
+		sourcePath, strings.ToUpper(t.format), strings.ToUpper(strings.TrimPrefix(sourceExt, ".")), convErr)
+	recordConversionFailure(t, convErr)
+	if outputPath := strings.TrimSuffix(targetPath, filepath.Ext(targetPath)) + outputExtension(t.format, sourceExt); outputPath != targetPath {
+		os.Remove(outputPath)
+	}
+	return copyFile(t, sourcePath, targetPath)
+}
+
+func processToFLAC(t *fileTask, sourcePath, targetPath, sourceExt string, audioInfo *AudioInfo) error {
+	// Change target extension to .flac
+	targetPath = changeExtensionToFlac(targetPath)
+
+	if sourceExt == ".mp3" || isLossyPassthroughExtension(sourceExt) {
+		// Never convert lossy files to FLAC - just copy the original
+		t.logf("Copying %s: %s (lossy files are not converted to lossless formats)\n", lossyName(sourceExt), sourcePath)
+		// Keep original extension for lossy files
+		originalTargetPath := strings.TrimSuffix(targetPath, ".flac") + sourceExt
+		return copyFile(t, sourcePath, originalTargetPath)
+	}
+
+	if sourceExt == ".flac" && audioInfo != nil {
+		// Check if FLAC needs conversion or can be copied
+		decision := t.decide(audioInfo)
+		if decision.Action == decisionCopy {
+			t.logf("Copying FLAC: %s (%s)\n", sourcePath, decision.Reason)
+			return copyCompliant(t, sourcePath, targetPath)
+		} else {
+			t.logf("Converting FLAC: %s (%s)\n", sourcePath, decision.Reason)
+			needsConversion, bitrateArgs, sampleRateArgs := decision.soxArgs()
+			return processAudioFile(t, sourcePath, targetPath, audioInfo, needsConversion, bitrateArgs, sampleRateArgs)
+		}
+	}
+
+	if (sourceExt == ".m4a" || sourceExt == ".wav") && audioInfo != nil {
+		// Convert ALAC and WAV to FLAC
+		decision := t.decide(audioInfo)
+		t.logf("Converting %s to FLAC: %s (%s)\n", strings.ToUpper(audioInfo.Format), sourcePath, decision.Reason)
+		needsConversion, bitrateArgs, sampleRateArgs := decision.soxArgs()
+		return processAudioFile(t, sourcePath, targetPath, audioInfo, needsConversion, bitrateArgs, sampleRateArgs)
+	}
+
+	return fmt.Errorf("unsupported source format for FLAC conversion: %s", sourceExt)
+}
+
+func processToMP3(t *fileTask, sourcePath, targetPath, sourceExt string, audioInfo *AudioInfo) error {
+	if isLossyPassthroughExtension(sourceExt) {
+		if !config.ReencodeLossy {
+			t.logf("Copying AAC: %s (use --reencode-lossy to convert it to MP3)\n", sourcePath)
+			return copyFile(t, sourcePath, targetPath)
+		}
+		t.logf("Warning: re-encoding %s to MP3 loses quality again (lossy to lossy)\n", sourcePath)
+		if probe, err := probeFile(t, sourcePath); err == nil {
+			audioInfo = mp3AudioInfo(probe)
+		}
+	}
+
+	// Change target extension to .mp3
+	targetPath = changeExtensionToMP3(targetPath)
+
+	if sourceExt == ".mp3" {
+		if !mp3NeedsReencode(t, sourcePath) {
+			t.logf("Copying MP3: %s (already in target format)\n", sourcePath)
+			return copyFile(t, sourcePath, targetPath)
+		}
+		if audioInfo == nil {
+			if probe, err := probeFile(t, sourcePath); err == nil {
+				audioInfo = mp3AudioInfo(probe)
+			}
+		}
+	}
+
+	decision := t.decide(audioInfo)
+	t.logf("Converting %s to MP3: %s (%s, %s)\n", strings.ToUpper(strings.TrimPrefix(sourceExt, ".")), sourcePath, mp3RateDescription(), decision.Reason)
+	return convertToMP3(t, sourcePath, targetPath, audioInfo)
+}
+
+func processToVorbis(t *fileTask, sourcePath, targetPath, sourceExt string, audioInfo *AudioInfo) error {
+	if sourceExt == ".mp3" || isLossyPassthroughExtension(sourceExt) {
+		// Never re-encode lossy files to another lossy format - just copy the original
+		t.logf("Copying %s: %s (lossy files are not re-encoded to Vorbis)\n", lossyName(sourceExt), sourcePath)
+		return copyFile(t, sourcePath, targetPath)
+	}
+
+	// Change target extension to .ogg
+	targetPath = changeExtensionToOgg(targetPath)
+
+	decision := t.decide(audioInfo)
+	t.logf("Converting %s to Vorbis: %s (quality %d, %s)\n", strings.ToUpper(strings.TrimPrefix(sourceExt, ".")), sourcePath, vorbisQuality(), decision.Reason)
+	return convertToVorbis(t, sourcePath, targetPath, audioInfo)
+}
+
+// vorbisQuality returns the configured Vorbis quality, defaulting to 6
+func vorbisQuality() int {
+	if config.VorbisQuality == 0 {
+		return 6
+	}
+	return config.VorbisQuality
+}
+
+func convertToVorbis(t *fileTask, sourcePath, targetPath string, audioInfo *AudioInfo) error {
+	// Vorbis conversion: Use SoX to encode, then FFmpeg to preserve metadata
+	tempPath := tempPathFor(t, targetPath)
+	control.trackTemp(tempPath)
+	defer control.releaseTemp(tempPath)
+
+	decision := t.policy.Decide(audioInfo)
+	args := []string{"-t", "vorbis", "-C", strconv.Itoa(vorbisQuality())}
+	if decision.TargetChannels != 0 {
+		args = append(args, "-c", strconv.Itoa(decision.TargetChannels))
+	}
+
+	var cmd *exec.Cmd
+	if config.UseDocker {
+		dockerArgs := []string{"run", "--rm",
+			"-v", fmt.Sprintf("%s:/source", sourceRoot()),
+			"-v", fmt.Sprintf("%s:/target", config.TargetDir),
+			config.DockerImage, getDockerPath(sourcePath)}
+		dockerArgs = append(dockerArgs, args...)
+		dockerArgs = append(dockerArgs, getDockerTargetPath(tempPath))
+		if decision.TargetRate != 0 {
+			dockerArgs = append(dockerArgs, "rate", "-v", "-L", strconv.Itoa(decision.TargetRate))
+		}
+		cmd = t.command("docker", dockerArgs...)
+	} else {
+		soxArgs := append([]string{sourcePath}, args...)
+		soxArgs = append(soxArgs, tempPath)
+		if decision.TargetRate != 0 {
+			soxArgs = append(soxArgs, "rate", "-v", "-L", strconv.Itoa(decision.TargetRate))
+		}
+		cmd = t.command(config.SoxCommand, soxArgs...)
+	}
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("conversion to Vorbis failed: %w", err)
+	}
+
+	if !config.NoPreserveMetadata {
+		if mergeErr := mergeMetadataWithFFmpeg(t, sourcePath, tempPath, targetPath); mergeErr != nil {
+			if config.KeepOriginal {
+				return fmt.Errorf("metadata merge failed: %w", mergeErr)
+			}
+			t.logf("Warning: Metadata preservation failed for %s, keeping converted audio without tags: %v\n", targetPath, mergeErr)
+			// Fallback: rename temp to target
+			if renameErr := moveIntoPlace(tempPath, targetPath); renameErr != nil {
+				return fmt.Errorf("fallback rename failed after metadata merge error: %w", renameErr)
+			}
+		}
+	} else if err := moveIntoPlace(tempPath, targetPath); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func processToOpus(t *fileTask, sourcePath, targetPath, sourceExt string, audioInfo *AudioInfo) error {
+	if sourceExt == ".mp3" || isLossyPassthroughExtension(sourceExt) {
+		// Never re-encode lossy files to another lossy format - just copy the original
+		t.logf("Copying %s: %s (lossy files are not re-encoded to Opus)\n", lossyName(sourceExt), sourcePath)
+		return copyFile(t, sourcePath, targetPath)
+	}
+
+	// Change target extension to .opus
+	targetPath = changeExtensionToOpus(targetPath)
+
+	decision := t.decide(audioInfo)
+	t.logf("Converting %s to Opus: %s (%dkbps, %s)\n", strings.ToUpper(strings.TrimPrefix(sourceExt, ".")), sourcePath, opusBitrate(), decision.Reason)
+	return convertToOpus(t, sourcePath, targetPath, audioInfo)
+}
+
+// opusBitrate returns the configured Opus bitrate in kbps, defaulting to 160
+func opusBitrate() int {
+	if config.OpusBitrate == 0 {
+		return 160
+	}
+	return config.OpusBitrate
+}
+
+// opusRate is the rate Opus is encoded at. Opus decodes at 48 kHz whatever
+// the input was, so every source is resampled to it.
+const opusRate = 48000
+
+func convertToOpus(t *fileTask, sourcePath, targetPath string, audioInfo *AudioInfo) error {
+	// Opus conversion: SoX cannot write Opus, so FFmpeg encodes it with
+	// libopus, then FFmpeg preserves the metadata as for the other formats
+	tempPath := tempPathFor(t, targetPath)
+	control.trackTemp(tempPath)
+	defer control.releaseTemp(tempPath)
+
+	decision := t.policy.Decide(audioInfo)
+	encodeArgs := []string{"-c:a", "libopus", "-b:a", fmt.Sprintf("%dk", opusBitrate()), "-ar", strconv.Itoa(opusRate)}
+	if decision.TargetChannels != 0 {
+		encodeArgs = append(encodeArgs, "-ac", strconv.Itoa(decision.TargetChannels))
+	}
+
+	var cmd *exec.Cmd
+	if config.UseDocker {
+		args := []string{"run", "--rm", "--entrypoint", "ffmpeg",
+			"-v", fmt.Sprintf("%s:/source", sourceRoot()),
+			"-v", fmt.Sprintf("%s:/target", config.TargetDir),
+			config.DockerImage, "-y", "-i", getDockerPath(sourcePath), "-vn"}
+		args = append(args, encodeArgs...)
+		args = append(args, getDockerTargetPath(tempPath))
+		cmd = t.command("docker", args...)
+	} else {
+		args := append([]string{"-y", "-i", sourcePath, "-vn"}, encodeArgs...)
+		args = append(args, tempPath)
+		cmd = t.command("ffmpeg", args...)
+	}
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("conversion to Opus failed: %w", err)
+	}
+
+	if !config.NoPreserveMetadata {
+		if mergeErr := mergeMetadataWithFFmpeg(t, sourcePath, tempPath, targetPath); mergeErr != nil {
+			if config.KeepOriginal {
+				return fmt.Errorf("metadata merge failed: %w", mergeErr)
+			}
+			t.logf("Warning: Metadata preservation failed for %s, keeping converted audio without tags: %v\n", targetPath, mergeErr)
+			// Fallback: rename temp to target
+			if renameErr := moveIntoPlace(tempPath, targetPath); renameErr != nil {
+				return fmt.Errorf("fallback rename failed after metadata merge error: %w", renameErr)
+			}
+		}
+	} else if err := moveIntoPlace(tempPath, targetPath); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func processToALAC(t *fileTask, sourcePath, targetPath, sourceExt string, audioInfo *AudioInfo) error {
+	// Change target extension to .m4a
+	targetPath = changeExtensionToM4A(targetPath)
+
+	if sourceExt == ".m4a" && audioInfo != nil {
+		// Check if ALAC needs conversion or can be copied
+		decision := t.decide(audioInfo)
+		if decision.Action == decisionCopy {
+			t.logf("Copying ALAC: %s (%s)\n", sourcePath, decision.Reason)
+			return copyCompliant(t, sourcePath, targetPath)
+		} else {
+			t.logf("Converting ALAC: %s (%s)\n", sourcePath, decision.Reason)
+			return convertToALAC(t, sourcePath, targetPath, audioInfo)
+		}
+	}
+
+	if sourceExt == ".flac" || sourceExt == ".wav" {
+		// Convert FLAC and WAV to ALAC
+		name := strings.ToUpper(strings.TrimPrefix(sourceExt, "."))
+		if audioInfo != nil {
+			t.logf("Converting %s to ALAC: %s (%s)\n", name, sourcePath, t.decide(audioInfo).Reason)
+		} else {
+			t.logf("Converting %s to ALAC: %s\n", name, sourcePath)
+		}
+		return convertToALAC(t, sourcePath, targetPath, audioInfo)
+	}
+
+	if sourceExt == ".mp3" || isLossyPassthroughExtension(sourceExt) {
+		// Never convert lossy files to ALAC - just copy the original
+		t.logf("Copying %s: %s (lossy files are not converted to lossless formats)\n", lossyName(sourceExt), sourcePath)
+		// Keep original extension for lossy files
+		originalTargetPath := strings.TrimSuffix(targetPath, ".m4a") + sourceExt
+		return copyFile(t, sourcePath, originalTargetPath)
+	}
+
+	return fmt.Errorf("unsupported source format for ALAC conversion: %s", sourceExt)
+}
+
+func getAudioInfo(t *fileTask, filePath string) (*AudioInfo, error) {
+	ext := strings.ToLower(filepath.Ext(filePath))
+
+	var info *AudioInfo
+	var err error
+	if ext == ".m4a" {
+		info, err = getALACInfo(t, filePath)
+	} else {
+		info, err = getFLACInfo(t, filePath)
+	}
+	if err == nil {
+		noteDuration(filePath, info.Duration)
+	}
+	return info, err
+}
+
+func getFLACInfo(t *fileTask, filePath string) (*AudioInfo, error) {
+	var cmd *exec.Cmd
+
+	if config.UseDocker {
+		dockerPath := getDockerPath(filePath)
+		args := []string{"run", "--rm",
+			"-v", fmt.Sprintf("%s:/source", sourceRoot()),
+			"-v", fmt.Sprintf("%s:/target", config.TargetDir),
+			config.DockerImage, "--i", dockerPath}
+		cmd = t.command("docker", args...)
+	} else {
+		cmd = t.command(config.SoxCommand, "--i", filePath)
+	}
+
+	output, err := commandOutput(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	audioInfo, err := parseAudioInfo(string(output))
+	if err != nil {
+		return nil, err
+	}
+
+	audioInfo.Format = "flac"
+	if strings.ToLower(filepath.Ext(filePath)) == ".wav" {
+		audioInfo.Format = "wav"
+	}
+	return audioInfo, nil
+}
+
+func getALACInfo(t *fileTask, filePath string) (*AudioInfo, error) {
+	probe, err := probeFile(t, filePath)
+	if err != nil {
+		return nil, err
+	}
+	info, err := audioInfoFromProbe(probe)
+	if err != nil {
+		return nil, err
+	}
+	if seconds, err := strconv.ParseFloat(probe.Format.Duration, 64); err == nil {
+		info.Duration = time.Duration(seconds * float64(time.Second))
+	}
+	if info.Bits == 0 {
+		// Kept on the cached probe, so the depth is decoded once per file
+		if probe.decodedBits == 0 {
+			if probe.decodedBits, err = decodedBits(t, filePath); err != nil {
+				return nil, fmt.Errorf("failed to determine the bit depth: %w", err)
+			}
+			t.logf("Detected: %d bits in the decoded audio of %s\n", probe.decodedBits, filePath)
+		}
+		info.Bits = probe.decodedBits
+	}
+	return info, nil
+}
+
+// decodedBits returns the bit depth of a file's first audio stream when
+// ffprobe cannot tell it, read from the STREAMINFO of a one second FLAC
+// decode that FFmpeg writes to stdout
+func decodedBits(t *fileTask, filePath string) (int, error) {
+	output, err := commandOutput(ffmpegCommand(t, "-v", "error", "-i", filePath, "-map", "0:a:0", "-t", "1", "-c:a", "flac", "-f", "flac", "-"))
+	if err != nil {
+		return 0, err
+	}
+	if len(output) < 42 || string(output[:4]) != "fLaC" {
+		return 0, errors.New("FFmpeg did not decode the audio to FLAC")
+	}
+	info, err := parseStreamInfo(output[4:42])
+	if err != nil {
+		return 0, err
+	}
+	return info.Bits, nil
+}
+
+// ProbeResult holds the parts of ffprobe's JSON output that lilt uses
+type ProbeResult struct {
+	Streams []ProbeStream `json:"streams"`
+	Format  ProbeFormat   `json:"format"`
+
+	// decodedBits is the bit depth getALACInfo decoded for a stream
+	// ffprobe reports none for
+	decodedBits int
+}
+
+// ProbeStream describes a single stream reported by ffprobe
+type ProbeStream struct {
+	Index            int            `json:"index"`
+	CodecName        string         `json:"codec_name"`
+	CodecType        string         `json:"codec_type"`
+	SampleRate       string         `json:"sample_rate"`
+	Channels         int            `json:"channels"`
+	ChannelLayout    string         `json:"channel_layout"`
+	SampleFmt        string         `json:"sample_fmt"`
+	BitsPerSample    int            `json:"bits_per_sample"`
+	BitsPerRawSample string         `json:"bits_per_raw_sample"`
+	BitRate          string         `json:"bit_rate"`
+	Width            int            `json:"width"`
+	Height           int            `json:"height"`
+	Disposition      map[string]int `json:"disposition"`
+	Tags             ProbeTags      `json:"tags"`
+}
+
+// maxProbeTagValue is the longest tag value kept from ffprobe's output.
+// Lyrics, cue sheets and other embedded blobs can run to megabytes, but lilt
+// only uses tags for names, track numbers and metadata checks.
+const maxProbeTagValue = 4 << 10
+
+// ProbeTags holds the tags ffprobe reports for a stream or container, with
+// every value cut to maxProbeTagValue bytes while decoding
+type ProbeTags map[string]string
+
+// UnmarshalJSON decodes a tag object one entry at a time, cutting each value
+// before the next one is read
+func (t *ProbeTags) UnmarshalJSON(data []byte) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	if token, err := decoder.Token(); err != nil {
+		return err
+	} else if token == nil {
+		*t = nil
+		return nil
+	} else if token != json.Delim('{') {
+		return fmt.Errorf("tags: expected an object, got %v", token)
+	}
+	tags := make(ProbeTags)
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+		key, _ := token.(string)
+		var value string
+		if err := decoder.Decode(&value); err != nil {
+			return fmt.Errorf("tag %q: %w", key, err)
+		}
+		tags[key] = truncateTagValue(value)
+	}
+	*t = tags
+	return nil
+}
+
+// truncateTagValue cuts value to maxProbeTagValue bytes without splitting a
+// UTF-8 sequence, copying it so the decoded original can be freed
+func truncateTagValue(value string) string {
+	if len(value) <= maxProbeTagValue {
+		return value
+	}
+	cut := maxProbeTagValue
+	for cut > 0 && !utf8.RuneStart(value[cut]) {
+		cut--
+	}
+	return strings.Clone(value[:cut])
+}
+
+// ffprobeArgs returns the ffprobe arguments reading the streams and format
+// of path as JSON, with the --probe-analyzeduration and --probe-size limits
+func ffprobeArgs(path string) []string {
+	args := []string{"-v", "quiet"}
+	if config.ProbeDuration > 0 {
+		args = append(args, "-analyzeduration", strconv.FormatInt(config.ProbeDuration, 10))
+	}
+	if config.ProbeSize > 0 {
+		args = append(args, "-probesize", strconv.FormatInt(config.ProbeSize, 10))
+	}
+	return append(args, "-of", "json", "-show_streams", "-show_format", path)
+}
+
+// ProbeFormat describes the container reported by ffprobe
+type ProbeFormat struct {
+	FormatName string    `json:"format_name"`
+	Duration   string    `json:"duration"`
+	BitRate    string    `json:"bit_rate"`
+	Tags       ProbeTags `json:"tags"`
+}
+
+// probeCache keeps ffprobe results for files that are currently being
+// processed, so every step working on a file shares a single ffprobe run.
+var probeCache = struct {
+	sync.Mutex
+	results map[string]*ProbeResult
+}{results: make(map[string]*ProbeResult)}
+
+// probeFile runs ffprobe once for a file and caches the parsed result until
+// forgetProbe is called for it.
+func probeFile(t *fileTask, filePath string) (*ProbeResult, error) {
+	probeCache.Lock()
+	cached, ok := probeCache.results[filePath]
+	probeCache.Unlock()
+	if ok {
+		return cached, nil
+	}
+
+	var cmd *exec.Cmd
+
+	if config.UseDocker {
+		dockerPath := getDockerMountedPath(filePath)
+		args := []string{"run", "--rm", "--entrypoint", "ffprobe",
+			"-v", fmt.Sprintf("%s:/source", sourceRoot()),
+			"-v", fmt.Sprintf("%s:/target", config.TargetDir),
+			config.DockerImage}
+		args = append(args, ffprobeArgs(dockerPath)...)
+		cmd = t.command("docker", args...)
+	} else {
+		// Check if ffprobe is available
+		if _, err := exec.LookPath("ffprobe"); err != nil {
+			return nil, fmt.Errorf("ffprobe is not installed. Please install FFmpeg for ALAC support or use --use-docker option")
+		}
+		cmd = t.command("ffprobe", ffprobeArgs(filePath)...)
+	}
+
+	probe, err := runProbe(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	probeCache.Lock()
+	probeCache.results[filePath] = probe
+	probeCache.Unlock()
+	return probe, nil
+}
+
+// forgetProbe drops the cached ffprobe result for a file
+func forgetProbe(filePath string) {
+	probeCache.Lock()
+	delete(probeCache.results, filePath)
+	probeCache.Unlock()
+}
+
+// runProbe runs an ffprobe command and decodes its JSON output straight from
+// the pipe instead of collecting it into a byte slice first. Output newCommand already captures for --error-log-dir is
+// decoded from that buffer once the command has finished.
+func runProbe(cmd *exec.Cmd) (*ProbeResult, error) {
+	if _, captured := cmd.Stdout.(*bytes.Buffer); captured {
+		output, err := commandOutput(cmd)
+		if err != nil {
+			return nil, err
+		}
+		return parseProbeJSON(output)
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	probe, decodeErr := decodeProbe(stdout)
+	// Drain whatever follows the JSON document so ffprobe can exit
+	io.Copy(io.Discard, stdout)
+	if err := cmd.Wait(); err != nil {
+		return nil, err
+	}
+	return probe, decodeErr
+}
+
+func parseProbeJSON(data []byte) (*ProbeResult, error) {
+	return decodeProbe(bytes.NewReader(data))
+}
+
+// decodeProbe decodes ffprobe's JSON report from r
+func decodeProbe(r io.Reader) (*ProbeResult, error) {
+	var probe ProbeResult
+	if err := json.NewDecoder(r).Decode(&probe); err != nil {
+		return nil, fmt.Errorf("failed to parse ffprobe output: %w", err)
+	}
+	return &probe, nil
+}
+
+// audioInfoFromProbe extracts the bit depth and sample rate of the first
+// usable audio stream of an ALAC file. Bits is 0 when ffprobe does not report
+// the bit depth in any of the fields probeBits looks at.
+func audioInfoFromProbe(probe *ProbeResult) (*AudioInfo, error) {
+	for _, stream := range probe.Streams {
+		if stream.CodecType != "" && stream.CodecType != "audio" {
+			continue
+		}
+
+		rate, err := strconv.Atoi(strings.TrimSpace(stream.SampleRate))
+		if err != nil {
+			continue // Skip streams with invalid sample rate
+		}
+
+		// Skip streams that don't look like audio (rate should be reasonable)
+		if rate < 8000 || rate > 500000 {
+			continue
+		}
+
+		return &AudioInfo{
+			Bits:          probeBits(stream),
+			Rate:          rate,
+			Channels:      stream.Channels,
+			ChannelLayout: stream.ChannelLayout,
+			Format:        "alac",
+		}, nil
+	}
+
+	return nil, fmt.Errorf("no valid audio stream information found")
+}
+
+// probeBits returns the bit depth of a stream. ffprobe leaves
+// bits_per_raw_sample empty or 0 for some ALAC files, so bits_per_sample and
+// the sample format are tried next. 32-bit sample formats also carry 24-bit
+// audio and do not tell the depth; 0 is returned for them.
+func probeBits(stream ProbeStream) int {
+	if bits, err := strconv.Atoi(strings.TrimSpace(stream.BitsPerRawSample)); err == nil && bits > 0 {
+		return bits
+	}
+	if stream.BitsPerSample > 0 {
+		return stream.BitsPerSample
+	}
+	switch strings.TrimSuffix(stream.SampleFmt, "p") {
+	case "u8":
+		return 8
+	case "s16":
+		return 16
+	}
+	return 0
+}
+
+// parseALACInfo parses "rate,bits" lines. An empty or 0 bit depth is kept
+// as 0, for the converters to treat as unknown.
+func parseALACInfo(info string) (*AudioInfo, error) {
+	lines := strings.Split(strings.TrimSpace(info), "\n")
+	if len(lines) == 0 {
+		return nil, fmt.Errorf("no audio stream information found")
+	}
+
+	// Look for the first line that contains valid audio stream data (both rate and bits)
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		parts := strings.Split(line, ",")
+		if len(parts) < 2 {
+			continue // Skip lines that don't have both values
+		}
+
+		rate, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+		if err != nil {
+			continue // Skip lines with invalid sample rate
+		}
+
+		bits := 0
+		if field := strings.TrimSpace(parts[1]); field != "" {
+			if bits, err = strconv.Atoi(field); err != nil || bits < 0 {
+				continue // Skip lines with invalid bit depth
+			}
+		}
+
+		// Skip streams that don't look like audio (rate should be reasonable)
+		if rate < 8000 || rate > 500000 {
+			continue
+		}
+
+		return &AudioInfo{
+			Bits:   bits,
+			Rate:   rate,
+			Format: "alac",
+		}, nil
+	}
+
+	return nil, fmt.Errorf("no valid audio stream information found")
+}
+
+func changeExtensionToFlac(filePath string) string {
+	ext := filepath.Ext(filePath)
+	return strings.TrimSuffix(filePath, ext) + ".flac"
+}
+
+func changeExtensionToMP3(filePath string) string {
+	ext := filepath.Ext(filePath)
+	return strings.TrimSuffix(filePath, ext) + ".mp3"
+}
+
+func changeExtensionToM4A(filePath string) string {
+	ext := filepath.Ext(filePath)
+	return strings.TrimSuffix(filePath, ext) + ".m4a"
+}
+
+func changeExtensionToOgg(filePath string) string {
+	ext := filepath.Ext(filePath)
+	return strings.TrimSuffix(filePath, ext) + ".ogg"
+}
+
+func changeExtensionToOpus(filePath string) string {
+	ext := filepath.Ext(filePath)
+	return strings.TrimSuffix(filePath, ext) + ".opus"
+}
+
+func convertToMP3(t *fileTask, sourcePath, targetPath string, audioInfo *AudioInfo) error {
+	// MP3 conversion: Use SoX to convert audio, then FFmpeg to preserve metadata
+	// Create temporary path for conversion output with proper extension
+	tempPath := tempPathFor(t, targetPath)
+	control.trackTemp(tempPath)
+	defer control.releaseTemp(tempPath)
+
+	targetSampleRate := mp3SampleRate(t.policy, audioInfo)
+	// A forced rate is reached with the high quality rate effect instead of
+	// SoX's default output resampling
+	rateArgs := []string{"-r", targetSampleRate}
+	var effectArgs []string
+	if t.policy.MP3Rate != 0 || t.policy.ResampleAll != 0 {
+		rateArgs = nil
+		effectArgs = []string{"rate", "-v", "-L", targetSampleRate}
+	}
+
+	var channels int
+	if audioInfo != nil {
+		channels = t.policy.channels(audioInfo.Channels)
+	}
+
+	var cmd *exec.Cmd
+
+	if mp3Mode() == "abr" || isLossyPassthroughExtension(strings.ToLower(filepath.Ext(sourcePath))) {
+		// SoX's MP3 writer has no ABR mode and SoX cannot decode AAC, so
+		// LAME is driven through FFmpeg
+		encodeArgs := append(ffmpegMP3Args(), "-ar", targetSampleRate)
+		if channels != 0 {
+			encodeArgs = append(encodeArgs, "-ac", strconv.Itoa(channels))
+		}
+		if config.UseDocker {
+			args := []string{"run", "--rm", "--entrypoint", "ffmpeg",
+				"-v", fmt.Sprintf("%s:/source", sourceRoot()),
+				"-v", fmt.Sprintf("%s:/target", config.TargetDir),
+				config.DockerImage, "-y", "-i", getDockerPath(sourcePath), "-vn"}
+			args = append(args, encodeArgs...)
+			args = append(args, getDockerTargetPath(tempPath))
+			cmd = t.command("docker", args...)
+		} else {
+			args := append([]string{"-y", "-i", sourcePath, "-vn"}, encodeArgs...)
+			args = append(args, tempPath)
+			cmd = t.command("ffmpeg", args...)
+		}
+	} else if config.UseDocker {
+		dockerSourcePath := getDockerPath(sourcePath)
+		dockerTempPath := getDockerTargetPath(tempPath)
+		args := []string{"run", "--rm",
+			"-v", fmt.Sprintf("%s:/source", sourceRoot()),
+			"-v", fmt.Sprintf("%s:/target", config.TargetDir),
+			config.DockerImage, dockerSourcePath, "-t", "mp3"}
+		args = append(args, mp3CompressionArgs()...)
+		args = append(args, rateArgs...)
+		if channels != 0 {
+			args = append(args, "-c", strconv.Itoa(channels))
+		}
+		args = append(args, dockerTempPath)
+		args = append(args, effectArgs...)
+		cmd = t.command("docker", args...)
+	} else {
+		args := []string{sourcePath, "-t", "mp3"}
+		args = append(args, mp3CompressionArgs()...)
+		args = append(args, rateArgs...)
+		if channels != 0 {
+			args = append(args, "-c", strconv.Itoa(channels))
+		}
+		args = append(args, tempPath)
+		args = append(args, effectArgs...)
+		cmd = t.command(config.SoxCommand, args...)
+	}
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("conversion to MP3 failed: %w", err)
+	}
+
+	if !config.NoPreserveMetadata {
+		// Merge metadata using FFmpeg
+		if mergeErr := mergeMetadataWithFFmpeg(t, sourcePath, tempPath, targetPath); mergeErr != nil {
+			if config.KeepOriginal {
+				return fmt.Errorf("metadata merge failed: %w", mergeErr)
+			}
+			t.logf("Warning: Metadata preservation failed for %s, keeping converted audio without tags: %v\n", targetPath, mergeErr)
+			// Fallback: rename temp to target
+			if renameErr := moveIntoPlace(tempPath, targetPath); renameErr != nil {
+				return fmt.Errorf("fallback rename failed after metadata merge error: %w", renameErr)
+			}
+			return nil
+		}
+		// If merge succeeded, temp is already removed in merge function
+	} else if err := moveIntoPlace(tempPath, targetPath); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Bitrates LAME accepts for CBR MPEG-1 Layer III
+var mp3CBRBitrates = []int{32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320}
+
+// validateMP3Options checks the MP3 output flags. VBR is driven by
+// quality, CBR and ABR by bitrate.
+func validateMP3Options() error {
+	if config.MP3MinCopyBitrate < 0 || config.MP3MinCopyBitrate > 320 {
+		return fmt.Errorf("invalid mp3-min-copy-bitrate: %d. It must be between 0 and 320", config.MP3MinCopyBitrate)
+	}
+	if config.MP3Rate != 0 && !slices.Contains([]int{32000, 44100, 48000}, config.MP3Rate) {
+		return fmt.Errorf("invalid mp3-rate: %d. Valid options are: 32000, 44100, 48000", config.MP3Rate)
+	}
+
+	if config.MP3Preset != "" {
+		if _, err := parseMP3Preset(config.MP3Preset); err != nil {
+			return err
+		}
+		if config.MP3Mode == "abr" {
+			return fmt.Errorf("mp3-bitrate %s is a VBR preset and cannot be used with abr mode", config.MP3Preset)
+		}
+		if config.MP3Quality != 0 {
+			return fmt.Errorf("mp3-bitrate %s cannot be combined with mp3-quality", config.MP3Preset)
+		}
+		return nil
+	}
+
+	switch config.MP3Mode {
+	case "", "cbr":
+		if config.MP3Bitrate != 0 && !slices.Contains(mp3CBRBitrates, config.MP3Bitrate) {
+			return fmt.Errorf("invalid mp3-bitrate for cbr: %d. Valid options are: %s", config.MP3Bitrate, strings.Trim(fmt.Sprint(mp3CBRBitrates), "[]"))
+		}
+	case "abr":
+		if config.MP3Bitrate != 0 && (config.MP3Bitrate < 8 || config.MP3Bitrate > 320) {
+			return fmt.Errorf("invalid mp3-bitrate for abr: %d. It must be between 8 and 320", config.MP3Bitrate)
+		}
+	case "vbr":
+		if config.MP3Bitrate != 0 {
+			return fmt.Errorf("mp3-bitrate cannot be used with vbr mode, use mp3-quality instead")
+		}
+		if config.MP3Quality < 0 || config.MP3Quality > 9 {
+			return fmt.Errorf("invalid mp3-quality: %d. It must be between 0 and 9", config.MP3Quality)
+		}
+		return nil
+	default:
+		return fmt.Errorf("invalid mp3-mode: %s. Valid options are: cbr, vbr, abr", config.MP3Mode)
+	}
+
+	if config.MP3Quality != 0 {
+		return fmt.Errorf("mp3-quality can only be used with vbr mode, use mp3-bitrate instead")
+	}
+	return nil
+}
+
+// mp3NeedsReencode reports whether an MP3 source is below
+// --mp3-min-copy-bitrate and has to be re-encoded instead of copied.
+// Sources whose bitrate cannot be probed, or that are copied unprobed, are
+// copied.
+func mp3NeedsReencode(t *fileTask, sourcePath string) bool {
+	if config.MP3MinCopyBitrate == 0 || copiedUnprobed("mp3", ".mp3") {
+		return false
+	}
+	probe, err := probeFile(t, sourcePath)
+	if err != nil {
+		t.logf("Warning: Could not probe the bitrate of %s, copying it: %v\n", sourcePath, err)
+		return false
+	}
+	kbps := probeBitrate(probe) / 1000
+	if kbps == 0 || kbps >= config.MP3MinCopyBitrate {
+		return false
+	}
+	t.logf("Warning: %s is %d kbps, below --mp3-min-copy-bitrate %d; re-encoding it loses quality again (lossy to lossy)\n", sourcePath, kbps, config.MP3MinCopyBitrate)
+	return true
+}
+
+// probeBitrate returns the bitrate of the first audio stream in bits per
+// second, falling back to the container's overall bitrate
+func probeBitrate(probe *ProbeResult) int {
+	for _, stream := range probe.Streams {
+		if stream.CodecType == "audio" {
+			if bitrate, err := strconv.Atoi(stream.BitRate); err == nil {
+				return bitrate
+			}
+			break
+		}
+	}
+	bitrate, _ := strconv.Atoi(probe.Format.BitRate)
+	return bitrate
+}
+
+// mp3AudioInfo returns the sample rate of a lossy source for picking the
+// MP3 output rate
+func mp3AudioInfo(probe *ProbeResult) *AudioInfo {
+	for _, stream := range probe.Streams {
+		if stream.CodecType == "audio" {
+			rate, _ := strconv.Atoi(stream.SampleRate)
+			return &AudioInfo{Rate: rate, Channels: stream.Channels, Format: "mp3"}
+		}
+	}
+	return nil
+}
+
+// mp3SampleRate returns the MP3 output rate of a policy
+func mp3SampleRate(policy ConversionPolicy, audioInfo *AudioInfo) string {
+	return strconv.Itoa(policy.mp3Rate(audioInfo))
+}
+
+// parseMP3Preset returns the quality of a VBR preset given to --mp3-bitrate
+func parseMP3Preset(preset string) (int, error) {
+	digits, ok := strings.CutPrefix(strings.ToUpper(preset), "V")
+	quality, err := strconv.Atoi(digits)
+	if !ok || err != nil || len(digits) != 1 || quality < 0 || quality > 9 {
+		return 0, fmt.Errorf("invalid mp3-bitrate: %q. Use a bitrate in kbps such as 192 or a VBR preset from V0 to V9", preset)
+	}
+	return quality, nil
+}
+
+// mp3Mode returns the MP3 rate control in effect: a VBR preset given to
+// --mp3-bitrate selects vbr over --mp3-mode
+func mp3Mode() string {
+	if config.MP3Preset != "" {
+		return "vbr"
+	}
+	return config.MP3Mode
+}
+
+// mp3Quality returns the VBR quality, from the --mp3-bitrate preset when
+// one was given
+func mp3Quality() int {
+	if quality, err := parseMP3Preset(config.MP3Preset); err == nil {
+		return quality
+	}
+	return config.MP3Quality
+}
+
+// mp3Bitrate returns the configured bitrate in kbps, defaulting to 320
+func mp3Bitrate() int {
+	if config.MP3Bitrate == 0 {
+		return 320
+	}
+	return config.MP3Bitrate
+}
+
+// ffmpegMP3Args returns FFmpeg's LAME encoder arguments for the configured
+// MP3 rate control
+func ffmpegMP3Args() []string {
+	switch mp3Mode() {
+	case "vbr":
+		return []string{"-c:a", "libmp3lame", "-q:a", strconv.Itoa(mp3Quality())}
+	case "abr":
+		return []string{"-c:a", "libmp3lame", "-abr", "1", "-b:a", fmt.Sprintf("%dk", mp3Bitrate())}
+	}
+	return []string{"-c:a", "libmp3lame", "-b:a", fmt.Sprintf("%dk", mp3Bitrate())}
+}
+
+// mp3CompressionArgs returns the SoX MP3 writer compression argument. A
+// positive -C value is a CBR bitrate, a negative one a VBR quality. The
+// fractional part is LAME's encoder quality, which also keeps V0 negative.
+func mp3CompressionArgs() []string {
+	if mp3Mode() == "vbr" {
+		return []string{"-C", fmt.Sprintf("-%d.2", mp3Quality())}
+	}
+	return []string{"-C", strconv.Itoa(mp3Bitrate())}
+}
+
+// errUnsupportedLayout fails ALAC output of a channel layout the encoder
+// cannot write
+var errUnsupportedLayout = errors.New("channel layout not supported by the ALAC encoder")
+
+// alacChannelLayouts are the layouts FFmpeg's ALAC encoder accepts, by
+// channel count
+var alacChannelLayouts = map[int]string{
+	1: "mono",
+	2: "stereo",
+	3: "3.0",
+	4: "4.0",
+	5: "5.0",
+	6: "5.1",
+	7: "6.1(back)",
+	8: "7.1(wide-side)",
+}
+
+// alacChannelArgs returns the FFmpeg arguments giving ALAC output an explicit
+// channel layout the encoder accepts. With --downmix, sources with more than
+// two channels are mixed down to stereo. Without a channel count the source
+// layout is passed through as before.
+func alacChannelArgs(t *fileTask, sourcePath string, info *AudioInfo) ([]string, error) {
+	if info == nil || info.Channels == 0 {
+		return nil, nil
+	}
+	if channels := t.policy.channels(info.Channels); channels != 0 {
+		return []string{"-ac", strconv.Itoa(channels)}, nil
+	}
+	if info.Channels > 2 && config.Downmix {
+		t.logf("Downmixing %s from %d channels to stereo\n", sourcePath, info.Channels)
+		return []string{"-ac", "2"}, nil
+	}
+	layout, ok := alacChannelLayouts[info.Channels]
+	if !ok {
+		name := info.ChannelLayout
+		if name == "" {
+			name = fmt.Sprintf("%d channels", info.Channels)
+		}
+		return nil, fmt.Errorf("%w: %s (%s), use --downmix to convert it to stereo", errUnsupportedLayout, sourcePath, name)
+	}
+	return []string{"-af", "aformat=channel_layouts=" + layout}, nil
+}
+
+// Highest compression_level FFmpeg's ALAC encoder accepts
+const maxALACCompressionLevel = 2
+
+// alacEncoderArgs returns the FFmpeg arguments for ALAC output of the given
+// bit depth; deeper than 16 bits needs 32-bit samples, which FFmpeg fills
+// with the depth of its FLAC input. A higher compression level trades encode
+// time for smaller files.
+func alacEncoderArgs(bits int) []string {
+	sampleFmt := "s16p"
+	if bits > 16 {
+		sampleFmt = "s32p"
+	}
+	args := []string{"-c:a", "alac", "-sample_fmt", sampleFmt}
+	if config.ALACCompression >= 0 {
+		args = append(args, "-compression_level", strconv.Itoa(config.ALACCompression))
+	}
+	return args
+}
+
+// mp3RateDescription describes the MP3 rate control for console output
+func mp3RateDescription() string {
+	switch mp3Mode() {
+	case "vbr":
+		return fmt.Sprintf("VBR V%d", mp3Quality())
+	case "abr":
+		return fmt.Sprintf("%dkbps ABR", mp3Bitrate())
+	}
+	return fmt.Sprintf("%dkbps", mp3Bitrate())
+}
+
+func convertToALAC(t *fileTask, sourcePath, targetPath string, audioInfo *AudioInfo) error {
+	// ALAC conversion:
+	// To preserve the best quality and metadata:
+	// First Use SoX to process and downsample audio to a temp FLAC, since sox can do this better
+	// Then since SoX can't encode to ALAC, use FFmpeg to convert to ALAC and preserve metadata
+
+	// Fail unsupported layouts before any work is done
+	channelArgs, err := alacChannelArgs(t, sourcePath, audioInfo)
+	if err != nil {
+		return err
+	}
+
+	// Create temporary path for conversion output with proper extension
+	tempPath := tempPathFor(t, targetPath)
+	control.trackTemp(tempPath)
+	defer control.releaseTemp(tempPath)
+
+	// Step 1: Use SoX to convert source to intermediate FLAC with proper bit depth/sample rate
+	tempFlacPath := strings.TrimSuffix(tempPath, ".m4a") + ".temp.flac"
+	control.trackTemp(tempFlacPath)
+	defer control.releaseTemp(tempFlacPath)
+
+	// Determine if we need SoX processing for bit depth/sample rate conversion
+	needsConversion := false
+	var bitrateArgs []string
+	sampleRateArgs := []string{"rate", "-v", "-L"}
+	bits := 0
+
+	if audioInfo != nil {
+		needsConversion, bitrateArgs, sampleRateArgs = determineConversion(t.policy, audioInfo)
+		bits = cmp.Or(t.policy.bits(audioInfo.Bits), audioInfo.Bits)
+	}
+
+	var cmd *exec.Cmd
+
+	if needsConversion {
+		// Use SoX for quality conversion to FLAC first
+		if config.UseDocker {
+			dockerSource := getDockerPath(sourcePath)
+			dockerTempFlac := getDockerTargetPath(tempFlacPath)
+
+			args := []string{"run", "--rm",
+				"-v", fmt.Sprintf("%s:/source", sourceRoot()),
+				"-v", fmt.Sprintf("%s:/target", config.TargetDir),
+				config.DockerImage, "--multi-threaded", "-G", dockerSource}
+
+			args = append(args, bitrateArgs...)
+			args = append(args, dockerTempFlac)
+			args = append(args, sampleRateArgs...)
+			args = append(args, t.policy.ditherArgs()...)
+
+			cmd = t.command("docker", args...)
+		} else {
+			args := []string{"--multi-threaded", "-G", sourcePath}
+			args = append(args, bitrateArgs...)
+			args = append(args, tempFlacPath)
+			args = append(args, sampleRateArgs...)
+			args = append(args, t.policy.ditherArgs()...)
+
+			cmd = t.command(config.SoxCommand, args...)
+		}
+
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("SoX conversion to FLAC failed: %w", err)
+		}
+		if err := checkSoxOutput(tempFlacPath, bitrateArgs, sampleRateArgs); err != nil {
+			os.Remove(tempFlacPath)
+			return err
+		}
+	} else {
+		// Direct conversion to FLAC without quality changes
+		if config.UseDocker {
+			dockerSource := getDockerPath(sourcePath)
+			dockerTempFlac := getDockerTargetPath(tempFlacPath)
+
+			args := []string{"run", "--rm",
+				"-v", fmt.Sprintf("%s:/source", sourceRoot()),
+				"-v", fmt.Sprintf("%s:/target", config.TargetDir),
+				config.DockerImage, dockerSource, dockerTempFlac}
+
+			cmd = t.command("docker", args...)
+		} else {
+			cmd = t.command(config.SoxCommand, sourcePath, tempFlacPath)
+		}
+
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("SoX conversion to FLAC failed: %w", err)
+		}
+	}
+
+	// Step 2: Convert FLAC to ALAC using FFmpeg
+	if config.UseDocker {
+		dockerTempFlac := getDockerTargetPath(tempFlacPath)
+		dockerTemp := getDockerTargetPath(tempPath)
+
+		args := []string{"run", "--rm", "--entrypoint", "ffmpeg",
+			"-v", fmt.Sprintf("%s:/source", sourceRoot()),
+			"-v", fmt.Sprintf("%s:/target", config.TargetDir),
+			config.DockerImage,
+			"-y", "-i", dockerTempFlac}
+		args = append(args, channelArgs...)
+		args = append(args, alacEncoderArgs(bits)...)
+		args = append(args, dockerTemp)
+
+		cmd = t.command("docker", args...)
+	} else {
+		args := []string{"-y", "-i", tempFlacPath}
+		args = append(args, channelArgs...)
+		args = append(args, alacEncoderArgs(bits)...)
+		args = append(args, tempPath)
+		cmd = t.command("ffmpeg", args...)
+	}
+
+	if err := cmd.Run(); err != nil {
+		os.Remove(tempFlacPath) // Clean up temp FLAC file
+		return fmt.Errorf("FFmpeg FLAC to ALAC conversion failed: %w", err)
+	}
+
+	// Clean up temp FLAC file
+	os.Remove(tempFlacPath)
+
+	if !needsConversion {
+		if err := verifyRoundtrip(t, sourcePath, tempPath); err != nil {
+			return err
+		}
+	}
+
+	if !config.NoPreserveMetadata {
+		// Merge metadata using FFmpeg
+		if mergeErr := mergeMetadataWithFFmpeg(t, sourcePath, tempPath, targetPath); mergeErr != nil {
+			if config.KeepOriginal {
+				return fmt.Errorf("metadata merge failed: %w", mergeErr)
+			}
+			t.logf("Warning: Metadata preservation failed for %s, keeping converted audio without tags: %v\n", targetPath, mergeErr)
+			// Fallback: rename temp to target
+			if renameErr := moveIntoPlace(tempPath, targetPath); renameErr != nil {
+				return fmt.Errorf("fallback rename failed after metadata merge error: %w", renameErr)
+			}
+			return nil
+		}
+		// If merge succeeded, temp is already removed in merge function
+	} else if err := moveIntoPlace(tempPath, targetPath); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func processAudioFile(t *fileTask, sourcePath, targetPath string, audioInfo *AudioInfo, needsConversion bool, bitrateArgs, sampleRateArgs []string) error {
+	switch audioInfo.Format {
+	case "alac":
+		return processALAC(t, sourcePath, targetPath, needsConversion, bitrateArgs, sampleRateArgs)
+	case "wav":
+		// SoX encodes WAV to FLAC even when the bit depth and rate stay
+		return processFlac(t, sourcePath, targetPath, true, bitrateArgs, sampleRateArgs)
+	default:
+		return processFlac(t, sourcePath, targetPath, needsConversion, bitrateArgs, sampleRateArgs)
+	}
+}
+
+func processALAC(t *fileTask, sourcePath, targetPath string, needsConversion bool, bitrateArgs, sampleRateArgs []string) error {
+	// Create temporary path for conversion output with proper extension
+	tempPath := tempPathFor(t, targetPath)
+	control.trackTemp(tempPath)
+	defer control.releaseTemp(tempPath)
+
+	// Convert ALAC to FLAC using FFmpeg, with optional quality adjustments via SoX
+	var cmd *exec.Cmd
+
+	if needsConversion {
+		// Two-step process: ALAC -> temp FLAC via FFmpeg, then temp FLAC -> final FLAC via SoX
+		tempAlacFlac := strings.TrimSuffix(tempPath, ".flac") + ".alac_temp.flac"
+		control.trackTemp(tempAlacFlac)
+		defer control.releaseTemp(tempAlacFlac)
+
+		// Step 1: Convert ALAC to FLAC using FFmpeg
+		if config.UseDocker {
+			dockerSource := getDockerPath(sourcePath)
+			dockerTempAlac := getDockerTargetPath(tempAlacFlac)
+
+			args := []string{"run", "--rm", "--entrypoint", "ffmpeg",
+				"-v", fmt.Sprintf("%s:/source", sourceRoot()),
+				"-v", fmt.Sprintf("%s:/target", config.TargetDir),
+				config.DockerImage,
+				"-i", dockerSource,
+				"-c:a", "flac",
+				dockerTempAlac}
+
+			cmd = t.command("docker", args...)
+		} else {
+			// Check if ffmpeg is available
+			if _, err := exec.LookPath("ffmpeg"); err != nil {
+				return fmt.Errorf("ffmpeg is not installed. Please install FFmpeg for ALAC support or use --use-docker option")
+			}
+			cmd = t.command("ffmpeg", "-i", sourcePath, "-c:a", "flac", tempAlacFlac)
+		}
+
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("FFmpeg ALAC to FLAC conversion failed: %w", err)
+		}
+		defer os.Remove(tempAlacFlac) // Clean up intermediate file
+
+		// Step 2: Process with SoX for quality adjustment
+		if config.UseDocker {
+			dockerTempAlac := getDockerTargetPath(tempAlacFlac)
+			dockerTemp := getDockerTargetPath(tempPath)
+
+			args := []string{"run", "--rm",
+				"-v", fmt.Sprintf("%s:/source", sourceRoot()),
+				"-v", fmt.Sprintf("%s:/target", config.TargetDir),
+				config.DockerImage, "--multi-threaded", "-G", dockerTempAlac}
+
+			args = append(args, bitrateArgs...)
+			args = append(args, dockerTemp)
+			args = append(args, sampleRateArgs...)
+			args = append(args, t.policy.ditherArgs()...)
+
+			cmd = t.command("docker", args...)
+		} else {
+			args := []string{"--multi-threaded", "-G", tempAlacFlac}
+			args = append(args, bitrateArgs...)
+			args = append(args, tempPath)
+			args = append(args, sampleRateArgs...)
+			args = append(args, t.policy.ditherArgs()...)
+
+			cmd = t.command(config.SoxCommand, args...)
+		}
+
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("SoX quality adjustment failed: %w", err)
+		}
+		if err := checkSoxOutput(tempPath, bitrateArgs, sampleRateArgs); err != nil {
+			os.Remove(tempPath)
+			return err
+		}
+	} else {
+		// Direct conversion ALAC to FLAC without quality changes
+		if config.UseDocker {
+			dockerSource := getDockerPath(sourcePath)
+			dockerTemp := getDockerTargetPath(tempPath)
+
+			args := []string{"run", "--rm", "--entrypoint", "ffmpeg",
+				"-v", fmt.Sprintf("%s:/source", sourceRoot()),
+				"-v", fmt.Sprintf("%s:/target", config.TargetDir),
+				config.DockerImage,
+				"-i", dockerSource,
+				"-c:a", "flac",
+				dockerTemp}
+
+			cmd = t.command("docker", args...)
+		} else {
+			// Check if ffmpeg is available
+			if _, err := exec.LookPath("ffmpeg"); err != nil {
+				return fmt.Errorf("ffmpeg is not installed. Please install FFmpeg for ALAC support or use --use-docker option")
+			}
+			cmd = t.command("ffmpeg", "-i", sourcePath, "-c:a", "flac", tempPath)
+		}
+
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("FFmpeg ALAC to FLAC conversion failed: %w", err)
+		}
+
+		if err := verifyRoundtrip(t, sourcePath, tempPath); err != nil {
+			return err
+		}
+	}
+
+	if !config.NoPreserveMetadata {
+		// Merge metadata using FFmpeg
+		if mergeErr := mergeMetadataWithFFmpeg(t, sourcePath, tempPath, targetPath); mergeErr != nil {
+			t.logf("Warning: Metadata preservation failed for %s, keeping converted audio without tags: %v\n", targetPath, mergeErr)
+			// Fallback: rename temp to target
+			if renameErr := moveIntoPlace(tempPath, targetPath); renameErr != nil {
+				return fmt.Errorf("fallback rename failed after metadata merge error: %w", renameErr)
+			}
+			return nil
+		}
+		// If merge succeeded, temp is already removed in merge function
+	} else if err := moveIntoPlace(tempPath, targetPath); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func parseAudioInfo(info string) (*AudioInfo, error) {
+	audioInfo := &AudioInfo{}
+	scanner := bufio.NewScanner(strings.NewReader(info))
+
+	bitsRegex := regexp.MustCompile(`Sample Encoding.*?(\d+)-bit`)
+	// WAV files in a compressed encoding such as "4-bit IMA ADPCM" decode
+	// to the precision SoX reports
+	precisionRegex := regexp.MustCompile(`^Precision\s*:\s*(\d+)-bit`)
+	precision := 0
+	rateRegex := regexp.MustCompile(`Sample Rate\s*:\s*(\d+)`)
+	channelsRegex := regexp.MustCompile(`^Channels\s*:\s*(\d+)`)
+	durationRegex := regexp.MustCompile(`^Duration\s*:\s*(\d+):(\d+):(\d+(?:\.\d+)?)`)
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if matches := bitsRegex.FindStringSubmatch(line); len(matches) > 1 {
+			if bits, err := strconv.Atoi(matches[1]); err == nil {
+				audioInfo.Bits = bits
+			}
+		}
+
+		if matches := precisionRegex.FindStringSubmatch(line); len(matches) > 1 {
+			precision, _ = strconv.Atoi(matches[1])
+		}
+
+		if matches := rateRegex.FindStringSubmatch(line); len(matches) > 1 {
+			if rate, err := strconv.Atoi(matches[1]); err == nil {
+				audioInfo.Rate = rate
+			}
+		}
+
+		if matches := channelsRegex.FindStringSubmatch(line); len(matches) > 1 {
+			if channels, err := strconv.Atoi(matches[1]); err == nil {
+				audioInfo.Channels = channels
+			}
+		}
+
+		// Duration       : 00:03:25.47 = 9060800 samples ~ 15408.2 CDDA sectors
+		if matches := durationRegex.FindStringSubmatch(line); len(matches) > 3 {
+			hours, _ := strconv.Atoi(matches[1])
+			minutes, _ := strconv.Atoi(matches[2])
+			seconds, _ := strconv.ParseFloat(matches[3], 64)
+			audioInfo.Duration = time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute + time.Duration(seconds*float64(time.Second))
+		}
+	}
+	if audioInfo.Bits == 0 || (precision > audioInfo.Bits && audioInfo.Bits < 8) {
+		audioInfo.Bits = precision
+	}
+
+	return audioInfo, nil
+}
+
+// ConversionPolicy answers what lilt does to an audio file and why. Built
+// from the configuration by policyFromConfig, it is the single place the
+// output bit depth, sample rate and channel count are decided, so every
+// pipeline, log line and report agrees.
+type ConversionPolicy struct {
+	Format          string // Output format: "flac", "alac", "mp3", "vorbis" or "opus"
+	DownsampleOnly  bool
+	ReduceBitsAbove int
+	TargetBits      int // Depth deeper sources are reduced to by default, 0 means 16
+	ResampleAbove   int
+	ResampleAll     int
+	MP3Rate         int
+	NoUpsample      bool
+	Channels        int
+	HighRate        int // Rate high rate sources are reduced to, 0 keeps their family
+}
+
+// Decision is what a ConversionPolicy does to one file. Zero targets keep
+// the source's value.
+type Decision struct {
+	Action         string `json:"action"` // "convert" or "copy"
+	TargetBits     int    `json:"target_bits,omitempty"`
+	TargetRate     int    `json:"target_rate,omitempty"`
+	TargetChannels int    `json:"target_channels,omitempty"`
+	Reason         string `json:"reason"`
+}
+
+const (
+	decisionConvert = "convert"
+	decisionCopy    = "copy"
+)
+
+// policyFromConfig returns the policy of the configuration for the output
+// format of a single format run
+func policyFromConfig() ConversionPolicy {
+	return policyFor(config.EnforceOutputFormat)
+}
+
+// policyFor returns the policy of the configuration for an output format,
+// "" in the default mode
+func policyFor(format string) ConversionPolicy {
+	return ConversionPolicy{
+		Format:          outputFormatName(format),
+		DownsampleOnly:  config.DownsampleOnly,
+		ReduceBitsAbove: config.ReduceBitsAbove,
+		TargetBits:      config.TargetBitDepth,
+		ResampleAbove:   config.ResampleAbove,
+		ResampleAll:     config.ResampleAll,
+		MP3Rate:         config.MP3Rate,
+		NoUpsample:      config.NoUpsample,
+		Channels:        config.Channels,
+		HighRate:        highSampleRate(),
+	}
+}
+
+// highSampleRate returns the --target-sample-rate high rate sources are
+// resampled to, or 0 for auto
+func highSampleRate() int {
+	rate, _ := strconv.Atoi(config.TargetSampleRate)
+	return rate
+}
+
+// Decide returns what happens to a lossless source. Lossless outputs are
+// converted when the bit depth, rate or channels change or the container
+// does; ALAC output without explicit thresholds is only kept at 16-bit, or
+// the target depth, at 44.1 or 48 kHz. MP3, Vorbis and Opus output is always
+// encoded, Vorbis at the rate a lossless output would have and Opus at 48 kHz.
+func (p ConversionPolicy) Decide(info *AudioInfo) Decision {
+	if p.Format == "vorbis" {
+		d := Decision{Action: decisionConvert}
+		if info == nil {
+			d.Reason = "encoded to Vorbis"
+			return d
+		}
+		d.TargetRate = p.rate(info.Rate)
+		d.TargetChannels = p.channels(info.Channels)
+		d.Reason = fmt.Sprintf("encoded to Vorbis at %d Hz", cmp.Or(d.TargetRate, info.Rate))
+		return d
+	}
+	if p.Format == "opus" {
+		d := Decision{Action: decisionConvert, Reason: fmt.Sprintf("encoded to Opus at %d Hz", opusRate)}
+		if info != nil {
+			if info.Rate != opusRate {
+				d.TargetRate = opusRate
+			}
+			d.TargetChannels = p.channels(info.Channels)
+		}
+		return d
+	}
+	if p.Format == "mp3" {
+		rate := p.mp3Rate(info)
+		d := Decision{Action: decisionConvert, TargetRate: rate, Reason: fmt.Sprintf("encoded to MP3 at %d Hz", rate)}
+		if info != nil {
+			d.TargetChannels = p.channels(info.Channels)
+		}
+		return d
+	}
+
+	d := p.targets(info)
+	keeping := describeDepth(info.Bits, info.Rate)
+	switch {
+	case d.changes():
+		d.Action = decisionConvert
+		d.Reason = d.describeChanges(info)
+	case (info.Format == "alac" || info.Format == "wav") && p.Format == "flac":
+		d.Action = decisionConvert
+		d.Reason = strings.ToUpper(info.Format) + " to FLAC, keeping " + keeping
+	case info.Format != "alac" && p.Format == "alac":
+		d.Action = decisionConvert
+		d.Reason = strings.ToUpper(cmp.Or(info.Format, "flac")) + " to ALAC, keeping " + keeping
+	case p.Format == "alac" && p.ReduceBitsAbove == 0 && p.ResampleAbove == 0 && ((info.Bits != 16 && info.Bits != p.targetBits()) || (info.Rate != 44100 && info.Rate != 48000)):
+		d.Action = decisionConvert
+		depths := "16-bit"
+		if p.targetBits() != 16 {
+			depths = fmt.Sprintf("16 or %d-bit", p.targetBits())
+		}
+		d.Reason = "ALAC is re-encoded unless it is " + depths + " at 44.1 or 48 kHz"
+	default:
+		d.Action = decisionCopy
+		d.Reason = "already " + keeping
+	}
+	return d
+}
+
+// targets returns the lossless conversion of a source without deciding the
+// action: the bit depth, channel count and rate it is converted to
+func (p ConversionPolicy) targets(info *AudioInfo) Decision {
+	return Decision{TargetBits: p.bits(info.Bits), TargetRate: p.rate(info.Rate), TargetChannels: p.channels(info.Channels)}
+}
+
+// changes reports whether the decision changes the audio itself
+func (d Decision) changes() bool {
+	return d.TargetBits != 0 || d.TargetRate != 0 || d.TargetChannels != 0
+}
+
+// describeChanges describes the conversion of a source, e.g.
+// "24-bit 96000 Hz → 16-bit 48000 Hz"
+func (d Decision) describeChanges(info *AudioInfo) string {
+	bits, rate := cmp.Or(d.TargetBits, info.Bits), cmp.Or(d.TargetRate, info.Rate)
+	description := describeDepth(info.Bits, info.Rate) + " → " + describeDepth(bits, rate)
+	if d.TargetChannels != 0 {
+		description += fmt.Sprintf(", %d → %d channels", info.Channels, d.TargetChannels)
+	}
+	return description
+}
+
+// describeDepth formats a bit depth and rate, e.g. "24-bit 96000 Hz",
+// leaving out a bit depth that is unknown
+func describeDepth(bits, rate int) string {
+	if bits == 0 {
+		return fmt.Sprintf("%d Hz", rate)
+	}
+	return fmt.Sprintf("%d-bit %d Hz", bits, rate)
+}
+
+// bitsLabel describes a detected bit depth for the log
+func bitsLabel(bits int) string {
+	if bits == 0 {
+		return "unknown bit depth"
+	}
+	return fmt.Sprintf("%d bits", bits)
+}
+
+func (d Decision) String() string {
+	return d.Action + ": " + d.Reason
+}
+
+// soxArgs returns whether SoX has to change the audio and its output format
+// options and rate effect
+func (d Decision) soxArgs() (bool, []string, []string) {
+	var bitrateArgs []string
+	sampleRateArgs := []string{"rate", "-v", "-L"}
+	if d.TargetBits != 0 {
+		bitrateArgs = []string{"-b", strconv.Itoa(d.TargetBits)}
+	}
+	// The channel count is an output option like the bit depth
+	if d.TargetChannels != 0 {
+		bitrateArgs = append(bitrateArgs, "-c", strconv.Itoa(d.TargetChannels))
+	}
+	if d.TargetRate != 0 {
+		sampleRateArgs = append(sampleRateArgs, strconv.Itoa(d.TargetRate))
+	}
+	return d.changes(), bitrateArgs, sampleRateArgs
+}
+
+// rate returns the sample rate a source rate has to be converted to, or 0
+// when it can stay. High rates are reduced within their family (48 kHz or
+// 44.1 kHz), or to --target-sample-rate when it is fixed; --resample-all
+// converts every other rate to the forced one, except lower rates with
+// --no-upsample. --resample-above only reduces rates above its threshold.
+func (p ConversionPolicy) rate(sourceRate int) int {
+	if p.ResampleAbove != 0 {
+		if sourceRate > p.ResampleAbove {
+			return familyRateAtMost(sourceRate, p.ResampleAbove)
+		}
+		return 0
+	}
+	if p.ResampleAll != 0 && !p.keepsSourceRate(sourceRate, p.ResampleAll) {
+		if sourceRate != p.ResampleAll {
+			return p.ResampleAll
+		}
+		return 0
+	}
+	family := highRateFamily(sourceRate)
+	if family != 0 && p.HighRate != 0 {
+		return p.HighRate
+	}
+	return family
+}
+
+// highRateFamily returns the base rate of the family a high sample rate
+// belongs to, or 0 for rates that are not resampled by default
+func highRateFamily(sourceRate int) int {
+	switch sourceRate {
+	case 96000, 192000, 384000:
+		return 48000
+	case 88200, 176400, 352800:
+		return 44100
+	}
+	return 0
+}
+
+// bits returns the bit depth a source is reduced to, or 0 to keep it.
+// --reduce-bits-above reduces only sources deeper than the threshold, to the
+// threshold; otherwise everything above --target-bit-depth (16 by default)
+// is reduced to it unless --downsample-only is given.
+func (p ConversionPolicy) bits(sourceBits int) int {
+	if p.ReduceBitsAbove != 0 {
+		if sourceBits > p.ReduceBitsAbove {
+			return p.ReduceBitsAbove
+		}
+		return 0
+	}
+	if sourceBits > p.targetBits() && !p.DownsampleOnly {
+		return p.targetBits()
+	}
+	return 0
+}
+
+// targetBits returns the depth deeper sources are reduced to by default
+func (p ConversionPolicy) targetBits() int {
+	return cmp.Or(p.TargetBits, 16)
+}
+
+// channels returns the channel count a source is remixed to by a
+// --spec-file entry, or 0 to keep it
+func (p ConversionPolicy) channels(sourceChannels int) int {
+	if p.Channels != 0 && sourceChannels != 0 && sourceChannels != p.Channels {
+		return p.Channels
+	}
+	return 0
+}
+
+// mp3Rate returns the MP3 output rate: --resample-all or --mp3-rate when set,
+// then --target-sample-rate for high rate sources, otherwise 48 kHz for the
+// 48 kHz family and 44.1 kHz for everything else.
+// With --no-upsample lower rate sources get the latter.
+func (p ConversionPolicy) mp3Rate(info *AudioInfo) int {
+	sourceRate := 0
+	if info != nil {
+		sourceRate = info.Rate
+	}
+	if p.ResampleAll != 0 && !p.keepsSourceRate(sourceRate, p.ResampleAll) {
+		return p.ResampleAll
+	}
+	if p.MP3Rate != 0 && !p.keepsSourceRate(sourceRate, p.MP3Rate) {
+		return p.MP3Rate
+	}
+	if p.HighRate != 0 && highRateFamily(sourceRate) != 0 {
+		return p.HighRate
+	}
+	switch sourceRate {
+	case 48000, 96000, 192000, 384000:
+		return 48000
+	}
+	return 44100
+}
+
+// keepsSourceRate reports whether --no-upsample keeps a source below the
+// forced rate at its own rate
+func (p ConversionPolicy) keepsSourceRate(sourceRate, forced int) bool {
+	return p.NoUpsample && sourceRate != 0 && sourceRate < forced
+}
+
+// errUpsample fails a file a forced rate would upsample with --strict-upsample
+var errUpsample = errors.New("conversion would upsample")
+
+// UpsampleDecision records what happened to a file a forced rate would
+// upsample, for the run report
+type UpsampleDecision struct {
+	Path       string `json:"path"`
+	SourceRate int    `json:"source_rate"`
+	TargetRate int    `json:"target_rate"`
+	Decision   string `json:"decision"` // "upsampled", "kept_rate" or "failed"
+	Reason     string `json:"reason"`
+}
+
+// upsampleDecisions collects the upsampling decisions of the current run
+var upsampleDecisions = struct {
+	sync.Mutex
+	list []UpsampleDecision
+}{}
+
+func recordedUpsampleDecisions() []UpsampleDecision {
+	upsampleDecisions.Lock()
+	defer upsampleDecisions.Unlock()
+	return slices.Clone(upsampleDecisions.list)
+}
+
+func resetUpsampleDecisions() {
+	upsampleDecisions.Lock()
+	upsampleDecisions.list = nil
+	upsampleDecisions.Unlock()
+}
+
+// forcedRate returns the rate --resample-all, or --mp3-rate for MP3 output,
+// imposes on every file, or 0
+func (p ConversionPolicy) forcedRate() int {
+	if p.ResampleAll != 0 {
+		return p.ResampleAll
+	}
+	if p.Format == "mp3" {
+		return p.MP3Rate
+	}
+	return 0
+}
+
+// checkUpsampling decides what to do with a file a forced rate would
+// upsample, which adds no information: warn and upsample by default, keep
+// the source rate with --no-upsample or fail with --strict-upsample
+func checkUpsampling(t *fileTask, path string, info *AudioInfo) error {
+	forced := t.policy.forcedRate()
+	if forced == 0 || info == nil || info.Rate == 0 || info.Rate >= forced {
+		return nil
+	}
+	decision := UpsampleDecision{Path: path, SourceRate: info.Rate, TargetRate: forced}
+	var err error
+	switch {
+	case t.policy.NoUpsample:
+		decision.Decision = "kept_rate"
+		decision.Reason = "--no-upsample keeps the source rate, only the bit depth is converted"
+		t.logf("Keeping %s at %d Hz instead of upsampling to %d Hz\n", path, info.Rate, forced)
+	case config.StrictUpsample:
+		decision.Decision = "failed"
+		decision.Reason = "--strict-upsample fails files the forced rate would upsample"
+		err = fmt.Errorf("%w: %s from %d Hz to %d Hz", errUpsample, path, info.Rate, forced)
+	default:
+		decision.Decision = "upsampled"
+		decision.Reason = "the forced rate is higher than the source rate"
+		t.logf("Warning: Upsampling %s from %d Hz to %d Hz\n", path, info.Rate, forced)
+	}
+	upsampleDecisions.Lock()
+	upsampleDecisions.list = append(upsampleDecisions.list, decision)
+	upsampleDecisions.Unlock()
+	return err
+}
+
+// ditherArgs returns the SoX dither effect. Dither is only needed when the bit
+// depth is reduced, which --downsample-only never does.
+func (p ConversionPolicy) ditherArgs() []string {
+	if p.DownsampleOnly {
+		return nil
+	}
+	return []string{"dither"}
+}
+
+// determineConversion returns whether SoX has to change a lossless source
+// and the SoX arguments doing it, following a policy
+func determineConversion(policy ConversionPolicy, info *AudioInfo) (bool, []string, []string) {
+	return policy.targets(info).soxArgs()
+}
+
+// familyRateAtMost returns the highest rate of the source rate's family
+// (multiples of 44.1 kHz or of 48 kHz) that does not exceed limit
+func familyRateAtMost(sourceRate, limit int) int {
+	rate := 48000
+	if sourceRate%11025 == 0 {
+		rate = 44100
+	}
+	for rate*2 <= limit {
+		rate *= 2
+	}
+	for rate > limit && rate%2 == 0 {
+		rate /= 2
+	}
+	return rate
+}
+
+func processFlac(t *fileTask, sourcePath, targetPath string, needsConversion bool, bitrateArgs, sampleRateArgs []string) error {
+	if !needsConversion {
+		return copyFile(t, sourcePath, targetPath)
+	}
+
+	// Create temporary path for SoX output with proper extension
+	tempPath := tempPathFor(t, targetPath)
+	control.trackTemp(tempPath)
+	defer control.releaseTemp(tempPath)
+
+	// Run SoX conversion to tempPath or targetPath
+	var cmd *exec.Cmd
+
+	if config.UseDocker {
+		dockerSource := getDockerPath(sourcePath)
+		dockerTemp := getDockerTargetPath(tempPath)
+
+		args := []string{"run", "--rm",
+			"-v", fmt.Sprintf("%s:/source", sourceRoot()),
+			"-v", fmt.Sprintf("%s:/target", config.TargetDir),
+			config.DockerImage, "--multi-threaded", "-G", dockerSource}
+
+		args = append(args, bitrateArgs...)
+		args = append(args, dockerTemp)
+		args = append(args, sampleRateArgs...)
+		args = append(args, t.policy.ditherArgs()...)
+
+		cmd = t.command("docker", args...)
+	} else {
+		args := []string{"--multi-threaded", "-G", sourcePath}
+		args = append(args, bitrateArgs...)
+		args = append(args, tempPath)
+		args = append(args, sampleRateArgs...)
+		args = append(args, t.policy.ditherArgs()...)
+
+		cmd = t.command(config.SoxCommand, args...)
+	}
+
+	if err := cmd.Run(); err != nil {
+		defer os.Remove(tempPath) // Clean up temp on error
+		return fmt.Errorf("SoX conversion failed: %w", err)
+	}
+	if err := checkSoxOutput(tempPath, bitrateArgs, sampleRateArgs); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+
+	if !config.NoPreserveMetadata && !config.AlwaysMerge && !rewritingTags() && coverArtFor(t, sourcePath) == "" && soxPreservedMetadata(t, sourcePath, tempPath) {
+		t.logf("Metadata already preserved by SoX, skipping FFmpeg merge: %s\n", targetPath)
+		if err := moveIntoPlace(tempPath, targetPath); err != nil {
+			return fmt.Errorf("failed to move converted file into place: %w", err)
+		}
+		return nil
+	}
+
+	if !config.NoPreserveMetadata {
+		// Merge metadata using FFmpeg
+		if mergeErr := mergeMetadataWithFFmpeg(t, sourcePath, tempPath, targetPath); mergeErr != nil {
+			t.logf("Warning: Metadata preservation failed for %s, keeping converted audio without tags: %v\n", targetPath, mergeErr)
+			// Fallback: rename temp to target
+			if renameErr := moveIntoPlace(tempPath, targetPath); renameErr != nil {
+				return fmt.Errorf("fallback rename failed after metadata merge error: %w", renameErr)
+			}
+			return nil
+		}
+		// If merge succeeded, temp is already removed in merge function
+	} else if err := moveIntoPlace(tempPath, targetPath); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// essentialTags are the tags that must survive the SoX conversion for the
+// FFmpeg metadata merge to be skipped
+var essentialTags = []string{"title", "artist", "album", "album_artist", "track", "disc", "date", "genre"}
+
+// soxPreservedMetadata reports whether the file SoX produced already carries
+// the source's essential tags and cover art, in which case the FFmpeg merge
+// can be skipped. Any probe failure falls back to merging.
+func soxPreservedMetadata(t *fileTask, sourcePath, convertedPath string) bool {
+	sourceProbe, err := probeFile(t, sourcePath)
+	if err != nil {
+		return false
+	}
+	convertedProbe, err := probeFile(t, convertedPath)
+	forgetProbe(convertedPath)
+	if err != nil {
+		return false
+	}
+	return metadataPreserved(sourceProbe, convertedProbe)
+}
+
+// metadataPreserved compares the essential tags and the presence of an
+// attached picture between the source and the converted probe results.
+func metadataPreserved(source, converted *ProbeResult) bool {
+	sourceTags := probeTags(source)
+	convertedTags := probeTags(converted)
+	for _, tag := range essentialTags {
+		value, ok := sourceTags[tag]
+		if !ok {
+			continue
+		}
+		if convertedTags[tag] != value {
+			return false
+		}
+	}
+	return !probeHasPicture(source) || probeHasPicture(converted)
+}
+
+// probeTags returns the container and audio stream tags with lowercased keys.
+// Vorbis comment names are normalized to their FFmpeg equivalents.
+func probeTags(probe *ProbeResult) map[string]string {
+	aliases := map[string]string{"tracknumber": "track", "discnumber": "disc", "albumartist": "album_artist"}
+	tags := make(map[string]string)
+	add := func(source map[string]string) {
+		for key, value := range source {
+			key = strings.ToLower(key)
+			if alias, ok := aliases[key]; ok {
+				key = alias
+			}
+			if _, exists := tags[key]; !exists {
+				tags[key] = value
+			}
+		}
+	}
+	add(probe.Format.Tags)
+	for _, stream := range probe.Streams {
+		if stream.CodecType == "audio" {
+			add(stream.Tags)
+		}
+	}
+	return tags
+}
+
+// probeHasPicture reports whether the probed file has embedded cover art
+func probeHasPicture(probe *ProbeResult) bool {
+	for _, stream := range probe.Streams {
+		if stream.Disposition["attached_pic"] == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// folderArtNames are the cover image names looked up next to source files,
+// in order of preference
+var folderArtNames = []string{"cover.jpg", "folder.jpg", "front.jpg", "cover.png", "folder.png", "front.png"}
+
+// findFolderArt returns the cover image in dir, or an empty string
+func findFolderArt(dir string) string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return ""
+	}
+	for _, name := range folderArtNames {
+		for _, entry := range entries {
+			if !entry.IsDir() && strings.EqualFold(entry.Name(), name) {
+				return filepath.Join(dir, entry.Name())
+			}
+		}
+	}
+	return ""
+}
+
+// probePictureArea returns the pixel count of the first video stream, which
+// is the attached picture for audio files and the image itself for image
+// files. Zero means no picture or unknown dimensions.
+func probePictureArea(probe *ProbeResult) int {
+	for _, stream := range probe.Streams {
+		if stream.CodecType == "video" {
+			return stream.Width * stream.Height
+		}
+	}
+	return 0
+}
+
+// preferFolderArt decides between embedded art and a folder image for the
+// given --art-source. Areas are in pixels; embeddedArea is 0 when the source
+// has no embedded picture. Ties in largest mode keep the embedded art.
+func preferFolderArt(artSource string, embeddedArea, folderArea int) bool {
+	if embeddedArea == 0 {
+		// Without embedded art only --art-source folder adds the folder image
+		return artSource == "folder"
+	}
+	switch artSource {
+	case "folder":
+		return true
+	case "largest":
+		return folderArea > embeddedArea
+	default:
+		return false
+	}
+}
+
+// coverArtFor returns the folder image to embed instead of the source's own
+// art, or an empty string to keep the embedded art
+func coverArtFor(t *fileTask, sourcePath string) string {
+	if config.ArtSource != "folder" && config.ArtSource != "largest" {
+		return ""
+	}
+	folderArt := findFolderArt(filepath.Dir(sourcePath))
+	if folderArt == "" {
+		return ""
+	}
+	embeddedArea := 0
+	if probe, err := probeFile(t, sourcePath); err == nil && probeHasPicture(probe) {
+		// Embedded art of unknown size still counts as present
+		embeddedArea = max(probePictureArea(probe), 1)
+	}
+	folderArea := 0
+	if config.ArtSource == "largest" && embeddedArea > 0 {
+		probe, err := probeFile(t, folderArt)
+		forgetProbe(folderArt)
+		if err != nil {
+			t.logf("Warning: Failed to probe %s, keeping embedded art: %v\n", folderArt, err)
+			return ""
+		}
+		folderArea = probePictureArea(probe)
+	}
+	if preferFolderArt(config.ArtSource, embeddedArea, folderArea) {
+		return folderArt
+	}
+	return ""
+}
+
+// sourceRoot returns the directory source relative paths are computed
+// against: --source-root when given, the source directory otherwise
+func sourceRoot() string {
+	if config.SourceRoot != "" {
+		return config.SourceRoot
+	}
+	return config.SourceDir
+}
+
+func getDockerPath(hostPath string) string {
+	relPath := normalizeForDocker(sourceRoot(), hostPath)
+	return "/source/" + relPath
+}
+
+func getDockerTargetPath(hostPath string) string {
+	relPath := normalizeForDocker(config.TargetDir, hostPath)
+	return "/target/" + relPath
+}
+
+// getDockerMountedPath maps a host path to the container, using the target
+// mount for paths inside the target directory and the source mount otherwise.
+func getDockerMountedPath(hostPath string) string {
+	if rel, err := filepath.Rel(config.TargetDir, hostPath); err == nil && !strings.HasPrefix(rel, "..") {
+		return getDockerTargetPath(hostPath)
+	}
+	return getDockerPath(hostPath)
+}
+
+func normalizeForDocker(base, path string) string {
+	// Convert backslashes to forward slashes first
+	base = strings.ReplaceAll(base, "\\", "/")
+	path = strings.ReplaceAll(path, "\\", "/")
+
+	// Try to use filepath.VolumeName
+	volBase := filepath.VolumeName(base)
+	baseStripped := base
+	if volBase != "" {
+		baseStripped = base[len(volBase):]
+	} else {
+		// Manual check for Windows drive letter (e.g., C:/ or c:/)
+		if len(base) >= 3 && base[1] == ':' && base[2] == '/' {
+			baseStripped = base[3:]
+		}
+	}
+
+	volPath := filepath.VolumeName(path)
+	pathStripped := path
+	if volPath != "" {
+		pathStripped = path[len(volPath):]
+	} else {
+		if len(path) >= 3 && path[1] == ':' && path[2] == '/' {
+			pathStripped = path[3:]
+		}
+	}
+
+	rel, err := filepath.Rel(baseStripped, pathStripped)
+	if err != nil {
+		return filepath.ToSlash(pathStripped)
+	}
+	return filepath.ToSlash(rel)
+}
+func mergeMetadataWithFFmpeg(t *fileTask, sourcePath, tempConvertedPath, targetPath string) error {
+	if config.NoPreserveMetadata {
+		// If not preserving metadata, just rename temp to target
+		return moveIntoPlace(tempConvertedPath, targetPath)
+	}
+
+	// The merged output is incomplete until FFmpeg exits, so it is written
+	// under a partial name and renamed
+	mergedPath := partialPath(targetPath)
+	os.Remove(mergedPath)
+	control.trackTemp(mergedPath)
+	defer control.releaseTemp(mergedPath)
+
+	var cmd *exec.Cmd
+	folderArt := ""
+	streamMaps := []string{"-map", "1", "-map_metadata", "0"}
+	// Ogg has no attached picture streams, so Vorbis and Opus output gets the
+	// tags only
+	if ext := strings.ToLower(filepath.Ext(targetPath)); ext != ".ogg" && ext != ".opus" {
+		folderArt = coverArtFor(t, sourcePath)
+		streamMaps = coverArtMaps(folderArt)
+	}
+
+	if config.UseDocker {
+		dockerSource := getDockerPath(sourcePath)
+		dockerTemp := getDockerTargetPath(tempConvertedPath)
+		dockerTarget := getDockerTargetPath(mergedPath)
+
+		args := []string{"run", "--rm", "--entrypoint", "ffmpeg",
+			"-v", fmt.Sprintf("%s:/source", sourceRoot()),
+			"-v", fmt.Sprintf("%s:/target", config.TargetDir),
+			config.DockerImage,
+			"-i", dockerSource,
+			"-i", dockerTemp}
+		if folderArt != "" {
+			args = append(args, "-i", getDockerPath(folderArt))
+		}
+		args = append(args, streamMaps...)
+		args = append(args, metadataOverrides(t, sourcePath)...)
+		args = append(args,
+			"-c", "copy", // Copy streams without re-encoding
+			dockerTarget)
+
+		cmd = t.command("docker", args...)
+	} else {
+		// Local FFmpeg
+		args := []string{
+			"-i", sourcePath,
+			"-i", tempConvertedPath}
+		if folderArt != "" {
+			args = append(args, "-i", folderArt)
+		}
+		args = append(args, streamMaps...)
+		args = append(args, metadataOverrides(t, sourcePath)...)
+		args = append(args,
+			"-c", "copy", // Copy streams without re-encoding
+			mergedPath)
+
+		cmd = t.command("ffmpeg", args...)
+	}
+
+	if err := cmd.Run(); err != nil {
+		os.Remove(mergedPath)
+		return fmt.Errorf("FFmpeg metadata merge failed: %w", err)
+	}
+	if err := os.Rename(mergedPath, targetPath); err != nil {
+		os.Remove(mergedPath)
+		return err
+	}
+
+	// Remove temp file after successful merge
+	if err := os.Remove(tempConvertedPath); err != nil {
+		t.logf("Warning: Failed to remove temp file %s: %v\n", tempConvertedPath, err)
+	}
+
+	return nil
+}
+
+// coverArtMaps returns the stream and metadata mapping of the merge. The
+// cover art comes from the source (input 0) unless a folder image was added
+// as input 2.
+func coverArtMaps(folderArt string) []string {
+	args := []string{"-map", "1"} // Map audio stream from the converted file (input 1)
+	if folderArt != "" {
+		args = append(args, "-map", "2:v", "-disposition:v", "attached_pic")
+	} else {
+		args = append(args, "-map", "0:v?") // Map video streams (cover art) from source file (input 0), ? makes it optional
+	}
+	return append(args, "-map_metadata", "0") // Map metadata from source file (input 0)
+}
+
+// tagRule replaces every occurrence of find in output tag values
+type tagRule struct {
+	find    string
+	replace string
+}
+
+// tagRules holds the rules loaded from --tag-rules
+var tagRules []tagRule
+
+// loadTagRules reads a CSV file of find,replace pairs. Lines starting with #
+// are comments. Values are used verbatim, so quote them to keep spaces.
+func loadTagRules(path string) ([]tagRule, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open tag rules: %w", err)
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = 2
+
+	var rules []tagRule
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid tag rules: %w", err)
+		}
+		if record[0] == "" {
+			line, _ := reader.FieldPos(0)
+			return nil, fmt.Errorf("invalid tag rules: empty find value on line %d", line)
+		}
+		rules = append(rules, tagRule{find: record[0], replace: record[1]})
+	}
+	return rules, nil
+}
+
+// rewritingTags reports whether output tags are rewritten during the merge
+func rewritingTags() bool {
+	return config.NormalizeTags || len(tagRules) > 0 || len(dropTagPatterns()) > 0
+}
+
+// defaultDropTags are ripper and encoder breadcrumbs removed by
+// --drop-tags @default
+var defaultDropTags = []string{
+	"encoder", "encoded_by", "encoder_settings", "encoding", "comment", "description",
+	"cddb*", "discid", "itun*", "accuraterip*", "ctdb*", "ripping tool", "rip date", "log",
+}
+
+// dropTagPatterns returns the lower-cased --drop-tags glob patterns with
+// @default expanded
+func dropTagPatterns() []string {
+	var patterns []string
+	for _, pattern := range strings.Split(config.DropTags, ",") {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		switch pattern {
+		case "":
+		case "@default":
+			patterns = append(patterns, defaultDropTags...)
+		default:
+			patterns = append(patterns, pattern)
+		}
+	}
+	return patterns
+}
+
+// validateDropTags checks that every --drop-tags pattern is a valid glob
+func validateDropTags() error {
+	for _, pattern := range dropTagPatterns() {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid drop-tags pattern: %s", pattern)
+		}
+	}
+	return nil
+}
+
+// tagDropped reports whether a tag matches one of the --drop-tags patterns.
+// Tag names are compared case-insensitively.
+func tagDropped(key string) bool {
+	key = strings.ToLower(key)
+	for _, pattern := range dropTagPatterns() {
+		if matched, _ := filepath.Match(pattern, key); matched {
+			return true
+		}
+	}
+	return false
+}
+
+var repeatedSpaces = regexp.MustCompile(`[ \t]{2,}`)
+
+// normalizeTagValue cleans up a single tag value: NFC normalization, trimmed
+// and collapsed whitespace, the --tag-rules replacements and title-casing for
+// the --title-case-tags fields. Line breaks, e.g. in lyrics, are kept.
+func normalizeTagValue(key, value string) string {
+	if config.NormalizeTags {
+		value = norm.NFC.String(value)
+		value = strings.TrimSpace(repeatedSpaces.ReplaceAllString(value, " "))
+	}
+	for _, rule := range tagRules {
+		value = strings.ReplaceAll(value, rule.find, rule.replace)
+	}
+	if config.NormalizeTags && slices.Contains(titleCaseFields(), strings.ToLower(key)) {
+		value = titleCase(value)
+	}
+	return value
+}
+
+func titleCaseFields() []string {
+	var fields []string
+	for _, field := range strings.Split(config.TitleCaseTags, ",") {
+		if field = strings.ToLower(strings.TrimSpace(field)); field != "" {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+// titleCase upper-cases the first letter of every word and lower-cases the rest
+func titleCase(value string) string {
+	words := strings.Split(value, " ")
+	for i, word := range words {
+		runes := []rune(strings.ToLower(word))
+		if len(runes) > 0 {
+			runes[0] = unicode.ToUpper(runes[0])
+		}
+		words[i] = string(runes)
+	}
+	return strings.Join(words, " ")
+}
+
+// metadataOverrides returns FFmpeg -metadata arguments for the source tags
+// that are dropped or change when normalized. They take precedence over
+// -map_metadata, so only the output is affected.
+func metadataOverrides(t *fileTask, sourcePath string) []string {
+	if !rewritingTags() {
+		return nil
+	}
+	probe, err := probeFile(t, sourcePath)
+	if err != nil {
+		t.logf("Warning: Could not read tags of %s, leaving them as they are: %v\n", sourcePath, err)
+		return nil
+	}
+
+	var args []string
+	if tagDropped("encoder") {
+		// Keep FFmpeg from writing its own encoder tag
+		args = append(args, "-fflags", "+bitexact")
+	}
+	for _, key := range slices.Sorted(maps.Keys(probe.Format.Tags)) {
+		value := probe.Format.Tags[key]
+		if tagDropped(key) {
+			// An empty value removes the tag
+			args = append(args, "-metadata", key+"=")
+		} else if normalized := normalizeTagValue(key, value); normalized != value {
+			args = append(args, "-metadata", key+"="+normalized)
+		}
+	}
+	return args
+}
+
+func copyImageFiles(format string) error {
+	console.setStage("images")
+	defer console.setStage("")
+	logf("Copying image files...\n")
+
+	return filepath.Walk(config.SourceDir, func(path string, info os.FileInfo, err error) error {
+		if isHidden(config.SourceDir, path) {
+			return skipEntry(info)
+		}
+		if err != nil {
+			return handleAccessError(path, err)
+		}
+
+		if info.IsDir() {
+			return nil
+		}
+
+		ext := strings.ToLower(filepath.Ext(path))
+		if !isImageExtension(ext) {
+			return nil
+		}
+
+		// Create target directory structure
+		relPath, err := filepath.Rel(sourceRoot(), path)
+		if err != nil {
+			return err
+		}
+
+		targetPath := targetPathFor(format, relPath)
+		targetDir := filepath.Dir(targetPath)
+
+		if err := os.MkdirAll(targetDir, 0755); err != nil {
+			return fmt.Errorf("failed to create target directory: %w", err)
+		}
+
+		if err := copyFile(nil, path, targetPath); err != nil {
+			return handleAccessError(path, err)
+		}
+		recordProduced(targetPath)
+		return nil
+	})
+}
+
+// isPlaylistExtension reports whether ext is a playlist extension
+func isPlaylistExtension(ext string) bool {
+	return ext == ".m3u" || ext == ".m3u8"
+}
+
+// copyPlaylists copies the source playlists to the target of an output
+// format, rewriting every entry that names an audio file under the source to
+// the file produced for it
+func copyPlaylists(format string) error {
+	console.setStage("playlists")
+	defer console.setStage("")
+	logf("Copying playlists...\n")
+
+	return filepath.Walk(config.SourceDir, func(path string, info os.FileInfo, err error) error {
+		if isHidden(config.SourceDir, path) {
+			return skipEntry(info)
+		}
+		if err != nil {
+			return handleAccessError(path, err)
+		}
+		if info.IsDir() || !isPlaylistExtension(strings.ToLower(filepath.Ext(path))) {
+			return nil
+		}
+
+		relPath, err := filepath.Rel(sourceRoot(), path)
+		if err != nil {
+			return err
+		}
+		targetPath := targetPathFor(format, relPath)
+		if err := os.MkdirAll(filepath.Dir(targetPath), 0755); err != nil {
+			return fmt.Errorf("failed to create target directory: %w", err)
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return handleAccessError(path, err)
+		}
+		rewritten := rewritePlaylist(format, string(data), filepath.Dir(path), filepath.Dir(targetPath))
+		if err := os.WriteFile(targetPath, []byte(rewritten), 0644); err != nil {
+			return fmt.Errorf("failed to write playlist %s: %w", targetPath, err)
+		}
+		recordProduced(targetPath)
+		logf("Copied playlist: %s\n", targetPath)
+		return nil
+	})
+}
+
+// rewritePlaylist rewrites the entries of an M3U playlist read from
+// sourceDir for a copy in an output format written to targetDir. Comments,
+// URLs and entries outside the source are kept as they are. Absolute entries
+// stay absolute, relative ones are made relative to targetDir.
+func rewritePlaylist(format, content, sourceDir, targetDir string) string {
+	lines := strings.SplitAfter(content, "\n")
+	for i, line := range lines {
+		entry := strings.TrimRight(line, "\r\n")
+		ending := line[len(entry):]
+		if entry == "" || strings.HasPrefix(entry, "#") || strings.Contains(entry, "://") {
+			continue
+		}
+		// Playlists written on Windows use backslashes
+		entryPath := filepath.FromSlash(strings.ReplaceAll(entry, `\`, "/"))
+		sourcePath := entryPath
+		if !filepath.IsAbs(sourcePath) {
+			sourcePath = filepath.Join(sourceDir, sourcePath)
+		}
+		output := playlistTarget(format, sourcePath)
+		if output == "" {
+			continue
+		}
+		var err error
+		if filepath.IsAbs(entryPath) {
+			entry, err = filepath.Abs(output)
+		} else {
+			entry, err = filepath.Rel(targetDir, output)
+			entry = filepath.ToSlash(entry)
+		}
+		if err != nil {
+			continue
+		}
+		lines[i] = entry + ending
+	}
+	return strings.Join(lines, "")
+}
+
+// playlistTarget returns the target file in an output format for an audio
+// source named in a playlist, or "" when it is not an audio file under the
+// source. A file the run produced is preferred; for a skipped or failed file
+// the path it would have been written to is used.
+func playlistTarget(format, sourcePath string) string {
+	ext := strings.ToLower(filepath.Ext(sourcePath))
+	if !isAudioExtension(ext) {
+		return ""
+	}
+	relPath, err := filepath.Rel(sourceRoot(), filepath.Clean(sourcePath))
+	if err != nil || relPath == ".." || strings.HasPrefix(relPath, ".."+string(filepath.Separator)) {
+		return ""
+	}
+	for _, candidate := range targetCandidates(format, relPath) {
+		if _, err := os.Stat(candidate); err == nil {
+			return candidate
+		}
+	}
+	return plannedTargetPath(format, relPath, ext)
+}
 
-			cmd = exec.Command("docker", args...)
-		} else {
-			// Check if ffmpeg is available
-			if _, err := exec.LookPath("ffmpeg"); err != nil {
-				return fmt.Errorf("ffmpeg is not installed. Please install FFmpeg for ALAC support or use --use-docker option")
-			}
-			cmd = exec.Command("ffmpeg", "-i", sourcePath, "-c:a", "flac", tempPath)
+// producedFiles collects the target files written by the current run, the
+// only files the --dedupe-art and --fix-permissions passes may change
+var producedFiles = struct {
+	sync.Mutex
+	paths map[string]bool
+}{paths: make(map[string]bool)}
+
+func recordProduced(path string) {
+	producedFiles.Lock()
+	defer producedFiles.Unlock()
+	producedFiles.paths[path] = true
+}
+
+func resetProducedFiles() {
+	producedFiles.Lock()
+	defer producedFiles.Unlock()
+	producedFiles.paths = make(map[string]bool)
+}
+
+// directoryBarrier tracks the audio files of each source directory that have
+// not finished or failed yet. Files are processed in --order, not directory
+// by directory, and an interrupted run leaves some unprocessed, so passes
+// over a whole directory check directoryComplete first.
+var directoryBarrier = struct {
+	sync.Mutex
+	pending map[string]int      // Source directory → files still to finish
+	targets map[string][]string // Source directory → target directories of its finished files
+}{pending: make(map[string]int), targets: make(map[string][]string)}
+
+// expectDirectories counts the files each source directory waits for
+func expectDirectories(work []audioWork) {
+	directoryBarrier.Lock()
+	defer directoryBarrier.Unlock()
+	for _, item := range work {
+		directoryBarrier.pending[filepath.Dir(item.path)]++
+	}
+}
+
+// finishInDirectory marks a source file finished or failed, with the outputs
+// it produced
+func finishInDirectory(path string, outputs []string) {
+	dir := filepath.Dir(path)
+	directoryBarrier.Lock()
+	defer directoryBarrier.Unlock()
+	directoryBarrier.pending[dir]--
+	for _, output := range outputs {
+		if targetDir := filepath.Dir(output); !slices.Contains(directoryBarrier.targets[dir], targetDir) {
+			directoryBarrier.targets[dir] = append(directoryBarrier.targets[dir], targetDir)
 		}
+	}
+}
 
-		if err := cmd.Run(); err != nil {
-			return fmt.Errorf("FFmpeg ALAC to FLAC conversion failed: %w", err)
+// directoryComplete reports whether every source directory with files in a
+// target directory has finished all of its files
+func directoryComplete(targetDir string) bool {
+	directoryBarrier.Lock()
+	defer directoryBarrier.Unlock()
+	for dir, targets := range directoryBarrier.targets {
+		if directoryBarrier.pending[dir] > 0 && slices.Contains(targets, targetDir) {
+			return false
 		}
 	}
+	return true
+}
 
-	if !config.NoPreserveMetadata {
-		// Merge metadata using FFmpeg
-		if mergeErr := mergeMetadataWithFFmpeg(sourcePath, tempPath, targetPath); mergeErr != nil {
-			fmt.Printf("Warning: Metadata preservation failed for %s, keeping converted audio without tags: %v\n", targetPath, mergeErr)
-			// Fallback: rename temp to target
-			if renameErr := os.Rename(tempPath, targetPath); renameErr != nil {
-				return fmt.Errorf("fallback rename failed after metadata merge error: %w", renameErr)
+func resetDirectoryBarrier() {
+	directoryBarrier.Lock()
+	defer directoryBarrier.Unlock()
+	clear(directoryBarrier.pending)
+	clear(directoryBarrier.targets)
+}
+
+// readableMode adds read permission for everyone to a mode, and for
+// directories search permission too
+func readableMode(mode os.FileMode) os.FileMode {
+	if mode.IsDir() {
+		return mode | 0755
+	}
+	return mode | 0644
+}
+
+// fixPermissions makes the produced files and the directories up to the
+// target root readable for --fix-permissions. Modes are only widened, never
+// narrowed. Failures are warnings.
+func fixPermissions() {
+	fixed := make(map[string]bool)
+	fix := func(path string) {
+		if fixed[path] {
+			return
+		}
+		fixed[path] = true
+		info, err := os.Stat(path)
+		if err != nil {
+			return
+		}
+		if mode := readableMode(info.Mode()); mode != info.Mode() {
+			if err := os.Chmod(path, mode.Perm()); err != nil {
+				logf("Warning: Failed to make %s readable: %v\n", path, err)
 			}
-			return nil
 		}
-		// If merge succeeded, temp is already removed in merge function
-	} else {
-		// If not preserving metadata, tempPath == targetPath, no action needed
 	}
-
-	return nil
+	for dir, paths := range producedByDir() {
+		for _, path := range paths {
+			fix(path)
+		}
+		for isWithin(config.TargetDir, dir) && !fixed[dir] {
+			fix(dir)
+			dir = filepath.Dir(dir)
+		}
+	}
 }
 
-func parseAudioInfo(info string) (*AudioInfo, error) {
-	audioInfo := &AudioInfo{}
-	scanner := bufio.NewScanner(strings.NewReader(info))
+// producedByDir groups the produced files by directory, sorted
+func producedByDir() map[string][]string {
+	producedFiles.Lock()
+	defer producedFiles.Unlock()
+	dirs := make(map[string][]string)
+	for path := range producedFiles.paths {
+		dir := filepath.Dir(path)
+		dirs[dir] = append(dirs[dir], path)
+	}
+	for _, paths := range dirs {
+		slices.Sort(paths)
+	}
+	return dirs
+}
 
-	bitsRegex := regexp.MustCompile(`Sample Encoding.*?(\d+)-bit`)
-	rateRegex := regexp.MustCompile(`Sample Rate\s*:\s*(\d+)`)
+// embeddedArtDigest hashes the embedded picture of an audio file
+var embeddedArtDigest = ffmpegArtDigest
+
+// dedupeArt stores album art once per target directory. It only acts on
+// directories whose produced tracks all embed the same picture, and only
+// changes files this run produced: with --dedupe-art folder the picture is
+// written to a folder image and stripped from the tracks, with embedded the
+// produced images identical to it are removed. Directories whose source
+// files did not all finish are left alone. Failures are warnings; the
+// tracks are complete either way.
+func dedupeArt() {
+	defer control.removeWorkerScratch(dispatchWorker)
+	dirs := producedByDir()
+	for _, dir := range slices.Sorted(maps.Keys(dirs)) {
+		if !directoryComplete(dir) {
+			logf("Skipping art deduplication in %s, not all of its tracks finished\n", dir)
+			continue
+		}
+		var tracks, images []string
+		for _, path := range dirs[dir] {
+			ext := strings.ToLower(filepath.Ext(path))
+			if isAudioExtension(ext) {
+				tracks = append(tracks, path)
+			} else if isImageExtension(ext) {
+				images = append(images, path)
+			}
+		}
+		if len(tracks) == 0 {
+			continue
+		}
 
-	for scanner.Scan() {
-		line := scanner.Text()
+		digest, codec, ok := sharedEmbeddedArt(tracks)
+		if !ok {
+			continue
+		}
 
-		if matches := bitsRegex.FindStringSubmatch(line); len(matches) > 1 {
-			if bits, err := strconv.Atoi(matches[1]); err == nil {
-				audioInfo.Bits = bits
+		if config.DedupeArt == "embedded" {
+			for _, image := range images {
+				if fileMD5(image) == digest {
+					if err := os.Remove(image); err != nil {
+						logf("Warning: Failed to remove duplicate art %s: %v\n", image, err)
+						continue
+					}
+					logf("Removed %s, the tracks embed the same picture\n", image)
+				}
 			}
+			continue
 		}
 
-		if matches := rateRegex.FindStringSubmatch(line); len(matches) > 1 {
-			if rate, err := strconv.Atoi(matches[1]); err == nil {
-				audioInfo.Rate = rate
+		folderArt := findFolderArt(dir)
+		if folderArt != "" && fileMD5(folderArt) != digest {
+			logf("Warning: %s differs from the embedded art, keeping the embedded art in %s\n", folderArt, dir)
+			continue
+		}
+		if folderArt == "" {
+			name := "folder.jpg"
+			if codec == "png" {
+				name = "folder.png"
+			}
+			folderArt = filepath.Join(dir, name)
+			if err := extractEmbeddedArt(tracks[0], folderArt); err != nil {
+				logf("Warning: Failed to write %s: %v\n", folderArt, err)
+				continue
 			}
+			recordProduced(folderArt)
 		}
+		for _, track := range tracks {
+			if err := stripEmbeddedArt(track); err != nil {
+				logf("Warning: Failed to strip embedded art from %s: %v\n", track, err)
+			}
+		}
+		logf("Stored the album art of %d track(s) once as %s\n", len(tracks), folderArt)
 	}
-
-	return audioInfo, nil
 }
 
-func determineConversion(info *AudioInfo) (bool, []string, []string) {
-	needsConversion := false
-	var bitrateArgs []string
-	sampleRateArgs := []string{"rate", "-v", "-L"}
-
-	// Check bit depth
-	if info.Bits > 16 {
-		needsConversion = true
-		bitrateArgs = []string{"-b", "16"}
+// sharedEmbeddedArt returns the digest and codec of the picture embedded in
+// all tracks, or false when a track has none or they differ
+func sharedEmbeddedArt(tracks []string) (string, string, bool) {
+	var digest, codec string
+	for _, track := range tracks {
+		probe, err := probeFile(nil, track)
+		forgetProbe(track)
+		if err != nil || !probeHasPicture(probe) {
+			return "", "", false
+		}
+		trackDigest, err := embeddedArtDigest(track)
+		if err != nil {
+			logf("Warning: Failed to hash the embedded art of %s: %v\n", track, err)
+			return "", "", false
+		}
+		if digest != "" && trackDigest != digest {
+			return "", "", false
+		}
+		digest = trackDigest
+		for _, stream := range probe.Streams {
+			if stream.Disposition["attached_pic"] == 1 {
+				codec = stream.CodecName
+			}
+		}
 	}
+	return digest, codec, true
+}
 
-	// Check sample rate
-	switch info.Rate {
-	case 96000, 192000, 384000:
-		needsConversion = true
-		sampleRateArgs = append(sampleRateArgs, "48000")
-	case 88200, 176400, 352800:
-		needsConversion = true
-		sampleRateArgs = append(sampleRateArgs, "44100")
+// fileMD5 returns the hex MD5 of a file, matching FFmpeg's md5 muxer output
+// for a picture stream copied out of a track, or "" when it cannot be read
+func fileMD5(path string) string {
+	file, err := os.Open(path)
+	if err != nil {
+		return ""
 	}
-
-	return needsConversion, bitrateArgs, sampleRateArgs
+	defer file.Close()
+	hasher := md5.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(hasher.Sum(nil))
 }
 
-func processFlac(sourcePath, targetPath string, needsConversion bool, bitrateArgs, sampleRateArgs []string) error {
-	if !needsConversion {
-		return copyFile(sourcePath, targetPath)
+// ffmpegCommand runs FFmpeg on files under the source or target directory,
+// locally or in the Docker image
+func ffmpegCommand(t *fileTask, args ...string) *exec.Cmd {
+	if !config.UseDocker {
+		return t.command("ffmpeg", args...)
 	}
-
-	var tempPath string
-
-	if !config.NoPreserveMetadata {
-		// Create temporary path for SoX output with proper extension
-		ext := filepath.Ext(targetPath)
-		tempPath = strings.TrimSuffix(targetPath, ext) + ".tmp" + ext
-	} else {
-		tempPath = targetPath
+	dockerArgs := []string{"run", "--rm", "--entrypoint", "ffmpeg",
+		"-v", fmt.Sprintf("%s:/source", sourceRoot()),
+		"-v", fmt.Sprintf("%s:/target", config.TargetDir),
+		config.DockerImage}
+	for _, arg := range args {
+		if filepath.IsAbs(arg) {
+			arg = getDockerMountedPath(arg)
+		}
+		dockerArgs = append(dockerArgs, arg)
 	}
+	return t.command("docker", dockerArgs...)
+}
 
-	// Run SoX conversion to tempPath or targetPath
-	var cmd *exec.Cmd
-
-	if config.UseDocker {
-		dockerSource := getDockerPath(sourcePath)
-		dockerTemp := getDockerTargetPath(tempPath)
+// ffmpegArtDigest returns FFmpeg's MD5 of the first embedded picture, which
+// is the hash of the picture file as stored
+func ffmpegArtDigest(path string) (string, error) {
+	output, err := commandOutput(ffmpegCommand(nil, "-v", "error", "-i", path, "-map", "0:v:0", "-c", "copy", "-f", "md5", "-"))
+	if err != nil {
+		return "", err
+	}
+	digest, ok := strings.CutPrefix(strings.TrimSpace(string(output)), "MD5=")
+	if !ok {
+		return "", fmt.Errorf("unexpected ffmpeg md5 output: %q", strings.TrimSpace(string(output)))
+	}
+	return digest, nil
+}
 
-		args := []string{"run", "--rm",
-			"-v", fmt.Sprintf("%s:/source", config.SourceDir),
-			"-v", fmt.Sprintf("%s:/target", config.TargetDir),
-			config.DockerImage, "--multi-threaded", "-G", dockerSource}
+// extractEmbeddedArt writes the first embedded picture of a track to imagePath
+func extractEmbeddedArt(trackPath, imagePath string) error {
+	return ffmpegCommand(nil, "-v", "error", "-y", "-i", trackPath, "-map", "0:v:0", "-c", "copy", "-frames:v", "1", "-update", "1", imagePath).Run()
+}
 
-		args = append(args, bitrateArgs...)
-		args = append(args, dockerTemp)
-		args = append(args, sampleRateArgs...)
-		args = append(args, "dither")
+// stripEmbeddedArt rewrites a track without its pictures, keeping the audio
+// and tags as they are
+func stripEmbeddedArt(trackPath string) error {
+	tempPath := tempPathFor(nil, trackPath)
+	if err := ffmpegCommand(nil, "-v", "error", "-y", "-i", trackPath, "-map", "0:a", "-map_metadata", "0", "-c", "copy", tempPath).Run(); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	return moveIntoPlace(tempPath, trackPath)
+}
 
-		cmd = exec.Command("docker", args...)
-	} else {
-		args := []string{"--multi-threaded", "-G", sourcePath}
-		args = append(args, bitrateArgs...)
-		args = append(args, tempPath)
-		args = append(args, sampleRateArgs...)
-		args = append(args, "dither")
+// errPostcheck is returned when SoX output does not have the bit depth or
+// sample rate it was asked for
+var errPostcheck = errors.New("SoX output does not match the conversion targets")
 
-		cmd = exec.Command(config.SoxCommand, args...)
+// checkSoxOutput reads the STREAMINFO of a FLAC file SoX wrote and compares
+// it with the bit depth, channel count and sample rate requested by
+// bitrateArgs and sampleRateArgs, unless --no-postcheck is set. SoX can silently ignore -b
+// when the output handler does not support it.
+func checkSoxOutput(path string, bitrateArgs, sampleRateArgs []string) error {
+	if config.NoPostcheck {
+		return nil
 	}
-
-	if err := cmd.Run(); err != nil {
-		if !config.NoPreserveMetadata && tempPath != "" {
-			defer os.Remove(tempPath) // Clean up temp on error
+	info, err := readFLACStreamInfo(path)
+	if err != nil {
+		return fmt.Errorf("failed to check SoX output %s: %w", path, err)
+	}
+	for i := 0; i+1 < len(bitrateArgs); i += 2 {
+		want, err := strconv.Atoi(bitrateArgs[i+1])
+		if err != nil {
+			continue
+		}
+		switch {
+		case bitrateArgs[i] == "-b" && info.Bits != want:
+			return fmt.Errorf("%w: expected %d-bit, got %d-bit", errPostcheck, want, info.Bits)
+		case bitrateArgs[i] == "-c" && info.Channels != want:
+			return fmt.Errorf("%w: expected %d channels, got %d", errPostcheck, want, info.Channels)
 		}
-		return fmt.Errorf("SoX conversion failed: %w", err)
 	}
-
-	if !config.NoPreserveMetadata {
-		// Merge metadata using FFmpeg
-		if mergeErr := mergeMetadataWithFFmpeg(sourcePath, tempPath, targetPath); mergeErr != nil {
-			fmt.Printf("Warning: Metadata preservation failed for %s, keeping converted audio without tags: %v\n", targetPath, mergeErr)
-			// Fallback: rename temp to target
-			if renameErr := os.Rename(tempPath, targetPath); renameErr != nil {
-				return fmt.Errorf("fallback rename failed after metadata merge error: %w", renameErr)
-			}
-			return nil
+	if len(sampleRateArgs) > 3 {
+		if rate, err := strconv.Atoi(sampleRateArgs[3]); err == nil && info.Rate != rate {
+			return fmt.Errorf("%w: expected %d Hz, got %d Hz", errPostcheck, rate, info.Rate)
 		}
-		// If merge succeeded, temp is already removed in merge function
-	} else {
-		// If not preserving metadata, tempPath == targetPath, no action needed
 	}
-
 	return nil
 }
 
-func getDockerPath(hostPath string) string {
-	relPath := normalizeForDocker(config.SourceDir, hostPath)
-	return "/source/" + relPath
+// readFLACStreamInfo reads the bit depth, sample rate, channel count and
+// duration from the STREAMINFO block of a FLAC file without external tools.
+// A leading ID3v2 tag is seeked over rather than read, so embedded artwork
+// and other large frames cost nothing.
+func readFLACStreamInfo(path string) (*AudioInfo, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+
+	header := make([]byte, 10)
+	if _, err := io.ReadFull(reader, header[:4]); err != nil {
+		return nil, fmt.Errorf("not a FLAC file: %w", err)
+	}
+	if string(header[:3]) == "ID3" {
+		if _, err := io.ReadFull(reader, header[4:]); err != nil {
+			return nil, fmt.Errorf("truncated ID3 tag: %w", err)
+		}
+		size := int64(header[6])<<21 | int64(header[7])<<14 | int64(header[8])<<7 | int64(header[9])
+		if header[5]&0x10 != 0 {
+			size += 10 // Footer
+		}
+		if _, err := file.Seek(int64(len(header))+size, io.SeekStart); err != nil {
+			return nil, fmt.Errorf("truncated ID3 tag: %w", err)
+		}
+		reader.Reset(file)
+		if _, err := io.ReadFull(reader, header[:4]); err != nil {
+			return nil, fmt.Errorf("not a FLAC file: %w", err)
+		}
+	}
+	if string(header[:4]) != "fLaC" {
+		return nil, errors.New("not a FLAC file")
+	}
+
+	block := make([]byte, 38)
+	if _, err := io.ReadFull(reader, block); err != nil {
+		return nil, fmt.Errorf("truncated STREAMINFO: %w", err)
+	}
+	return parseStreamInfo(block)
 }
 
-func getDockerTargetPath(hostPath string) string {
-	relPath := normalizeForDocker(config.TargetDir, hostPath)
-	return "/target/" + relPath
+// parseStreamInfo decodes the metadata block that follows the "fLaC" marker.
+// The first block is always STREAMINFO: a 4 byte block header and 34 bytes,
+// with the sample rate (20 bits), channels - 1 (3 bits), bits per sample - 1
+// (5 bits) and total samples (36 bits) starting at byte 10.
+func parseStreamInfo(block []byte) (*AudioInfo, error) {
+	if block[0]&0x7f != 0 {
+		return nil, errors.New("first FLAC metadata block is not STREAMINFO")
+	}
+	fields := block[14:22]
+	rate := int(fields[0])<<12 | int(fields[1])<<4 | int(fields[2])>>4
+	info := &AudioInfo{
+		Rate:     rate,
+		Channels: int(fields[2]>>1&0x07) + 1,
+		Bits:     int(fields[2]&0x01)<<4 | int(fields[3]>>4) + 1,
+		Format:   "flac",
+	}
+	samples := int64(fields[3]&0x0f)<<32 | int64(fields[4])<<24 | int64(fields[5])<<16 | int64(fields[6])<<8 | int64(fields[7])
+	if rate > 0 {
+		info.Duration = time.Duration(float64(samples) / float64(rate) * float64(time.Second))
+	}
+	return info, nil
 }
 
-func normalizeForDocker(base, path string) string {
-	// Convert backslashes to forward slashes first
-	base = strings.ReplaceAll(base, "\\", "/")
-	path = strings.ReplaceAll(path, "\\", "/")
+// errRoundtripMismatch is returned when a lossless conversion changed the audio
+var errRoundtripMismatch = errors.New("decoded audio differs from the source")
 
-	// Try to use filepath.VolumeName
-	volBase := filepath.VolumeName(base)
-	baseStripped := base
-	if volBase != "" {
-		baseStripped = base[len(volBase):]
-	} else {
-		// Manual check for Windows drive letter (e.g., C:/ or c:/)
-		if len(base) >= 3 && base[1] == ':' && base[2] == '/' {
-			baseStripped = base[3:]
-		}
-	}
+// decodedPCMDigest hashes the decoded audio samples of a file
+var decodedPCMDigest = ffmpegPCMDigest
 
-	volPath := filepath.VolumeName(path)
-	pathStripped := path
-	if volPath != "" {
-		pathStripped = path[len(volPath):]
-	} else {
-		if len(path) >= 3 && path[1] == ':' && path[2] == '/' {
-			pathStripped = path[3:]
-		}
+// verifyRoundtrip checks, with --verify-roundtrip, that a lossless conversion
+// which neither resampled nor reduced bit depth kept every decoded sample. A
+// mismatch fails the conversion like any other conversion error.
+func verifyRoundtrip(t *fileTask, sourcePath, convertedPath string) error {
+	if !config.VerifyRoundtrip {
+		return nil
 	}
 
-	rel, err := filepath.Rel(baseStripped, pathStripped)
+	sourceDigest, err := decodedPCMDigest(sourcePath)
 	if err != nil {
-		return filepath.ToSlash(pathStripped)
+		return fmt.Errorf("roundtrip verification failed to decode %s: %w", sourcePath, err)
 	}
-	return filepath.ToSlash(rel)
-}
-func mergeMetadataWithFFmpeg(sourcePath, tempConvertedPath, targetPath string) error {
-	if config.NoPreserveMetadata {
-		// If not preserving metadata, just rename temp to target
-		return os.Rename(tempConvertedPath, targetPath)
+	convertedDigest, err := decodedPCMDigest(convertedPath)
+	if err != nil {
+		return fmt.Errorf("roundtrip verification failed to decode %s: %w", convertedPath, err)
 	}
 
-	var cmd *exec.Cmd
+	if sourceDigest != convertedDigest {
+		return fmt.Errorf("%w: %s", errRoundtripMismatch, sourcePath)
+	}
+	t.logf("Roundtrip verified: %s\n", sourcePath)
+	return nil
+}
 
+// ffmpegPCMDigest decodes the first audio stream to 32-bit PCM and returns
+// FFmpeg's MD5 of the samples, so files of any container compare equal when
+// their audio is identical
+func ffmpegPCMDigest(path string) (string, error) {
+	var cmd *exec.Cmd
 	if config.UseDocker {
-		dockerSource := getDockerPath(sourcePath)
-		dockerTemp := getDockerTargetPath(tempConvertedPath)
-		dockerTarget := getDockerTargetPath(targetPath)
-
 		args := []string{"run", "--rm", "--entrypoint", "ffmpeg",
-			"-v", fmt.Sprintf("%s:/source", config.SourceDir),
+			"-v", fmt.Sprintf("%s:/source", sourceRoot()),
 			"-v", fmt.Sprintf("%s:/target", config.TargetDir),
 			config.DockerImage,
-			"-i", dockerSource,
-			"-i", dockerTemp,
-			"-map", "1", // Map audio stream from the converted file (input 1)
-			"-map", "0:v?", // Map video streams (cover art) from source file (input 0), ? makes it optional
-			"-map_metadata", "0", // Map metadata from source file (input 0)
-			"-c", "copy", // Copy streams without re-encoding
-			dockerTarget}
-
-		cmd = exec.Command("docker", args...)
+			"-v", "error", "-i", getDockerMountedPath(path), "-map", "0:a:0", "-c:a", "pcm_s32le", "-f", "md5", "-"}
+		cmd = newCommand("docker", args...)
 	} else {
-		// Local FFmpeg
-		cmd = exec.Command("ffmpeg",
-			"-i", sourcePath,
-			"-i", tempConvertedPath,
-			"-map", "1", // Map audio stream from the converted file (input 1)
-			"-map", "0:v?", // Map video streams (cover art) from source file (input 0), ? makes it optional
-			"-map_metadata", "0", // Map metadata from source file (input 0)
-			"-c", "copy", // Copy streams without re-encoding
-			targetPath)
+		cmd = newCommand("ffmpeg", "-v", "error", "-i", path, "-map", "0:a:0", "-c:a", "pcm_s32le", "-f", "md5", "-")
 	}
 
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("FFmpeg metadata merge failed: %w", err)
+	output, err := commandOutput(cmd)
+	if err != nil {
+		return "", err
 	}
-
-	// Remove temp file after successful merge
-	if err := os.Remove(tempConvertedPath); err != nil {
-		fmt.Printf("Warning: Failed to remove temp file %s: %v\n", tempConvertedPath, err)
+	digest, ok := strings.CutPrefix(strings.TrimSpace(string(output)), "MD5=")
+	if !ok {
+		return "", fmt.Errorf("unexpected ffmpeg md5 output: %q", strings.TrimSpace(string(output)))
 	}
-
-	return nil
+	return digest, nil
 }
 
-func copyImageFiles() error {
-	fmt.Println("Copying image files...")
-
-	return filepath.Walk(config.SourceDir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
+// copyFile copies a file, preserving its mode and timestamps. With
+// --verify-copies a copy that fails verification is retried once before
+// giving up.
+func copyFile(t *fileTask, src, dst string) error {
+	err := copyFileOnce(t, src, dst)
+	if errors.Is(err, errCopyVerification) {
+		t.logf("Warning: %v, retrying copy of %s\n", err, src)
+		err = copyFileOnce(t, src, dst)
+	}
+	return err
+}
 
-		if info.IsDir() {
-			return nil
-		}
+const (
+	defaultCopyBufferKiB = 1024
+	minCopyBufferKiB     = 4
+)
 
-		ext := strings.ToLower(filepath.Ext(path))
-		if ext != ".jpg" && ext != ".png" {
-			return nil
-		}
+// copyBufferSize returns the copy buffer size in bytes
+func copyBufferSize() int {
+	if config.CopyBufferSize == 0 {
+		return defaultCopyBufferKiB << 10
+	}
+	return config.CopyBufferSize << 10
+}
 
-		// Create target directory structure
-		relPath, err := filepath.Rel(config.SourceDir, path)
-		if err != nil {
-			return err
-		}
+// errCopyVerification is returned when a verified copy does not match its source
+var errCopyVerification = errors.New("copy verification failed")
 
-		targetPath := filepath.Join(config.TargetDir, relPath)
-		targetDir := filepath.Dir(targetPath)
+// destinationDigest hashes a copied file for verification
+var destinationDigest = fileSHA256
 
-		if err := os.MkdirAll(targetDir, 0755); err != nil {
-			return fmt.Errorf("failed to create target directory: %w", err)
-		}
+// copyProgress publishes a FileProgress event for every chunk of a copy
+type copyProgress struct {
+	path   string
+	total  int64
+	copied int64
+}
 
-		return copyFile(path, targetPath)
-	})
+func (c *copyProgress) Write(p []byte) (int, error) {
+	c.copied += int64(len(p))
+	progress.publish(FileProgress{Path: c.path, Bytes: c.copied, Total: c.total})
+	return len(p), nil
 }
 
-func copyFile(src, dst string) error {
+func copyFileOnce(t *fileTask, src, dst string) error {
+	// A forced stop starts no copies, such as the fallback for a file whose
+	// conversion was killed
+	if control.ctx.Err() != nil {
+		return errInterrupted
+	}
+
 	sourceFile, err := os.Open(src)
 	if err != nil {
 		return err
@@ -1112,14 +9013,33 @@ func copyFile(src, dst string) error {
 		return err
 	}
 
-	destFile, err := os.Create(dst)
+	// The copy is written under a partial name and renamed once complete
+	partial := partialPath(dst)
+	control.trackTemp(partial)
+	defer control.releaseTemp(partial)
+	destFile, err := os.Create(partial)
 	if err != nil {
 		return err
 	}
 	defer destFile.Close()
+	defer os.Remove(partial)
+
+	// Hash the source while copying when verifying
+	var reader io.Reader = sourceFile
+	hasher := sha256.New()
+	if config.VerifyCopies {
+		reader = io.TeeReader(sourceFile, hasher)
+	}
+
+	// Report copy progress to an embedding caller. This reads through the
+	// buffer, like verification does.
+	if config.OnEvent != nil {
+		reader = io.TeeReader(reader, &copyProgress{path: src, total: sourceInfo.Size()})
+	}
 
-	// Copy file content
-	_, err = io.Copy(destFile, sourceFile)
+	// Copy file content. Without verification or progress events the kernel
+	// may copy the data directly, in which case the buffer is not used.
+	_, err = io.CopyBuffer(destFile, reader, make([]byte, copyBufferSize()))
 	if err != nil {
 		return err
 	}
@@ -1128,17 +9048,41 @@ func copyFile(src, dst string) error {
 	if err := destFile.Sync(); err != nil {
 		return err
 	}
+	if err := destFile.Close(); err != nil {
+		return err
+	}
+
+	// Re-read the destination and compare digests before finalizing
+	if config.VerifyCopies {
+		digest := hex.EncodeToString(hasher.Sum(nil))
+		written, err := destinationDigest(partial)
+		if err != nil {
+			return err
+		}
+		if written != digest {
+			return fmt.Errorf("%w for %s: expected sha256 %s, got %s", errCopyVerification, dst, digest, written)
+		}
+	}
 
-	// Preserve file permissions
-	if err := os.Chmod(dst, sourceInfo.Mode()); err != nil {
+	// Preserve file permissions, made readable with --fix-permissions
+	mode := sourceInfo.Mode()
+	if config.FixPermissions {
+		mode = readableMode(mode)
+	}
+	if err := os.Chmod(partial, mode); err != nil {
 		return err
 	}
 
 	// Preserve file timestamps (access time and modification time)
-	if err := os.Chtimes(dst, sourceInfo.ModTime(), sourceInfo.ModTime()); err != nil {
+	if err := os.Chtimes(partial, sourceInfo.ModTime(), sourceInfo.ModTime()); err != nil {
+		return err
+	}
+	if err := os.Rename(partial, dst); err != nil {
 		return err
 	}
 
+	markAction(src, actionCopied)
+	t.note("copy")
 	return nil
 }
 
@@ -5,17 +5,24 @@ import (
 	"archive/zip"
 	"bytes"
 	"compress/gzip"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"slices"
 	"strings"
+	"syscall"
 	"testing"
 	"time"
+	"unicode/utf8"
 )
 
 // MockTransport is a simple mock for http.RoundTripper to simulate API responses
@@ -196,7 +203,7 @@ func TestCopyFile(t *testing.T) {
 
 	// Copy the file
 	dstPath := filepath.Join(tmpDir, "destination.txt")
-	if err := copyFile(srcPath, dstPath); err != nil {
+	if err := copyFile(nil, srcPath, dstPath); err != nil {
 		t.Fatalf("Failed to copy file: %v", err)
 	}
 
@@ -491,7 +498,7 @@ func TestGetAudioInfoDocker(t *testing.T) {
 	testFile := filepath.Join(tmpDir, "test.flac")
 	os.WriteFile(testFile, []byte("dummy"), 0644)
 
-	info, err := getAudioInfo(testFile)
+	info, err := getAudioInfo(nil, testFile)
 	// We expect this to fail since docker is not available, but it tests the Docker path
 	if err == nil {
 		t.Logf("getAudioInfo with Docker succeeded unexpectedly with: %+v", info)
@@ -522,7 +529,7 @@ func TestProcessFlacDocker(t *testing.T) {
 	bitrateArgs := []string{"-b", "16"}
 	sampleRateArgs := []string{"rate", "-v", "-L", "44100"}
 
-	err = processFlac(sourceFile, targetFile, true, bitrateArgs, sampleRateArgs)
+	err = processFlac(newFileTask(sourceFile), sourceFile, targetFile, true, bitrateArgs, sampleRateArgs)
 	// We expect this to fail since docker is not available, but it tests the Docker path
 	if err == nil {
 		t.Logf("processFlac with Docker succeeded unexpectedly")
@@ -588,7 +595,7 @@ func TestMergeMetadataWithFFmpeg(t *testing.T) {
 
 	config.NoPreserveMetadata = true
 
-	err = mergeMetadataWithFFmpeg(sourceFile, tempFile, targetFile)
+	err = mergeMetadataWithFFmpeg(nil, sourceFile, tempFile, targetFile)
 	if err != nil {
 		t.Errorf("mergeMetadataWithFFmpeg failed with NoPreserveMetadata=true: %v", err)
 	}
@@ -698,7 +705,7 @@ func TestCopyFileErrors(t *testing.T) {
 	defer os.RemoveAll(tmpDir)
 
 	// Test with non-existent source file
-	err = copyFile("/non/existent/source", filepath.Join(tmpDir, "dest"))
+	err = copyFile(nil, "/non/existent/source", filepath.Join(tmpDir, "dest"))
 	if err == nil {
 		t.Error("Expected error for non-existent source file")
 	}
@@ -712,7 +719,7 @@ func TestCopyFileErrors(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	err = copyFile(srcPath, dstPath)
+	err = copyFile(nil, srcPath, dstPath)
 	if err != nil {
 		t.Errorf("copyFile failed: %v", err)
 	}
@@ -789,7 +796,7 @@ func TestCopyImageFilesErrors(t *testing.T) {
 	config.TargetDir = targetDir
 
 	// Test copyImageFiles
-	err = copyImageFiles()
+	err = copyImageFiles(config.EnforceOutputFormat)
 	if err != nil {
 		t.Fatalf("copyImageFiles failed: %v", err)
 	}
@@ -972,7 +979,7 @@ func TestCopyFilePermissions(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	err = copyFile(srcPath, dstPath)
+	err = copyFile(nil, srcPath, dstPath)
 	if err != nil {
 		t.Errorf("copyFile failed: %v", err)
 	}
@@ -1175,7 +1182,7 @@ func TestCopyFileDestinationExists(t *testing.T) {
 	}
 
 	// Copy should overwrite destination
-	err = copyFile(srcPath, dstPath)
+	err = copyFile(nil, srcPath, dstPath)
 	if err != nil {
 		t.Errorf("copyFile failed: %v", err)
 	}
@@ -1220,7 +1227,7 @@ func TestCopyImageFilesWithSubdirs(t *testing.T) {
 	config.TargetDir = targetDir
 
 	// Test copyImageFiles
-	err = copyImageFiles()
+	err = copyImageFiles(config.EnforceOutputFormat)
 	if err != nil {
 		t.Fatalf("copyImageFiles failed: %v", err)
 	}
@@ -1371,7 +1378,7 @@ func TestDetermineConversionAllCases(t *testing.T) {
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			needsConversion, bitrateArgs, sampleRateArgs := determineConversion(&tc.input)
+			needsConversion, bitrateArgs, sampleRateArgs := determineConversion(policyFromConfig(), &tc.input)
 
 			if needsConversion != tc.expectedConversion {
 				t.Errorf("Expected conversion %v, got %v", tc.expectedConversion, needsConversion)
@@ -1400,166 +1407,304 @@ func TestDetermineConversionAllCases(t *testing.T) {
 	}
 }
 
-// TestTargetRateMapping tests the target rate determination logic for logging
-// This covers the logic that determines whether we target 44.1kHz or 48kHz
-func TestTargetRateMapping(t *testing.T) {
-	testCases := []struct {
-		name           string
-		inputRate      int
-		expectedTarget string
-	}{
-		// 48kHz family - should map to 48kHz
-		{name: "48kHz stays 48kHz", inputRate: 48000, expectedTarget: "48kHz"},
-		{name: "96kHz goes to 48kHz", inputRate: 96000, expectedTarget: "48kHz"},
-		{name: "192kHz goes to 48kHz", inputRate: 192000, expectedTarget: "48kHz"},
-		{name: "384kHz goes to 48kHz", inputRate: 384000, expectedTarget: "48kHz"},
+func TestTargetSampleRate(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig; progress = &progressReporter{} }()
 
-		// 44.1kHz family - should map to 44.1kHz
-		{name: "44.1kHz stays 44.1kHz", inputRate: 44100, expectedTarget: "44.1kHz"},
-		{name: "88.2kHz goes to 44.1kHz", inputRate: 88200, expectedTarget: "44.1kHz"},
-		{name: "176.4kHz goes to 44.1kHz", inputRate: 176400, expectedTarget: "44.1kHz"},
-		{name: "352.8kHz goes to 44.1kHz", inputRate: 352800, expectedTarget: "44.1kHz"},
+	for rate, want := range map[string]int{"": 0, "auto": 0, "44100": 44100, "48000": 48000} {
+		config = Config{TargetSampleRate: rate}
+		if got := policyFromConfig().HighRate; got != want {
+			t.Errorf("target-sample-rate %q: HighRate = %d, want %d", rate, got, want)
+		}
+	}
 
-		// Edge cases - other rates
-		{name: "22.05kHz unusual rate", inputRate: 22050, expectedTarget: "same rate"},
-		{name: "32kHz unusual rate", inputRate: 32000, expectedTarget: "same rate"},
+	sourceDir := t.TempDir()
+	os.WriteFile(filepath.Join(sourceDir, "song.mp3"), []byte("mp3"), 0644)
+	config = Config{TargetDir: t.TempDir(), SoxCommand: "true", NoPreserveMetadata: true, TargetSampleRate: "44100"}
+	output, err := captureOutput(func() {
+		if err := runConverter(nil, []string{sourceDir}); err != nil {
+			t.Errorf("runConverter failed: %v", err)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(output, "Resampling high sample rate files to 44100 Hz\n") {
+		t.Errorf("Expected the chosen rate to be logged, got:\n%s", output)
 	}
 
-	for _, tc := range testCases {
-		t.Run(tc.name, func(t *testing.T) {
-			// Test the target rate determination logic used for logging
-			var targetRateStr string
-			switch tc.inputRate {
-			case 48000, 96000, 192000, 384000:
-				targetRateStr = "48kHz"
-			case 44100, 88200, 176400, 352800:
-				targetRateStr = "44.1kHz"
-			default:
-				targetRateStr = "same rate"
-			}
+	for _, cfg := range []Config{
+		{TargetSampleRate: "96000"},
+		{TargetSampleRate: "48000", ResampleAll: 44100},
+		{TargetSampleRate: "44100", ResampleAbove: 48000},
+	} {
+		config = cfg
+		config.TargetDir = t.TempDir()
+		if err := convertLibrary([]string{t.TempDir()}); err == nil || !strings.Contains(err.Error(), "target-sample-rate") {
+			t.Errorf("Expected %+v to be rejected, got %v", cfg, err)
+		}
+	}
+}
 
-			if targetRateStr != tc.expectedTarget {
-				t.Errorf("Expected target rate %s, got %s", tc.expectedTarget, targetRateStr)
-			}
+func TestTargetBitDepth(t *testing.T) {
+	originalConfig := config
+	originalPath := os.Getenv("PATH")
+	defer func() { config = originalConfig; os.Setenv("PATH", originalPath); progress = &progressReporter{} }()
 
-			// Also verify the conversion logic handles these rates correctly
-			audioInfo := AudioInfo{Bits: 16, Rate: tc.inputRate}
-			needsConversion, _, sampleRateArgs := determineConversion(&audioInfo)
+	for _, tc := range []struct {
+		depth, bits int
+		want        []string
+	}{
+		{0, 24, []string{"-b", "16"}},
+		{16, 24, []string{"-b", "16"}},
+		{24, 24, nil},
+		{24, 16, nil},
+		{24, 32, []string{"-b", "24"}},
+	} {
+		config = Config{TargetBitDepth: tc.depth}
+		if _, bitrateArgs, _ := determineConversion(policyFromConfig(), &AudioInfo{Bits: tc.bits, Rate: 44100}); !slices.Equal(bitrateArgs, tc.want) {
+			t.Errorf("target %d, %d-bit source: expected %q, got %q", tc.depth, tc.bits, tc.want, bitrateArgs)
+		}
+	}
+
+	// 24-bit ALAC needs 32-bit samples, 16-bit output keeps 16-bit ones
+	tmpDir := t.TempDir()
+	argsFile := filepath.Join(tmpDir, "args")
+	sox := writeFakeTool(t, tmpDir, "sox", `for a in "$@"; do case "$a" in *.flac) touch "$a";; esac; done`)
+	writeFakeTool(t, tmpDir, "ffmpeg", `echo "$@" > `+argsFile+`; for a in "$@"; do case "$a" in *.m4a) touch "$a";; esac; done`)
+	os.Setenv("PATH", tmpDir+string(os.PathListSeparator)+originalPath)
+	source := filepath.Join(tmpDir, "song.flac")
+	os.WriteFile(source, []byte("flac"), 0644)
+	for depth, want := range map[int]string{16: "-sample_fmt s16p", 24: "-sample_fmt s32p"} {
+		config = Config{SourceDir: tmpDir, TargetDir: tmpDir, SoxCommand: sox, NoPreserveMetadata: true, NoPostcheck: true, ALACCompression: -1, TargetBitDepth: depth}
+		if err := convertToALAC(newFileTask(source), source, filepath.Join(tmpDir, "song.m4a"), &AudioInfo{Bits: 24, Rate: 44100}); err != nil {
+			t.Fatalf("target %d: convertToALAC failed: %v", depth, err)
+		}
+		if args, _ := os.ReadFile(argsFile); !strings.Contains(string(args), want) {
+			t.Errorf("target %d: expected %q in the FFmpeg arguments, got %q", depth, want, args)
+		}
+	}
+
+	sourceDir := t.TempDir()
+	os.WriteFile(filepath.Join(sourceDir, "song.mp3"), []byte("mp3"), 0644)
+	config = Config{TargetDir: t.TempDir(), SoxCommand: "true", NoPreserveMetadata: true, TargetBitDepth: 24}
+	output, err := captureOutput(func() {
+		if err := runConverter(nil, []string{sourceDir}); err != nil {
+			t.Errorf("runConverter failed: %v", err)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(output, "Reducing the bit depth of deeper files to 24 bits\n") {
+		t.Errorf("Expected the target depth to be logged, got:\n%s", output)
+	}
 
-			// Verify that high sample rates get converted
-			if tc.inputRate > 48000 {
-				if !needsConversion {
-					t.Errorf("Expected conversion needed for %d Hz", tc.inputRate)
-				}
-				// Check that the correct target rate is in args
-				if len(sampleRateArgs) >= 4 {
-					switch tc.inputRate {
-					case 96000, 192000, 384000:
-						if sampleRateArgs[3] != "48000" {
-							t.Errorf("Expected 48000 target for %d Hz, got %s", tc.inputRate, sampleRateArgs[3])
-						}
-					case 88200, 176400, 352800:
-						if sampleRateArgs[3] != "44100" {
-							t.Errorf("Expected 44100 target for %d Hz, got %s", tc.inputRate, sampleRateArgs[3])
-						}
-					}
-				}
-			}
-		})
+	for _, cfg := range []Config{
+		{TargetBitDepth: 20},
+		{TargetBitDepth: 24, ReduceBitsAbove: 16},
+		{TargetBitDepth: 24, DownsampleOnly: true},
+	} {
+		config = cfg
+		config.TargetDir = t.TempDir()
+		if err := convertLibrary([]string{t.TempDir()}); err == nil || !strings.Contains(err.Error(), "target-bit-depth") {
+			t.Errorf("Expected %+v to be rejected, got %v", cfg, err)
+		}
 	}
 }
 
-// TestConversionFormatValidation tests the format string used for conversion logging
-// This validates the expected output format without duplicating production logic
-func TestConversionFormatValidation(t *testing.T) {
+// TestConversionPolicy covers what the policy decides for each output format
+// and option, and the reason it gives
+func TestConversionPolicy(t *testing.T) {
 	testCases := []struct {
-		name           string
-		inputBits      int
-		inputRate      int
-		expectedFormat string // What the log format should look like
+		name     string
+		policy   ConversionPolicy
+		info     AudioInfo
+		expected Decision
 	}{
 		{
-			name:           "24-bit 96kHz conversion format",
-			inputBits:      24,
-			inputRate:      96000,
-			expectedFormat: "24-bit 96000 Hz → 16-bit 48kHz",
+			name:     "16-bit 44.1kHz FLAC is copied",
+			policy:   ConversionPolicy{Format: "flac"},
+			info:     AudioInfo{Bits: 16, Rate: 44100, Format: "flac"},
+			expected: Decision{Action: "copy", Reason: "already 16-bit 44100 Hz"},
+		},
+		{
+			name:     "Odd rates stay",
+			policy:   ConversionPolicy{Format: "flac"},
+			info:     AudioInfo{Bits: 16, Rate: 32000, Format: "flac"},
+			expected: Decision{Action: "copy", Reason: "already 16-bit 32000 Hz"},
+		},
+		{
+			name:     "24-bit 96kHz goes to 16-bit 48kHz",
+			policy:   ConversionPolicy{Format: "flac"},
+			info:     AudioInfo{Bits: 24, Rate: 96000, Format: "flac"},
+			expected: Decision{Action: "convert", TargetBits: 16, TargetRate: 48000, Reason: "24-bit 96000 Hz → 16-bit 48000 Hz"},
+		},
+		{
+			name:     "16-bit 176.4kHz goes to 44.1kHz",
+			policy:   ConversionPolicy{Format: "flac"},
+			info:     AudioInfo{Bits: 16, Rate: 176400, Format: "flac"},
+			expected: Decision{Action: "convert", TargetRate: 44100, Reason: "16-bit 176400 Hz → 16-bit 44100 Hz"},
+		},
+		{
+			name:     "Downsample-only keeps the bit depth",
+			policy:   ConversionPolicy{Format: "flac", DownsampleOnly: true},
+			info:     AudioInfo{Bits: 24, Rate: 44100, Format: "flac"},
+			expected: Decision{Action: "copy", Reason: "already 24-bit 44100 Hz"},
+		},
+		{
+			name:     "Reduce-bits-above reduces to the threshold",
+			policy:   ConversionPolicy{Format: "flac", ReduceBitsAbove: 20},
+			info:     AudioInfo{Bits: 24, Rate: 44100, Format: "flac"},
+			expected: Decision{Action: "convert", TargetBits: 20, Reason: "24-bit 44100 Hz → 20-bit 44100 Hz"},
+		},
+		{
+			name:     "Resample-above keeps rates under the threshold",
+			policy:   ConversionPolicy{Format: "flac", ResampleAbove: 96000},
+			info:     AudioInfo{Bits: 16, Rate: 88200, Format: "flac"},
+			expected: Decision{Action: "copy", Reason: "already 16-bit 88200 Hz"},
+		},
+		{
+			name:     "Resample-all forces the rate",
+			policy:   ConversionPolicy{Format: "flac", ResampleAll: 48000},
+			info:     AudioInfo{Bits: 16, Rate: 44100, Format: "flac"},
+			expected: Decision{Action: "convert", TargetRate: 48000, Reason: "16-bit 44100 Hz → 16-bit 48000 Hz"},
+		},
+		{
+			name:     "No-upsample keeps lower rates",
+			policy:   ConversionPolicy{Format: "flac", ResampleAll: 48000, NoUpsample: true},
+			info:     AudioInfo{Bits: 16, Rate: 44100, Format: "flac"},
+			expected: Decision{Action: "copy", Reason: "already 16-bit 44100 Hz"},
+		},
+		{
+			name:     "Channels are remixed",
+			policy:   ConversionPolicy{Format: "flac", Channels: 2},
+			info:     AudioInfo{Bits: 16, Rate: 44100, Channels: 6, Format: "flac"},
+			expected: Decision{Action: "convert", TargetChannels: 2, Reason: "16-bit 44100 Hz → 16-bit 44100 Hz, 6 → 2 channels"},
+		},
+		{
+			name:     "ALAC is always converted to FLAC",
+			policy:   ConversionPolicy{Format: "flac"},
+			info:     AudioInfo{Bits: 16, Rate: 44100, Format: "alac"},
+			expected: Decision{Action: "convert", Reason: "ALAC to FLAC, keeping 16-bit 44100 Hz"},
+		},
+		{
+			name:     "FLAC is always converted to ALAC",
+			policy:   ConversionPolicy{Format: "alac"},
+			info:     AudioInfo{Bits: 16, Rate: 48000, Format: "flac"},
+			expected: Decision{Action: "convert", Reason: "FLAC to ALAC, keeping 16-bit 48000 Hz"},
+		},
+		{
+			name:     "Compliant ALAC is copied",
+			policy:   ConversionPolicy{Format: "alac"},
+			info:     AudioInfo{Bits: 16, Rate: 48000, Format: "alac"},
+			expected: Decision{Action: "copy", Reason: "already 16-bit 48000 Hz"},
+		},
+		{
+			name:     "Other ALAC is re-encoded",
+			policy:   ConversionPolicy{Format: "alac", DownsampleOnly: true},
+			info:     AudioInfo{Bits: 24, Rate: 44100, Format: "alac"},
+			expected: Decision{Action: "convert", Reason: "ALAC is re-encoded unless it is 16-bit at 44.1 or 48 kHz"},
+		},
+		{
+			name:     "ALAC under explicit thresholds is copied",
+			policy:   ConversionPolicy{Format: "alac", ReduceBitsAbove: 24},
+			info:     AudioInfo{Bits: 24, Rate: 44100, Format: "alac"},
+			expected: Decision{Action: "copy", Reason: "already 24-bit 44100 Hz"},
+		},
+		{
+			name:     "MP3 keeps the 48kHz family",
+			policy:   ConversionPolicy{Format: "mp3"},
+			info:     AudioInfo{Bits: 24, Rate: 96000, Format: "flac"},
+			expected: Decision{Action: "convert", TargetRate: 48000, Reason: "encoded to MP3 at 48000 Hz"},
+		},
+		{
+			name:     "Target sample rate overrides the family",
+			policy:   ConversionPolicy{Format: "flac", HighRate: 44100},
+			info:     AudioInfo{Bits: 16, Rate: 96000, Format: "flac"},
+			expected: Decision{Action: "convert", TargetRate: 44100, Reason: "16-bit 96000 Hz → 16-bit 44100 Hz"},
 		},
 		{
-			name:           "16-bit 88.2kHz conversion format",
-			inputBits:      16,
-			inputRate:      88200,
-			expectedFormat: "16-bit 88200 Hz → 16-bit 44.1kHz",
+			name:     "Target bit depth 24 keeps 24-bit",
+			policy:   ConversionPolicy{Format: "flac", TargetBits: 24},
+			info:     AudioInfo{Bits: 24, Rate: 96000, Format: "flac"},
+			expected: Decision{Action: "convert", TargetRate: 48000, Reason: "24-bit 96000 Hz → 24-bit 48000 Hz"},
 		},
 		{
-			name:           "24-bit 176.4kHz conversion format",
-			inputBits:      24,
-			inputRate:      176400,
-			expectedFormat: "24-bit 176400 Hz → 16-bit 44.1kHz",
+			name:     "Target bit depth 24 reduces deeper sources",
+			policy:   ConversionPolicy{Format: "flac", TargetBits: 24},
+			info:     AudioInfo{Bits: 32, Rate: 44100, Format: "flac"},
+			expected: Decision{Action: "convert", TargetBits: 24, Reason: "32-bit 44100 Hz → 24-bit 44100 Hz"},
 		},
 		{
-			name:           "16-bit 44.1kHz no conversion format",
-			inputBits:      16,
-			inputRate:      44100,
-			expectedFormat: "16-bit 44100 Hz → 16-bit 44.1kHz",
+			name:     "Target bit depth 24 copies 24-bit ALAC",
+			policy:   ConversionPolicy{Format: "alac", TargetBits: 24},
+			info:     AudioInfo{Bits: 24, Rate: 48000, Format: "alac"},
+			expected: Decision{Action: "copy", Reason: "already 24-bit 48000 Hz"},
 		},
 		{
-			name:           "24-bit 384kHz conversion format",
-			inputBits:      24,
-			inputRate:      384000,
-			expectedFormat: "24-bit 384000 Hz → 16-bit 48kHz",
+			name:     "Target bit depth 24 re-encodes odd ALAC",
+			policy:   ConversionPolicy{Format: "alac", TargetBits: 24},
+			info:     AudioInfo{Bits: 20, Rate: 44100, Format: "alac"},
+			expected: Decision{Action: "convert", Reason: "ALAC is re-encoded unless it is 16 or 24-bit at 44.1 or 48 kHz"},
+		},
+		{
+			name:     "Target sample rate keeps rates that are not high",
+			policy:   ConversionPolicy{Format: "flac", HighRate: 44100},
+			info:     AudioInfo{Bits: 16, Rate: 48000, Format: "flac"},
+			expected: Decision{Action: "copy", Reason: "already 16-bit 48000 Hz"},
+		},
+		{
+			name:     "Target sample rate applies to MP3",
+			policy:   ConversionPolicy{Format: "mp3", HighRate: 48000},
+			info:     AudioInfo{Bits: 24, Rate: 176400, Format: "flac"},
+			expected: Decision{Action: "convert", TargetRate: 48000, Reason: "encoded to MP3 at 48000 Hz"},
+		},
+		{
+			name:     "MP3 rate is forced",
+			policy:   ConversionPolicy{Format: "mp3", MP3Rate: 48000},
+			info:     AudioInfo{Bits: 16, Rate: 44100, Format: "flac"},
+			expected: Decision{Action: "convert", TargetRate: 48000, Reason: "encoded to MP3 at 48000 Hz"},
+		},
+		{
+			name:     "MP3 rate is not upsampled with no-upsample",
+			policy:   ConversionPolicy{Format: "mp3", MP3Rate: 48000, NoUpsample: true},
+			info:     AudioInfo{Bits: 16, Rate: 32000, Format: "flac"},
+			expected: Decision{Action: "convert", TargetRate: 44100, Reason: "encoded to MP3 at 44100 Hz"},
 		},
 	}
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			audioInfo := AudioInfo{Bits: tc.inputBits, Rate: tc.inputRate}
-			needsConversion, bitrateArgs, sampleRateArgs := determineConversion(&audioInfo)
-
-			// Test that conversion determination works correctly
-			expectedConversion := tc.inputBits > 16 || tc.inputRate == 88200 || tc.inputRate == 176400 || tc.inputRate == 352800 || tc.inputRate == 96000 || tc.inputRate == 192000 || tc.inputRate == 384000
-			if needsConversion != expectedConversion {
-				t.Errorf("Expected conversion %v, got %v", expectedConversion, needsConversion)
-			}
-
-			// Test bitrate args for high bit depth
-			if tc.inputBits > 16 {
-				if len(bitrateArgs) != 2 || bitrateArgs[0] != "-b" || bitrateArgs[1] != "16" {
-					t.Errorf("Expected bitrate args [-b 16], got %v", bitrateArgs)
-				}
-			} else {
-				if len(bitrateArgs) != 0 {
-					t.Errorf("Expected no bitrate args for 16-bit, got %v", bitrateArgs)
-				}
+			decision := tc.policy.Decide(&tc.info)
+			if decision != tc.expected {
+				t.Errorf("Expected %+v, got %+v", tc.expected, decision)
 			}
+		})
+	}
 
-			// Test sample rate args for high sample rates
-			expectedMinArgs := 3 // Always has "rate", "-v", "-L"
-			if tc.inputRate == 96000 || tc.inputRate == 192000 || tc.inputRate == 384000 {
-				expectedMinArgs = 4 // Should also have "48000"
-				if len(sampleRateArgs) >= 4 && sampleRateArgs[3] != "48000" {
-					t.Errorf("Expected 48000 target rate, got %s", sampleRateArgs[3])
-				}
-			} else if tc.inputRate == 88200 || tc.inputRate == 176400 || tc.inputRate == 352800 {
-				expectedMinArgs = 4 // Should also have "44100"
-				if len(sampleRateArgs) >= 4 && sampleRateArgs[3] != "44100" {
-					t.Errorf("Expected 44100 target rate, got %s", sampleRateArgs[3])
-				}
-			}
+	t.Run("FromConfig", func(t *testing.T) {
+		originalConfig := config
+		defer func() { config = originalConfig }()
+		config = Config{EnforceOutputFormat: "alac", ReduceBitsAbove: 20, NoUpsample: true}
+		expected := ConversionPolicy{Format: "alac", ReduceBitsAbove: 20, NoUpsample: true}
+		if policy := policyFromConfig(); policy != expected {
+			t.Errorf("Expected %+v, got %+v", expected, policy)
+		}
+	})
 
-			if len(sampleRateArgs) < expectedMinArgs {
-				t.Errorf("Expected at least %d sample rate args, got %d: %v",
-					expectedMinArgs, len(sampleRateArgs), sampleRateArgs)
-			}
+	t.Run("SoxArgs", func(t *testing.T) {
+		changes, bitrateArgs, sampleRateArgs := Decision{TargetBits: 16, TargetRate: 48000, TargetChannels: 2}.soxArgs()
+		if !changes || !slices.Equal(bitrateArgs, []string{"-b", "16", "-c", "2"}) || !slices.Equal(sampleRateArgs, []string{"rate", "-v", "-L", "48000"}) {
+			t.Errorf("Unexpected SoX args: %v %v %v", changes, bitrateArgs, sampleRateArgs)
+		}
+	})
 
-			// Validate the basic structure of format string components
-			if tc.inputBits < 16 || tc.inputBits > 32 {
-				t.Errorf("Unexpected bit depth in test: %d", tc.inputBits)
-			}
-			if tc.inputRate < 22050 || tc.inputRate > 384000 {
-				t.Errorf("Unexpected sample rate in test: %d", tc.inputRate)
-			}
-		})
-	}
+	t.Run("String", func(t *testing.T) {
+		if s := (Decision{Action: "copy", Reason: "already 16-bit 44100 Hz"}).String(); s != "copy: already 16-bit 44100 Hz" {
+			t.Errorf("Unexpected string %q", s)
+		}
+	})
 }
 
 // TestConversionEdgeCases tests edge cases and unusual scenarios
@@ -1610,7 +1755,7 @@ func TestConversionEdgeCases(t *testing.T) {
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			needsConversion, bitrateArgs, sampleRateArgs := determineConversion(&tc.input)
+			needsConversion, bitrateArgs, sampleRateArgs := determineConversion(policyFromConfig(), &tc.input)
 
 			if needsConversion != tc.expectedConversion {
 				t.Errorf("Expected conversion %v, got %v", tc.expectedConversion, needsConversion)
@@ -1733,7 +1878,7 @@ func TestCopyFileSyncError(t *testing.T) {
 	}
 
 	// Copy should fail because destination directory doesn't exist
-	err = copyFile(srcPath, dstPath)
+	err = copyFile(nil, srcPath, dstPath)
 	if err == nil {
 		t.Error("Expected error when destination directory doesn't exist")
 	}
@@ -1760,7 +1905,7 @@ func TestCopyFileLargeFile(t *testing.T) {
 	}
 
 	// Copy the large file
-	err = copyFile(srcPath, dstPath)
+	err = copyFile(nil, srcPath, dstPath)
 	if err != nil {
 		t.Errorf("copyFile failed for large file: %v", err)
 	}
@@ -1837,7 +1982,7 @@ func TestCopyImageFiles(t *testing.T) {
 	config.TargetDir = targetDir
 
 	// Test copyImageFiles
-	err = copyImageFiles()
+	err = copyImageFiles(config.EnforceOutputFormat)
 	if err != nil {
 		t.Fatalf("copyImageFiles failed: %v", err)
 	}
@@ -1875,7 +2020,7 @@ func TestGetAudioInfo(t *testing.T) {
 	testFile := filepath.Join(tmpDir, "test.flac")
 	os.WriteFile(testFile, []byte("dummy"), 0644)
 
-	info, err := getAudioInfo(testFile)
+	info, err := getAudioInfo(nil, testFile)
 	// We expect this to fail since echo doesn't produce sox output, but it tests the function call
 	if err == nil {
 		t.Logf("getAudioInfo succeeded unexpectedly with: %+v", info)
@@ -1978,7 +2123,7 @@ func TestCopyFileReadOnlySource(t *testing.T) {
 	}
 
 	// Test copy operation
-	if err := copyFile(srcPath, dstPath); err != nil {
+	if err := copyFile(nil, srcPath, dstPath); err != nil {
 		t.Fatalf("copyFile failed: %v", err)
 	}
 
@@ -2607,7 +2752,7 @@ func TestMergeMetadataWithFFmpegNoPreserve(t *testing.T) {
 	os.WriteFile(sourcePath, []byte("source"), 0644)
 	os.WriteFile(tempPath, []byte("temp"), 0644)
 
-	err = mergeMetadataWithFFmpeg(sourcePath, tempPath, targetPath)
+	err = mergeMetadataWithFFmpeg(nil, sourcePath, tempPath, targetPath)
 	if err != nil {
 		t.Fatalf("Expected no error when not preserving metadata, got: %v", err)
 	}
@@ -2644,7 +2789,7 @@ func TestMergeMetadataWithFFmpegLocalSuccess(t *testing.T) {
 
 	// This test checks FFmpeg availability and skips if not installed, as mocking exec.Command is complex for unit tests.
 	// The test validates the success path when FFmpeg is available, or gracefully skips when it's not.
-	err = mergeMetadataWithFFmpeg(sourcePath, tempPath, targetPath)
+	err = mergeMetadataWithFFmpeg(nil, sourcePath, tempPath, targetPath)
 	if err != nil {
 		// If ffmpeg not installed, log but don't fail test
 		t.Logf("FFmpeg not available, skipping success test: %v", err)
@@ -2686,7 +2831,7 @@ func TestMergeMetadataWithFFmpegLocalFailure(t *testing.T) {
 		t.Skip("FFmpeg is available, cannot test failure case easily without mocking")
 	}
 
-	err = mergeMetadataWithFFmpeg(sourcePath, tempPath, targetPath)
+	err = mergeMetadataWithFFmpeg(nil, sourcePath, tempPath, targetPath)
 	if err == nil {
 		t.Error("Expected error when FFmpeg fails")
 	}
@@ -2720,7 +2865,7 @@ func TestMergeMetadataWithFFmpegDocker(t *testing.T) {
 	os.WriteFile(sourcePath, []byte("source"), 0644)
 	os.WriteFile(tempPath, []byte("temp"), 0644)
 
-	err = mergeMetadataWithFFmpeg(sourcePath, tempPath, targetPath)
+	err = mergeMetadataWithFFmpeg(nil, sourcePath, tempPath, targetPath)
 	if err == nil {
 		t.Error("Expected Docker error but got nil")
 	}
@@ -2755,7 +2900,7 @@ func TestMergeMetadataDockerFailure(t *testing.T) {
 	config.SourceDir = tmpDir
 	config.TargetDir = tmpDir
 
-	err = mergeMetadataWithFFmpeg(sourcePath, tempPath, targetPath)
+	err = mergeMetadataWithFFmpeg(nil, sourcePath, tempPath, targetPath)
 	if err == nil {
 		t.Error("Expected Docker error but got nil")
 	}
@@ -2792,7 +2937,7 @@ func TestFFmpegExecutionPaths(t *testing.T) {
 			t.Skipf("FFmpeg not available locally, skipping local execution test: %v", err)
 		}
 
-		err = mergeMetadataWithFFmpeg(sourcePath, tempPath, targetPath)
+		err = mergeMetadataWithFFmpeg(nil, sourcePath, tempPath, targetPath)
 		if err != nil {
 			t.Logf("Local FFmpeg execution failed (may be expected with dummy files): %v", err)
 		} else {
@@ -2829,7 +2974,7 @@ func TestFFmpegExecutionPaths(t *testing.T) {
 			t.Skipf("Docker not available, skipping Docker execution test: %v", err)
 		}
 
-		err = mergeMetadataWithFFmpeg(sourcePath, tempPath, targetPath)
+		err = mergeMetadataWithFFmpeg(nil, sourcePath, tempPath, targetPath)
 		if err != nil {
 			t.Logf("Docker FFmpeg execution failed (expected with test image): %v", err)
 		} else {
@@ -2859,7 +3004,7 @@ func TestFFmpegExecutionPaths(t *testing.T) {
 			t.Skip("FFmpeg is available, cannot test missing binary scenario")
 		}
 
-		err = mergeMetadataWithFFmpeg(sourcePath, tempPath, targetPath)
+		err = mergeMetadataWithFFmpeg(nil, sourcePath, tempPath, targetPath)
 		if err == nil {
 			t.Error("Expected error when FFmpeg binary is not found")
 		} else {
@@ -2880,6 +3025,7 @@ func TestMergeMetadataWithFFmpegTempRemovalError(t *testing.T) {
 	config.NoPreserveMetadata = false
 	config.UseDocker = false
 	config.SoxCommand = "true" // Mock sox success
+	config.NoPostcheck = true  // The mock writes no FLAC to check
 
 	tmpDir, err := os.MkdirTemp("", "test-convert-metadata")
 	if err != nil {
@@ -2896,7 +3042,7 @@ func TestMergeMetadataWithFFmpegTempRemovalError(t *testing.T) {
 	bitrateArgs := []string{"-b", "16"}
 	sampleRateArgs := []string{"rate", "-v", "-L", "44100"}
 
-	err = processFlac(sourcePath, targetPath, true, bitrateArgs, sampleRateArgs)
+	err = processFlac(newFileTask(sourcePath), sourcePath, targetPath, true, bitrateArgs, sampleRateArgs)
 	if err != nil {
 		// If ffmpeg not available, accept fallback rename error as known case
 		if strings.Contains(err.Error(), "fallback rename failed") || strings.Contains(err.Error(), "FFmpeg metadata merge failed") {
@@ -2935,7 +3081,7 @@ func TestProcessFlacDockerFailure(t *testing.T) {
 	bitrateArgs := []string{"-b", "16"}
 	sampleRateArgs := []string{"rate", "-v", "-L", "44100"}
 
-	err = processFlac(sourcePath, targetPath, true, bitrateArgs, sampleRateArgs)
+	err = processFlac(newFileTask(sourcePath), sourcePath, targetPath, true, bitrateArgs, sampleRateArgs)
 	if err == nil {
 		t.Error("Expected Docker failure but got nil")
 	}
@@ -2968,7 +3114,7 @@ func TestProcessFlacMetadataFallback(t *testing.T) {
 	bitrateArgs := []string{"-b", "16"}
 	sampleRateArgs := []string{"rate", "-v", "-L", "44100"}
 
-	err = processFlac(sourcePath, targetPath, true, bitrateArgs, sampleRateArgs)
+	err = processFlac(newFileTask(sourcePath), sourcePath, targetPath, true, bitrateArgs, sampleRateArgs)
 	if err == nil {
 		t.Error("Expected error on sox failure")
 	}
@@ -3002,7 +3148,7 @@ func TestProcessFlacNoConversionWithMetadata(t *testing.T) {
 	bitrateArgs := []string{}
 	sampleRateArgs := []string{"rate", "-v", "-L"}
 
-	err = processFlac(sourcePath, targetPath, false, bitrateArgs, sampleRateArgs)
+	err = processFlac(newFileTask(sourcePath), sourcePath, targetPath, false, bitrateArgs, sampleRateArgs)
 	if err != nil {
 		t.Errorf("Expected no error for no conversion, got: %v", err)
 	}
@@ -3105,6 +3251,19 @@ func TestFFmpegBinaryExistence(t *testing.T) {
 		}
 	})
 
+	t.Run("ABRWithoutMetadataPreservation_FFmpegRequired", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		sox := writeFakeTool(t, tmpDir, "sox", "exit 0")
+		savedConfig, originalPath := config, os.Getenv("PATH")
+		defer func() { config = savedConfig; os.Setenv("PATH", originalPath) }()
+		os.Setenv("PATH", tmpDir)
+
+		config = Config{SourceDir: tmpDir, TargetDir: tmpDir, SoxCommand: sox, NoPreserveMetadata: true, EnforceOutputFormat: "mp3", MP3Mode: "abr"}
+		if err := setupSoxCommand(); err == nil || !strings.Contains(err.Error(), "ffmpeg is not installed") {
+			t.Errorf("Expected ABR output to require FFmpeg up front, got: %v", err)
+		}
+	})
+
 	t.Run("DockerMode_FFmpegNotRequiredLocally", func(t *testing.T) {
 		config.UseDocker = true
 		config.NoPreserveMetadata = false // Metadata preservation enabled
@@ -3251,6 +3410,7 @@ func TestProcessFlac(t *testing.T) {
 
 	originalConfig := config
 	defer func() { config = originalConfig }()
+	config.NoPostcheck = true // The mocked SoX writes no FLAC to check
 
 	t.Run("NoConversionCopy", func(t *testing.T) {
 		config.UseDocker = false
@@ -3258,7 +3418,7 @@ func TestProcessFlac(t *testing.T) {
 		config.NoPreserveMetadata = true
 		bitrateArgs := []string{}
 		sampleRateArgs := []string{"rate", "-v", "-L"}
-		err := processFlac(sourcePath, targetPath, false, bitrateArgs, sampleRateArgs)
+		err := processFlac(newFileTask(sourcePath), sourcePath, targetPath, false, bitrateArgs, sampleRateArgs)
 		if err != nil {
 			t.Errorf("Expected no error for no conversion, got: %v", err)
 		}
@@ -3273,7 +3433,7 @@ func TestProcessFlac(t *testing.T) {
 		config.NoPreserveMetadata = true
 		bitrateArgs := []string{"-b", "16"}
 		sampleRateArgs := []string{"rate", "-v", "-L"}
-		err := processFlac(sourcePath, targetPath, true, bitrateArgs, sampleRateArgs)
+		err := processFlac(newFileTask(sourcePath), sourcePath, targetPath, true, bitrateArgs, sampleRateArgs)
 		if err != nil {
 			t.Logf("Conversion error (if no sox): %v", err)
 		}
@@ -3285,7 +3445,7 @@ func TestProcessFlac(t *testing.T) {
 		config.NoPreserveMetadata = true
 		bitrateArgs := []string{}
 		sampleRateArgs := []string{"rate", "-v", "-L", "44100"}
-		err := processFlac(sourcePath, targetPath, true, bitrateArgs, sampleRateArgs)
+		err := processFlac(newFileTask(sourcePath), sourcePath, targetPath, true, bitrateArgs, sampleRateArgs)
 		if err != nil {
 			t.Logf("Conversion error (if no sox): %v", err)
 		}
@@ -3298,7 +3458,7 @@ func TestProcessFlac(t *testing.T) {
 		// Assume FFmpeg available or test fallback
 		bitrateArgs := []string{"-b", "16"}
 		sampleRateArgs := []string{"rate", "-v", "-L", "44100"}
-		err := processFlac(sourcePath, targetPath, true, bitrateArgs, sampleRateArgs)
+		err := processFlac(newFileTask(sourcePath), sourcePath, targetPath, true, bitrateArgs, sampleRateArgs)
 		if err != nil {
 			t.Logf("Metadata preserve error (if no ffmpeg): %v", err)
 		}
@@ -3311,7 +3471,7 @@ func TestProcessFlac(t *testing.T) {
 		// If FFmpeg fails, fallback rename
 		bitrateArgs := []string{"-b", "16"}
 		sampleRateArgs := []string{"rate", "-v", "-L", "44100"}
-		err := processFlac(sourcePath, targetPath, true, bitrateArgs, sampleRateArgs)
+		err := processFlac(newFileTask(sourcePath), sourcePath, targetPath, true, bitrateArgs, sampleRateArgs)
 		if err != nil {
 			t.Logf("Expected fallback on metadata fail: %v", err)
 		}
@@ -3327,7 +3487,7 @@ func TestProcessFlac(t *testing.T) {
 		config.TargetDir = tmpDir
 		bitrateArgs := []string{"-b", "16"}
 		sampleRateArgs := []string{"rate", "-v", "-L", "44100"}
-		err := processFlac(sourcePath, targetPath, true, bitrateArgs, sampleRateArgs)
+		err := processFlac(newFileTask(sourcePath), sourcePath, targetPath, true, bitrateArgs, sampleRateArgs)
 		if err == nil {
 			t.Logf("Docker conversion succeeded unexpectedly")
 		}
@@ -3339,7 +3499,7 @@ func TestProcessFlac(t *testing.T) {
 		config.NoPreserveMetadata = true
 		bitrateArgs := []string{"-b", "16"}
 		sampleRateArgs := []string{"rate", "-v", "-L", "44100"}
-		err := processFlac(sourcePath, targetPath, true, bitrateArgs, sampleRateArgs)
+		err := processFlac(newFileTask(sourcePath), sourcePath, targetPath, true, bitrateArgs, sampleRateArgs)
 		if err == nil {
 			t.Error("Expected error on sox failure")
 		}
@@ -3574,7 +3734,7 @@ func TestMergeMetadataDocker(t *testing.T) {
 	os.WriteFile(sourcePath, []byte("source"), 0644)
 	os.WriteFile(tempPath, []byte("temp"), 0644)
 
-	err = mergeMetadataWithFFmpeg(sourcePath, tempPath, targetPath)
+	err = mergeMetadataWithFFmpeg(nil, sourcePath, tempPath, targetPath)
 	t.Logf("Docker merge error expected: %v", err)
 }
 
@@ -4007,7 +4167,7 @@ func TestDetermineConversionWithALAC(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			needsConversion, bitrateArgs, sampleRateArgs := determineConversion(tt.audioInfo)
+			needsConversion, bitrateArgs, sampleRateArgs := determineConversion(policyFromConfig(), tt.audioInfo)
 
 			if needsConversion != tt.expectedConversion {
 				t.Errorf("Expected needsConversion %v, got %v", tt.expectedConversion, needsConversion)
@@ -4067,8 +4227,8 @@ func TestGetAudioInfoALAC(t *testing.T) {
 
 	// Note: These will fail because we don't have actual audio files
 	// but we can test that the right functions are called
-	_, err1 := getAudioInfo(alacFile)
-	_, err2 := getAudioInfo(flacFile)
+	_, err1 := getAudioInfo(nil, alacFile)
+	_, err2 := getAudioInfo(nil, flacFile)
 
 	// We expect errors because these are fake files, but we can verify
 	// the function routing worked by checking the error messages
@@ -4112,7 +4272,7 @@ func TestProcessAudioFile(t *testing.T) {
 	}
 
 	// Test FLAC route (should call processFlac)
-	err = processAudioFile(sourcePath, targetPath, flacInfo, false, []string{}, []string{})
+	err = processAudioFile(newFileTask(sourcePath), sourcePath, targetPath, flacInfo, false, []string{}, []string{})
 	// This may succeed if the fake file is just copied without processing
 	if err != nil {
 		t.Logf("FLAC processing failed as expected: %v", err)
@@ -4129,7 +4289,7 @@ func TestProcessAudioFile(t *testing.T) {
 	}
 
 	// Test ALAC route (should call processALAC)
-	err = processAudioFile(alacSourcePath, alacTargetPath, alacInfo, false, []string{}, []string{})
+	err = processAudioFile(newFileTask(alacSourcePath), alacSourcePath, alacTargetPath, alacInfo, false, []string{}, []string{})
 	if err == nil {
 		t.Error("Expected error for fake ALAC file, got none")
 	}
@@ -4164,7 +4324,7 @@ func TestProcessALAC(t *testing.T) {
 		config.TargetDir = tmpDir
 
 		// Should fail because ffmpeg is not available, but we can test the path
-		err := processALAC(sourcePath, targetPath, false, []string{}, []string{})
+		err := processALAC(newFileTask(sourcePath), sourcePath, targetPath, false, []string{}, []string{})
 		if err == nil {
 			t.Error("Expected error for missing ffmpeg, got none")
 		}
@@ -4180,7 +4340,7 @@ func TestProcessALAC(t *testing.T) {
 		config.TargetDir = tmpDir
 
 		// Should fail because ffmpeg is not available
-		err := processALAC(sourcePath, targetPath, true, []string{"-b", "16"}, []string{"rate", "-v", "-L", "48000"})
+		err := processALAC(newFileTask(sourcePath), sourcePath, targetPath, true, []string{"-b", "16"}, []string{"rate", "-v", "-L", "48000"})
 		if err == nil {
 			t.Error("Expected error for missing ffmpeg, got none")
 		}
@@ -4197,7 +4357,7 @@ func TestProcessALAC(t *testing.T) {
 		config.DockerImage = "test/image"
 
 		// Should fail because docker image doesn't exist, but we can test the path
-		err := processALAC(sourcePath, targetPath, false, []string{}, []string{})
+		err := processALAC(newFileTask(sourcePath), sourcePath, targetPath, false, []string{}, []string{})
 		if err == nil {
 			t.Log("Docker might not be available or test image doesn't exist")
 		}
@@ -4213,7 +4373,7 @@ func TestProcessALAC(t *testing.T) {
 		// Test with various bit depths and effects
 		bitDepths := []string{"16", "24"}
 		for _, depth := range bitDepths {
-			err := processALAC(sourcePath, targetPath, true, []string{"-b", depth}, []string{"rate", "-v", "-L", "44100"})
+			err := processALAC(newFileTask(sourcePath), sourcePath, targetPath, true, []string{"-b", depth}, []string{"rate", "-v", "-L", "44100"})
 			if err == nil {
 				t.Errorf("Expected error for bit depth %s, got none", depth)
 			}
@@ -4227,7 +4387,7 @@ func TestProcessALAC(t *testing.T) {
 		config.TargetDir = tmpDir
 		config.DockerImage = "test/image"
 
-		err := processALAC(sourcePath, targetPath, true, []string{"-b", "16"}, []string{"rate", "-v", "-L", "44100"})
+		err := processALAC(newFileTask(sourcePath), sourcePath, targetPath, true, []string{"-b", "16"}, []string{"rate", "-v", "-L", "44100"})
 		// This will test Docker command construction even if it fails
 		if err != nil {
 			t.Logf("Expected Docker failure: %v", err)
@@ -4241,7 +4401,7 @@ func TestProcessALAC(t *testing.T) {
 		config.TargetDir = tmpDir
 
 		// Test the metadata-only preservation path
-		err := processALAC(sourcePath, targetPath, false, []string{}, []string{})
+		err := processALAC(newFileTask(sourcePath), sourcePath, targetPath, false, []string{}, []string{})
 		if err != nil {
 			// Should fail due to missing ffmpeg, but tests the code path
 			t.Logf("Expected metadata preservation failure: %v", err)
@@ -4255,7 +4415,7 @@ func TestProcessALAC(t *testing.T) {
 		config.TargetDir = tmpDir
 
 		nonExistentSource := filepath.Join(tmpDir, "nonexistent.m4a")
-		err := processALAC(nonExistentSource, targetPath, false, []string{}, []string{})
+		err := processALAC(newFileTask(nonExistentSource), nonExistentSource, targetPath, false, []string{}, []string{})
 		if err == nil {
 			t.Error("Expected error for non-existent source file")
 		}
@@ -4285,7 +4445,7 @@ func TestGetALACInfoError(t *testing.T) {
 		config.UseDocker = false
 
 		// This should fail because ffprobe/ffmpeg is not available
-		_, err := getALACInfo(alacFile)
+		_, err := getALACInfo(nil, alacFile)
 		if err == nil {
 			t.Error("Expected error when ffprobe is not available, got none")
 		}
@@ -4299,7 +4459,7 @@ func TestGetALACInfoError(t *testing.T) {
 		config.DockerImage = "test/image"
 
 		// This might fail due to docker not being available or test image not existing
-		_, err := getALACInfo(alacFile)
+		_, err := getALACInfo(nil, alacFile)
 		if err != nil {
 			t.Logf("Docker ALAC info extraction failed (expected): %v", err)
 		}
@@ -4745,7 +4905,7 @@ func TestCopyImageFilesEdgeCases(t *testing.T) {
 			t.Fatal(err)
 		}
 
-		err := copyImageFiles()
+		err := copyImageFiles(config.EnforceOutputFormat)
 		if err != nil {
 			t.Errorf("copyImageFiles failed: %v", err)
 		}
@@ -4793,7 +4953,7 @@ func TestCopyImageFilesEdgeCases(t *testing.T) {
 			t.Fatal(err)
 		}
 
-		err = copyImageFiles()
+		err = copyImageFiles(config.EnforceOutputFormat)
 		if err != nil {
 			t.Errorf("copyImageFiles failed: %v", err)
 		}
@@ -4888,7 +5048,7 @@ func TestMergeMetadataWithFFmpegEdgeCases(t *testing.T) {
 	t.Run("NoPreserveMetadata", func(t *testing.T) {
 		config.NoPreserveMetadata = true
 
-		err := mergeMetadataWithFFmpeg(sourcePath, tempPath, targetPath)
+		err := mergeMetadataWithFFmpeg(nil, sourcePath, tempPath, targetPath)
 		if err != nil {
 			t.Errorf("mergeMetadataWithFFmpeg with NoPreserveMetadata failed: %v", err)
 		}
@@ -4912,7 +5072,7 @@ func TestMergeMetadataWithFFmpegEdgeCases(t *testing.T) {
 		config.NoPreserveMetadata = false
 		config.UseDocker = false
 
-		err := mergeMetadataWithFFmpeg(sourcePath, tempPath, targetPath)
+		err := mergeMetadataWithFFmpeg(nil, sourcePath, tempPath, targetPath)
 		if err == nil {
 			t.Error("Expected error when FFmpeg is not available locally")
 		}
@@ -5064,7 +5224,7 @@ func TestAudioInfoStruct(t *testing.T) {
 
 func TestFileOperationEdgeCases(t *testing.T) {
 	// Test copyFile with invalid source
-	err := copyFile("/non/existent/file", "/tmp/target")
+	err := copyFile(nil, "/non/existent/file", "/tmp/target")
 	if err == nil {
 		t.Error("Expected error when copying non-existent file")
 	}
@@ -5083,7 +5243,7 @@ func TestFileOperationEdgeCases(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	err = copyFile(srcPath, dstPath)
+	err = copyFile(nil, srcPath, dstPath)
 	if err != nil {
 		t.Errorf("copyFile failed: %v", err)
 	}
@@ -5309,7 +5469,7 @@ func TestProcessAudioFilesCoverage(t *testing.T) {
 			NoPreserveMetadata: true,
 		}
 
-		// This should process .flac, .mp3, .m4a but skip .txt and .wav
+		// This should process .flac, .mp3, .m4a and .wav but skip .txt
 		err = processAudioFiles()
 		if err != nil {
 			t.Logf("processAudioFiles with various extensions: %v", err)
@@ -5327,12 +5487,12 @@ func TestProcessAudioFilesCoverage(t *testing.T) {
 			t.Error("MP3 file should have been copied")
 		}
 
-		// .txt and .wav should not be processed
+		// .txt should not be processed; the unreadable WAV is copied as it is
 		if processedFiles["test.txt"] {
 			t.Error("TXT file should not have been processed")
 		}
-		if processedFiles["test.wav"] {
-			t.Error("WAV file should not have been processed")
+		if !processedFiles["test.wav"] {
+			t.Error("WAV file should have been processed")
 		}
 	})
 }
@@ -5366,7 +5526,7 @@ func TestFinalCoveragePushOver75(t *testing.T) {
 		}
 
 		// This exercises the metadata preservation failure path in processFlac
-		err = processFlac(sourceFile, targetFile, false, []string{}, []string{})
+		err = processFlac(newFileTask(sourceFile), sourceFile, targetFile, false, []string{}, []string{})
 		if err != nil {
 			t.Logf("processFlac metadata path error: %v", err)
 		}
@@ -5481,7 +5641,7 @@ func TestProcessAudioFileWithEnforcedFormat(t *testing.T) {
 
 	t.Run("EnforceMP3FromMP3", func(t *testing.T) {
 		targetPath := filepath.Join(tmpDir, "target.mp3")
-		err := processAudioFileWithEnforcedFormat(mp3File, targetPath, ".mp3")
+		err := processAudioFileWithEnforcedFormat(newFileTask(mp3File), mp3File, targetPath, ".mp3")
 		if err != nil {
 			t.Errorf("processAudioFileWithEnforcedFormat failed: %v", err)
 		}
@@ -5489,7 +5649,7 @@ func TestProcessAudioFileWithEnforcedFormat(t *testing.T) {
 
 	t.Run("EnforceMP3FromFLAC", func(t *testing.T) {
 		targetPath := filepath.Join(tmpDir, "target.mp3")
-		err := processAudioFileWithEnforcedFormat(flacFile, targetPath, ".flac")
+		err := processAudioFileWithEnforcedFormat(newFileTask(flacFile), flacFile, targetPath, ".flac")
 		// This will fail because we don't have real sox, but we test the path
 		if err == nil {
 			t.Log("processAudioFileWithEnforcedFormat unexpectedly succeeded")
@@ -5500,7 +5660,7 @@ func TestProcessAudioFileWithEnforcedFormat(t *testing.T) {
 
 	t.Run("EnforceMP3FromALAC", func(t *testing.T) {
 		targetPath := filepath.Join(tmpDir, "target.mp3")
-		err := processAudioFileWithEnforcedFormat(alacFile, targetPath, ".m4a")
+		err := processAudioFileWithEnforcedFormat(newFileTask(alacFile), alacFile, targetPath, ".m4a")
 		// This will fail because we don't have real ffmpeg, but we test the path
 		if err == nil {
 			t.Log("processAudioFileWithEnforcedFormat unexpectedly succeeded")
@@ -5512,7 +5672,7 @@ func TestProcessAudioFileWithEnforcedFormat(t *testing.T) {
 	config.EnforceOutputFormat = "flac"
 	t.Run("EnforceFlacFromMP3", func(t *testing.T) {
 		targetPath := filepath.Join(tmpDir, "target.flac")
-		err := processAudioFileWithEnforcedFormat(mp3File, targetPath, ".mp3")
+		err := processAudioFileWithEnforcedFormat(newFileTask(mp3File), mp3File, targetPath, ".mp3")
 		// This will fail because we don't have real sox, but we test the path
 		if err == nil {
 			t.Log("processAudioFileWithEnforcedFormat unexpectedly succeeded")
@@ -5523,7 +5683,7 @@ func TestProcessAudioFileWithEnforcedFormat(t *testing.T) {
 
 	t.Run("EnforceFlacFromFLAC", func(t *testing.T) {
 		targetPath := filepath.Join(tmpDir, "target.flac")
-		err := processAudioFileWithEnforcedFormat(flacFile, targetPath, ".flac")
+		err := processAudioFileWithEnforcedFormat(newFileTask(flacFile), flacFile, targetPath, ".flac")
 		if err != nil {
 			t.Errorf("processAudioFileWithEnforcedFormat FLAC to FLAC failed: %v", err)
 		}
@@ -5531,7 +5691,7 @@ func TestProcessAudioFileWithEnforcedFormat(t *testing.T) {
 
 	t.Run("EnforceFlacFromALAC", func(t *testing.T) {
 		targetPath := filepath.Join(tmpDir, "target.flac")
-		err := processAudioFileWithEnforcedFormat(alacFile, targetPath, ".m4a")
+		err := processAudioFileWithEnforcedFormat(newFileTask(alacFile), alacFile, targetPath, ".m4a")
 		// This will fail because we don't have real ffmpeg, but we test the path
 		if err == nil {
 			t.Log("processAudioFileWithEnforcedFormat unexpectedly succeeded")
@@ -5543,7 +5703,7 @@ func TestProcessAudioFileWithEnforcedFormat(t *testing.T) {
 	config.EnforceOutputFormat = "alac"
 	t.Run("EnforceALACFromMP3", func(t *testing.T) {
 		targetPath := filepath.Join(tmpDir, "target.m4a")
-		err := processAudioFileWithEnforcedFormat(mp3File, targetPath, ".mp3")
+		err := processAudioFileWithEnforcedFormat(newFileTask(mp3File), mp3File, targetPath, ".mp3")
 		// This will fail because we don't have real ffmpeg, but we test the path
 		if err == nil {
 			t.Log("processAudioFileWithEnforcedFormat unexpectedly succeeded")
@@ -5554,7 +5714,7 @@ func TestProcessAudioFileWithEnforcedFormat(t *testing.T) {
 
 	t.Run("EnforceALACFromFLAC", func(t *testing.T) {
 		targetPath := filepath.Join(tmpDir, "target.m4a")
-		err := processAudioFileWithEnforcedFormat(flacFile, targetPath, ".flac")
+		err := processAudioFileWithEnforcedFormat(newFileTask(flacFile), flacFile, targetPath, ".flac")
 		// This will fail because we don't have real ffmpeg, but we test the path
 		if err == nil {
 			t.Log("processAudioFileWithEnforcedFormat unexpectedly succeeded")
@@ -5565,20 +5725,20 @@ func TestProcessAudioFileWithEnforcedFormat(t *testing.T) {
 
 	t.Run("EnforceALACFromALAC", func(t *testing.T) {
 		targetPath := filepath.Join(tmpDir, "target.m4a")
-		err := processAudioFileWithEnforcedFormat(alacFile, targetPath, ".m4a")
+		err := processAudioFileWithEnforcedFormat(newFileTask(alacFile), alacFile, targetPath, ".m4a")
 		if err != nil {
 			t.Errorf("processAudioFileWithEnforcedFormat ALAC to ALAC failed: %v", err)
 		}
 	})
 
 	t.Run("UnsupportedSourceFormat", func(t *testing.T) {
-		wavFile := filepath.Join(tmpDir, "test.wav")
-		if err := os.WriteFile(wavFile, []byte("fake wav data"), 0644); err != nil {
+		oggFile := filepath.Join(tmpDir, "test.ogg")
+		if err := os.WriteFile(oggFile, []byte("fake ogg data"), 0644); err != nil {
 			t.Fatal(err)
 		}
 
 		targetPath := filepath.Join(tmpDir, "target.mp3")
-		err := processAudioFileWithEnforcedFormat(wavFile, targetPath, ".wav")
+		err := processAudioFileWithEnforcedFormat(newFileTask(oggFile), oggFile, targetPath, ".ogg")
 		if err == nil {
 			t.Error("Expected error for unsupported source format")
 		}
@@ -5590,7 +5750,7 @@ func TestProcessAudioFileWithEnforcedFormat(t *testing.T) {
 		defer func() { config.UseDocker = false }()
 
 		targetPath := filepath.Join(tmpDir, "target.m4a")
-		err := processAudioFileWithEnforcedFormat(flacFile, targetPath, ".flac")
+		err := processAudioFileWithEnforcedFormat(newFileTask(flacFile), flacFile, targetPath, ".flac")
 		// This will test Docker command construction even if it fails
 		if err != nil {
 			t.Logf("Expected Docker failure: %v", err)
@@ -5628,7 +5788,7 @@ func TestProcessToFLAC(t *testing.T) {
 	}
 
 	t.Run("MP3ToFLAC", func(t *testing.T) {
-		err := processToFLAC(sourceFile, targetFile, ".mp3", nil)
+		err := processToFLAC(newFileTask(sourceFile), sourceFile, targetFile, ".mp3", nil)
 		if err == nil {
 			t.Log("processToFLAC unexpectedly succeeded")
 		} else {
@@ -5637,7 +5797,7 @@ func TestProcessToFLAC(t *testing.T) {
 	})
 
 	t.Run("ALACToFLAC", func(t *testing.T) {
-		err := processToFLAC(alacSourceFile, targetFile, ".m4a", nil)
+		err := processToFLAC(newFileTask(alacSourceFile), alacSourceFile, targetFile, ".m4a", nil)
 		if err == nil {
 			t.Log("processToFLAC ALAC conversion unexpectedly succeeded")
 		} else {
@@ -5647,7 +5807,7 @@ func TestProcessToFLAC(t *testing.T) {
 
 	t.Run("ALACToFLACWithAudioInfo", func(t *testing.T) {
 		audioInfo := &AudioInfo{Bits: 24, Rate: 96000, Format: "alac"}
-		err := processToFLAC(alacSourceFile, targetFile, ".m4a", audioInfo)
+		err := processToFLAC(newFileTask(alacSourceFile), alacSourceFile, targetFile, ".m4a", audioInfo)
 		if err == nil {
 			t.Log("processToFLAC ALAC with audio info unexpectedly succeeded")
 		} else {
@@ -5656,7 +5816,7 @@ func TestProcessToFLAC(t *testing.T) {
 	})
 
 	t.Run("UnsupportedFormat", func(t *testing.T) {
-		err := processToFLAC(sourceFile, targetFile, ".wav", nil)
+		err := processToFLAC(newFileTask(sourceFile), sourceFile, targetFile, ".wav", nil)
 		if err == nil {
 			t.Error("Expected error for unsupported format")
 		}
@@ -5667,7 +5827,7 @@ func TestProcessToFLAC(t *testing.T) {
 		config.DockerImage = "test-image"
 		defer func() { config.UseDocker = false }()
 
-		err := processToFLAC(sourceFile, targetFile, ".mp3", nil)
+		err := processToFLAC(newFileTask(sourceFile), sourceFile, targetFile, ".mp3", nil)
 		if err == nil {
 			t.Log("processToFLAC with Docker unexpectedly succeeded")
 		} else {
@@ -5679,7 +5839,7 @@ func TestProcessToFLAC(t *testing.T) {
 		config.NoPreserveMetadata = false
 		defer func() { config.NoPreserveMetadata = true }()
 
-		err := processToFLAC(sourceFile, targetFile, ".mp3", nil)
+		err := processToFLAC(newFileTask(sourceFile), sourceFile, targetFile, ".mp3", nil)
 		if err == nil {
 			t.Log("processToFLAC with metadata unexpectedly succeeded")
 		} else {
@@ -5714,7 +5874,7 @@ func TestProcessToMP3(t *testing.T) {
 	}
 
 	t.Run("MP3ToMP3Copy", func(t *testing.T) {
-		err := processToMP3(sourceFile, targetFile, ".mp3", nil)
+		err := processToMP3(newFileTask(sourceFile), sourceFile, targetFile, ".mp3", nil)
 		if err != nil {
 			t.Errorf("processToMP3 copy failed: %v", err)
 		}
@@ -5722,7 +5882,7 @@ func TestProcessToMP3(t *testing.T) {
 
 	t.Run("FLACToMP3", func(t *testing.T) {
 		audioInfo := &AudioInfo{Bits: 16, Rate: 44100, Format: "flac"}
-		err := processToMP3(sourceFile, targetFile, ".flac", audioInfo)
+		err := processToMP3(newFileTask(sourceFile), sourceFile, targetFile, ".flac", audioInfo)
 		if err == nil {
 			t.Log("processToMP3 conversion unexpectedly succeeded")
 		} else {
@@ -5749,16 +5909,17 @@ func TestProcessToALAC(t *testing.T) {
 	}
 
 	config = Config{
-		SourceDir:          tmpDir,
-		TargetDir:          tmpDir,
-		UseDocker:          false,
-		NoPreserveMetadata: true,
-		SoxCommand:         "echo", // Mock command
+		SourceDir:           tmpDir,
+		TargetDir:           tmpDir,
+		UseDocker:           false,
+		NoPreserveMetadata:  true,
+		SoxCommand:          "echo", // Mock command
+		EnforceOutputFormat: "alac",
 	}
 
 	t.Run("ALACToALACCopy", func(t *testing.T) {
 		audioInfo := &AudioInfo{Bits: 16, Rate: 44100, Format: "alac"}
-		err := processToALAC(sourceFile, targetFile, ".m4a", audioInfo)
+		err := processToALAC(newFileTask(sourceFile), sourceFile, targetFile, ".m4a", audioInfo)
 		if err != nil {
 			t.Errorf("processToALAC copy failed: %v", err)
 		}
@@ -5766,7 +5927,7 @@ func TestProcessToALAC(t *testing.T) {
 
 	t.Run("ALACToALACConvert", func(t *testing.T) {
 		audioInfo := &AudioInfo{Bits: 24, Rate: 96000, Format: "alac"}
-		err := processToALAC(sourceFile, targetFile, ".m4a", audioInfo)
+		err := processToALAC(newFileTask(sourceFile), sourceFile, targetFile, ".m4a", audioInfo)
 		if err == nil {
 			t.Log("processToALAC conversion unexpectedly succeeded")
 		} else {
@@ -5776,7 +5937,7 @@ func TestProcessToALAC(t *testing.T) {
 
 	t.Run("MP3ToALAC", func(t *testing.T) {
 		audioInfo := &AudioInfo{Bits: 16, Rate: 44100, Format: "mp3"}
-		err := processToALAC(sourceFile, targetFile, ".mp3", audioInfo)
+		err := processToALAC(newFileTask(sourceFile), sourceFile, targetFile, ".mp3", audioInfo)
 		if err == nil {
 			t.Log("processToALAC from MP3 unexpectedly succeeded")
 		} else {
@@ -5785,7 +5946,7 @@ func TestProcessToALAC(t *testing.T) {
 	})
 
 	t.Run("UnsupportedFormat", func(t *testing.T) {
-		err := processToALAC(sourceFile, targetFile, ".wav", nil)
+		err := processToALAC(newFileTask(sourceFile), sourceFile, targetFile, ".wav", nil)
 		if err == nil {
 			t.Error("Expected error for unsupported format")
 		}
@@ -5819,7 +5980,7 @@ func TestConvertToMP3(t *testing.T) {
 
 	t.Run("ConvertWithAudioInfo", func(t *testing.T) {
 		audioInfo := &AudioInfo{Bits: 16, Rate: 48000, Format: "flac"}
-		err := convertToMP3(sourceFile, targetFile, audioInfo)
+		err := convertToMP3(newFileTask(sourceFile), sourceFile, targetFile, audioInfo)
 		if err == nil {
 			t.Log("convertToMP3 unexpectedly succeeded")
 		} else {
@@ -5828,7 +5989,7 @@ func TestConvertToMP3(t *testing.T) {
 	})
 
 	t.Run("ConvertWithoutAudioInfo", func(t *testing.T) {
-		err := convertToMP3(sourceFile, targetFile, nil)
+		err := convertToMP3(newFileTask(sourceFile), sourceFile, targetFile, nil)
 		if err == nil {
 			t.Log("convertToMP3 without audio info unexpectedly succeeded")
 		} else {
@@ -5841,7 +6002,7 @@ func TestConvertToMP3(t *testing.T) {
 
 	t.Run("ConvertWithDocker", func(t *testing.T) {
 		audioInfo := &AudioInfo{Bits: 16, Rate: 44100, Format: "flac"}
-		err := convertToMP3(sourceFile, targetFile, audioInfo)
+		err := convertToMP3(newFileTask(sourceFile), sourceFile, targetFile, audioInfo)
 		if err == nil {
 			t.Log("convertToMP3 with Docker unexpectedly succeeded")
 		} else {
@@ -5863,7 +6024,7 @@ func TestConvertToMP3(t *testing.T) {
 		}
 
 		audioInfo := &AudioInfo{Bits: 16, Rate: 44100, Format: "flac"}
-		err := convertToMP3(sourceFile, finalFile, audioInfo)
+		err := convertToMP3(newFileTask(sourceFile), sourceFile, finalFile, audioInfo)
 
 		// This should attempt metadata preservation and likely fail with mock commands,
 		// but we're testing the code path
@@ -5900,7 +6061,7 @@ func TestConvertToALAC(t *testing.T) {
 
 	t.Run("ConvertWithAudioInfo", func(t *testing.T) {
 		audioInfo := &AudioInfo{Bits: 16, Rate: 48000, Format: "flac"}
-		err := convertToALAC(sourceFile, targetFile, audioInfo)
+		err := convertToALAC(newFileTask(sourceFile), sourceFile, targetFile, audioInfo)
 		if err == nil {
 			t.Log("convertToALAC unexpectedly succeeded")
 		} else {
@@ -5909,7 +6070,7 @@ func TestConvertToALAC(t *testing.T) {
 	})
 
 	t.Run("ConvertWithoutAudioInfo", func(t *testing.T) {
-		err := convertToALAC(sourceFile, targetFile, nil)
+		err := convertToALAC(newFileTask(sourceFile), sourceFile, targetFile, nil)
 		if err == nil {
 			t.Log("convertToALAC without audio info unexpectedly succeeded")
 		} else {
@@ -5919,7 +6080,7 @@ func TestConvertToALAC(t *testing.T) {
 
 	t.Run("ConvertWithHighBitDepth", func(t *testing.T) {
 		audioInfo := &AudioInfo{Bits: 24, Rate: 96000, Format: "flac"}
-		err := convertToALAC(sourceFile, targetFile, audioInfo)
+		err := convertToALAC(newFileTask(sourceFile), sourceFile, targetFile, audioInfo)
 		if err == nil {
 			t.Log("convertToALAC with high bit depth unexpectedly succeeded")
 		} else {
@@ -5931,7 +6092,7 @@ func TestConvertToALAC(t *testing.T) {
 		testRates := []int{44100, 88200, 176400, 352800}
 		for _, rate := range testRates {
 			audioInfo := &AudioInfo{Bits: 24, Rate: rate, Format: "flac"}
-			err := convertToALAC(sourceFile, targetFile, audioInfo)
+			err := convertToALAC(newFileTask(sourceFile), sourceFile, targetFile, audioInfo)
 			if err == nil {
 				t.Logf("convertToALAC with rate %d unexpectedly succeeded", rate)
 			} else {
@@ -5945,7 +6106,7 @@ func TestConvertToALAC(t *testing.T) {
 
 	t.Run("ConvertWithDocker", func(t *testing.T) {
 		audioInfo := &AudioInfo{Bits: 16, Rate: 44100, Format: "flac"}
-		err := convertToALAC(sourceFile, targetFile, audioInfo)
+		err := convertToALAC(newFileTask(sourceFile), sourceFile, targetFile, audioInfo)
 		if err == nil {
 			t.Log("convertToALAC with Docker unexpectedly succeeded")
 		} else {
@@ -5958,7 +6119,7 @@ func TestConvertToALAC(t *testing.T) {
 		config.UseDocker = false
 
 		audioInfo := &AudioInfo{Bits: 16, Rate: 44100, Format: "flac"}
-		err := convertToALAC(sourceFile, targetFile, audioInfo)
+		err := convertToALAC(newFileTask(sourceFile), sourceFile, targetFile, audioInfo)
 
 		// This should attempt metadata preservation and likely fail with mock commands,
 		// but we're testing the code path
@@ -6040,3 +6201,6130 @@ func TestProcessAudioFilesWithEnforce(t *testing.T) {
 		}
 	})
 }
+
+func TestTargetPathForFormatSubdir(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig }()
+
+	config = Config{TargetDir: "/music/out"}
+	rel := filepath.Join("Artist", "Album", "01.flac")
+
+	if got, want := targetPathFor("", rel), filepath.Join("/music/out", rel); got != want {
+		t.Errorf("targetPathFor without subdir = %s, want %s", got, want)
+	}
+
+	config.FormatSubdir = true
+	if got, want := targetPathFor("", rel), filepath.Join("/music/out", "flac", rel); got != want {
+		t.Errorf("targetPathFor default format = %s, want %s", got, want)
+	}
+
+	if got, want := targetPathFor("mp3", rel), filepath.Join("/music/out", "mp3", rel); got != want {
+		t.Errorf("targetPathFor enforced mp3 = %s, want %s", got, want)
+	}
+
+	// The Docker target mount stays at the root target dir, so the format
+	// component shows up inside the container path.
+	if got, want := getDockerTargetPath(targetPathFor("mp3", rel)), "/target/mp3/Artist/Album/01.flac"; got != want {
+		t.Errorf("getDockerTargetPath = %s, want %s", got, want)
+	}
+}
+
+func TestProcessAudioFilesFormatSubdir(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig }()
+
+	tmpDir := t.TempDir()
+	sourceDir := filepath.Join(tmpDir, "source")
+	targetDir := filepath.Join(tmpDir, "target")
+	if err := os.MkdirAll(filepath.Join(sourceDir, "Album"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(sourceDir, "Album", "song.mp3"), []byte("mp3"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	config = Config{SourceDir: sourceDir, TargetDir: targetDir, FormatSubdir: true, NoPreserveMetadata: true}
+	if _, err := captureOutput(func() {
+		if err := processAudioFiles(); err != nil {
+			t.Errorf("processAudioFiles failed: %v", err)
+		}
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(targetDir, "flac", "Album", "song.mp3")); err != nil {
+		t.Errorf("expected output under format subdir: %v", err)
+	}
+}
+
+func TestFindOrphans(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig }()
+
+	tmpDir := t.TempDir()
+	sourceDir := filepath.Join(tmpDir, "source")
+	targetDir := filepath.Join(tmpDir, "target")
+
+	for _, rel := range []string{"Album/01.flac", "Album/02.mp3", "Album/03.m4a", "Album/cover.jpg"} {
+		path := filepath.Join(sourceDir, rel)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := os.WriteFile(path, []byte("source"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, rel := range []string{"Album/01.flac", "Album/02.mp3", "Album/03.flac", "Album/cover.jpg", "Album/04.flac", "Gone/01.mp3", stateFileName} {
+		path := filepath.Join(targetDir, rel)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := os.WriteFile(path, []byte("target"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	config = Config{SourceDir: sourceDir, TargetDir: targetDir}
+	orphans, err := findOrphans()
+	if err != nil {
+		t.Fatalf("findOrphans failed: %v", err)
+	}
+
+	want := []string{filepath.Join(targetDir, "Album", "04.flac"), filepath.Join(targetDir, "Gone", "01.mp3")}
+	if len(orphans) != len(want) {
+		t.Fatalf("findOrphans = %v, want %v", orphans, want)
+	}
+	for i := range want {
+		if orphans[i] != want[i] {
+			t.Errorf("orphan[%d] = %s, want %s", i, orphans[i], want[i])
+		}
+	}
+
+	// Nothing must have been removed
+	if _, err := os.Stat(want[0]); err != nil {
+		t.Errorf("orphan was removed: %v", err)
+	}
+
+	t.Run("EnforcedALACMapping", func(t *testing.T) {
+		config.EnforceOutputFormat = "alac"
+		orphans, err := findOrphans()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 01.flac would now be written as 01.m4a, but a copy under the original
+		// extension is still a legitimate output
+		for _, orphan := range orphans {
+			if strings.HasSuffix(orphan, "01.flac") {
+				t.Errorf("01.flac reported as orphan under alac mapping")
+			}
+		}
+		if !slices.Contains(orphans, filepath.Join(targetDir, "Album", "03.flac")) {
+			t.Errorf("expected 03.flac to be an orphan under alac mapping, got %v", orphans)
+		}
+	})
+
+	t.Run("CopiedPlaylists", func(t *testing.T) {
+		config = Config{SourceDir: sourceDir, TargetDir: targetDir}
+		for _, dir := range []string{sourceDir, targetDir} {
+			os.WriteFile(filepath.Join(dir, "Album", "list.m3u"), []byte("01.flac\n"), 0644)
+		}
+		playlist := filepath.Join(targetDir, "Album", "list.m3u")
+		if orphans, _ := findOrphans(); !slices.Contains(orphans, playlist) {
+			t.Errorf("expected the playlist to be an orphan without --copy-playlists-rewritten, got %v", orphans)
+		}
+		config.CopyPlaylists = true
+		if orphans, _ := findOrphans(); slices.Contains(orphans, playlist) {
+			t.Errorf("expected the copied playlist not to be an orphan, got %v", orphans)
+		}
+	})
+}
+
+func TestRunConverterReportOrphans(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig }()
+
+	tmpDir := t.TempDir()
+	sourceDir := filepath.Join(tmpDir, "source")
+	targetDir := filepath.Join(tmpDir, "target")
+	os.MkdirAll(sourceDir, 0755)
+	os.MkdirAll(targetDir, 0755)
+	os.WriteFile(filepath.Join(targetDir, "stale.mp3"), []byte("old"), 0644)
+	reportPath := filepath.Join(tmpDir, "report.json")
+
+	config = Config{TargetDir: targetDir, SoxCommand: "true", NoPreserveMetadata: true, ReportOrphans: true, ReportPath: reportPath}
+	output, _ := captureOutput(func() {
+		if err := runConverter(nil, []string{sourceDir}); err != nil {
+			t.Errorf("runConverter failed: %v", err)
+		}
+	})
+	if !strings.Contains(output, "stale.mp3") {
+		t.Errorf("expected orphan in output, got: %s", output)
+	}
+
+	data, err := os.ReadFile(reportPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report RunReport
+	if err := json.Unmarshal(data, &report); err != nil {
+		t.Fatalf("invalid report JSON: %v", err)
+	}
+	if len(report.Orphans) != 1 || !strings.HasSuffix(report.Orphans[0], "stale.mp3") {
+		t.Errorf("report orphans = %v", report.Orphans)
+	}
+	if _, err := os.Stat(filepath.Join(targetDir, "stale.mp3")); err != nil {
+		t.Error("orphan was removed")
+	}
+}
+
+func TestReportAppend(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig; progress = &progressReporter{} }()
+
+	tmpDir := t.TempDir()
+	sourceDir := filepath.Join(tmpDir, "source")
+	targetDir := filepath.Join(tmpDir, "target")
+	os.MkdirAll(sourceDir, 0755)
+	os.WriteFile(filepath.Join(sourceDir, "song.mp3"), []byte("mp3"), 0644)
+	reportPath := filepath.Join(tmpDir, "report.ndjson")
+
+	for range 2 {
+		config = Config{TargetDir: targetDir, SoxCommand: "true", NoPreserveMetadata: true, ReportPath: reportPath, ReportAppend: true}
+		captureOutput(func() {
+			if err := runConverter(nil, []string{sourceDir}); err != nil {
+				t.Errorf("runConverter failed: %v", err)
+			}
+		})
+	}
+
+	data, err := os.ReadFile(reportPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected one line per run, got %d:\n%s", len(lines), data)
+	}
+	var runs []RunReport
+	for _, line := range lines {
+		var report RunReport
+		if err := json.Unmarshal([]byte(line), &report); err != nil {
+			t.Fatalf("invalid report line %q: %v", line, err)
+		}
+		if report.RunID == "" || report.Finished.IsZero() || report.Build.Version == "" {
+			t.Errorf("Expected a run ID, timestamp and build info, got %+v", report)
+		}
+		runs = append(runs, report)
+	}
+	if runs[0].RunID == runs[1].RunID {
+		t.Errorf("Expected distinct run IDs, got %s twice", runs[0].RunID)
+	}
+	if runs[1].Finished.Before(runs[0].Finished) {
+		t.Error("Expected the second run to be appended after the first")
+	}
+
+	config = Config{TargetDir: targetDir, ReportAppend: true}
+	if err := convertLibrary([]string{sourceDir}); err == nil {
+		t.Error("Expected --report-append to require --report")
+	}
+}
+
+func TestBucketByAdded(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig; resetAssignedPaths() }()
+
+	tmpDir := t.TempDir()
+	sourceDir := filepath.Join(tmpDir, "source")
+	targetDir := filepath.Join(tmpDir, "target")
+
+	files := map[string]time.Time{
+		"Artist/Album/one.mp3":  time.Date(2025, time.June, 14, 12, 0, 0, 0, time.Local),
+		"Artist/Album/two.mp3":  time.Date(2024, time.December, 31, 12, 0, 0, 0, time.Local),
+		"Other/Single/four.mp3": time.Date(2025, time.January, 2, 12, 0, 0, 0, time.Local),
+		// Another album's track of the same name, added the same month
+		"Other/Album/one.mp3": time.Date(2025, time.June, 20, 12, 0, 0, 0, time.Local),
+	}
+	for rel, mtime := range files {
+		path := filepath.Join(sourceDir, rel)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := os.WriteFile(path, []byte(rel), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	config = Config{SourceDir: sourceDir, TargetDir: targetDir, BucketBy: "added", NoPreserveMetadata: true}
+	resetAssignedPaths()
+	output, _ := captureOutput(func() {
+		if err := processAudioFiles(); err != nil {
+			t.Errorf("processAudioFiles failed: %v", err)
+		}
+	})
+
+	for _, expected := range []string{"2025/06/one.mp3", "2025/06/one (2).mp3", "2024/12/two.mp3", "2025/01/four.mp3"} {
+		if _, err := os.Stat(filepath.Join(targetDir, filepath.FromSlash(expected))); err != nil {
+			t.Errorf("expected %s in target: %v", expected, err)
+		}
+	}
+	want := fmt.Sprintf("Warning: %s and %s both map to %s", filepath.FromSlash("Artist/Album/one.mp3"), filepath.FromSlash("Other/Album/one.mp3"), filepath.FromSlash("2025/06/one.mp3"))
+	if !strings.Contains(output, want) {
+		t.Errorf("Expected a warning about the colliding names, got:\n%s", output)
+	}
+	if _, err := os.Stat(filepath.Join(targetDir, "Artist")); !os.IsNotExist(err) {
+		t.Error("source structure should not be mirrored when bucketing")
+	}
+}
+
+func TestCompareTrees(t *testing.T) {
+	tmpDir := t.TempDir()
+	outputDir := filepath.Join(tmpDir, "output")
+	referenceDir := filepath.Join(tmpDir, "reference")
+
+	write := func(root, rel, content string) {
+		path := filepath.Join(root, rel)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(outputDir, "Album/same.flac", "identical")
+	write(referenceDir, "Album/same.flac", "identical")
+	write(outputDir, "Album/resized.flac", "longer content")
+	write(referenceDir, "Album/resized.flac", "short")
+	write(outputDir, "Album/rehashed.flac", "aaaa")
+	write(referenceDir, "Album/rehashed.flac", "bbbb")
+	write(outputDir, "Album/new.mp3", "new")
+	write(referenceDir, "Album/old.mp3", "old")
+	// The bookkeeping of an earlier lilt run into the reference is not compared
+	write(referenceDir, stateFileName, "{}")
+	write(referenceDir, "Album/"+scannerMarkers[0].name, scannerMarkers[0].content)
+	write(referenceDir, "Album/.cut.partial.flac", "cut")
+	write(outputDir, "Album/"+scannerMarkers[0].name, scannerMarkers[0].content)
+
+	comparison, err := compareTrees(outputDir, referenceDir)
+	if err != nil {
+		t.Fatalf("compareTrees failed: %v", err)
+	}
+
+	check := func(name string, got []string, want ...string) {
+		t.Helper()
+		if len(got) != len(want) {
+			t.Errorf("%s = %v, want %v", name, got, want)
+			return
+		}
+		for i := range want {
+			if got[i] != filepath.FromSlash(want[i]) {
+				t.Errorf("%s[%d] = %s, want %s", name, i, got[i], want[i])
+			}
+		}
+	}
+	check("Identical", comparison.Identical, "Album/same.flac")
+	check("Changed", comparison.Changed, "Album/rehashed.flac", "Album/resized.flac")
+	check("Added", comparison.Added, "Album/new.mp3")
+	check("Removed", comparison.Removed, "Album/old.mp3")
+}
+
+func TestRunConverterCompareWith(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig }()
+
+	tmpDir := t.TempDir()
+	sourceDir := filepath.Join(tmpDir, "source")
+	referenceDir := filepath.Join(tmpDir, "reference")
+	targetDir := filepath.Join(tmpDir, "target")
+	os.MkdirAll(sourceDir, 0755)
+	os.MkdirAll(referenceDir, 0755)
+	os.WriteFile(filepath.Join(sourceDir, "a.mp3"), []byte("same"), 0644)
+	os.WriteFile(filepath.Join(sourceDir, "b.mp3"), []byte("different"), 0644)
+	os.WriteFile(filepath.Join(referenceDir, "a.mp3"), []byte("same"), 0644)
+	os.WriteFile(filepath.Join(referenceDir, "b.mp3"), []byte("previous"), 0644)
+
+	config = Config{TargetDir: targetDir, SoxCommand: "true", NoPreserveMetadata: true, CompareWith: referenceDir}
+	output, _ := captureOutput(func() {
+		if err := runConverter(nil, []string{sourceDir}); err != nil {
+			t.Errorf("runConverter failed: %v", err)
+		}
+	})
+
+	if !strings.Contains(output, "0 added, 1 changed, 1 identical, 0 removed") {
+		t.Errorf("unexpected comparison summary: %s", output)
+	}
+	if _, err := os.Stat(targetDir); !os.IsNotExist(err) {
+		t.Error("target directory must not be written in compare mode")
+	}
+}
+
+func TestParseProbeJSON(t *testing.T) {
+	output := `{
+		"streams": [
+			{"index": 0, "codec_name": "alac", "codec_type": "audio", "sample_rate": "96000", "channels": 2, "sample_fmt": "s32p", "bits_per_raw_sample": "24"},
+			{"index": 1, "codec_name": "mjpeg", "codec_type": "video", "disposition": {"attached_pic": 1}}
+		],
+		"format": {"format_name": "mov,mp4,m4a,3gp,3g2,mj2", "duration": "245.120000", "tags": {"title": "Song", "artist": "Band"}}
+	}`
+
+	probe, err := parseProbeJSON([]byte(output))
+	if err != nil {
+		t.Fatalf("parseProbeJSON failed: %v", err)
+	}
+	if len(probe.Streams) != 2 || probe.Streams[0].CodecName != "alac" || probe.Streams[1].Disposition["attached_pic"] != 1 {
+		t.Errorf("unexpected streams: %+v", probe.Streams)
+	}
+	if probe.Format.Tags["title"] != "Song" || probe.Format.Duration != "245.120000" {
+		t.Errorf("unexpected format: %+v", probe.Format)
+	}
+
+	info, err := audioInfoFromProbe(probe)
+	if err != nil {
+		t.Fatalf("audioInfoFromProbe failed: %v", err)
+	}
+	if info.Bits != 24 || info.Rate != 96000 || info.Format != "alac" {
+		t.Errorf("audioInfoFromProbe = %+v", info)
+	}
+
+	if _, err := parseProbeJSON([]byte("not json")); err == nil {
+		t.Error("expected error for invalid JSON")
+	}
+	if _, err := audioInfoFromProbe(&ProbeResult{}); err == nil {
+		t.Error("expected error when no audio stream is present")
+	}
+}
+
+func TestProbeFileCache(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig }()
+	config = Config{}
+
+	path := "/music/cached.m4a"
+	cached := &ProbeResult{Streams: []ProbeStream{{CodecType: "audio", SampleRate: "44100", BitsPerRawSample: "16"}}}
+	probeCache.Lock()
+	probeCache.results[path] = cached
+	probeCache.Unlock()
+	defer forgetProbe(path)
+
+	// A cached result is served without spawning ffprobe
+	info, err := getALACInfo(nil, path)
+	if err != nil {
+		t.Fatalf("getALACInfo with cached probe failed: %v", err)
+	}
+	if info.Bits != 16 || info.Rate != 44100 {
+		t.Errorf("getALACInfo = %+v", info)
+	}
+
+	forgetProbe(path)
+	probeCache.Lock()
+	_, ok := probeCache.results[path]
+	probeCache.Unlock()
+	if ok {
+		t.Error("forgetProbe did not drop the cached result")
+	}
+}
+
+func TestSanitizeComponent(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"Track 1: Intro?.flac", "Track 1_ Intro_.flac"},
+		{`A*B<C>D"E|F\G.mp3`, "A_B_C_D_E_F_G.mp3"},
+		{"Album. ", "Album"},
+		{"Trailing...", "Trailing"},
+		{"...", "_"},
+		{"Normal Name.flac", "Normal Name.flac"},
+	}
+
+	for _, tt := range tests {
+		if got := sanitizeComponent(tt.input); got != tt.expected {
+			t.Errorf("sanitizeComponent(%q) = %q, want %q", tt.input, got, tt.expected)
+		}
+	}
+}
+
+func TestTargetPathForSanitizeFilenames(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig }()
+	defer resetAssignedPaths()
+
+	resetAssignedPaths()
+	config = Config{TargetDir: "/usb", SanitizeFilenames: true}
+
+	got := targetPathFor(config.EnforceOutputFormat, filepath.Join("What? Album.", "Song: Part 1.flac"))
+	want := filepath.Join("/usb", "What_ Album", "Song_ Part 1.flac")
+	if got != want {
+		t.Errorf("targetPathFor = %s, want %s", got, want)
+	}
+
+	// Two names that only differ in illegal characters collide after
+	// sanitization and must get distinct targets
+	first := targetPathFor(config.EnforceOutputFormat, filepath.Join("Album", "Song?.flac"))
+	second := targetPathFor(config.EnforceOutputFormat, filepath.Join("Album", "Song*.flac"))
+	if first == second {
+		t.Fatalf("colliding names got the same target: %s", first)
+	}
+	if first != filepath.Join("/usb", "Album", "Song_.flac") {
+		t.Errorf("first target = %s", first)
+	}
+	if second != filepath.Join("/usb", "Album", "Song_ (2).flac") {
+		t.Errorf("second target = %s", second)
+	}
+
+	// Repeated lookups are stable
+	if again := targetPathFor(config.EnforceOutputFormat, filepath.Join("Album", "Song*.flac")); again != second {
+		t.Errorf("repeated lookup = %s, want %s", again, second)
+	}
+}
+
+// writeFakeTool writes an executable shell script standing in for an external
+// tool and returns its path. Tests using it are skipped on Windows.
+func writeFakeTool(t *testing.T, dir, name, script string) string {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("fake tools are shell scripts")
+	}
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+script+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestMetadataPreserved(t *testing.T) {
+	picture := ProbeStream{CodecType: "video", Disposition: map[string]int{"attached_pic": 1}}
+	audio := func(tags map[string]string) ProbeStream {
+		return ProbeStream{CodecType: "audio", Tags: tags}
+	}
+
+	tests := []struct {
+		name      string
+		source    *ProbeResult
+		converted *ProbeResult
+		expected  bool
+	}{
+		{
+			name:      "tags carried over with different case",
+			source:    &ProbeResult{Format: ProbeFormat{Tags: map[string]string{"TITLE": "Song", "ARTIST": "Band", "TRACKNUMBER": "3"}}},
+			converted: &ProbeResult{Format: ProbeFormat{Tags: map[string]string{"title": "Song", "artist": "Band", "track": "3"}}},
+			expected:  true,
+		},
+		{
+			name:      "missing tag",
+			source:    &ProbeResult{Format: ProbeFormat{Tags: map[string]string{"title": "Song", "album": "Record"}}},
+			converted: &ProbeResult{Format: ProbeFormat{Tags: map[string]string{"title": "Song"}}},
+			expected:  false,
+		},
+		{
+			name:      "changed tag",
+			source:    &ProbeResult{Format: ProbeFormat{Tags: map[string]string{"artist": "Band"}}},
+			converted: &ProbeResult{Format: ProbeFormat{Tags: map[string]string{"artist": "Bnad"}}},
+			expected:  false,
+		},
+		{
+			name:      "picture dropped",
+			source:    &ProbeResult{Streams: []ProbeStream{audio(nil), picture}, Format: ProbeFormat{Tags: map[string]string{"title": "Song"}}},
+			converted: &ProbeResult{Streams: []ProbeStream{audio(nil)}, Format: ProbeFormat{Tags: map[string]string{"title": "Song"}}},
+			expected:  false,
+		},
+		{
+			name:      "picture and stream tags kept",
+			source:    &ProbeResult{Streams: []ProbeStream{audio(map[string]string{"title": "Song"}), picture}},
+			converted: &ProbeResult{Streams: []ProbeStream{audio(map[string]string{"TITLE": "Song"}), picture}},
+			expected:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := metadataPreserved(tt.source, tt.converted); got != tt.expected {
+				t.Errorf("metadataPreserved = %v, want %v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestProcessFlacSkipsMergeWhenSoxPreservedTags(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig }()
+
+	tmpDir := t.TempDir()
+	toolDir := filepath.Join(tmpDir, "bin")
+	os.MkdirAll(toolDir, 0755)
+	// Fake sox writes its output file (the argument ending in .tmp.flac)
+	sox := writeFakeTool(t, toolDir, "sox", `for a in "$@"; do case "$a" in *.tmp.flac) echo converted > "$a";; esac; done`)
+
+	sourcePath := filepath.Join(tmpDir, "song.flac")
+	targetPath := filepath.Join(tmpDir, "out", "song.flac")
+	tempPath := filepath.Join(tmpDir, "out", "song.tmp.flac")
+	os.WriteFile(sourcePath, []byte("source"), 0644)
+	os.MkdirAll(filepath.Dir(targetPath), 0755)
+
+	tags := map[string]string{"title": "Song", "artist": "Band"}
+	seedProbe := func() {
+		probeCache.Lock()
+		probeCache.results[sourcePath] = &ProbeResult{Format: ProbeFormat{Tags: tags}}
+		probeCache.results[tempPath] = &ProbeResult{Format: ProbeFormat{Tags: tags}}
+		probeCache.Unlock()
+	}
+	defer forgetProbe(sourcePath)
+
+	config = Config{SourceDir: tmpDir, TargetDir: filepath.Join(tmpDir, "out"), SoxCommand: sox, NoPostcheck: true}
+
+	t.Run("SkipsMerge", func(t *testing.T) {
+		seedProbe()
+		output, _ := captureOutput(func() {
+			if err := processFlac(newFileTask(sourcePath), sourcePath, targetPath, true, []string{"-b", "16"}, []string{"rate", "-v", "-L", "48000"}); err != nil {
+				t.Errorf("processFlac failed: %v", err)
+			}
+		})
+		if !strings.Contains(output, "skipping FFmpeg merge") {
+			t.Errorf("expected skip to be logged, got: %s", output)
+		}
+		data, err := os.ReadFile(targetPath)
+		if err != nil || strings.TrimSpace(string(data)) != "converted" {
+			t.Errorf("expected converted output at target, got %q (%v)", data, err)
+		}
+		if _, err := os.Stat(tempPath); !os.IsNotExist(err) {
+			t.Error("temp file should have been renamed into place")
+		}
+	})
+
+	t.Run("AlwaysMergeForcesFFmpeg", func(t *testing.T) {
+		os.Remove(targetPath)
+		seedProbe()
+		config.AlwaysMerge = true
+		defer func() { config.AlwaysMerge = false }()
+		output, _ := captureOutput(func() {
+			processFlac(newFileTask(sourcePath), sourcePath, targetPath, true, []string{"-b", "16"}, []string{"rate", "-v", "-L", "48000"})
+		})
+		if strings.Contains(output, "skipping FFmpeg merge") {
+			t.Errorf("merge must not be skipped with --always-merge: %s", output)
+		}
+		forgetProbe(tempPath)
+	})
+}
+
+func TestRenameMap(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig; renameMap = nil }()
+
+	tmpDir := t.TempDir()
+	sourceDir := filepath.Join(tmpDir, "source")
+	targetDir := filepath.Join(tmpDir, "target")
+	for _, rel := range []string{"Album/01 - intro.mp3", "Album/02 - song.mp3"} {
+		path := filepath.Join(sourceDir, rel)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		os.WriteFile(path, []byte(rel), 0644)
+	}
+
+	mapPath := filepath.Join(tmpDir, "map.csv")
+	mapContent := "# source,target\nAlbum/01 - intro.mp3,Specials/Intro.mp3\nAlbum/missing.mp3,Nowhere/missing.mp3\n"
+	os.WriteFile(mapPath, []byte(mapContent), 0644)
+
+	config = Config{TargetDir: targetDir, SoxCommand: "true", NoPreserveMetadata: true, RenameMapPath: mapPath}
+	output, _ := captureOutput(func() {
+		if err := runConverter(nil, []string{sourceDir}); err != nil {
+			t.Errorf("runConverter failed: %v", err)
+		}
+	})
+
+	if !strings.Contains(output, `"Album/missing.mp3" does not match any source file`) {
+		t.Errorf("expected warning for missing source, got: %s", output)
+	}
+	if _, err := os.Stat(filepath.Join(targetDir, "Specials", "Intro.mp3")); err != nil {
+		t.Errorf("mapped file not at custom target: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(targetDir, "Album", "01 - intro.mp3")); !os.IsNotExist(err) {
+		t.Error("mapped file also written to default target")
+	}
+	if _, err := os.Stat(filepath.Join(targetDir, "Album", "02 - song.mp3")); err != nil {
+		t.Errorf("unmapped file not at default target: %v", err)
+	}
+}
+
+func TestLoadRenameMapValidation(t *testing.T) {
+	tmpDir := t.TempDir()
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"wrong field count", "a.flac,b.flac,c.flac\n"},
+		{"empty target", "a.flac,\n"},
+		{"escaping target", "a.flac,../outside.flac\n"},
+		{"duplicate source", "a.flac,b.flac\na.flac,c.flac\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(tmpDir, "map.csv")
+			os.WriteFile(path, []byte(tt.content), 0644)
+			captureOutput(func() {
+				if _, err := loadRenameMap(path, tmpDir); err == nil {
+					t.Errorf("expected validation error for %q", tt.content)
+				}
+			})
+		})
+	}
+}
+
+func TestCopyFileVerify(t *testing.T) {
+	originalConfig := config
+	originalDigest := destinationDigest
+	defer func() { config = originalConfig; destinationDigest = originalDigest }()
+
+	tmpDir := t.TempDir()
+	src := filepath.Join(tmpDir, "src.flac")
+	dst := filepath.Join(tmpDir, "dst.flac")
+	if err := os.WriteFile(src, bytes.Repeat([]byte("lilt"), 4096), 0644); err != nil {
+		t.Fatal(err)
+	}
+	expected, err := fileSHA256(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config = Config{VerifyCopies: true}
+
+	t.Run("Success", func(t *testing.T) {
+		calls := 0
+		destinationDigest = func(path string) (string, error) {
+			calls++
+			return fileSHA256(path)
+		}
+		if err := copyFile(nil, src, dst); err != nil {
+			t.Fatalf("verified copy failed: %v", err)
+		}
+		if digest, _ := fileSHA256(dst); calls != 1 || digest != expected {
+			t.Errorf("expected one verified copy with sha256 %s, got %d verifications and %s", expected, calls, digest)
+		}
+	})
+
+	t.Run("RetriesOnce", func(t *testing.T) {
+		calls := 0
+		destinationDigest = func(path string) (string, error) {
+			calls++
+			if calls == 1 {
+				return "corrupted", nil
+			}
+			return fileSHA256(path)
+		}
+		output, _ := captureOutput(func() {
+			if err := copyFile(nil, src, dst); err != nil {
+				t.Errorf("copy should succeed after retry: %v", err)
+			}
+		})
+		if calls != 2 || !strings.Contains(output, "retrying") {
+			t.Errorf("expected one retry, got %d verification calls, output: %s", calls, output)
+		}
+	})
+
+	t.Run("FailsAfterRetry", func(t *testing.T) {
+		calls := 0
+		destinationDigest = func(path string) (string, error) {
+			calls++
+			return "corrupted", nil
+		}
+		captureOutput(func() {
+			err := copyFile(nil, src, dst)
+			if !errors.Is(err, errCopyVerification) {
+				t.Errorf("expected verification error, got %v", err)
+			}
+		})
+		if calls != 2 {
+			t.Errorf("expected 2 attempts, got %d", calls)
+		}
+	})
+}
+
+func TestProgressFD(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("progress-fd is a Unix feature")
+	}
+	originalConfig := config
+	defer func() { config = originalConfig; progress = &progressReporter{} }()
+
+	tmpDir := t.TempDir()
+	sourceDir := filepath.Join(tmpDir, "source")
+	os.MkdirAll(sourceDir, 0755)
+	os.WriteFile(filepath.Join(sourceDir, "a.mp3"), []byte("a"), 0644)
+	os.WriteFile(filepath.Join(sourceDir, "b.mp3"), []byte("b"), 0644)
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+
+	config = Config{TargetDir: filepath.Join(tmpDir, "target"), SoxCommand: "true", NoPreserveMetadata: true, ProgressFD: int(w.Fd())}
+	output, _ := captureOutput(func() {
+		if err := runConverter(nil, []string{sourceDir}); err != nil {
+			t.Errorf("runConverter failed: %v", err)
+		}
+	})
+	w.Close()
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(output, `"event"`) {
+		t.Error("progress events leaked to stdout")
+	}
+
+	var events []ProgressEvent
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var event ProgressEvent
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			t.Fatalf("invalid NDJSON line %q: %v", line, err)
+		}
+		events = append(events, event)
+	}
+
+	var kinds []string
+	for _, event := range events {
+		kinds = append(kinds, event.Event)
+	}
+	want := []string{"run_started", "file_started", "file_completed", "file_started", "file_completed", "run_completed"}
+	if !slices.Equal(kinds, want) {
+		t.Fatalf("events = %v, want %v", kinds, want)
+	}
+	if events[0].Total != 2 {
+		t.Errorf("unexpected run start: %+v", events[0])
+	}
+	if events[2].Status != "ok" || !strings.HasSuffix(events[2].Path, "a.mp3") {
+		t.Errorf("unexpected completion event: %+v", events[2])
+	}
+	if events[5].Completed != 2 || events[5].Failed != 0 {
+		t.Errorf("unexpected run summary: %+v", events[5])
+	}
+}
+
+func TestOpenProgressFDValidation(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("progress-fd is a Unix feature")
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+
+	if _, err := openProgressFD(int(r.Fd())); err == nil {
+		t.Error("expected error for read-only descriptor")
+	}
+	if _, err := openProgressFD(int(w.Fd())); err != nil {
+		t.Errorf("writable descriptor rejected: %v", err)
+	}
+}
+
+func TestHandleAccessError(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig; resetFailures() }()
+
+	tmpDir := t.TempDir()
+	sourceDir := filepath.Join(tmpDir, "source")
+	targetDir := filepath.Join(tmpDir, "target")
+	config = Config{SourceDir: sourceDir, TargetDir: targetDir}
+
+	unreadable := filepath.Join(sourceDir, "Album", "locked.flac")
+	accessErr := &fs.PathError{Op: "open", Path: unreadable, Err: syscall.EACCES}
+
+	t.Run("RecordedAndContinues", func(t *testing.T) {
+		resetFailures()
+		captureOutput(func() {
+			if err := handleAccessError(unreadable, accessErr); err != nil {
+				t.Errorf("expected access error to be recorded, got %v", err)
+			}
+		})
+		recorded := recordedFailures()
+		if len(recorded) != 1 || recorded[0].Path != unreadable || recorded[0].Errno != int(syscall.EACCES) {
+			t.Errorf("unexpected recorded failures: %+v", recorded)
+		}
+	})
+
+	t.Run("SourceRootIsFatal", func(t *testing.T) {
+		rootErr := &fs.PathError{Op: "open", Path: sourceDir, Err: syscall.EACCES}
+		if err := handleAccessError(sourceDir, rootErr); err == nil {
+			t.Error("expected unreadable source root to be fatal")
+		}
+	})
+
+	t.Run("TargetErrorsAreFatal", func(t *testing.T) {
+		targetErr := &fs.PathError{Op: "open", Path: filepath.Join(targetDir, "x.flac"), Err: syscall.EACCES}
+		if err := handleAccessError(unreadable, targetErr); err == nil {
+			t.Error("expected target error to be fatal")
+		}
+	})
+
+	t.Run("StrictIsFatal", func(t *testing.T) {
+		config.Strict = true
+		defer func() { config.Strict = false }()
+		if err := handleAccessError(unreadable, accessErr); err == nil {
+			t.Error("expected access error to be fatal in strict mode")
+		}
+	})
+}
+
+func TestProcessAudioFilesUnreadableFile(t *testing.T) {
+	if runtime.GOOS == "windows" || os.Geteuid() == 0 {
+		t.Skip("permission bits are not enforced for this user")
+	}
+	originalConfig := config
+	defer func() { config = originalConfig; resetFailures() }()
+
+	tmpDir := t.TempDir()
+	sourceDir := filepath.Join(tmpDir, "source")
+	targetDir := filepath.Join(tmpDir, "target")
+	os.MkdirAll(sourceDir, 0755)
+	locked := filepath.Join(sourceDir, "a.mp3")
+	os.WriteFile(locked, []byte("a"), 0000)
+	os.WriteFile(filepath.Join(sourceDir, "b.mp3"), []byte("b"), 0644)
+
+	resetFailures()
+	config = Config{SourceDir: sourceDir, TargetDir: targetDir, NoPreserveMetadata: true}
+	captureOutput(func() {
+		if err := processAudioFiles(); err != nil {
+			t.Errorf("unreadable file aborted the run: %v", err)
+		}
+	})
+	if _, err := os.Stat(filepath.Join(targetDir, "b.mp3")); err != nil {
+		t.Errorf("readable file after the unreadable one was not processed: %v", err)
+	}
+	if recorded := recordedFailures(); len(recorded) != 1 || recorded[0].Path != locked {
+		t.Errorf("unexpected recorded failures: %+v", recorded)
+	}
+}
+
+// drainOnStart requests a drain as soon as the first file is dispatched
+type drainOnStart struct {
+	started []string
+}
+
+func (d *drainOnStart) Write(p []byte) (int, error) {
+	var event ProgressEvent
+	if err := json.Unmarshal(p, &event); err == nil && event.Event == "file_started" {
+		d.started = append(d.started, event.Path)
+		control.requestDrain()
+	}
+	return len(p), nil
+}
+
+func TestDrainStopsDispatchingNewFiles(t *testing.T) {
+	originalConfig := config
+	originalControl := control
+	defer func() { config = originalConfig; control = originalControl; progress = &progressReporter{} }()
+
+	tmpDir := t.TempDir()
+	sourceDir := filepath.Join(tmpDir, "source")
+	targetDir := filepath.Join(tmpDir, "target")
+	os.MkdirAll(sourceDir, 0755)
+	for _, name := range []string{"a.mp3", "b.mp3", "c.mp3"} {
+		os.WriteFile(filepath.Join(sourceDir, name), []byte(name), 0644)
+	}
+
+	config = Config{SourceDir: sourceDir, TargetDir: targetDir, NoPreserveMetadata: true}
+	control = newRunControl()
+	recorder := &drainOnStart{}
+	progress = &progressReporter{encoder: json.NewEncoder(recorder)}
+
+	captureOutput(func() {
+		if err := processAudioFiles(); err != nil {
+			t.Errorf("processAudioFiles failed: %v", err)
+		}
+	})
+
+	if len(recorder.started) != 1 {
+		t.Fatalf("expected only one file to start after drain, started: %v", recorder.started)
+	}
+	// The in-flight file is finished
+	if _, err := os.Stat(filepath.Join(targetDir, "a.mp3")); err != nil {
+		t.Errorf("in-flight file was not finished: %v", err)
+	}
+	for _, name := range []string{"b.mp3", "c.mp3"} {
+		if _, err := os.Stat(filepath.Join(targetDir, name)); !os.IsNotExist(err) {
+			t.Errorf("%s was started after drain was requested", name)
+		}
+	}
+}
+
+func TestRunControlForceStop(t *testing.T) {
+	tmpDir := t.TempDir()
+	partial := filepath.Join(tmpDir, "song.tmp.flac")
+	finished := filepath.Join(tmpDir, "done.tmp.flac")
+	os.WriteFile(partial, []byte("partial"), 0644)
+	os.WriteFile(finished, []byte("done"), 0644)
+
+	c := newRunControl()
+	c.trackTemp(partial)
+	c.trackTemp(finished)
+	c.releaseTemp(finished)
+	c.forceStop()
+
+	if _, err := os.Stat(partial); !os.IsNotExist(err) {
+		t.Error("tracked partial file was not removed")
+	}
+	if _, err := os.Stat(finished); err != nil {
+		t.Error("released file must not be removed")
+	}
+	if c.ctx.Err() == nil {
+		t.Error("force stop must cancel running commands")
+	}
+}
+
+func TestSecondInterrupt(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Interrupts cannot be sent to the own process on Windows")
+	}
+	originalControl := control
+	originalPath := os.Getenv("PATH")
+	defer func() { control = originalControl; os.Setenv("PATH", originalPath) }()
+	control = newRunControl()
+
+	tmpDir := t.TempDir()
+	dockerArgs := filepath.Join(tmpDir, "docker-args")
+	writeFakeTool(t, tmpDir, "docker", `echo "$@" >> `+dockerArgs+`; if [ "$1" = run ]; then exec sleep 5; fi`)
+	os.Setenv("PATH", tmpDir+string(os.PathListSeparator)+originalPath)
+
+	cmd := newCommand("docker", "run", "--rm", "img", "a.flac")
+	name := fmt.Sprintf("lilt-%d-%d", os.Getpid(), containerCount.Load())
+	if want := []string{"docker", "run", "--init", "--name", name, "--rm", "img", "a.flac"}; !slices.Equal(cmd.Args, want) {
+		t.Errorf("Unexpected docker arguments %v, want %v", cmd.Args, want)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	stopWatching := watchInterrupts()
+	defer stopWatching()
+	self, _ := os.FindProcess(os.Getpid())
+	captureOutput(func() {
+		self.Signal(os.Interrupt)
+		for deadline := time.Now().Add(5 * time.Second); !control.isDraining() && time.Now().Before(deadline); {
+			time.Sleep(10 * time.Millisecond)
+		}
+		self.Signal(os.Interrupt)
+		done := make(chan error, 1)
+		go func() { done <- cmd.Wait() }()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Error("Expected the second interrupt to stop the running container")
+		}
+	})
+
+	// The process is still running here, so the run can clean up and exit
+	if data, _ := os.ReadFile(dockerArgs); !strings.Contains(string(data), "kill "+name+"\n") {
+		t.Errorf("Expected the container to be killed by name, got:\n%s", data)
+	}
+	source := filepath.Join(tmpDir, "song.mp3")
+	os.WriteFile(source, []byte("mp3"), 0644)
+	if err := copyFile(nil, source, filepath.Join(tmpDir, "copy.mp3")); !errors.Is(err, errInterrupted) {
+		t.Errorf("Expected no copies after a forced stop, got %v", err)
+	}
+}
+
+func TestRunControlPauseResume(t *testing.T) {
+	c := newRunControl()
+	original := control
+	control = c
+	defer func() { control = original }()
+
+	captureOutput(func() {
+		c.pause()
+		if !c.isPaused() {
+			t.Fatal("expected run to be paused")
+		}
+
+		released := make(chan struct{})
+		go func() {
+			c.waitIfPaused()
+			close(released)
+		}()
+
+		select {
+		case <-released:
+			t.Fatal("dispatch continued while paused")
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		c.togglePause()
+		select {
+		case <-released:
+		case <-time.After(time.Second):
+			t.Fatal("dispatch did not continue after resume")
+		}
+	})
+
+	if c.pausedFor() < 50*time.Millisecond {
+		t.Errorf("paused time not tracked: %v", c.pausedFor())
+	}
+}
+
+func TestRunControlDrainWhilePaused(t *testing.T) {
+	c := newRunControl()
+	captureOutput(func() { c.pause() })
+
+	released := make(chan struct{})
+	go func() {
+		c.waitIfPaused()
+		close(released)
+	}()
+
+	c.requestDrain()
+	select {
+	case <-released:
+	case <-time.After(time.Second):
+		t.Fatal("drain did not release a paused dispatcher")
+	}
+}
+
+func TestGroupedOutputByAlbum(t *testing.T) {
+	originalConfig := config
+	originalConsole := console
+	defer func() { config = originalConfig; console = originalConsole }()
+
+	tmpDir := t.TempDir()
+	sourceDir := filepath.Join(tmpDir, "source")
+	targetDir := filepath.Join(tmpDir, "target")
+	album := filepath.Join(sourceDir, "Artist", "Album")
+	os.MkdirAll(album, 0755)
+	for _, name := range []string{"01.mp3", "02.mp3", "cover.jpg"} {
+		os.WriteFile(filepath.Join(album, name), []byte(name), 0644)
+	}
+
+	config = Config{SourceDir: sourceDir, TargetDir: targetDir, NoPreserveMetadata: true}
+	console = &consoleWriter{group: true}
+
+	output, _ := captureOutput(func() {
+		if err := processAudioFiles(); err != nil {
+			t.Errorf("processAudioFiles failed: %v", err)
+		}
+	})
+
+	if !strings.Contains(output, "── Artist/Album (2 files)\n") {
+		t.Errorf("missing album header in output:\n%s", output)
+	}
+	if !strings.Contains(output, "   Processing: "+filepath.Join(album, "01.mp3")) {
+		t.Errorf("per-file lines are not indented:\n%s", output)
+	}
+	if !strings.HasSuffix(output, "   └ 2 files: 2 copied\n") {
+		t.Errorf("missing album summary in output:\n%s", output)
+	}
+
+	// A subdirectory walked between the files of an album is written after it,
+	// so the album keeps one header and one summary
+	os.MkdirAll(filepath.Join(album, "Sub"), 0755)
+	for _, name := range []string{"Sub/01.mp3", "zz.mp3"} {
+		os.WriteFile(filepath.Join(album, filepath.FromSlash(name)), []byte(name), 0644)
+	}
+	config.TargetDir = filepath.Join(tmpDir, "split")
+	console = &consoleWriter{group: true}
+	output, _ = captureOutput(func() {
+		if err := processAudioFiles(); err != nil {
+			t.Errorf("processAudioFiles failed: %v", err)
+		}
+	})
+	var headers []string
+	for _, line := range strings.Split(output, "\n") {
+		if strings.HasPrefix(line, "──") || strings.HasPrefix(line, "   └") {
+			headers = append(headers, line)
+		}
+	}
+	want := []string{"── Artist/Album (3 files)", "   └ 3 files: 3 copied", "── Artist/Album/Sub (1 files)", "   └ 1 files: 1 copied"}
+	if !slices.Equal(headers, want) {
+		t.Errorf("Expected each directory once, got %q in:\n%s", headers, output)
+	}
+	if strings.Index(output, "zz.mp3") > strings.Index(output, "── Artist/Album/Sub") {
+		t.Errorf("Expected the album's lines before the subdirectory:\n%s", output)
+	}
+}
+
+func TestPerFileNiceOutput(t *testing.T) {
+	originalConfig := config
+	originalConsole := console
+	originalPath := os.Getenv("PATH")
+	defer func() { config = originalConfig; console = originalConsole; os.Setenv("PATH", originalPath) }()
+
+	tmpDir := t.TempDir()
+	sourceDir := filepath.Join(tmpDir, "source")
+	targetDir := filepath.Join(tmpDir, "target")
+	album := filepath.Join(sourceDir, "Artist", "Album")
+	os.MkdirAll(album, 0755)
+	for _, name := range []string{"01.mp3", "02.flac", "03.flac", "cover.jpg"} {
+		os.WriteFile(filepath.Join(album, name), []byte(name), 0644)
+	}
+
+	// 02.flac is converted, 03.flac cannot be probed and is copied
+	sox := writeFakeTool(t, tmpDir, "sox", `if [ "$1" = "--i" ]; then
+  case "$2" in *03.flac) exit 1;; esac
+  printf 'Channels       : 2\nSample Rate    : 96000\nSample Encoding: 24-bit FLAC\n'
+  exit 0
+fi
+for a in "$@"; do case "$a" in `+targetDir+`/*) echo converted > "$a";; esac; done`)
+	os.Setenv("PATH", tmpDir+string(os.PathListSeparator)+originalPath)
+
+	config = Config{SourceDir: sourceDir, TargetDir: targetDir, SoxCommand: sox, NoPreserveMetadata: true, NoPostcheck: true}
+	console = &consoleWriter{group: true, nice: true}
+	progress = &progressReporter{}
+
+	output, _ := captureOutput(func() {
+		if err := processAudioFiles(); err != nil {
+			t.Errorf("processAudioFiles failed: %v", err)
+		}
+	})
+
+	want := "── Artist/Album (3 files)\n" +
+		"   ├ 01.mp3: copied\n" +
+		"   ├ 02.flac: converted\n" +
+		"   ├ 03.flac: copied\n" +
+		"   │   Warning: Could not get audio info for " + filepath.Join(album, "03.flac") + ", copying original\n" +
+		"   └ 3 tracks: 1 converted, 2 copied\n"
+	if output != want {
+		t.Errorf("unexpected nice output:\n%s\nwant:\n%s", output, want)
+	}
+}
+
+func TestFlatOutput(t *testing.T) {
+	originalConsole := console
+	defer func() { console = originalConsole }()
+
+	console = &consoleWriter{}
+	output, _ := captureOutput(func() {
+		console.enterDir("/music/Album")
+		logf("Processing: %s\n", "song.flac")
+		console.closeDir()
+	})
+
+	if output != "Processing: song.flac\n" {
+		t.Errorf("flat output should not be grouped, got %q", output)
+	}
+}
+
+func TestConsoleFileBuffering(t *testing.T) {
+	originalConsole := console
+	defer func() { console = originalConsole }()
+
+	var out bytes.Buffer
+	console = &consoleWriter{out: &out}
+	logf("streamed\n")
+	if out.String() != "streamed\n" {
+		t.Fatalf("Expected lines outside a file to be written at once, got %q", out.String())
+	}
+	out.Reset()
+
+	// Tasks without an output stream their lines like logf
+	newFileTask("song.flac").logf("streamed %s\n", "song.flac")
+	if out.String() != "streamed song.flac\n" {
+		t.Fatalf("Expected the lines of a task without an output to be written at once, got %q", out.String())
+	}
+	out.Reset()
+
+	// Two files log alternately; each comes out in one piece
+	a, b := newFileTask("a.flac"), newFileTask("b.flac")
+	a.out, b.out = console.beginFile(a.path), console.beginFile(b.path)
+	for step := 0; step < 2; step++ {
+		a.logf("a.flac step %d\n", step)
+		b.logf("b.flac step %d\n", step)
+	}
+	if out.Len() != 0 {
+		t.Errorf("Expected the lines to be held back until the files end, got %q", out.String())
+	}
+	console.endFile(b.out)
+	console.endFile(a.out)
+	want := "b.flac step 0\nb.flac step 1\na.flac step 0\na.flac step 1\n"
+	if out.String() != want {
+		t.Errorf("Unexpected buffered output:\n%s\nwant:\n%s", out.String(), want)
+	}
+	out.Reset()
+
+	// Long running files write their complete lines periodically
+	long := newFileTask("long.flac")
+	long.out = console.beginFile(long.path)
+	long.logf("Processing: long.flac\n")
+	if out.Len() != 0 {
+		t.Errorf("Expected the line to be held back, got %q", out.String())
+	}
+	long.out.flushed = time.Now().Add(-fileOutputFlushInterval)
+	long.logf("Converting ")
+	long.logf("long.flac\n")
+	if out.String() != "Processing: long.flac\nConverting long.flac\n" {
+		t.Errorf("Expected the held back lines after the flush interval, got %q", out.String())
+	}
+	console.endFile(long.out)
+}
+
+func TestProgressLine(t *testing.T) {
+	originalConfig := config
+	originalConsole := console
+	defer func() { config = originalConfig; console = originalConsole; progress = &progressReporter{} }()
+
+	config = Config{SourceDir: "/music"}
+	tests := []struct {
+		status RunStatus
+		want   string
+	}{
+		{RunStatus{Total: 1890, Current: []string{"/music/Artist/Album/track.flac"}}, "[0/1890] 0.0% – ETA --:--:-- – currently: Artist/Album/track.flac"},
+		{RunStatus{Total: 1890, Completed: 120, Failed: 3, ETASeconds: 872, Current: []string{"/music/Artist/Album/track.flac"}}, "[123/1890] 6.5% – ETA 00:14:32 – currently: Artist/Album/track.flac"},
+		{RunStatus{Total: 10, Completed: 5, ETASeconds: 3600, Current: []string{"/music/a.flac", "/music/b.flac"}}, "[5/10] 50.0% – ETA 01:00:00 – currently: a.flac (+1 more)"},
+		{RunStatus{Total: 2, Completed: 2}, "[2/2] 100.0%"},
+	}
+	for _, tt := range tests {
+		if got := progressLine(tt.status); got != tt.want {
+			t.Errorf("progressLine(%+v) = %q, want %q", tt.status, got, tt.want)
+		}
+	}
+
+	// On a terminal the line is redrawn below the output
+	var out bytes.Buffer
+	console = &consoleWriter{out: &out, progress: true, terminal: true}
+	console.updateProgress(RunStatus{Total: 2, Completed: 1})
+	logf("Processing: %s\n", "b.flac")
+	console.finishProgress()
+	if want := "\r\033[K[1/2] 50.0% – ETA --:--:--\r\033[KProcessing: b.flac\n[1/2] 50.0% – ETA --:--:--\n"; out.String() != want {
+		t.Errorf("Unexpected terminal output %q, want %q", out.String(), want)
+	}
+
+	// Elsewhere it is printed periodically and when the run is done
+	out.Reset()
+	console = &consoleWriter{out: &out, progress: true}
+	console.updateProgress(RunStatus{Total: 3})
+	console.updateProgress(RunStatus{Total: 3, Completed: 1})
+	console.updateProgress(RunStatus{Total: 3, Completed: 3})
+	if want := "[0/3] 0.0% – ETA --:--:--\n[3/3] 100.0%\n"; out.String() != want {
+		t.Errorf("Unexpected plain progress output %q, want %q", out.String(), want)
+	}
+
+	sourceDir := t.TempDir()
+	for _, name := range []string{"a.mp3", "b.mp3"} {
+		os.WriteFile(filepath.Join(sourceDir, name), []byte(name), 0644)
+	}
+	config = Config{TargetDir: t.TempDir(), SoxCommand: "true", NoPreserveMetadata: true, Quiet: true, Jobs: 1}
+	output, err := captureOutput(func() {
+		if err := runConverter(nil, []string{sourceDir}); err != nil {
+			t.Errorf("runConverter failed: %v", err)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(output, "Processing: ") || !strings.Contains(output, "[2/2] 100.0%\n") || !strings.Contains(output, "Processing complete!") {
+		t.Errorf("Expected --quiet to keep only the progress and the summary, got:\n%s", output)
+	}
+
+	config = Config{TargetDir: t.TempDir(), Quiet: true, Verbose: true}
+	if err := convertLibrary([]string{sourceDir}); err == nil || !strings.Contains(err.Error(), "--quiet") {
+		t.Errorf("Expected --quiet to be rejected with --verbose, got %v", err)
+	}
+}
+
+func TestMP3CompressionArgs(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig }()
+
+	tests := []struct {
+		mode    string
+		bitrate int
+		quality int
+		want    []string
+		desc    string
+	}{
+		{"", 0, 0, []string{"-C", "320"}, "320kbps"},
+		{"cbr", 192, 0, []string{"-C", "192"}, "192kbps"},
+		{"vbr", 0, 0, []string{"-C", "-0.2"}, "VBR V0"},
+		{"vbr", 0, 4, []string{"-C", "-4.2"}, "VBR V4"},
+		{"abr", 256, 0, []string{"-C", "256"}, "256kbps ABR"},
+	}
+
+	for _, tt := range tests {
+		config = Config{MP3Mode: tt.mode, MP3Bitrate: tt.bitrate, MP3Quality: tt.quality}
+		if got := mp3CompressionArgs(); !slices.Equal(got, tt.want) {
+			t.Errorf("mode %q: mp3CompressionArgs() = %v, want %v", tt.mode, got, tt.want)
+		}
+		if got := mp3RateDescription(); got != tt.desc {
+			t.Errorf("mode %q: mp3RateDescription() = %q, want %q", tt.mode, got, tt.desc)
+		}
+	}
+}
+
+func TestValidateMP3Options(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig }()
+
+	tests := []struct {
+		name    string
+		cfg     Config
+		wantErr bool
+	}{
+		{"Default", Config{}, false},
+		{"CBRBitrate", Config{MP3Mode: "cbr", MP3Bitrate: 256}, false},
+		{"CBRNonStandardBitrate", Config{MP3Mode: "cbr", MP3Bitrate: 250}, true},
+		{"CBRWithQuality", Config{MP3Mode: "cbr", MP3Quality: 2}, true},
+		{"ABRBitrate", Config{MP3Mode: "abr", MP3Bitrate: 250}, false},
+		{"ABRTooHigh", Config{MP3Mode: "abr", MP3Bitrate: 400}, true},
+		{"VBRQuality", Config{MP3Mode: "vbr", MP3Quality: 9}, false},
+		{"VBRQualityOutOfRange", Config{MP3Mode: "vbr", MP3Quality: 10}, true},
+		{"VBRWithBitrate", Config{MP3Mode: "vbr", MP3Bitrate: 320}, true},
+		{"UnknownMode", Config{MP3Mode: "cvbr"}, true},
+		{"Preset", Config{MP3Mode: "cbr", MP3Preset: "V2"}, false},
+		{"LowerCasePreset", Config{MP3Preset: "v0"}, false},
+		{"PresetOutOfRange", Config{MP3Preset: "V10"}, true},
+		{"Garbage", Config{MP3Preset: "fast"}, true},
+		{"PresetWithABR", Config{MP3Mode: "abr", MP3Preset: "V2"}, true},
+		{"PresetWithQuality", Config{MP3Preset: "V2", MP3Quality: 4}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config = tt.cfg
+			if err := validateMP3Options(); (err != nil) != tt.wantErr {
+				t.Errorf("validateMP3Options() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMP3BitrateFlag(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig }()
+
+	config = Config{MP3Mode: "cbr"}
+	value := &mp3BitrateValue{&config.MP3Bitrate, &config.MP3Preset}
+	value.Set("192")
+	if config.MP3Bitrate != 192 || config.MP3Preset != "" || value.String() != "192" {
+		t.Errorf("Expected a 192 kbps bitrate, got %+v", config)
+	}
+	if got := mp3CompressionArgs(); !slices.Equal(got, []string{"-C", "192"}) {
+		t.Errorf("mp3CompressionArgs() = %v", got)
+	}
+
+	value.Set("V2")
+	if config.MP3Bitrate != 0 || config.MP3Preset != "V2" || value.String() != "V2" {
+		t.Errorf("Expected the V2 preset, got %+v", config)
+	}
+	if got := mp3CompressionArgs(); !slices.Equal(got, []string{"-C", "-2.2"}) {
+		t.Errorf("mp3CompressionArgs() = %v", got)
+	}
+	if got := ffmpegMP3Args(); !slices.Equal(got, []string{"-c:a", "libmp3lame", "-q:a", "2"}) {
+		t.Errorf("ffmpegMP3Args() = %v", got)
+	}
+	if got := mp3RateDescription(); got != "VBR V2" {
+		t.Errorf("mp3RateDescription() = %q", got)
+	}
+
+	config = Config{TargetDir: t.TempDir(), EnforceOutputFormat: "mp3", MP3Preset: "320k"}
+	if err := convertLibrary([]string{t.TempDir()}); err == nil || !strings.Contains(err.Error(), `invalid mp3-bitrate: "320k"`) {
+		t.Errorf("Expected a garbage bitrate to be rejected before processing, got %v", err)
+	}
+}
+
+func TestConvertToMP3RateControl(t *testing.T) {
+	originalConfig := config
+	originalPath := os.Getenv("PATH")
+	defer func() { config = originalConfig; os.Setenv("PATH", originalPath) }()
+
+	tmpDir := t.TempDir()
+	argsFile := filepath.Join(tmpDir, "args")
+	record := `echo "$@" > ` + argsFile + `; for a in "$@"; do case "$a" in *.mp3) touch "$a";; esac; done`
+	sox := writeFakeTool(t, tmpDir, "sox", record)
+	writeFakeTool(t, tmpDir, "ffmpeg", record)
+	os.Setenv("PATH", tmpDir+string(os.PathListSeparator)+originalPath)
+
+	source := filepath.Join(tmpDir, "song.flac")
+	os.WriteFile(source, []byte("flac"), 0644)
+	info := &AudioInfo{Bits: 24, Rate: 96000}
+
+	tests := []struct {
+		mode string
+		want string
+	}{
+		{"cbr", "-t mp3 -C 320 -r 48000"},
+		{"vbr", "-t mp3 -C -2.2 -r 48000"},
+		{"abr", "-c:a libmp3lame -abr 1 -b:a 192k -ar 48000"},
+	}
+
+	for _, tt := range tests {
+		config = Config{SourceDir: tmpDir, TargetDir: tmpDir, SoxCommand: sox, NoPreserveMetadata: true, MP3Mode: tt.mode}
+		switch tt.mode {
+		case "vbr":
+			config.MP3Quality = 2
+		case "abr":
+			config.MP3Bitrate = 192
+		}
+
+		target := filepath.Join(tmpDir, tt.mode+".mp3")
+		if err := convertToMP3(newFileTask(source), source, target, info); err != nil {
+			t.Fatalf("mode %s: convertToMP3 failed: %v", tt.mode, err)
+		}
+		args, _ := os.ReadFile(argsFile)
+		if !strings.Contains(string(args), tt.want) {
+			t.Errorf("mode %s: expected arguments containing %q, got %q", tt.mode, tt.want, strings.TrimSpace(string(args)))
+		}
+	}
+}
+
+func TestVerifyRoundtrip(t *testing.T) {
+	originalConfig := config
+	originalDigest := decodedPCMDigest
+	defer func() { config = originalConfig; decodedPCMDigest = originalDigest; resetFailures() }()
+
+	digests := map[string]string{
+		"source.m4a":   "aaaa",
+		"same.flac":    "aaaa",
+		"changed.flac": "bbbb",
+	}
+	decodedPCMDigest = func(path string) (string, error) {
+		digest, ok := digests[path]
+		if !ok {
+			return "", errors.New("decode failed")
+		}
+		return digest, nil
+	}
+
+	config = Config{}
+	if err := verifyRoundtrip(newFileTask("source.m4a"), "source.m4a", "changed.flac"); err != nil {
+		t.Errorf("verification should be skipped unless enabled, got %v", err)
+	}
+
+	config = Config{VerifyRoundtrip: true}
+	resetFailures()
+	captureOutput(func() {
+		if err := verifyRoundtrip(newFileTask("source.m4a"), "source.m4a", "same.flac"); err != nil {
+			t.Errorf("matching PCM should verify, got %v", err)
+		}
+		if err := verifyRoundtrip(newFileTask("source.m4a"), "source.m4a", "changed.flac"); !errors.Is(err, errRoundtripMismatch) {
+			t.Errorf("expected errRoundtripMismatch, got %v", err)
+		}
+		if err := verifyRoundtrip(newFileTask("source.m4a"), "source.m4a", "missing.flac"); err == nil || errors.Is(err, errRoundtripMismatch) {
+			t.Errorf("expected a decode error, got %v", err)
+		}
+	})
+
+	// The caller records the mismatch as a failed conversion, it is not a
+	// file that could not be read
+	if recorded := recordedFailures(); len(recorded) != 0 {
+		t.Errorf("expected no read failures, got %+v", recorded)
+	}
+}
+
+func TestFFmpegPCMDigest(t *testing.T) {
+	originalConfig := config
+	originalPath := os.Getenv("PATH")
+	defer func() { config = originalConfig; os.Setenv("PATH", originalPath) }()
+
+	tmpDir := t.TempDir()
+	writeFakeTool(t, tmpDir, "ffmpeg", `echo "MD5=0123abcd"`)
+	os.Setenv("PATH", tmpDir+string(os.PathListSeparator)+originalPath)
+	config = Config{}
+
+	digest, err := ffmpegPCMDigest(filepath.Join(tmpDir, "song.flac"))
+	if err != nil {
+		t.Fatalf("ffmpegPCMDigest failed: %v", err)
+	}
+	if digest != "0123abcd" {
+		t.Errorf("expected digest 0123abcd, got %q", digest)
+	}
+}
+
+func TestSortWork(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig }()
+
+	work := []audioWork{
+		{path: "a/1.flac", size: 10},
+		{path: "a/2.flac", size: 300},
+		{path: "b/1.flac", size: 10},
+		{path: "c/1.flac", size: 2000},
+	}
+	paths := func(items []audioWork) []string {
+		var out []string
+		for _, item := range items {
+			out = append(out, item.path)
+		}
+		return out
+	}
+
+	config = Config{}
+	unsorted := slices.Clone(work)
+	sortWork(unsorted)
+	if !slices.Equal(paths(unsorted), paths(work)) {
+		t.Errorf("default order should stay by path, got %v", paths(unsorted))
+	}
+
+	config = Config{Sort: "size-desc"}
+	sorted := slices.Clone(work)
+	sortWork(sorted)
+	want := []string{"c/1.flac", "a/2.flac", "a/1.flac", "b/1.flac"}
+	if !slices.Equal(paths(sorted), want) {
+		t.Errorf("size-desc order = %v, want %v", paths(sorted), want)
+	}
+}
+
+func TestRecordedFailuresOrderedByPath(t *testing.T) {
+	defer resetFailures()
+	resetFailures()
+
+	recordFailure("/music/b.flac", errors.New("b"))
+	recordFailure("/music/a.flac", errors.New("a"))
+
+	recorded := recordedFailures()
+	if len(recorded) != 2 || recorded[0].Path != "/music/a.flac" || recorded[1].Path != "/music/b.flac" {
+		t.Errorf("failures not ordered by path: %+v", recorded)
+	}
+}
+
+func TestNameTemplateRender(t *testing.T) {
+	tmpl, err := parseNameTemplate("{artist}/{album}/{track:00} - {title|Unknown}")
+	if err != nil {
+		t.Fatalf("parseNameTemplate failed: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		tags map[string]string
+		want string
+	}{
+		{"AllTags", map[string]string{"artist": "Artist", "album": "Album", "track": "3", "title": "Song"}, filepath.Join("Artist", "Album", "03 - Song")},
+		{"TrackWithTotal", map[string]string{"artist": "Artist", "album": "Album", "track": "7/12", "title": "Song"}, filepath.Join("Artist", "Album", "07 - Song")},
+		{"WidePadKeepsLongNumbers", map[string]string{"artist": "Artist", "album": "Album", "track": "112", "title": "Song"}, filepath.Join("Artist", "Album", "112 - Song")},
+		{"MissingTitleFallback", map[string]string{"artist": "Artist", "album": "Album", "track": "1"}, filepath.Join("Artist", "Album", "01 - Unknown")},
+		{"MissingAlbumDropsSegment", map[string]string{"artist": "Artist", "track": "1", "title": "Song"}, filepath.Join("Artist", "01 - Song")},
+		{"SlashInTag", map[string]string{"artist": "AC/DC", "album": "Album", "track": "1", "title": "Song"}, filepath.Join("AC-DC", "Album", "01 - Song")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tmpl.render(tt.tags); got != tt.want {
+				t.Errorf("render() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNameTemplateFallbackPadding(t *testing.T) {
+	tmpl, err := parseNameTemplate("{disc:0|1}-{tracknumber:000|0} {title}")
+	if err != nil {
+		t.Fatalf("parseNameTemplate failed: %v", err)
+	}
+	if got := tmpl.render(map[string]string{"title": "Intro"}); got != "1-000 Intro" {
+		t.Errorf("expected padded fallbacks, got %q", got)
+	}
+	if got := tmpl.render(map[string]string{"disc": "2", "track": "9", "title": "Outro"}); got != "2-009 Outro" {
+		t.Errorf("expected padded tags, got %q", got)
+	}
+}
+
+func TestParseNameTemplateErrors(t *testing.T) {
+	for _, text := range []string{"{artist", "{}", "{track:0a}", "{track:}", "artist}", "{a{b}"} {
+		if _, err := parseNameTemplate(text); err == nil {
+			t.Errorf("parseNameTemplate(%q) should fail", text)
+		}
+	}
+}
+
+func TestTargetPathForNameTemplate(t *testing.T) {
+	originalConfig := config
+	originalTemplate := nameTemplate
+	defer func() { config = originalConfig; nameTemplate = originalTemplate }()
+
+	sourceDir := t.TempDir()
+	config = Config{SourceDir: sourceDir, TargetDir: "/target"}
+	nameTemplate, _ = parseNameTemplate("{artist|Unknown Artist}/{track:00} {title}")
+
+	source := filepath.Join(sourceDir, "in", "song.flac")
+	probeCache.Lock()
+	probeCache.results[source] = &ProbeResult{Format: ProbeFormat{Tags: map[string]string{"TITLE": "Song", "TRACKNUMBER": "4"}}}
+	probeCache.Unlock()
+	defer forgetProbe(source)
+
+	want := filepath.Join("/target", "Unknown Artist", "04 Song.flac")
+	if got := targetPathFor(config.EnforceOutputFormat, filepath.Join("in", "song.flac")); got != want {
+		t.Errorf("targetPathFor() = %q, want %q", got, want)
+	}
+}
+
+func TestCopiedMP3IsNotProbed(t *testing.T) {
+	originalConfig := config
+	originalPath := os.Getenv("PATH")
+	defer func() {
+		config = originalConfig
+		os.Setenv("PATH", originalPath)
+		nameTemplate = nil
+		resetAssignedPaths()
+	}()
+
+	tmpDir := t.TempDir()
+	probes := filepath.Join(tmpDir, "probes")
+	writeFakeTool(t, tmpDir, "ffprobe", `echo "$@" >> `+probes+`
+echo '{"streams":[{"codec_type":"audio","sample_rate":"44100"}],"format":{"tags":{"title":"Song"}}}'`)
+	writeFakeTool(t, tmpDir, "ffmpeg", `printf ' A..... alac ALAC\n A..... libmp3lame MP3\n A..... libvorbis Vorbis\n'`)
+	os.Setenv("PATH", tmpDir+string(os.PathListSeparator)+originalPath)
+	sourceDir := filepath.Join(tmpDir, "source")
+	os.MkdirAll(sourceDir, 0755)
+	os.WriteFile(filepath.Join(sourceDir, "song.mp3"), []byte("mp3"), 0644)
+
+	for _, format := range []string{"", "flac", "mp3", "alac", "vorbis"} {
+		os.Remove(probes)
+		config = Config{TargetDir: filepath.Join(tmpDir, "target-"+format), SoxCommand: "true", EnforceOutputFormat: format}
+		captureOutput(func() {
+			if err := runConverter(nil, []string{sourceDir}); err != nil {
+				t.Errorf("%q: runConverter failed: %v", format, err)
+			}
+		})
+		if data, err := os.ReadFile(probes); err == nil {
+			t.Errorf("%q: expected the copied MP3 not to be probed, got %q", format, data)
+		}
+	}
+
+	// A templated name needs the tags, but only once
+	os.Remove(probes)
+	config = Config{TargetDir: filepath.Join(tmpDir, "templated"), SoxCommand: "true", NoPreserveMetadata: true, NameTemplate: "{title}"}
+	captureOutput(func() {
+		if err := runConverter(nil, []string{sourceDir}); err != nil {
+			t.Errorf("runConverter failed: %v", err)
+		}
+	})
+	data, _ := os.ReadFile(probes)
+	if count := strings.Count(string(data), "\n"); count != 1 {
+		t.Errorf("Expected one probe for the templated name, got %d:\n%s", count, data)
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, "templated", "Song.mp3")); err != nil {
+		t.Errorf("Expected the templated copy: %v", err)
+	}
+
+	// --no-probe-copy leaves copies alone by the options that would probe them
+	probing := Config{SoxCommand: "true", NoPreserveMetadata: true, NameTemplate: "{title}", PadTracks: true, MinDuration: "10"}
+	for name, extra := range map[string]Config{
+		"no-probe-copy":             {NoProbeCopy: true},
+		"mp3 no-probe-copy":         {NoProbeCopy: true, EnforceOutputFormat: "mp3", MP3MinCopyBitrate: 192},
+		"probe-only-extensions":     {ProbeOnlyExtensions: "flac, .AAC"},
+		"mp3 probe-only-extensions": {ProbeOnlyExtensions: "aac", EnforceOutputFormat: "mp3", MP3MinCopyBitrate: 192},
+		"probed extension":          {ProbeOnlyExtensions: "MP3"},
+	} {
+		os.Remove(probes)
+		config = probing
+		config.TargetDir = filepath.Join(tmpDir, name)
+		config.NoProbeCopy = extra.NoProbeCopy
+		config.ProbeOnlyExtensions = extra.ProbeOnlyExtensions
+		config.EnforceOutputFormat = extra.EnforceOutputFormat
+		config.MP3MinCopyBitrate = extra.MP3MinCopyBitrate
+		resetAssignedPaths()
+		captureOutput(func() {
+			if err := runConverter(nil, []string{sourceDir}); err != nil {
+				t.Errorf("%s: runConverter failed: %v", name, err)
+			}
+		})
+		data, _ := os.ReadFile(probes)
+		target := "song.mp3"
+		if name == "probed extension" {
+			target = "Song.mp3"
+			if len(data) == 0 {
+				t.Errorf("%s: expected the MP3 to be probed", name)
+			}
+		} else if len(data) != 0 {
+			t.Errorf("%s: expected the copied MP3 not to be probed, got %q", name, data)
+		}
+		if _, err := os.Stat(filepath.Join(config.TargetDir, target)); err != nil {
+			t.Errorf("%s: expected the copy at %s: %v", name, target, err)
+		}
+	}
+
+	config = Config{TargetDir: filepath.Join(tmpDir, "conflict"), NoProbeCopy: true, ProbeOnlyExtensions: "mp3"}
+	if err := runConverter(nil, []string{sourceDir}); err == nil || !strings.Contains(err.Error(), "--no-probe-copy cannot be used with --probe-only-extensions") {
+		t.Errorf("Expected --no-probe-copy and --probe-only-extensions to conflict, got %v", err)
+	}
+}
+
+func TestTrackPadWidth(t *testing.T) {
+	tests := []struct {
+		tags map[string]string
+		want int
+	}{
+		{map[string]string{}, 2},
+		{map[string]string{"track": "2"}, 2},
+		{map[string]string{"track": "2/9"}, 2},
+		{map[string]string{"track": "2/120"}, 3},
+		{map[string]string{"track": "2", "tracktotal": "100"}, 3},
+		{map[string]string{"track": "2", "totaltracks": "1000"}, 4},
+	}
+	for _, tt := range tests {
+		if got := trackPadWidth(tt.tags); got != tt.want {
+			t.Errorf("trackPadWidth(%v) = %d, want %d", tt.tags, got, tt.want)
+		}
+	}
+
+	tmpl, _ := parseNameTemplate("{track} {title}")
+	if got := tmpl.render(map[string]string{"track": "2", "tracktotal": "120", "title": "Song"}); got != "002 Song" {
+		t.Errorf("template track padding = %q, want %q", got, "002 Song")
+	}
+}
+
+func TestTrackNumberNormalization(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig }()
+
+	tmpl, _ := parseNameTemplate("{track} {title}")
+	tests := []struct {
+		track      string
+		want, wide string
+	}{
+		{"1", "01", "001"},
+		{"01", "01", "001"},
+		{"001", "01", "001"},
+		{"1/12", "01", "001"},
+		{"12/12", "12", "012"},
+		{" 7 ", "07", "007"},
+		{"0", "00", "000"},
+		{"A1", "A1", "A1"},
+	}
+	for _, tt := range tests {
+		config = Config{}
+		if got := tmpl.render(map[string]string{"track": tt.track, "title": "Song"}); got != tt.want+" Song" {
+			t.Errorf("render(%q) = %q, want %q", tt.track, got, tt.want+" Song")
+		}
+		config = Config{TrackWidth: 3}
+		if got := tmpl.render(map[string]string{"track": tt.track, "title": "Song"}); got != tt.wide+" Song" {
+			t.Errorf("render(%q) with --track-width 3 = %q, want %q", tt.track, got, tt.wide+" Song")
+		}
+	}
+
+	config = Config{TargetDir: t.TempDir(), TrackWidth: 2}
+	if err := convertLibrary([]string{t.TempDir()}); err == nil || !strings.Contains(err.Error(), "--track-width") {
+		t.Errorf("Expected --track-width without a naming option to be rejected, got %v", err)
+	}
+	config = Config{TargetDir: t.TempDir(), TrackWidth: -1, PadTracks: true}
+	if err := convertLibrary([]string{t.TempDir()}); err == nil || !strings.Contains(err.Error(), "track-width") {
+		t.Errorf("Expected a negative --track-width to be rejected, got %v", err)
+	}
+}
+
+func TestPadTracksMirroredLayout(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig }()
+	defer resetAssignedPaths()
+
+	resetAssignedPaths()
+	config = Config{SourceDir: t.TempDir(), TargetDir: "/target", PadTracks: true}
+
+	tests := []struct {
+		relPath string
+		want    string
+	}{
+		{filepath.Join("Album", "2 Song.flac"), filepath.Join("/target", "Album", "02 Song.flac")},
+		{filepath.Join("Album", "10 Other.flac"), filepath.Join("/target", "Album", "10 Other.flac")},
+		{filepath.Join("Album", "Intro.flac"), filepath.Join("/target", "Album", "Intro.flac")},
+		// Collides with the padded name of "2 Song.flac"
+		{filepath.Join("Album", "02 Song.flac"), filepath.Join("/target", "Album", "02 Song (2).flac")},
+	}
+	for _, tt := range tests {
+		if got := targetPathFor(config.EnforceOutputFormat, tt.relPath); got != tt.want {
+			t.Errorf("targetPathFor(%q) = %q, want %q", tt.relPath, got, tt.want)
+		}
+	}
+}
+
+func TestDownsampleOnly(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig }()
+
+	tmpDir := t.TempDir()
+	argsFile := filepath.Join(tmpDir, "args")
+	sox := writeFakeTool(t, tmpDir, "sox", `echo "$@" > `+argsFile+`; for a in "$@"; do case "$a" in *.flac) touch "$a";; esac; done`)
+
+	config = Config{SourceDir: tmpDir, TargetDir: tmpDir, SoxCommand: sox, NoPreserveMetadata: true, NoPostcheck: true, DownsampleOnly: true}
+
+	needsConversion, bitrateArgs, sampleRateArgs := determineConversion(policyFromConfig(), &AudioInfo{Bits: 24, Rate: 96000})
+	if !needsConversion {
+		t.Fatal("24/96 source should still be resampled")
+	}
+	if len(bitrateArgs) != 0 {
+		t.Errorf("bit depth must be kept, got %v", bitrateArgs)
+	}
+	if sampleRateArgs[len(sampleRateArgs)-1] != "48000" {
+		t.Errorf("expected resampling to 48000, got %v", sampleRateArgs)
+	}
+
+	source := filepath.Join(tmpDir, "song.flac")
+	os.WriteFile(source, []byte("flac"), 0644)
+	captureOutput(func() {
+		if err := processFlac(newFileTask(source), source, filepath.Join(tmpDir, "out.flac"), needsConversion, bitrateArgs, sampleRateArgs); err != nil {
+			t.Fatalf("processFlac failed: %v", err)
+		}
+	})
+
+	data, _ := os.ReadFile(argsFile)
+	args := strings.Fields(string(data))
+	if slices.Contains(args, "-b") || slices.Contains(args, "dither") {
+		t.Errorf("downsample-only must not change bit depth or dither, got %v", args)
+	}
+	if !slices.Contains(args, "48000") {
+		t.Errorf("expected SoX to resample to 48000, got %v", args)
+	}
+
+	// 24/48 needs nothing at all
+	if needs, _, _ := determineConversion(policyFromConfig(), &AudioInfo{Bits: 24, Rate: 48000}); needs {
+		t.Error("24/48 source should be copied with --downsample-only")
+	}
+}
+
+func TestNormalizeTagValue(t *testing.T) {
+	originalConfig := config
+	originalRules := tagRules
+	defer func() { config = originalConfig; tagRules = originalRules }()
+
+	config = Config{NormalizeTags: true, TitleCaseTags: "Genre, artist"}
+	tagRules = []tagRule{{find: " ft. ", replace: " feat. "}}
+
+	tests := []struct {
+		key   string
+		value string
+		want  string
+	}{
+		{"ARTIST", "  daft   PUNK ", "Daft Punk"},
+		{"genre", "hip hop", "Hip Hop"},
+		{"title", "Song  ft. Someone", "Song feat. Someone"},
+		{"title", "Café", "Café"},
+		{"lyrics", "line one\nline  two", "line one\nline two"},
+		{"album", "already clean", "already clean"},
+	}
+	for _, tt := range tests {
+		if got := normalizeTagValue(tt.key, tt.value); got != tt.want {
+			t.Errorf("normalizeTagValue(%q, %q) = %q, want %q", tt.key, tt.value, got, tt.want)
+		}
+	}
+
+	// Rules alone do not normalize whitespace
+	config = Config{}
+	if got := normalizeTagValue("title", " A  ft. B"); got != " A  feat. B" {
+		t.Errorf("rules-only normalization = %q", got)
+	}
+}
+
+func TestLoadTagRules(t *testing.T) {
+	tmpDir := t.TempDir()
+	path := filepath.Join(tmpDir, "rules.csv")
+	os.WriteFile(path, []byte("# find,replace\n\" ft. \",\" feat. \"\nHip-Hop,Hip Hop\n"), 0644)
+
+	rules, err := loadTagRules(path)
+	if err != nil {
+		t.Fatalf("loadTagRules failed: %v", err)
+	}
+	want := []tagRule{{" ft. ", " feat. "}, {"Hip-Hop", "Hip Hop"}}
+	if !slices.Equal(rules, want) {
+		t.Errorf("rules = %+v, want %+v", rules, want)
+	}
+
+	os.WriteFile(path, []byte(",empty\n"), 0644)
+	if _, err := loadTagRules(path); err == nil {
+		t.Error("expected an error for an empty find value")
+	}
+	if _, err := loadTagRules(filepath.Join(tmpDir, "missing.csv")); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+}
+
+func TestMetadataOverrides(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig }()
+
+	source := filepath.Join(t.TempDir(), "song.flac")
+	probeCache.Lock()
+	probeCache.results[source] = &ProbeResult{Format: ProbeFormat{Tags: map[string]string{
+		"ARTIST": "Some  Artist ",
+		"TITLE":  "Clean",
+	}}}
+	probeCache.Unlock()
+	defer forgetProbe(source)
+
+	config = Config{}
+	if args := metadataOverrides(nil, source); args != nil {
+		t.Errorf("no overrides expected without normalization, got %v", args)
+	}
+
+	config = Config{NormalizeTags: true}
+	want := []string{"-metadata", "ARTIST=Some Artist"}
+	if args := metadataOverrides(nil, source); !slices.Equal(args, want) {
+		t.Errorf("metadataOverrides() = %v, want %v", args, want)
+	}
+}
+
+func TestSourceRootRelativePaths(t *testing.T) {
+	originalConfig := config
+	originalRenameMap := renameMap
+	defer func() { config = originalConfig; renameMap = originalRenameMap; resetAssignedPaths() }()
+
+	tmpDir := t.TempDir()
+	root := filepath.Join(tmpDir, "library")
+	sourceDir := filepath.Join(root, "Artist", "Album")
+	targetDir := filepath.Join(tmpDir, "target")
+	os.MkdirAll(sourceDir, 0755)
+	os.WriteFile(filepath.Join(sourceDir, "a.mp3"), []byte("a"), 0644)
+	os.WriteFile(filepath.Join(sourceDir, "b.mp3"), []byte("b"), 0644)
+
+	// Walk: outputs keep their path below the root, not below the walked directory
+	config = Config{SourceDir: sourceDir, SourceRoot: root, TargetDir: targetDir, NoPreserveMetadata: true}
+	captureOutput(func() {
+		if err := processAudioFiles(); err != nil {
+			t.Fatalf("processAudioFiles failed: %v", err)
+		}
+	})
+	if _, err := os.Stat(filepath.Join(targetDir, "Artist", "Album", "a.mp3")); err != nil {
+		t.Errorf("expected output relative to the source root: %v", err)
+	}
+
+	// Rename map entries are relative to the root as well
+	mapPath := filepath.Join(tmpDir, "rename.csv")
+	os.WriteFile(mapPath, []byte("Artist/Album/b.mp3,Renamed/b.mp3\n"), 0644)
+	var err error
+	captureOutput(func() { renameMap, err = loadRenameMap(mapPath, sourceRoot()) })
+	if err != nil {
+		t.Fatalf("loadRenameMap failed: %v", err)
+	}
+	if got, want := targetPathFor(config.EnforceOutputFormat, filepath.Join("Artist", "Album", "b.mp3")), filepath.Join(targetDir, "Renamed", "b.mp3"); got != want {
+		t.Errorf("targetPathFor() = %q, want %q", got, want)
+	}
+
+	// Docker paths are mounted from the root
+	if got := getDockerPath(filepath.Join(sourceDir, "a.mp3")); got != "/source/Artist/Album/a.mp3" {
+		t.Errorf("getDockerPath() = %q", got)
+	}
+
+	// Without --source-root the positional directory is the root
+	config.SourceRoot = ""
+	if sourceRoot() != sourceDir {
+		t.Errorf("sourceRoot() should default to the source directory, got %q", sourceRoot())
+	}
+}
+
+func TestSourceRootMustContainSource(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig }()
+
+	tmpDir := t.TempDir()
+	root := filepath.Join(tmpDir, "library")
+	outside := filepath.Join(tmpDir, "elsewhere")
+	os.MkdirAll(root, 0755)
+	os.MkdirAll(outside, 0755)
+
+	config = Config{SourceRoot: root, TargetDir: filepath.Join(tmpDir, "target"), SoxCommand: "true"}
+	err := runConverter(nil, []string{outside})
+	if err == nil || !strings.Contains(err.Error(), "not inside source root") {
+		t.Errorf("expected a source root error, got %v", err)
+	}
+}
+
+func TestDropTags(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig }()
+
+	config = Config{DropTags: "Comment, itunes*"}
+	for key, want := range map[string]bool{"COMMENT": true, "iTunSMPB": false, "itunes_cddb_1": true, "TITLE": false} {
+		if got := tagDropped(key); got != want {
+			t.Errorf("tagDropped(%q) = %v, want %v", key, got, want)
+		}
+	}
+
+	config = Config{DropTags: "@default,custom"}
+	for _, key := range []string{"ENCODER", "iTunNORM", "CDDB", "custom"} {
+		if !tagDropped(key) {
+			t.Errorf("%s should be dropped by @default,custom", key)
+		}
+	}
+	if tagDropped("ARTIST") {
+		t.Error("ARTIST must not be dropped by the default list")
+	}
+
+	config = Config{DropTags: "enc[oder"}
+	if err := validateDropTags(); err == nil {
+		t.Error("expected an invalid pattern error")
+	}
+}
+
+func TestMetadataOverridesDropTags(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig }()
+
+	source := filepath.Join(t.TempDir(), "song.flac")
+	probeCache.Lock()
+	probeCache.results[source] = &ProbeResult{Format: ProbeFormat{Tags: map[string]string{
+		"ARTIST":  " Artist",
+		"COMMENT": "Exact Audio Copy",
+		"ENCODER": "libFLAC",
+	}}}
+	probeCache.Unlock()
+	defer forgetProbe(source)
+
+	config = Config{DropTags: "encoder,comment", NormalizeTags: true}
+	want := []string{"-fflags", "+bitexact", "-metadata", "ARTIST=Artist", "-metadata", "COMMENT=", "-metadata", "ENCODER="}
+	if args := metadataOverrides(nil, source); !slices.Equal(args, want) {
+		t.Errorf("metadataOverrides() = %v, want %v", args, want)
+	}
+}
+
+func TestEstimateDuration(t *testing.T) {
+	work := []audioWork{
+		{path: "a.flac", ext: ".flac", size: 30 << 20},
+		{path: "b.flac", ext: ".flac", size: 10 << 20},
+		{path: "c.mp3", ext: ".mp3", size: 20 << 20},
+	}
+
+	slow := estimateDuration(work, 1<<20)
+	if slow != time.Minute {
+		t.Errorf("60 MB at 1 MB/s should take a minute, got %v", slow)
+	}
+	if fast := estimateDuration(work, 4<<20); fast != slow/4 {
+		t.Errorf("four times the throughput should take a quarter of the time, got %v", fast)
+	}
+	if fallback := estimateDuration(work, 0); fallback != estimateDuration(work, defaultThroughput) {
+		t.Errorf("an unmeasured throughput should use the default, got %v", fallback)
+	}
+}
+
+func TestRepresentativeWork(t *testing.T) {
+	work := []audioWork{
+		{path: "big.flac", ext: ".flac", size: 300},
+		{path: "song.mp3", ext: ".mp3", size: 1000},
+		{path: "small.m4a", ext: ".m4a", size: 100},
+		{path: "medium.flac", ext: ".flac", size: 200},
+	}
+	if got := representativeWork(work); got == nil || got.path != "medium.flac" {
+		t.Errorf("expected the median lossless file, got %+v", got)
+	}
+	if got := representativeWork(work[1:2]); got != nil {
+		t.Errorf("MP3-only work has nothing to calibrate with, got %+v", got)
+	}
+}
+
+func TestEstimateOnlyDoesNotConvert(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig }()
+
+	tmpDir := t.TempDir()
+	sourceDir := filepath.Join(tmpDir, "source")
+	targetDir := filepath.Join(tmpDir, "target")
+	os.MkdirAll(sourceDir, 0755)
+	os.WriteFile(filepath.Join(sourceDir, "a.mp3"), make([]byte, 1<<20), 0644)
+
+	config = Config{TargetDir: targetDir, SoxCommand: "true", NoPreserveMetadata: true, EstimateOnly: true}
+	output, _ := captureOutput(func() {
+		if err := runConverter(nil, []string{sourceDir}); err != nil {
+			t.Errorf("runConverter failed: %v", err)
+		}
+	})
+
+	if !strings.Contains(output, "Estimated processing time for 1 files (1.0 MB)") {
+		t.Errorf("missing estimate in output:\n%s", output)
+	}
+	if _, err := os.Stat(targetDir); !os.IsNotExist(err) {
+		t.Error("estimate-only must not create the target directory")
+	}
+}
+
+func TestMP3SampleRate(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig }()
+
+	tests := []struct {
+		force  int
+		source int
+		want   string
+	}{
+		{0, 96000, "48000"},
+		{0, 88200, "44100"},
+		{0, 48000, "48000"},
+		{44100, 96000, "44100"},
+		{44100, 48000, "44100"},
+		{32000, 44100, "32000"},
+	}
+	for _, tt := range tests {
+		config = Config{MP3Rate: tt.force}
+		if got := mp3SampleRate(policyFromConfig(), &AudioInfo{Bits: 24, Rate: tt.source}); got != tt.want {
+			t.Errorf("mp3SampleRate(force %d, source %d) = %s, want %s", tt.force, tt.source, got, tt.want)
+		}
+	}
+
+	config = Config{MP3Rate: 22050}
+	if err := validateMP3Options(); err == nil {
+		t.Error("expected an invalid mp3-rate error")
+	}
+}
+
+func TestConvertToMP3ForcedRate(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig }()
+
+	tmpDir := t.TempDir()
+	argsFile := filepath.Join(tmpDir, "args")
+	sox := writeFakeTool(t, tmpDir, "sox", `echo "$@" > `+argsFile+`; for a in "$@"; do case "$a" in *.mp3) touch "$a";; esac; done`)
+	source := filepath.Join(tmpDir, "song.flac")
+	os.WriteFile(source, []byte("flac"), 0644)
+
+	config = Config{SourceDir: tmpDir, TargetDir: tmpDir, SoxCommand: sox, NoPreserveMetadata: true, MP3Rate: 44100}
+	if err := convertToMP3(newFileTask(source), source, filepath.Join(tmpDir, "song.mp3"), &AudioInfo{Bits: 24, Rate: 96000}); err != nil {
+		t.Fatalf("convertToMP3 failed: %v", err)
+	}
+
+	data, _ := os.ReadFile(argsFile)
+	args := strings.TrimSpace(string(data))
+	if !strings.HasSuffix(args, "song.tmp.mp3 rate -v -L 44100") {
+		t.Errorf("expected the high quality rate effect to 44100, got %q", args)
+	}
+	if strings.Contains(args, "-r ") {
+		t.Errorf("forced rate should not use -r, got %q", args)
+	}
+}
+
+func TestVorbisOutput(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig }()
+
+	config = Config{EnforceOutputFormat: "FLAC,ogg"}
+	if err := validateOutputFormats(); err != nil || config.EnforceOutputFormat != "flac,vorbis" {
+		t.Errorf("Expected ogg to be accepted as vorbis, got %q (%v)", config.EnforceOutputFormat, err)
+	}
+	config = Config{VorbisQuality: 11}
+	if err := convertLibrary([]string{t.TempDir()}); err == nil || !strings.Contains(err.Error(), "invalid vorbis-quality") {
+		t.Errorf("Expected an invalid vorbis-quality error, got %v", err)
+	}
+
+	tmpDir := t.TempDir()
+	argsFile := filepath.Join(tmpDir, "args")
+	sox := writeFakeTool(t, tmpDir, "sox", `echo "$@" > `+argsFile+`; for a in "$@"; do case "$a" in *.ogg) touch "$a";; esac; done`)
+	source := filepath.Join(tmpDir, "song.flac")
+	os.WriteFile(source, []byte("flac"), 0644)
+	lossy := filepath.Join(tmpDir, "lossy.mp3")
+	os.WriteFile(lossy, []byte("mp3"), 0644)
+	targetDir := filepath.Join(tmpDir, "target")
+	os.MkdirAll(targetDir, 0755)
+
+	config = Config{SourceDir: tmpDir, TargetDir: targetDir, SoxCommand: sox, NoPreserveMetadata: true, EnforceOutputFormat: "vorbis"}
+	output, _ := captureOutput(func() {
+		if err := processToVorbis(newFileTask(source), source, filepath.Join(targetDir, "song.flac"), ".flac", &AudioInfo{Bits: 24, Rate: 96000, Channels: 2, Format: "flac"}); err != nil {
+			t.Errorf("processToVorbis failed: %v", err)
+		}
+	})
+	data, _ := os.ReadFile(argsFile)
+	args := strings.TrimSpace(string(data))
+	if args != source+" -t vorbis -C 6 "+filepath.Join(targetDir, "song.tmp.ogg")+" rate -v -L 48000" {
+		t.Errorf("Unexpected SoX arguments %q", args)
+	}
+	if _, err := os.Stat(filepath.Join(targetDir, "song.ogg")); err != nil {
+		t.Errorf("Expected song.ogg: %v", err)
+	}
+	if !strings.Contains(output, "Converting FLAC to Vorbis: "+source+" (quality 6, encoded to Vorbis at 48000 Hz)") {
+		t.Errorf("Unexpected output:\n%s", output)
+	}
+
+	// Lossy sources keep their format
+	captureOutput(func() {
+		if err := processToVorbis(newFileTask(lossy), lossy, filepath.Join(targetDir, "lossy.mp3"), ".mp3", nil); err != nil {
+			t.Errorf("processToVorbis failed for MP3: %v", err)
+		}
+	})
+	if _, err := os.Stat(filepath.Join(targetDir, "lossy.mp3")); err != nil {
+		t.Errorf("Expected the MP3 to be copied: %v", err)
+	}
+
+	if got := outputExtension(config.EnforceOutputFormat, ".wav"); got != ".ogg" {
+		t.Errorf("outputExtension(.wav) = %q, want .ogg", got)
+	}
+	policy := ConversionPolicy{Format: "vorbis", Channels: 2}
+	if d := policy.Decide(&AudioInfo{Bits: 16, Rate: 44100, Channels: 6}); d.Action != decisionConvert || d.TargetRate != 0 || d.TargetChannels != 2 || d.Reason != "encoded to Vorbis at 44100 Hz" {
+		t.Errorf("Unexpected Vorbis decision %+v", d)
+	}
+}
+
+func TestOpusOutput(t *testing.T) {
+	originalConfig := config
+	originalPath := os.Getenv("PATH")
+	defer func() { config = originalConfig; os.Setenv("PATH", originalPath) }()
+
+	config = Config{EnforceOutputFormat: "flac,OPUS"}
+	if err := validateOutputFormats(); err != nil || config.EnforceOutputFormat != "flac,opus" {
+		t.Errorf("Expected opus to be accepted, got %q (%v)", config.EnforceOutputFormat, err)
+	}
+	config = Config{OpusBitrate: 600}
+	if err := convertLibrary([]string{t.TempDir()}); err == nil || !strings.Contains(err.Error(), "invalid opus-bitrate") {
+		t.Errorf("Expected an invalid opus-bitrate error, got %v", err)
+	}
+
+	tmpDir := t.TempDir()
+	argsFile := filepath.Join(tmpDir, "args")
+	writeFakeTool(t, tmpDir, "ffmpeg", `echo "$@" > `+argsFile+`; for a in "$@"; do case "$a" in *.opus) touch "$a";; esac; done`)
+	os.Setenv("PATH", tmpDir+string(os.PathListSeparator)+originalPath)
+	source := filepath.Join(tmpDir, "song.flac")
+	os.WriteFile(source, []byte("flac"), 0644)
+	lossy := filepath.Join(tmpDir, "lossy.mp3")
+	os.WriteFile(lossy, []byte("mp3"), 0644)
+	targetDir := filepath.Join(tmpDir, "target")
+	os.MkdirAll(targetDir, 0755)
+
+	for bitrate, want := range map[int]string{0: "160k", 96: "96k"} {
+		config = Config{SourceDir: tmpDir, TargetDir: targetDir, NoPreserveMetadata: true, EnforceOutputFormat: "opus", OpusBitrate: bitrate}
+		output, _ := captureOutput(func() {
+			if err := processToOpus(newFileTask(source), source, filepath.Join(targetDir, "song.flac"), ".flac", &AudioInfo{Bits: 24, Rate: 96000, Channels: 2, Format: "flac"}); err != nil {
+				t.Errorf("processToOpus failed: %v", err)
+			}
+		})
+		data, _ := os.ReadFile(argsFile)
+		if args := strings.TrimSpace(string(data)); args != "-y -i "+source+" -vn -c:a libopus -b:a "+want+" -ar 48000 "+filepath.Join(targetDir, "song.tmp.opus") {
+			t.Errorf("Unexpected FFmpeg arguments %q", args)
+		}
+		if !strings.Contains(output, "Converting FLAC to Opus: "+source+" ("+strings.TrimSuffix(want, "k")+"kbps, encoded to Opus at 48000 Hz)") {
+			t.Errorf("Unexpected output:\n%s", output)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(targetDir, "song.opus")); err != nil {
+		t.Errorf("Expected song.opus: %v", err)
+	}
+
+	// Lossy sources keep their format
+	captureOutput(func() {
+		if err := processToOpus(newFileTask(lossy), lossy, filepath.Join(targetDir, "lossy.mp3"), ".mp3", nil); err != nil {
+			t.Errorf("processToOpus failed for MP3: %v", err)
+		}
+	})
+	if _, err := os.Stat(filepath.Join(targetDir, "lossy.mp3")); err != nil {
+		t.Errorf("Expected the MP3 to be copied: %v", err)
+	}
+	if plan := planFile(config.EnforceOutputFormat, lossy, ".mp3"); plan.Action != actionCopied || plan.Reason != "lossy files are not re-encoded to Opus" {
+		t.Errorf("Unexpected plan for an MP3 %+v", plan)
+	}
+
+	if got := outputExtension(config.EnforceOutputFormat, ".m4a"); got != ".opus" {
+		t.Errorf("outputExtension(.m4a) = %q, want .opus", got)
+	}
+	policy := ConversionPolicy{Format: "opus", Channels: 2}
+	if d := policy.Decide(&AudioInfo{Bits: 16, Rate: 44100, Channels: 6}); d.Action != decisionConvert || d.TargetRate != 48000 || d.TargetChannels != 2 || d.Reason != "encoded to Opus at 48000 Hz" {
+		t.Errorf("Unexpected Opus decision %+v", d)
+	}
+	if d := policy.Decide(&AudioInfo{Bits: 24, Rate: 48000, Channels: 2}); d.TargetRate != 0 || d.TargetChannels != 0 {
+		t.Errorf("Expected a 48 kHz stereo source to keep its rate and channels, got %+v", d)
+	}
+}
+
+func TestPassthroughSubdir(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig }()
+
+	tmpDir := t.TempDir()
+	sourceDir := filepath.Join(tmpDir, "source")
+	targetDir := filepath.Join(tmpDir, "target")
+	os.MkdirAll(filepath.Join(sourceDir, "Album"), 0755)
+	os.WriteFile(filepath.Join(sourceDir, "Album", "cd.flac"), []byte("cd"), 0644)
+	os.WriteFile(filepath.Join(sourceDir, "Album", "hires.flac"), []byte("hires"), 0644)
+
+	// The fake SoX reports hires.flac as 24/96 and everything else as 16/44.1
+	sox := writeFakeTool(t, tmpDir, "sox", `if [ "$1" = "--i" ]; then
+  case "$2" in
+    *hires*) printf 'Sample Rate    : 96000\nSample Encoding: 24-bit FLAC\n';;
+    *) printf 'Sample Rate    : 44100\nSample Encoding: 16-bit FLAC\n';;
+  esac
+  exit 0
+fi
+for a in "$@"; do case "$a" in *.flac) echo converted > "$a";; esac; done`)
+
+	config = Config{SourceDir: sourceDir, TargetDir: targetDir, SoxCommand: sox, NoPreserveMetadata: true, PassthroughSubdir: "untouched"}
+	captureOutput(func() {
+		if err := processAudioFiles(); err != nil {
+			t.Fatalf("processAudioFiles failed: %v", err)
+		}
+	})
+
+	if _, err := os.Stat(filepath.Join(targetDir, "untouched", "Album", "cd.flac")); err != nil {
+		t.Errorf("compliant FLAC should be in the passthrough subdir: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(targetDir, "Album", "cd.flac")); !os.IsNotExist(err) {
+		t.Error("compliant FLAC should not be in the normal path")
+	}
+	if _, err := os.Stat(filepath.Join(targetDir, "Album", "hires.flac")); err != nil {
+		t.Errorf("converted FLAC should be in the normal path: %v", err)
+	}
+}
+
+func TestResampleAll(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig }()
+
+	config = Config{ResampleAll: 48000}
+	tests := []struct {
+		info     AudioInfo
+		needs    bool
+		wantRate string
+	}{
+		{AudioInfo{Bits: 16, Rate: 44100}, true, "48000"},
+		{AudioInfo{Bits: 16, Rate: 48000}, false, ""},
+		{AudioInfo{Bits: 24, Rate: 96000}, true, "48000"},
+		{AudioInfo{Bits: 24, Rate: 88200}, true, "48000"},
+	}
+	for _, tt := range tests {
+		needs, _, rateArgs := determineConversion(policyFromConfig(), &tt.info)
+		if needs != tt.needs {
+			t.Errorf("%d/%d: needsConversion = %v, want %v", tt.info.Bits, tt.info.Rate, needs, tt.needs)
+		}
+		if tt.wantRate != "" && rateArgs[len(rateArgs)-1] != tt.wantRate {
+			t.Errorf("%d/%d: rate args = %v, want %s", tt.info.Bits, tt.info.Rate, rateArgs, tt.wantRate)
+		}
+	}
+
+	if got := mp3SampleRate(policyFromConfig(), &AudioInfo{Rate: 44100}); got != "48000" {
+		t.Errorf("MP3 outputs should use the forced rate, got %s", got)
+	}
+
+	output, _ := captureOutput(func() {
+		checkUpsampling(newFileTask("song.flac"), "song.flac", &AudioInfo{Rate: 44100})
+		checkUpsampling(newFileTask("hires.flac"), "hires.flac", &AudioInfo{Rate: 96000})
+	})
+	if !strings.Contains(output, "Upsampling song.flac from 44100 Hz to 48000 Hz") || strings.Contains(output, "hires.flac") {
+		t.Errorf("unexpected upsampling warnings:\n%s", output)
+	}
+}
+
+func TestResampleAllSkipsCompliantALACCopy(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig }()
+
+	tmpDir := t.TempDir()
+	source := filepath.Join(tmpDir, "song.m4a")
+	os.WriteFile(source, []byte("alac"), 0644)
+
+	// A 16/44.1 ALAC would be copied as-is, but not when everything must be 48 kHz
+	config = Config{SourceDir: tmpDir, TargetDir: tmpDir, SoxCommand: "false", NoPreserveMetadata: true, EnforceOutputFormat: "alac", ResampleAll: 48000}
+	output, _ := captureOutput(func() {
+		processToALAC(newFileTask(source), source, filepath.Join(tmpDir, "out.m4a"), ".m4a", &AudioInfo{Bits: 16, Rate: 44100})
+	})
+	if strings.Contains(output, "Copying ALAC") {
+		t.Errorf("ALAC at a different rate must not be copied:\n%s", output)
+	}
+}
+
+func TestJSONLogs(t *testing.T) {
+	originalConsole := console
+	originalStderr := os.Stderr
+	defer func() { console = originalConsole; os.Stderr = originalStderr }()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stderr = w
+	console = &consoleWriter{json: true}
+
+	stdout, _ := captureOutput(func() {
+		console.setStage("audio")
+		console.setFile("/music/song.flac")
+		logf("Processing: %s\n", "/music/song.flac")
+		logf("Warning: Could not get audio info for %s, copying original\n", "/music/song.flac")
+		logf("Error: Audio conversion failed\n")
+	})
+	w.Close()
+	data, _ := io.ReadAll(r)
+
+	if stdout != "" {
+		t.Errorf("JSON logs must replace the text output, got %q", stdout)
+	}
+
+	var entries []LogEntry
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var entry LogEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("invalid JSON log line %q: %v", line, err)
+		}
+		entries = append(entries, entry)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 log entries, got %d", len(entries))
+	}
+
+	wantLevels := []string{"info", "warn", "error"}
+	for i, entry := range entries {
+		if entry.Level != wantLevels[i] {
+			t.Errorf("entry %d level = %q, want %q", i, entry.Level, wantLevels[i])
+		}
+		if entry.Time == "" || entry.Stage != "audio" || entry.File != "/music/song.flac" {
+			t.Errorf("entry %d is missing fields: %+v", i, entry)
+		}
+	}
+	if entries[1].Message != "Could not get audio info for /music/song.flac, copying original" {
+		t.Errorf("level prefix should be removed from the message, got %q", entries[1].Message)
+	}
+}
+
+func TestProgressSnapshot(t *testing.T) {
+	p := &progressReporter{}
+	if status := p.snapshot(); status.Total != 0 || status.ETASeconds != 0 || len(status.Current) != 0 {
+		t.Errorf("Expected an empty status before the run, got %+v", status)
+	}
+
+	p.runStarted(4)
+	p.fileStarted("a.flac")
+	if status := p.snapshot(); !slices.Equal(status.Current, []string{"a.flac"}) || status.ETASeconds != 0 {
+		t.Errorf("Expected a.flac in flight and no ETA yet, got %+v", status)
+	}
+
+	p.started = time.Now().Add(-10 * time.Second)
+	p.fileCompleted(FileCompleted{Path: "a.flac", Action: actionConverted})
+	p.fileStarted("b.flac")
+	p.fileCompleted(FileCompleted{Path: "b.flac", Action: actionFailed, Err: errors.New("boom")})
+	status := p.snapshot()
+	if status.Completed != 1 || status.Failed != 1 || len(status.Current) != 0 {
+		t.Errorf("Unexpected counts: %+v", status)
+	}
+	// Two files in ten seconds leaves about ten seconds for the other two
+	if status.ETASeconds < 9 || status.ETASeconds > 11 {
+		t.Errorf("Expected an ETA of about 10s, got %v", status.ETASeconds)
+	}
+}
+
+func TestStatusServer(t *testing.T) {
+	originalConsole := console
+	defer func() { progress = &progressReporter{}; console = originalConsole }()
+	progress = &progressReporter{}
+	console = &consoleWriter{}
+	progress.runStarted(3)
+	progress.fileStarted("Artist/Album/01.flac")
+
+	var stop func()
+	output, _ := captureOutput(func() {
+		var err error
+		stop, err = startStatusServer("127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("startStatusServer failed: %v", err)
+		}
+	})
+	defer stop()
+	addr := strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(output), "Serving status on http://"), "/status")
+
+	resp, err := http.Get("http://" + addr + "/status")
+	if err != nil {
+		t.Fatalf("GET /status failed: %v", err)
+	}
+	var status RunStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		t.Fatalf("Failed to decode status: %v", err)
+	}
+	resp.Body.Close()
+	if status.Total != 3 || !slices.Equal(status.Current, []string{"Artist/Album/01.flac"}) {
+		t.Errorf("Unexpected status: %+v", status)
+	}
+
+	resp, err = http.Get("http://" + addr + "/healthz")
+	if err != nil {
+		t.Fatalf("GET /healthz failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if strings.TrimSpace(string(body)) != "ok" {
+		t.Errorf("Expected ok from /healthz, got %q", body)
+	}
+
+	stop()
+	if _, err := http.Get("http://" + addr + "/healthz"); err == nil {
+		t.Error("Expected the server to be shut down")
+	}
+
+	if _, err := startStatusServer("not-an-address"); err == nil {
+		t.Error("Expected an error for an invalid address")
+	}
+}
+
+func TestPreferFolderArt(t *testing.T) {
+	tests := []struct {
+		artSource    string
+		embeddedArea int
+		folderArea   int
+		want         bool
+	}{
+		{"embedded", 500 * 500, 1200 * 1200, false},
+		{"", 500 * 500, 1200 * 1200, false},
+		{"folder", 1200 * 1200, 500 * 500, true},
+		{"largest", 500 * 500, 1200 * 1200, true},
+		{"largest", 1200 * 1200, 500 * 500, false},
+		{"largest", 600 * 600, 600 * 600, false},
+		{"largest", 600 * 600, 0, false},
+		// No embedded art: only folder mode adds the folder image
+		{"folder", 0, 500 * 500, true},
+		{"largest", 0, 500 * 500, false},
+		{"embedded", 0, 500 * 500, false},
+	}
+	for _, tt := range tests {
+		if got := preferFolderArt(tt.artSource, tt.embeddedArea, tt.folderArea); got != tt.want {
+			t.Errorf("preferFolderArt(%q, %d, %d) = %v, want %v", tt.artSource, tt.embeddedArea, tt.folderArea, got, tt.want)
+		}
+	}
+}
+
+func TestCoverArtFor(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig }()
+
+	dir := t.TempDir()
+	source := filepath.Join(dir, "01.flac")
+	folder := filepath.Join(dir, "Folder.JPG")
+	os.WriteFile(source, []byte("flac"), 0644)
+	os.WriteFile(folder, []byte("jpeg"), 0644)
+
+	seed := func(path string, stream ProbeStream) {
+		probeCache.Lock()
+		probeCache.results[path] = &ProbeResult{Streams: []ProbeStream{stream}}
+		probeCache.Unlock()
+	}
+	defer forgetProbe(source)
+	seed(source, ProbeStream{CodecType: "video", Width: 500, Height: 500, Disposition: map[string]int{"attached_pic": 1}})
+
+	config = Config{ArtSource: "embedded"}
+	if got := coverArtFor(nil, source); got != "" {
+		t.Errorf("Expected embedded art to be kept, got %q", got)
+	}
+
+	config = Config{ArtSource: "folder"}
+	if got := coverArtFor(nil, source); got != folder {
+		t.Errorf("Expected folder art %q, got %q", folder, got)
+	}
+
+	config = Config{ArtSource: "largest"}
+	seed(folder, ProbeStream{CodecType: "video", Width: 1000, Height: 1000})
+	if got := coverArtFor(nil, source); got != folder {
+		t.Errorf("Expected the larger folder art, got %q", got)
+	}
+	seed(folder, ProbeStream{CodecType: "video", Width: 300, Height: 300})
+	if got := coverArtFor(nil, source); got != "" {
+		t.Errorf("Expected the larger embedded art to be kept, got %q", got)
+	}
+	forgetProbe(folder)
+
+	if args := coverArtMaps(folder); !slices.Equal(args, []string{"-map", "1", "-map", "2:v", "-disposition:v", "attached_pic", "-map_metadata", "0"}) {
+		t.Errorf("Unexpected folder art mapping: %v", args)
+	}
+	if args := coverArtMaps(""); !slices.Equal(args, []string{"-map", "1", "-map", "0:v?", "-map_metadata", "0"}) {
+		t.Errorf("Unexpected source art mapping: %v", args)
+	}
+}
+
+func TestInterruptedRunSummary(t *testing.T) {
+	originalConfig := config
+	originalControl := control
+	defer func() {
+		config = originalConfig
+		control = originalControl
+		progress = &progressReporter{}
+		resetFailures()
+	}()
+
+	tmpDir := t.TempDir()
+	sourceDir := filepath.Join(tmpDir, "source")
+	os.MkdirAll(sourceDir, 0755)
+	for _, name := range []string{"a.mp3", "b.mp3", "c.mp3"} {
+		os.WriteFile(filepath.Join(sourceDir, name), []byte(name), 0644)
+	}
+
+	reportPath := filepath.Join(tmpDir, "report.json")
+	config = Config{SourceDir: sourceDir, TargetDir: filepath.Join(tmpDir, "target"), NoPreserveMetadata: true, ReportPath: reportPath}
+	control = newRunControl()
+	progress = &progressReporter{encoder: json.NewEncoder(&drainOnStart{})}
+
+	output, _ := captureOutput(func() {
+		if err := processAudioFiles(); err != nil {
+			t.Errorf("processAudioFiles failed: %v", err)
+		}
+		if err := finishInterrupted(); !errors.Is(err, errInterrupted) {
+			t.Errorf("Expected errInterrupted, got %v", err)
+		}
+	})
+	if !strings.Contains(output, "Run interrupted: 1 processed, 0 failed, 2 not processed.") {
+		t.Errorf("Expected an interrupted summary, got: %s", output)
+	}
+
+	data, err := os.ReadFile(reportPath)
+	if err != nil {
+		t.Fatalf("Report was not written: %v", err)
+	}
+	var report RunReport
+	if err := json.Unmarshal(data, &report); err != nil {
+		t.Fatalf("Invalid report: %v", err)
+	}
+	want := []string{filepath.Join(sourceDir, "b.mp3"), filepath.Join(sourceDir, "c.mp3")}
+	if !report.Interrupted || !slices.Equal(report.Unprocessed, want) {
+		t.Errorf("Unexpected report: %+v", report)
+	}
+}
+
+func TestErrorLogDir(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a shell script")
+	}
+	originalConfig := config
+	defer func() { config = originalConfig; resetConversionFailures() }()
+
+	tmpDir := t.TempDir()
+	sourceDir := filepath.Join(tmpDir, "source")
+	logDir := filepath.Join(tmpDir, "errors")
+	source := filepath.Join(sourceDir, "Artist", "Album", "01 Song.flac")
+	config = Config{SourceDir: sourceDir, ErrorLogDir: logDir}
+	resetConversionFailures()
+
+	// Nothing is created until a conversion fails
+	if out, err := commandOutput(newFileTask(source).command("sh", "-c", "echo fine")); err != nil || string(out) != "fine\n" {
+		t.Errorf("commandOutput = %q, %v", out, err)
+	}
+	if _, err := os.Stat(logDir); !os.IsNotExist(err) {
+		t.Error("Expected the error log directory to be created lazily")
+	}
+
+	// Only the commands of the failing file are logged
+	task := newFileTask(source)
+	newFileTask(filepath.Join(sourceDir, "other.flac")).command("sh", "-c", "echo other").Run()
+	task.command("sh", "-c", "echo probing").Run()
+	err := task.command("sh", "-c", "echo partial; echo 'sox FAIL formats' >&2; exit 2").Run()
+	if err == nil {
+		t.Fatal("Expected the command to fail")
+	}
+	recordConversionFailure(task, err)
+
+	logPath := filepath.Join(logDir, "Artist", "Album", "01 Song.flac.log")
+	data, readErr := os.ReadFile(logPath)
+	if readErr != nil {
+		t.Fatalf("Error log was not written: %v", readErr)
+	}
+	log := string(data)
+	for _, want := range []string{
+		"Source: " + source,
+		"Error: exit status 2",
+		"$ sh -c \"echo probing\"",
+		"--- stdout ---\npartial\n",
+		"--- stderr ---\nsox FAIL formats\n",
+	} {
+		if !strings.Contains(log, want) {
+			t.Errorf("Error log missing %q:\n%s", want, log)
+		}
+	}
+	if strings.Contains(log, "echo other") {
+		t.Errorf("Error log has the commands of another file:\n%s", log)
+	}
+
+	failures := recordedConversionFailures()
+	if len(failures) != 1 || failures[0].Path != source || failures[0].Log != logPath {
+		t.Errorf("Unexpected conversion failures: %+v", failures)
+	}
+}
+
+func TestScannerMarkers(t *testing.T) {
+	originalConfig := config
+	originalControl := control
+	defer func() {
+		config = originalConfig
+		control = originalControl
+		resetConversionFailures()
+	}()
+
+	tmpDir := t.TempDir()
+	sourceDir := filepath.Join(tmpDir, "source")
+	targetDir := filepath.Join(tmpDir, "target")
+	logDir := filepath.Join(targetDir, "errors")
+	config = Config{SourceDir: sourceDir, TargetDir: targetDir, ErrorLogDir: logDir}
+	control = newRunControl()
+
+	hasMarkers := func(dir string) bool {
+		for _, marker := range scannerMarkers {
+			if _, err := os.Stat(filepath.Join(dir, marker.name)); err != nil {
+				return false
+			}
+		}
+		return true
+	}
+
+	if err := control.createWorkDir(targetDir); err != nil {
+		t.Fatal(err)
+	}
+	if !hasMarkers(control.workDirPath()) {
+		t.Error("Expected the working directory to be marked")
+	}
+	if data, _ := os.ReadFile(filepath.Join(control.workDirPath(), ".plexignore")); string(data) != "*\n" {
+		t.Errorf("Expected .plexignore to ignore everything, got %q", data)
+	}
+	control.removeWorkDir()
+
+	recordConversionFailure(newFileTask(filepath.Join(sourceDir, "Album", "01.flac")), errors.New("exit status 2"))
+	if !hasMarkers(logDir) {
+		t.Error("Expected the error log directory to be marked")
+	}
+	// Markers are written once and left alone afterwards
+	os.WriteFile(filepath.Join(logDir, ".plexignore"), []byte("custom\n"), 0644)
+	recordConversionFailure(newFileTask(filepath.Join(sourceDir, "Album", "02.flac")), errors.New("exit status 2"))
+	if data, _ := os.ReadFile(filepath.Join(logDir, ".plexignore")); string(data) != "custom\n" {
+		t.Errorf("Expected an existing marker to be kept, got %q", data)
+	}
+
+	// Markers in the target are not orphans
+	os.MkdirAll(sourceDir, 0755)
+	orphans, err := findOrphans()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, orphan := range orphans {
+		if isScannerMarker(filepath.Base(orphan)) {
+			t.Errorf("Expected markers not to be orphans, got %s", orphan)
+		}
+	}
+
+	config.NoScannerMarkers = true
+	if err := control.createWorkDir(tmpDir); err != nil {
+		t.Fatal(err)
+	}
+	defer control.removeWorkDir()
+	if entries, _ := os.ReadDir(control.workDirPath()); len(entries) != 0 {
+		t.Errorf("Expected no markers with --no-scanner-markers, got %v", entries)
+	}
+}
+
+func TestSkipMultichannel(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig; resetMultichannelSkips() }()
+
+	tmpDir := t.TempDir()
+	sourceDir := filepath.Join(tmpDir, "source")
+	targetDir := filepath.Join(tmpDir, "target")
+	os.MkdirAll(sourceDir, 0755)
+	surround := filepath.Join(sourceDir, "01 surround.flac")
+	stereo := filepath.Join(sourceDir, "02 stereo.flac")
+	os.WriteFile(surround, []byte("surround"), 0644)
+	os.WriteFile(stereo, []byte("stereo"), 0644)
+
+	sox := writeFakeTool(t, tmpDir, "sox", `channels=2
+case "$2" in *surround*) channels=6;; esac
+printf 'Channels       : %s\nSample Rate    : 44100\nSample Encoding: 16-bit Signed Integer PCM\n' "$channels"`)
+
+	resetMultichannelSkips()
+	config = Config{SourceDir: sourceDir, TargetDir: targetDir, SoxCommand: sox, NoPreserveMetadata: true, SkipMultichannel: true}
+	captureOutput(func() {
+		if err := processAudioFiles(); err != nil {
+			t.Errorf("processAudioFiles failed: %v", err)
+		}
+	})
+
+	if _, err := os.Stat(filepath.Join(targetDir, "01 surround.flac")); !os.IsNotExist(err) {
+		t.Error("Expected the 6-channel file to be skipped")
+	}
+	if _, err := os.Stat(filepath.Join(targetDir, "02 stereo.flac")); err != nil {
+		t.Errorf("Expected the stereo file to be processed: %v", err)
+	}
+	if skipped := recordedMultichannelSkips(); !slices.Equal(skipped, []string{surround}) {
+		t.Errorf("Expected only the surround file to be listed, got %v", skipped)
+	}
+
+	info, _ := parseAudioInfo("Channels       : 6\nSample Rate    : 48000\n")
+	if info.Channels != 6 {
+		t.Errorf("Expected 6 channels from sox --i output, got %d", info.Channels)
+	}
+}
+
+func TestDurationFilters(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig; resetDurationSkips() }()
+
+	tmpDir := t.TempDir()
+	sourceDir := filepath.Join(tmpDir, "source")
+	targetDir := filepath.Join(tmpDir, "target")
+	os.MkdirAll(sourceDir, 0755)
+	names := []string{"01 interlude.flac", "02 song.flac", "03 long song.flac", "04 mix.flac"}
+	for _, name := range names {
+		os.WriteFile(filepath.Join(sourceDir, name), []byte(name), 0644)
+	}
+	sox := writeFakeTool(t, tmpDir, "sox", `case "$2" in
+  *interlude*) duration=00:00:03.00;;
+  *long*) duration=00:19:59.50;;
+  *mix*) duration=01:05:00.00;;
+  *) duration=00:03:25.47;;
+esac
+printf 'Channels       : 2\nSample Rate    : 44100\nSample Encoding: 16-bit Signed Integer PCM\nDuration       : %s = 1 samples\n' "$duration"`)
+
+	resetDurationSkips()
+	config = Config{SourceDir: sourceDir, TargetDir: targetDir, SoxCommand: sox, NoPreserveMetadata: true, MinDuration: "10", MaxDuration: "20:00"}
+	output, _ := captureOutput(func() {
+		if err := processAudioFiles(); err != nil {
+			t.Errorf("processAudioFiles failed: %v", err)
+		}
+	})
+
+	for name, processed := range map[string]bool{names[0]: false, names[1]: true, names[2]: true, names[3]: false} {
+		if _, err := os.Stat(filepath.Join(targetDir, name)); (err == nil) != processed {
+			t.Errorf("%s: expected processed=%v, stat error %v", name, processed, err)
+		}
+	}
+	want := []string{filepath.Join(sourceDir, names[0]), filepath.Join(sourceDir, names[3])}
+	if skipped := recordedDurationSkips(); !slices.Equal(skipped, want) {
+		t.Errorf("Expected the interlude and the mix to be listed, got %v", skipped)
+	}
+	if !strings.Contains(output, "(3s is shorter than --min-duration 10)") || !strings.Contains(output, "(1h5m0s is longer than --max-duration 20:00)") {
+		t.Errorf("Expected the skips to be explained, got:\n%s", output)
+	}
+
+	for value, want := range map[string]time.Duration{"90": 90 * time.Second, "2.5": 2500 * time.Millisecond, "1:30": 90 * time.Second, "1:02:03": time.Hour + 2*time.Minute + 3*time.Second} {
+		if got, err := parseClockDuration(value); err != nil || got != want {
+			t.Errorf("parseClockDuration(%q) = %v, %v, want %v", value, got, err, want)
+		}
+	}
+	for _, value := range []string{"", "abc", "-5", "1:60", "1:60:00", "1:2:3:4", "Inf"} {
+		if _, err := parseClockDuration(value); err == nil {
+			t.Errorf("parseClockDuration(%q) should fail", value)
+		}
+	}
+	for _, cfg := range []Config{{MinDuration: "ten"}, {MinDuration: "5:00", MaxDuration: "1:00"}} {
+		config = cfg
+		config.TargetDir = targetDir
+		if err := convertLibrary([]string{sourceDir}); err == nil || !strings.Contains(err.Error(), "duration") {
+			t.Errorf("Expected %+v to be rejected, got %v", cfg, err)
+		}
+	}
+}
+
+func TestCopyFileBufferSize(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig }()
+
+	tmpDir := t.TempDir()
+	src := filepath.Join(tmpDir, "large.flac")
+	data := make([]byte, 3<<20+12345)
+	for i := range data {
+		data[i] = byte(i * 31)
+	}
+	os.WriteFile(src, data, 0644)
+
+	for _, size := range []int{0, minCopyBufferKiB, 64, 4096} {
+		config = Config{CopyBufferSize: size, VerifyCopies: true}
+		dst := filepath.Join(tmpDir, fmt.Sprintf("copy-%d.flac", size))
+		captureOutput(func() {
+			if err := copyFile(nil, src, dst); err != nil {
+				t.Fatalf("copyFile with %d KiB buffer failed: %v", size, err)
+			}
+		})
+		copied, err := os.ReadFile(dst)
+		if err != nil || !bytes.Equal(copied, data) {
+			t.Errorf("Copy with %d KiB buffer does not match the source", size)
+		}
+	}
+
+	config = Config{}
+	if got := copyBufferSize(); got != defaultCopyBufferKiB<<10 {
+		t.Errorf("Expected the default buffer of %d bytes, got %d", defaultCopyBufferKiB<<10, got)
+	}
+
+	config = Config{CopyBufferSize: 1}
+	if err := runConverter(nil, []string{tmpDir}); err == nil || !strings.Contains(err.Error(), "copy-buffer-size") {
+		t.Errorf("Expected a copy-buffer-size validation error, got %v", err)
+	}
+}
+
+func TestMetricsTextfile(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig; progress = &progressReporter{} }()
+
+	tmpDir := t.TempDir()
+	sourceDir := filepath.Join(tmpDir, "source")
+	metricsDir := filepath.Join(tmpDir, "textfile")
+	os.MkdirAll(sourceDir, 0755)
+	os.MkdirAll(metricsDir, 0755)
+	os.WriteFile(filepath.Join(sourceDir, "a.mp3"), []byte("12345"), 0644)
+	os.WriteFile(filepath.Join(sourceDir, "b.mp3"), []byte("123"), 0644)
+	metricsPath := filepath.Join(metricsDir, "lilt.prom")
+
+	config = Config{TargetDir: filepath.Join(tmpDir, "target"), SoxCommand: "true", NoPreserveMetadata: true, MetricsTextfile: metricsPath}
+	captureOutput(func() {
+		if err := runConverter(nil, []string{sourceDir}); err != nil {
+			t.Errorf("runConverter failed: %v", err)
+		}
+	})
+
+	data, err := os.ReadFile(metricsPath)
+	if err != nil {
+		t.Fatalf("Metrics file was not written: %v", err)
+	}
+	metrics := string(data)
+	for _, want := range []string{
+		"# TYPE lilt_last_run_files gauge\n",
+		"lilt_last_run_files{result=\"copied\"} 2\n",
+		"lilt_last_run_files{result=\"failed\"} 0\n",
+		"lilt_last_run_bytes_read 8\n",
+		"lilt_last_run_bytes_written 8\n",
+		"lilt_last_run_exit_status 0\n",
+		"lilt_last_run_duration_seconds ",
+		"lilt_last_run_timestamp_seconds ",
+	} {
+		if !strings.Contains(metrics, want) {
+			t.Errorf("Metrics missing %q:\n%s", want, metrics)
+		}
+	}
+	if entries, _ := os.ReadDir(metricsDir); len(entries) != 1 {
+		t.Errorf("Expected only the metrics file in its directory, got %d entries", len(entries))
+	}
+
+	// A failed run is still reported
+	config = Config{TargetDir: filepath.Join(tmpDir, "target"), MetricsTextfile: metricsPath}
+	captureOutput(func() {
+		runConverter(nil, []string{filepath.Join(tmpDir, "missing")})
+	})
+	data, _ = os.ReadFile(metricsPath)
+	if !strings.Contains(string(data), "lilt_last_run_exit_status 1\n") {
+		t.Errorf("Expected exit status 1 after a failed run:\n%s", data)
+	}
+}
+
+func TestMultipleOutputFormats(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig; progress = &progressReporter{} }()
+
+	tmpDir := t.TempDir()
+	sourceDir := filepath.Join(tmpDir, "source")
+	os.MkdirAll(filepath.Join(sourceDir, "Album"), 0755)
+	os.WriteFile(filepath.Join(sourceDir, "Album", "a.mp3"), []byte("a"), 0644)
+
+	run := func(formats string) string {
+		targetDir := filepath.Join(tmpDir, "target-"+strings.ReplaceAll(formats, ",", "-"))
+		config = Config{TargetDir: targetDir, SoxCommand: "true", NoPreserveMetadata: true, EnforceOutputFormat: formats}
+		captureOutput(func() {
+			if err := runConverter(nil, []string{sourceDir}); err != nil {
+				t.Errorf("runConverter with %s failed: %v", formats, err)
+			}
+		})
+		return targetDir
+	}
+
+	targetDir := run("flac,mp3")
+	for _, format := range []string{"flac", "mp3"} {
+		if _, err := os.Stat(filepath.Join(targetDir, format, "Album", "a.mp3")); err != nil {
+			t.Errorf("Expected output under the %s subdirectory: %v", format, err)
+		}
+	}
+	if config.EnforceOutputFormat != "flac,mp3" {
+		t.Errorf("Expected the requested formats to be restored, got %q", config.EnforceOutputFormat)
+	}
+
+	targetDir = run("mp3")
+	if _, err := os.Stat(filepath.Join(targetDir, "Album", "a.mp3")); err != nil {
+		t.Errorf("Expected a single format to write without a subdirectory: %v", err)
+	}
+
+	// Repeating the flag appends formats
+	formats := ""
+	value := &formatListValue{&formats}
+	value.Set("flac")
+	value.Set("mp3")
+	if formats != "flac,mp3" {
+		t.Errorf("Expected repeated flags to append, got %q", formats)
+	}
+
+	config = Config{TargetDir: filepath.Join(tmpDir, "t"), EnforceOutputFormat: "mp3,mp3"}
+	if err := runConverter(nil, []string{sourceDir}); err == nil {
+		t.Error("Expected an error for a duplicated format")
+	}
+}
+
+func TestDumpConfig(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig }()
+
+	sourceDir := t.TempDir()
+	config = Config{TargetDir: filepath.Join(sourceDir, "target"), EnforceOutputFormat: "flac,mp3", DumpConfig: true}
+	output, err := captureOutput(func() {
+		if err := runConverter(nil, []string{sourceDir}); err != nil {
+			t.Errorf("runConverter failed: %v", err)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dumped Config
+	if err := json.Unmarshal([]byte(output), &dumped); err != nil {
+		t.Fatalf("Expected JSON output, got %q: %v", output, err)
+	}
+	if !dumped.FormatSubdir || dumped.SourceDir != sourceDir {
+		t.Errorf("Expected the automatic format subdirectories in the dump, got %+v", dumped)
+	}
+	if _, err := os.Stat(config.TargetDir); !os.IsNotExist(err) {
+		t.Error("Expected --dump-config to exit before creating the target")
+	}
+}
+
+func TestRunWorkDir(t *testing.T) {
+	originalConfig := config
+	originalControl := control
+	defer func() { config = originalConfig; control = originalControl }()
+
+	tmpDir := t.TempDir()
+	targetDir := filepath.Join(tmpDir, "target")
+	config = Config{TargetDir: targetDir}
+	control = newRunControl()
+
+	target := filepath.Join(targetDir, "Artist", "Album", "01.flac")
+	if got := tempPathFor(nil, target); got != filepath.Join(targetDir, "Artist", "Album", "01.tmp.flac") {
+		t.Errorf("Expected a sibling temp path without a working directory, got %s", got)
+	}
+
+	if err := control.createWorkDir(targetDir); err != nil {
+		t.Fatalf("createWorkDir failed: %v", err)
+	}
+	workDir := control.workDirPath()
+	if !strings.HasPrefix(filepath.Base(workDir), workDirPrefix) || !strings.HasSuffix(workDir, fmt.Sprintf("-%d", os.Getpid())) {
+		t.Errorf("Unexpected working directory name: %s", workDir)
+	}
+
+	tempPath := tempPathFor(nil, target)
+	if tempPath != filepath.Join(workDir, "worker-0", "Artist", "Album", "01.tmp.flac") {
+		t.Errorf("Expected the temp path inside the worker's scratch directory, got %s", tempPath)
+	}
+	os.WriteFile(tempPath, []byte("converted"), 0644)
+	os.MkdirAll(filepath.Dir(target), 0755)
+	if err := moveIntoPlace(tempPath, target); err != nil {
+		t.Fatalf("moveIntoPlace failed: %v", err)
+	}
+	if data, _ := os.ReadFile(target); string(data) != "converted" {
+		t.Errorf("Expected the intermediate to be moved into place, got %q", data)
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(target)); len(entries) != 1 {
+		t.Errorf("Expected only the final output in the album directory, got %d entries", len(entries))
+	}
+
+	// A worker's scratch goes away on its own, the working directory stays
+	os.WriteFile(tempPathFor(nil, filepath.Join(targetDir, "left.flac")), []byte("partial"), 0644)
+	control.removeWorkerScratch(dispatchWorker)
+	if _, err := os.Stat(filepath.Join(workDir, "worker-0")); !os.IsNotExist(err) {
+		t.Error("Expected the worker's scratch directory to be removed")
+	}
+	if _, err := os.Stat(workDir); err != nil {
+		t.Errorf("Expected the working directory to remain: %v", err)
+	}
+	if scratch := control.workerScratch(3); scratch != filepath.Join(workDir, "worker-3") {
+		t.Errorf("Expected a separate scratch directory per worker, got %s", scratch)
+	}
+
+	// A forced stop removes the working directory with its contents
+	os.WriteFile(tempPathFor(nil, filepath.Join(targetDir, "x.flac")), []byte("partial"), 0644)
+	control.forceStop()
+	if _, err := os.Stat(workDir); !os.IsNotExist(err) {
+		t.Error("Expected the working directory to be removed on a forced stop")
+	}
+}
+
+func TestRunConverterRemovesWorkDir(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig; progress = &progressReporter{} }()
+
+	tmpDir := t.TempDir()
+	sourceDir := filepath.Join(tmpDir, "source")
+	os.MkdirAll(sourceDir, 0755)
+	os.WriteFile(filepath.Join(sourceDir, "a.mp3"), []byte("a"), 0644)
+	tempParent := filepath.Join(tmpDir, "scratch")
+	os.MkdirAll(tempParent, 0755)
+
+	config = Config{TargetDir: filepath.Join(tmpDir, "target"), SoxCommand: "true", NoPreserveMetadata: true, TempDir: tempParent}
+	captureOutput(func() {
+		if err := runConverter(nil, []string{sourceDir}); err != nil {
+			t.Errorf("runConverter failed: %v", err)
+		}
+	})
+	if entries, _ := os.ReadDir(tempParent); len(entries) != 0 {
+		t.Errorf("Expected the working directory to be removed after the run, found %d entries", len(entries))
+	}
+
+	config = Config{TargetDir: filepath.Join(tmpDir, "target"), UseDocker: true, TempDir: tempParent}
+	if err := runConverter(nil, []string{sourceDir}); err == nil || !strings.Contains(err.Error(), "temp-dir") {
+		t.Errorf("Expected --temp-dir outside the target to be rejected with Docker, got %v", err)
+	}
+}
+
+func TestMP3MinCopyBitrate(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig }()
+
+	tmpDir := t.TempDir()
+	seed := func(name string, streamBitrate, formatBitrate string) string {
+		path := filepath.Join(tmpDir, name)
+		os.WriteFile(path, []byte(name), 0644)
+		probeCache.Lock()
+		probeCache.results[path] = &ProbeResult{
+			Streams: []ProbeStream{{CodecType: "audio", CodecName: "mp3", SampleRate: "44100", BitRate: streamBitrate}},
+			Format:  ProbeFormat{BitRate: formatBitrate},
+		}
+		probeCache.Unlock()
+		t.Cleanup(func() { forgetProbe(path) })
+		return path
+	}
+
+	tests := []struct {
+		name     string
+		path     string
+		minimum  int
+		reencode bool
+	}{
+		{"96kbps below minimum", seed("96.mp3", "96000", ""), 192, true},
+		{"192kbps at minimum", seed("192.mp3", "192000", ""), 192, false},
+		{"320kbps above minimum", seed("320.mp3", "320000", ""), 192, false},
+		{"VBR falls back to container bitrate", seed("vbr.mp3", "N/A", "128000"), 192, true},
+		{"unknown bitrate is copied", seed("unknown.mp3", "", ""), 192, false},
+		{"no minimum copies everything", seed("64.mp3", "64000", ""), 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config = Config{EnforceOutputFormat: "mp3", MP3MinCopyBitrate: tt.minimum}
+			var got bool
+			captureOutput(func() { got = mp3NeedsReencode(nil, tt.path) })
+			if got != tt.reencode {
+				t.Errorf("mp3NeedsReencode = %v, want %v", got, tt.reencode)
+			}
+		})
+	}
+
+	// Sources at the minimum are still copied unchanged
+	config = Config{EnforceOutputFormat: "mp3", MP3MinCopyBitrate: 192, NoPreserveMetadata: true}
+	target := filepath.Join(tmpDir, "out", "192.mp3")
+	os.MkdirAll(filepath.Dir(target), 0755)
+	captureOutput(func() {
+		if err := processToMP3(newFileTask(filepath.Join(tmpDir, "192.mp3")), filepath.Join(tmpDir, "192.mp3"), target, ".mp3", nil); err != nil {
+			t.Errorf("processToMP3 failed: %v", err)
+		}
+	})
+	if data, _ := os.ReadFile(target); string(data) != "192.mp3" {
+		t.Errorf("Expected the MP3 to be copied, got %q", data)
+	}
+
+	config = Config{MP3MinCopyBitrate: 400}
+	if err := validateMP3Options(); err == nil {
+		t.Error("Expected an error for a minimum above 320 kbps")
+	}
+}
+
+func TestExitCodes(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig; progress = &progressReporter{}; resetConversionFailures() }()
+
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{nil, 0},
+		{errors.New("invalid sort: random"), exitUsage},
+		{&exitError{code: exitEnvironment, err: errors.New("sox is not installed")}, exitEnvironment},
+		{fmt.Errorf("wrapped: %w", &exitError{code: exitUpdate, err: errors.New("download failed")}), exitUpdate},
+		{errInterrupted, exitInterrupted},
+	}
+	for _, tt := range tests {
+		if got := exitCode(tt.err); got != tt.want {
+			t.Errorf("exitCode(%v) = %d, want %d", tt.err, got, tt.want)
+		}
+	}
+
+	tmpDir := t.TempDir()
+	sourceDir := filepath.Join(tmpDir, "source")
+	os.MkdirAll(sourceDir, 0755)
+	os.WriteFile(filepath.Join(sourceDir, "hires.flac"), []byte("flac"), 0644)
+
+	config = Config{TargetDir: filepath.Join(tmpDir, "target"), SoxCommand: filepath.Join(tmpDir, "missing-sox")}
+	if err := runConverter(nil, []string{sourceDir}); exitCode(err) != exitEnvironment {
+		t.Errorf("Expected exit code %d for a missing SoX, got %d (%v)", exitEnvironment, exitCode(err), err)
+	}
+
+	// A conversion that fails falls back to a copy, but the run reports it
+	sox := writeFakeTool(t, tmpDir, "sox", `if [ "$1" = "--i" ]; then
+printf 'Sample Rate    : 96000\nSample Encoding: 24-bit Signed Integer PCM\n'
+exit 0
+fi
+exit 1`)
+	config = Config{TargetDir: filepath.Join(tmpDir, "target"), SoxCommand: sox, NoPreserveMetadata: true}
+	var err error
+	captureOutput(func() { err = runConverter(nil, []string{sourceDir}) })
+	if exitCode(err) != exitFileFailures {
+		t.Errorf("Expected exit code %d after a failed conversion, got %d (%v)", exitFileFailures, exitCode(err), err)
+	}
+}
+
+func TestConfirmDestructive(t *testing.T) {
+	originalConfig := config
+	originalInput, originalTerminal := confirmInput, stdinIsTerminal
+	defer func() { config = originalConfig; confirmInput, stdinIsTerminal = originalInput, originalTerminal }()
+
+	ask := func(terminal bool, answer string, deletes, overwrites int) (string, error) {
+		stdinIsTerminal = func() bool { return terminal }
+		confirmInput = strings.NewReader(answer)
+		var err error
+		output, _ := captureOutput(func() { err = confirmDestructive("prune the target directory", deletes, overwrites) })
+		return output, err
+	}
+
+	config = Config{}
+	output, err := ask(true, "y\n", 412, 3020)
+	if err != nil {
+		t.Errorf("Expected confirmation with y, got %v", err)
+	}
+	if !strings.Contains(output, "will delete 412 file(s), overwrite 3,020 file(s). Continue? [y/N]") {
+		t.Errorf("Unexpected prompt: %q", output)
+	}
+	if _, err := ask(true, "\n", 1, 0); !errors.Is(err, errNotConfirmed) {
+		t.Errorf("Expected the default answer to decline, got %v", err)
+	}
+	if _, err := ask(false, "y\n", 1, 0); !errors.Is(err, errNotConfirmed) {
+		t.Errorf("Expected a non-interactive run to abort, got %v", err)
+	}
+	if _, err := ask(false, "", 0, 0); err != nil {
+		t.Errorf("Expected no prompt when nothing is deleted, got %v", err)
+	}
+
+	config = Config{Yes: true}
+	if output, err := ask(false, "", 5, 0); err != nil || output != "" {
+		t.Errorf("Expected --yes to skip the prompt, got %q, %v", output, err)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	originalConfig := config
+	originalInput, originalTerminal := confirmInput, stdinIsTerminal
+	defer func() {
+		config = originalConfig
+		confirmInput, stdinIsTerminal = originalInput, originalTerminal
+		progress = &progressReporter{}
+	}()
+	stdinIsTerminal = func() bool { return false }
+
+	tmpDir := t.TempDir()
+	sourceDir := filepath.Join(tmpDir, "source")
+	targetDir := filepath.Join(tmpDir, "target")
+	os.MkdirAll(sourceDir, 0755)
+	os.MkdirAll(filepath.Join(targetDir, "Old"), 0755)
+	os.WriteFile(filepath.Join(sourceDir, "a.mp3"), []byte("a"), 0644)
+	orphan := filepath.Join(targetDir, "Old", "gone.mp3")
+	os.WriteFile(orphan, []byte("gone"), 0644)
+
+	config = Config{TargetDir: targetDir, SoxCommand: "true", NoPreserveMetadata: true, Prune: true}
+	captureOutput(func() {
+		if err := runConverter(nil, []string{sourceDir}); !errors.Is(err, errNotConfirmed) {
+			t.Errorf("Expected an unconfirmed prune to abort, got %v", err)
+		}
+	})
+	if _, err := os.Stat(orphan); err != nil {
+		t.Error("Orphan was removed without confirmation")
+	}
+
+	config = Config{TargetDir: targetDir, SoxCommand: "true", NoPreserveMetadata: true, Prune: true, Yes: true}
+	captureOutput(func() {
+		if err := runConverter(nil, []string{sourceDir}); err != nil {
+			t.Errorf("runConverter failed: %v", err)
+		}
+	})
+	if _, err := os.Stat(orphan); !os.IsNotExist(err) {
+		t.Error("Expected the orphan to be pruned with --yes")
+	}
+	if _, err := os.Stat(filepath.Join(targetDir, "a.mp3")); err != nil {
+		t.Errorf("Pruning removed a current output: %v", err)
+	}
+}
+
+func TestAbortIfNoFiles(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig; progress = &progressReporter{} }()
+
+	tmpDir := t.TempDir()
+	sourceDir := filepath.Join(tmpDir, "source")
+	os.MkdirAll(filepath.Join(sourceDir, "Album"), 0755)
+	os.WriteFile(filepath.Join(sourceDir, "Album", "notes.txt"), []byte("notes"), 0644)
+	os.WriteFile(filepath.Join(sourceDir, "Album", "track.ogg"), []byte("ogg"), 0644)
+
+	run := func(abort bool) error {
+		config = Config{TargetDir: filepath.Join(tmpDir, "target"), SoxCommand: "true", NoPreserveMetadata: true, AbortIfNoFiles: abort}
+		var err error
+		captureOutput(func() { err = runConverter(nil, []string{sourceDir}) })
+		return err
+	}
+
+	if err := run(false); err != nil {
+		t.Errorf("Expected an empty run to succeed by default, got %v", err)
+	}
+	if err := run(true); !errors.Is(err, errNoFiles) {
+		t.Errorf("Expected errNoFiles with --abort-if-no-files, got %v", err)
+	}
+
+	os.WriteFile(filepath.Join(sourceDir, "Album", "a.mp3"), []byte("a"), 0644)
+	if err := run(true); err != nil {
+		t.Errorf("Expected a run with files to succeed, got %v", err)
+	}
+}
+
+func TestNormalizeUnicode(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig; progress = &progressReporter{}; resetAssignedPaths() }()
+
+	tmpDir := t.TempDir()
+	sourceDir := filepath.Join(tmpDir, "source")
+	targetDir := filepath.Join(tmpDir, "target")
+	// "Beyoncé/Café.mp3" with decomposed accents, as macOS stores it
+	nfdDir := "Beyonce\u0301"
+	nfdFile := "Cafe\u0301.mp3"
+	os.MkdirAll(filepath.Join(sourceDir, nfdDir), 0755)
+	os.WriteFile(filepath.Join(sourceDir, nfdDir, nfdFile), []byte("a"), 0644)
+
+	config = Config{TargetDir: targetDir, SoxCommand: "true", NoPreserveMetadata: true, NormalizeUnicode: "nfc"}
+	captureOutput(func() {
+		if err := runConverter(nil, []string{sourceDir}); err != nil {
+			t.Errorf("runConverter failed: %v", err)
+		}
+	})
+
+	entries, _ := os.ReadDir(targetDir)
+	if len(entries) != 1 || entries[0].Name() != "Beyonc\u00e9" {
+		t.Fatalf("Expected an NFC directory name, got %v", entries)
+	}
+	files, _ := os.ReadDir(filepath.Join(targetDir, "Beyonc\u00e9"))
+	if len(files) != 1 || files[0].Name() != "Caf\u00e9.mp3" {
+		t.Errorf("Expected an NFC file name, got %v", files)
+	}
+
+	config = Config{NormalizeUnicode: "nfd"}
+	if got := normalizeUnicodeName("Caf\u00e9.mp3"); got != nfdFile {
+		t.Errorf("Expected an NFD name, got %q", got)
+	}
+
+	config = Config{TargetDir: targetDir, NormalizeUnicode: "nfkc"}
+	if err := runConverter(nil, []string{sourceDir}); err == nil {
+		t.Error("Expected an error for an unknown normalization form")
+	}
+}
+
+func TestMaxPathLength(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig; progress = &progressReporter{}; resetAssignedPaths() }()
+
+	tmpDir := t.TempDir()
+	sourceDir := filepath.Join(tmpDir, "source")
+	targetDir := filepath.Join(tmpDir, "target")
+	box := strings.Repeat("Complete Symphonies ", 5)
+	title := strings.Repeat("Allegro ma non troppo é ", 5)
+	sources := []string{
+		filepath.Join(box, "01 "+title+"I.mp3"),
+		filepath.Join(box, "01 "+title+"II.mp3"),
+		"Short.mp3",
+	}
+	for _, name := range sources {
+		path := filepath.Join(sourceDir, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		os.WriteFile(path, []byte(name), 0644)
+	}
+
+	limit := len(targetDir) + 1 + 120
+	config = Config{TargetDir: targetDir, SoxCommand: "true", NoPreserveMetadata: true, MaxPathLength: limit}
+	output, _ := captureOutput(func() {
+		if err := runConverter(nil, []string{sourceDir}); err != nil {
+			t.Errorf("runConverter failed: %v", err)
+		}
+	})
+
+	var written []string
+	filepath.Walk(targetDir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			written = append(written, path)
+			if len(path) > limit || !utf8.ValidString(path) {
+				t.Errorf("%s is %d bytes, over the limit of %d", path, len(path), limit)
+			}
+		}
+		return nil
+	})
+	if len(written) != 3 {
+		t.Fatalf("Expected 3 files, got %v", written)
+	}
+	entries, _ := os.ReadDir(targetDir)
+	if len(entries) != 2 || !strings.HasSuffix(entries[0].Name(), pathEllipsis) || entries[1].Name() != "Short.mp3" {
+		t.Fatalf("Expected one shortened album directory and Short.mp3, got %v", entries)
+	}
+	files, _ := os.ReadDir(filepath.Join(targetDir, entries[0].Name()))
+	if len(files) != 2 || !strings.HasSuffix(files[0].Name(), pathEllipsis+".mp3") || !strings.HasSuffix(files[1].Name(), pathEllipsis+" (2).mp3") {
+		t.Errorf("Expected two shortened, distinct file names, got %v", files)
+	}
+	if !strings.Contains(output, "Shortened 2 target path(s) to fit --max-path-length") {
+		t.Errorf("Expected the shortened paths to be reported, got:\n%s", output)
+	}
+
+	// Orphan detection maps sources to the same shortened paths
+	orphans, err := findOrphans()
+	if err != nil || len(orphans) != 0 {
+		t.Errorf("Expected no orphans, got %v (%v)", orphans, err)
+	}
+
+	config = Config{TargetDir: targetDir, MaxPathLength: len(targetDir) + 32}
+	if err := convertLibrary([]string{sourceDir}); err == nil {
+		t.Error("Expected an error for a limit leaving no room for names")
+	}
+}
+
+func TestBuildInfo(t *testing.T) {
+	originalVersion, originalCommit, originalDate := version, commit, buildDate
+	defer func() {
+		version, commit, buildDate = originalVersion, originalCommit, originalDate
+		versionJSON = false
+	}()
+
+	version, commit, buildDate = "v1.2.3", "abc1234", "2025-01-02T03:04:05Z"
+	info := buildInfo()
+	want := BuildInfo{Version: "v1.2.3", Commit: "abc1234", Date: "2025-01-02T03:04:05Z", GoVersion: runtime.Version(), OS: runtime.GOOS, Arch: runtime.GOARCH}
+	if info != want {
+		t.Errorf("buildInfo() = %+v, want %+v", info, want)
+	}
+	if got := info.String(); got != fmt.Sprintf("lilt v1.2.3 (commit abc1234, built 2025-01-02T03:04:05Z) %s %s/%s", runtime.Version(), runtime.GOOS, runtime.GOARCH) {
+		t.Errorf("Unexpected human-readable version: %s", got)
+	}
+
+	versionJSON = true
+	output, _ := captureOutput(func() {
+		if err := versionCmd.RunE(versionCmd, nil); err != nil {
+			t.Errorf("version command failed: %v", err)
+		}
+	})
+	var printed BuildInfo
+	if err := json.Unmarshal([]byte(output), &printed); err != nil || printed != want {
+		t.Errorf("Unexpected version --json output %q: %v", output, err)
+	}
+
+	reportPath := filepath.Join(t.TempDir(), "report.json")
+	if err := writeReport(reportPath, &RunReport{}); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(reportPath)
+	if !strings.HasPrefix(string(data), "{\n  \"build\": {\n    \"version\": \"v1.2.3\"") {
+		t.Errorf("Expected the build information at the top of the report, got:\n%s", data)
+	}
+}
+
+func TestProbeCommand(t *testing.T) {
+	originalConfig := config
+	originalPath := os.Getenv("PATH")
+	defer func() { config = originalConfig; os.Setenv("PATH", originalPath); probeJSON = false }()
+
+	toolDir := t.TempDir()
+	probes := filepath.Join(toolDir, "probes")
+	writeFakeTool(t, toolDir, "ffprobe", `for a in "$@"; do f="$a"; done
+echo "$f" >> `+probes+`
+case "$f" in
+*long.flac) echo '{"streams":[{"codec_name":"flac","codec_type":"audio","sample_rate":"44100","channels":2,"bits_per_raw_sample":"16"}],"format":{"duration":"900.0"}}';;
+*.flac) echo '{"streams":[{"codec_name":"flac","codec_type":"audio","sample_rate":"96000","channels":2,"bits_per_raw_sample":"24"}],"format":{"duration":"225.4","tags":{"ARTIST":"Artist","TRACKNUMBER":"1"}}}';;
+*) echo '{"streams":[],"format":{}}';;
+esac`)
+	os.Setenv("PATH", toolDir+string(os.PathListSeparator)+originalPath)
+
+	sourceDir := t.TempDir()
+	os.MkdirAll(filepath.Join(sourceDir, "Album"), 0755)
+	for _, name := range []string{"Album/01.flac", "Album/02.flac", "Album/long.flac", "Album/broken.mp3", "Album/cover.jpg", ".hidden.flac"} {
+		os.WriteFile(filepath.Join(sourceDir, name), []byte("audio"), 0644)
+	}
+
+	config = Config{Jobs: 4, MaxDuration: "10:00"}
+	probeJSON = true
+	var out bytes.Buffer
+	if err := probeLibrary(sourceDir, &out); err != nil {
+		t.Fatalf("probeLibrary failed: %v", err)
+	}
+	var files []ProbedFile
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var file ProbedFile
+		if err := json.Unmarshal([]byte(line), &file); err != nil {
+			t.Fatalf("Expected a JSON object per line, got %q: %v", line, err)
+		}
+		files = append(files, file)
+	}
+	var paths []string
+	for _, file := range files {
+		paths = append(paths, strings.TrimPrefix(file.Path, sourceDir+string(filepath.Separator)))
+	}
+	if want := []string{"Album/01.flac", "Album/02.flac", "Album/broken.mp3"}; !slices.Equal(paths, want) {
+		t.Fatalf("Expected %v in path order, got %v", want, paths)
+	}
+	first := files[0]
+	if first.Codec != "flac" || first.Bits != 24 || first.Rate != 96000 || first.Channels != 2 || first.Duration != 225.4 || first.Size != 5 || first.ModTime.IsZero() {
+		t.Errorf("Unexpected probe result %+v", first)
+	}
+	if first.Tags["artist"] != "Artist" || first.Tags["track"] != "1" {
+		t.Errorf("Expected the normalized tags, got %v", first.Tags)
+	}
+	if files[2].Error == "" {
+		t.Errorf("Expected the unreadable file to carry an error, got %+v", files[2])
+	}
+	if data, _ := os.ReadFile(probes); len(strings.Split(strings.TrimSpace(string(data)), "\n")) != 4 {
+		t.Errorf("Expected every audio file to be probed once, got:\n%s", data)
+	}
+
+	probeJSON = false
+	out.Reset()
+	config = Config{Jobs: 1}
+	if err := probeLibrary(sourceDir, &out); err != nil {
+		t.Fatalf("probeLibrary failed: %v", err)
+	}
+	if !strings.Contains(out.String(), "01.flac: flac, 24-bit 96000 Hz, 2 channels, 3:45\n") || !strings.Contains(out.String(), "long.flac: flac, 16-bit 44100 Hz, 2 channels, 15:00\n") {
+		t.Errorf("Unexpected text output:\n%s", out.String())
+	}
+
+	if err := probeLibrary(filepath.Join(sourceDir, "missing"), &out); err == nil {
+		t.Error("Expected a missing source directory to fail")
+	}
+	config = Config{MinDuration: "soon"}
+	if err := probeLibrary(sourceDir, &out); err == nil {
+		t.Error("Expected an invalid --min-duration to fail")
+	}
+}
+
+func TestALACUnknownBitDepth(t *testing.T) {
+	originalConfig := config
+	originalPath := os.Getenv("PATH")
+	defer func() { config = originalConfig; os.Setenv("PATH", originalPath) }()
+
+	for _, input := range []string{"44100,\n", "44100,0\n"} {
+		info, err := parseALACInfo(input)
+		if err != nil || info.Bits != 0 || info.Rate != 44100 {
+			t.Errorf("parseALACInfo(%q) = %+v, %v, want an unknown bit depth at 44100 Hz", input, info, err)
+		}
+	}
+
+	for _, tt := range []struct {
+		stream ProbeStream
+		want   int
+	}{
+		{ProbeStream{BitsPerRawSample: "24", BitsPerSample: 16}, 24},
+		{ProbeStream{BitsPerRawSample: "0", BitsPerSample: 16}, 16},
+		{ProbeStream{SampleFmt: "s16p"}, 16},
+		{ProbeStream{SampleFmt: "s32p"}, 0},
+	} {
+		if got := probeBits(tt.stream); got != tt.want {
+			t.Errorf("probeBits(%+v) = %d, want %d", tt.stream, got, tt.want)
+		}
+	}
+	probe := &ProbeResult{Streams: []ProbeStream{{CodecType: "audio", SampleRate: "44100", SampleFmt: "s32p"}}}
+	if info, err := audioInfoFromProbe(probe); err != nil || info.Bits != 0 || info.Rate != 44100 {
+		t.Errorf("audioInfoFromProbe = %+v, %v, want the rate with an unknown bit depth", info, err)
+	}
+
+	// No plan may carry a 0-bit target
+	unknown := &AudioInfo{Rate: 96000, Format: "alac"}
+	for _, format := range []string{"flac", "alac"} {
+		d := policyFor(format).Decide(unknown)
+		if _, bitrateArgs, _ := d.soxArgs(); d.TargetBits != 0 || slices.Contains(bitrateArgs, "-b") || strings.Contains(d.Reason, "0-bit") {
+			t.Errorf("%s: unexpected decision for an unknown bit depth: %+v", format, d)
+		}
+	}
+
+	// ALAC to FLAC: the depth is decoded once, before the plan is made
+	tmpDir := t.TempDir()
+	decoded := filepath.Join(tmpDir, "fixture.flac")
+	os.WriteFile(decoded, flacWithStreamInfo(24, 96000, 2, 96000), 0644)
+	reduced := filepath.Join(tmpDir, "reduced.flac")
+	os.WriteFile(reduced, flacWithStreamInfo(16, 48000, 2, 48000), 0644)
+	soxArgs := filepath.Join(tmpDir, "sox-args")
+	decodes := filepath.Join(tmpDir, "decodes")
+	sox := writeFakeTool(t, tmpDir, "sox", `echo "$@" > `+soxArgs+`; for a in "$@"; do case "$a" in *.alac_temp.flac) ;; *.flac) cp `+reduced+` "$a";; esac; done`)
+	writeFakeTool(t, tmpDir, "ffprobe", `echo '{"streams":[{"codec_name":"alac","codec_type":"audio","sample_rate":"96000","sample_fmt":"s32p","channels":2}],"format":{"format_name":"mov,mp4,m4a"}}'`)
+	writeFakeTool(t, tmpDir, "ffmpeg", `last=""; for a in "$@"; do last="$a"; done
+if [ "$last" = "-" ]; then echo decode >> `+decodes+`; cat `+decoded+`; else cp `+decoded+` "$last"; fi`)
+	os.Setenv("PATH", tmpDir+string(os.PathListSeparator)+originalPath)
+
+	sourceDir := filepath.Join(tmpDir, "source")
+	targetDir := filepath.Join(tmpDir, "target")
+	os.MkdirAll(sourceDir, 0755)
+	source := filepath.Join(sourceDir, "song.m4a")
+	os.WriteFile(source, []byte("alac"), 0644)
+	config = Config{SourceDir: sourceDir, TargetDir: targetDir, SoxCommand: sox, NoPreserveMetadata: true, ALACCompression: -1}
+	var err error
+	output, _ := captureOutput(func() { err = processSourceFile(newFileTask(source), ".m4a") })
+	if err != nil {
+		t.Fatalf("processSourceFile failed: %v", err)
+	}
+	args, _ := os.ReadFile(soxArgs)
+	if !strings.Contains(string(args), ".alac_temp.flac -b 16 ") {
+		t.Errorf("Expected SoX to reduce the decoded depth of 24 bits to 16, got %q", args)
+	}
+	if !strings.Contains(output, "Detected: 24 bits in the decoded audio") || !strings.Contains(output, "Detected: 24 bits, 96000 Hz") {
+		t.Errorf("Expected the decoded bit depth to be used, got:\n%s", output)
+	}
+	if runs, _ := os.ReadFile(decodes); string(runs) != "decode\n" {
+		t.Errorf("Expected the depth to be decoded once, got %q", runs)
+	}
+	if _, err := os.Stat(filepath.Join(targetDir, "song.flac")); err != nil {
+		t.Errorf("Expected the converted FLAC: %v", err)
+	}
+}
+
+func TestALACCompression(t *testing.T) {
+	originalConfig := config
+	originalPath := os.Getenv("PATH")
+	defer func() { config = originalConfig; os.Setenv("PATH", originalPath) }()
+
+	tmpDir := t.TempDir()
+	argsFile := filepath.Join(tmpDir, "args")
+	sox := writeFakeTool(t, tmpDir, "sox", `for a in "$@"; do case "$a" in *.flac) touch "$a";; esac; done`)
+	writeFakeTool(t, tmpDir, "ffmpeg", `echo "$@" > `+argsFile+`; for a in "$@"; do case "$a" in *.m4a) touch "$a";; esac; done`)
+	os.Setenv("PATH", tmpDir+string(os.PathListSeparator)+originalPath)
+
+	source := filepath.Join(tmpDir, "song.flac")
+	os.WriteFile(source, []byte("flac"), 0644)
+
+	for _, level := range []int{-1, 0, 2} {
+		config = Config{SourceDir: tmpDir, TargetDir: tmpDir, SoxCommand: sox, NoPreserveMetadata: true, ALACCompression: level}
+		target := filepath.Join(tmpDir, fmt.Sprintf("level%d.m4a", level))
+		if err := convertToALAC(newFileTask(source), source, target, &AudioInfo{Bits: 16, Rate: 44100}); err != nil {
+			t.Fatalf("level %d: convertToALAC failed: %v", level, err)
+		}
+		args, _ := os.ReadFile(argsFile)
+		fields := strings.Fields(string(args))
+		i := slices.Index(fields, "-compression_level")
+		if level < 0 {
+			if i != -1 {
+				t.Errorf("Expected no -compression_level by default, got %q", args)
+			}
+			continue
+		}
+		if i == -1 || i+1 >= len(fields) {
+			t.Fatalf("level %d: expected -compression_level in %q", level, args)
+		}
+		var got int
+		if _, err := fmt.Sscan(fields[i+1], &got); err != nil || got != level || got < 0 || got > maxALACCompressionLevel {
+			t.Errorf("level %d: expected -compression_level %d, got %q", level, level, fields[i+1])
+		}
+	}
+
+	config = Config{ALACCompression: 3}
+	if err := convertLibrary([]string{tmpDir}); err == nil || !strings.Contains(err.Error(), "alac-compression-level") {
+		t.Errorf("Expected an alac-compression-level error, got %v", err)
+	}
+}
+
+func TestOnEvent(t *testing.T) {
+	originalConfig := config
+	originalConsole := console
+	defer func() { config = originalConfig; console = originalConsole; progress = &progressReporter{} }()
+
+	tmpDir := t.TempDir()
+	sourceDir := filepath.Join(tmpDir, "source")
+	album := filepath.Join(sourceDir, "Album")
+	os.MkdirAll(album, 0755)
+	os.WriteFile(filepath.Join(album, "01.mp3"), bytes.Repeat([]byte("a"), 10000), 0644)
+
+	var events []Event
+	config = Config{SourceDir: sourceDir, TargetDir: filepath.Join(tmpDir, "target"), NoPreserveMetadata: true, CopyBufferSize: minCopyBufferKiB}
+	config.OnEvent = func(event Event) { events = append(events, event) }
+	console = &consoleWriter{group: true}
+	progress = &progressReporter{}
+
+	output, _ := captureOutput(func() {
+		if err := processAudioFiles(); err != nil {
+			t.Errorf("processAudioFiles failed: %v", err)
+		}
+		progress.runCompleted()
+	})
+
+	path := filepath.Join(album, "01.mp3")
+	if len(events) < 5 {
+		t.Fatalf("Expected start, progress, completion and run events, got %#v", events)
+	}
+	if events[0] != (RunStarted{Total: 1}) || events[1] != (FileStarted{Path: path}) {
+		t.Errorf("Unexpected first events: %#v", events[:2])
+	}
+	var last FileProgress
+	for _, event := range events[2 : len(events)-2] {
+		if p, ok := event.(FileProgress); ok && p.Path == path && p.Total == 10000 {
+			last = p
+		} else {
+			t.Errorf("Expected FileProgress events of the copy, got %#v", event)
+		}
+	}
+	if last.Bytes != 10000 {
+		t.Errorf("Expected the copy to reach 10000 bytes, got %d", last.Bytes)
+	}
+	completed, ok := events[len(events)-2].(FileCompleted)
+	if !ok || completed.Path != path || completed.Action != actionCopied || completed.BytesOut != 10000 || completed.Err != nil {
+		t.Errorf("Unexpected FileCompleted: %#v", events[len(events)-2])
+	}
+	run, ok := events[len(events)-1].(RunCompleted)
+	if !ok || run.Summary.Completed != 1 || run.Summary.Results[actionCopied] != 1 || run.Summary.Interrupted {
+		t.Errorf("Unexpected RunCompleted: %#v", events[len(events)-1])
+	}
+
+	// The console output is derived from the same events
+	if !strings.Contains(output, "── Album (1 files)") || !strings.Contains(output, "Processing complete! (1 processed, 0 failed)") {
+		t.Errorf("Console output does not follow the events:\n%s", output)
+	}
+}
+
+func TestChangedOnly(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig; progress = &progressReporter{}; changedSince = time.Time{} }()
+
+	tmpDir := t.TempDir()
+	sourceDir := filepath.Join(tmpDir, "source")
+	targetDir := filepath.Join(tmpDir, "target")
+	os.MkdirAll(sourceDir, 0755)
+	old := filepath.Join(sourceDir, "old.mp3")
+	edited := filepath.Join(sourceDir, "edited.mp3")
+	os.WriteFile(old, []byte("old"), 0644)
+	os.WriteFile(edited, []byte("edited"), 0644)
+
+	run := func() (string, error) {
+		config = Config{TargetDir: targetDir, SoxCommand: "true", NoPreserveMetadata: true, ChangedOnly: true, AbortIfNoFiles: true}
+		var err error
+		output, _ := captureOutput(func() { err = runConverter(nil, []string{sourceDir}) })
+		return output, err
+	}
+
+	// Without a state file everything is processed and the run is recorded
+	if _, err := run(); err != nil {
+		t.Fatalf("First run failed: %v", err)
+	}
+	state, err := readRunState(targetDir)
+	if err != nil || time.Since(state.LastSuccess) > time.Minute {
+		t.Fatalf("Expected a recent last success, got %v (%v)", state.LastSuccess, err)
+	}
+
+	// Files older than the recorded run less the skew margin are skipped
+	os.Remove(filepath.Join(targetDir, "old.mp3"))
+	os.Remove(filepath.Join(targetDir, "edited.mp3"))
+	longAgo := time.Now().Add(-time.Hour)
+	os.Chtimes(old, longAgo, longAgo)
+	withinSkew := state.LastSuccess.Add(-changedOnlySkew / 2)
+	os.Chtimes(edited, withinSkew, withinSkew)
+
+	output, err := run()
+	if err != nil {
+		t.Fatalf("Second run failed: %v", err)
+	}
+	if !strings.Contains(output, "Skipping 1 file(s) unchanged since the last run") {
+		t.Errorf("Expected one unchanged file, got:\n%s", output)
+	}
+	if _, err := os.Stat(filepath.Join(targetDir, "old.mp3")); err == nil {
+		t.Error("Expected the unchanged file to be skipped")
+	}
+	if _, err := os.Stat(filepath.Join(targetDir, "edited.mp3")); err != nil {
+		t.Errorf("Expected the file written within the skew margin to be processed: %v", err)
+	}
+
+	// A run with only unchanged files is not an empty source tree
+	os.Chtimes(edited, longAgo, longAgo)
+	if _, err := run(); err != nil {
+		t.Errorf("Expected a run without changes to succeed with --abort-if-no-files, got %v", err)
+	}
+
+	config = Config{TargetDir: targetDir, ChangedOnly: true, CompareWith: tmpDir}
+	if err := convertLibrary([]string{sourceDir}); err == nil {
+		t.Error("Expected --changed-only to be rejected with --compare-with")
+	}
+}
+
+func TestChangedOnlyResumesInterruptedRun(t *testing.T) {
+	originalConfig := config
+	defer func() {
+		config = originalConfig
+		progress = &progressReporter{}
+		changedSince = time.Time{}
+		resetCompletedSources(nil)
+	}()
+
+	tmpDir := t.TempDir()
+	sourceDir := filepath.Join(tmpDir, "source")
+	targetDir := filepath.Join(tmpDir, "target")
+	os.MkdirAll(sourceDir, 0755)
+	for _, name := range []string{"a.mp3", "b.mp3", "c.mp3"} {
+		os.WriteFile(filepath.Join(sourceDir, name), []byte(name), 0644)
+	}
+
+	run := func(drain bool) (string, error) {
+		config = Config{TargetDir: targetDir, SoxCommand: "true", NoPreserveMetadata: true, ChangedOnly: true, Jobs: 1}
+		if drain {
+			// Stop dispatching once the first file started
+			config.OnEvent = func(event Event) {
+				if _, ok := event.(FileStarted); ok {
+					control.requestDrain()
+				}
+			}
+		}
+		var err error
+		output, _ := captureOutput(func() { err = runConverter(nil, []string{sourceDir}) })
+		return output, err
+	}
+
+	if _, err := run(true); !errors.Is(err, errInterrupted) {
+		t.Fatalf("Expected the first run to be interrupted, got %v", err)
+	}
+	state, err := readRunState(targetDir)
+	if err != nil || !state.LastSuccess.IsZero() || len(state.Completed) != 1 || state.Completed["a.mp3"].Size != 5 {
+		t.Fatalf("Expected the state to record only the finished file, got %+v (%v)", state, err)
+	}
+
+	// The resumed run only processes what the interrupted one did not finish
+	os.Remove(filepath.Join(targetDir, "a.mp3"))
+	output, err := run(false)
+	if err != nil {
+		t.Fatalf("Resumed run failed: %v", err)
+	}
+	if !strings.Contains(output, "Skipping 1 file(s) unchanged since the last run") {
+		t.Errorf("Expected the finished file to be skipped, got:\n%s", output)
+	}
+	if _, err := os.Stat(filepath.Join(targetDir, "a.mp3")); err == nil {
+		t.Error("Expected the finished file not to be processed again")
+	}
+	for _, name := range []string{"b.mp3", "c.mp3"} {
+		if _, err := os.Stat(filepath.Join(targetDir, name)); err != nil {
+			t.Errorf("Expected %s to be processed by the resumed run: %v", name, err)
+		}
+	}
+	state, err = readRunState(targetDir)
+	if err != nil || state.LastSuccess.IsZero() || len(state.Completed) != 0 {
+		t.Errorf("Expected a successful run to replace the completed list, got %+v (%v)", state, err)
+	}
+}
+
+func TestSourceChecksumCache(t *testing.T) {
+	originalConfig := config
+	originalDigest := sourceDigest
+	defer func() {
+		config = originalConfig
+		sourceDigest = originalDigest
+		progress = &progressReporter{}
+		changedSince = time.Time{}
+		resetSourceHashes(nil)
+	}()
+
+	tmpDir := t.TempDir()
+	sourceDir := filepath.Join(tmpDir, "source")
+	targetDir := filepath.Join(tmpDir, "target")
+	os.MkdirAll(sourceDir, 0755)
+	song := filepath.Join(sourceDir, "song.mp3")
+	os.WriteFile(song, []byte("song"), 0644)
+	target := filepath.Join(targetDir, "song.mp3")
+
+	reads := map[string]int{}
+	sourceDigest = func(path string) (string, error) {
+		reads[filepath.Base(path)]++
+		return fileSHA256(path)
+	}
+
+	run := func() string {
+		t.Helper()
+		config = Config{TargetDir: targetDir, SoxCommand: "true", NoPreserveMetadata: true, ChangedOnly: true, SourceChecksumCache: true}
+		var err error
+		output, _ := captureOutput(func() { err = runConverter(nil, []string{sourceDir}) })
+		if err != nil {
+			t.Fatalf("run failed: %v\n%s", err, output)
+		}
+		return output
+	}
+
+	// The first run hashes the source and records its digest
+	run()
+	state, err := readRunState(targetDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cached, ok := state.SourceHashes["song.mp3"]
+	if !ok || cached.Size != 4 || cached.SHA256 == "" || reads["song.mp3"] != 1 {
+		t.Fatalf("Expected a cached digest after one read, got %+v (%d reads)", state.SourceHashes, reads["song.mp3"])
+	}
+
+	// An unchanged file is skipped from the cache without being read, even
+	// though its modification time is after the last run
+	os.Remove(target)
+	future := time.Now().Add(time.Hour)
+	os.Chtimes(song, future, future)
+	run()
+	if reads["song.mp3"] != 2 {
+		t.Fatalf("Expected the touched file to be hashed once more, got %d reads", reads["song.mp3"])
+	}
+	if _, err := os.Stat(target); err == nil {
+		t.Error("Expected a touched file with the same content to be skipped")
+	}
+	output := run()
+	if reads["song.mp3"] != 2 {
+		t.Errorf("Expected the cached, unchanged file not to be rehashed, got %d reads", reads["song.mp3"])
+	}
+	if !strings.Contains(output, "Skipping 1 file(s) unchanged since the last run") {
+		t.Errorf("Expected the file to be skipped as unchanged, got:\n%s", output)
+	}
+
+	// Changed content is processed
+	os.WriteFile(song, []byte("remastered"), 0644)
+	os.Chtimes(song, future, future)
+	run()
+	if _, err := os.Stat(target); err != nil {
+		t.Errorf("Expected changed content to be processed: %v", err)
+	}
+	if state, _ := readRunState(targetDir); state.SourceHashes["song.mp3"].Size != int64(len("remastered")) {
+		t.Errorf("Expected the cache to hold the new digest, got %+v", state.SourceHashes)
+	}
+
+	config = Config{TargetDir: targetDir, SourceChecksumCache: true}
+	if err := convertLibrary([]string{sourceDir}); err == nil {
+		t.Error("Expected --source-checksum-cache to require --changed-only")
+	}
+}
+
+func TestTreeListing(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig; progress = &progressReporter{}; resetAssignedPaths() }()
+
+	tmpDir := t.TempDir()
+	sourceDir := filepath.Join(tmpDir, "source")
+	targetDir := filepath.Join(tmpDir, "target")
+	for _, name := range []string{"Artist/Album/1 Intro.flac", "Artist/Album/2 Song.m4a", "Artist/Album/cover.jpg", "Single.mp3"} {
+		path := filepath.Join(sourceDir, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(path), 0755)
+		os.WriteFile(path, []byte(name), 0644)
+	}
+
+	config = Config{TargetDir: targetDir, Tree: true, PadTracks: true, FormatSubdir: true, EnforceOutputFormat: "flac,mp3", CopyImages: true}
+	output, err := captureOutput(func() {
+		if err := convertLibrary([]string{sourceDir}); err != nil {
+			t.Errorf("convertLibrary failed: %v", err)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := targetDir + `/
+  flac/
+    Artist/
+      Album/
+        01 Intro.flac
+        02 Song.flac
+        cover.jpg
+    Single.mp3
+  mp3/
+    Artist/
+      Album/
+        01 Intro.mp3
+        02 Song.mp3
+        cover.jpg
+    Single.mp3
+`
+	if output != want {
+		t.Errorf("Unexpected tree:\n%s\nwant:\n%s", output, want)
+	}
+	if _, err := os.Stat(targetDir); !os.IsNotExist(err) {
+		t.Error("Expected --tree not to create the target directory")
+	}
+}
+
+func TestTargetDiff(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig; progress = &progressReporter{}; resetAssignedPaths() }()
+
+	tmpDir := t.TempDir()
+	sourceDir := filepath.Join(tmpDir, "source")
+	targetDir := filepath.Join(tmpDir, "target")
+	write := func(path string, modTime time.Time) {
+		os.MkdirAll(filepath.Dir(path), 0755)
+		os.WriteFile(path, []byte(filepath.Base(path)), 0644)
+		os.Chtimes(path, modTime, modTime)
+	}
+	earlier := time.Now().Add(-2 * time.Hour)
+	later := time.Now().Add(-time.Hour)
+
+	// The ALAC source maps to a FLAC target, like a real run would write it
+	write(filepath.Join(sourceDir, "Album", "1 Intro.m4a"), earlier)
+	write(filepath.Join(targetDir, "Album", "01 Intro.flac"), later)
+	write(filepath.Join(sourceDir, "Album", "2 Song.flac"), later)
+	write(filepath.Join(targetDir, "Album", "02 Song.flac"), earlier)
+	write(filepath.Join(sourceDir, "Album", "3 Outro.mp3"), earlier)
+	write(filepath.Join(sourceDir, "Album", "cover.jpg"), earlier)
+	write(filepath.Join(targetDir, "Album", "cover.jpg"), earlier)
+	write(filepath.Join(targetDir, "Album", "04 Removed.flac"), earlier)
+
+	config = Config{TargetDir: targetDir, Diff: true, PadTracks: true, CopyImages: true}
+	output, err := captureOutput(func() {
+		if err := convertLibrary([]string{sourceDir}); err != nil {
+			t.Errorf("convertLibrary failed: %v", err)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "M\tAlbum/02 Song.flac\n" +
+		"A\tAlbum/03 Outro.mp3\n" +
+		"D\tAlbum/04 Removed.flac\n" +
+		"Diff: 1 new, 1 modified, 2 unchanged, 1 orphaned\n"
+	if output != want {
+		t.Errorf("Unexpected diff:\n%s\nwant:\n%s", output, want)
+	}
+	if _, err := os.Stat(filepath.Join(targetDir, "Album", "03 Outro.mp3")); !os.IsNotExist(err) {
+		t.Error("Expected --diff not to write anything")
+	}
+
+	config = Config{TargetDir: targetDir, Diff: true, SummaryJSON: true}
+	if err := convertLibrary([]string{sourceDir}); err == nil {
+		t.Error("Expected --diff to be rejected with --summary-json")
+	}
+}
+
+func TestSkipExisting(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig; progress = &progressReporter{} }()
+
+	tmpDir := t.TempDir()
+	sourceDir := filepath.Join(tmpDir, "source")
+	targetDir := filepath.Join(tmpDir, "target")
+	write := func(path, content string, modTime time.Time) {
+		os.MkdirAll(filepath.Dir(path), 0755)
+		os.WriteFile(path, []byte(content), 0644)
+		os.Chtimes(path, modTime, modTime)
+	}
+	earlier := time.Now().Add(-2 * time.Hour)
+	later := time.Now().Add(-time.Hour)
+
+	write(filepath.Join(sourceDir, "Album", "01 Done.mp3"), "new", earlier)
+	write(filepath.Join(targetDir, "Album", "01 Done.mp3"), "old", later)
+	write(filepath.Join(sourceDir, "Album", "02 Stale.mp3"), "new", later)
+	write(filepath.Join(targetDir, "Album", "02 Stale.mp3"), "old", earlier)
+	write(filepath.Join(sourceDir, "Album", "03 Missing.mp3"), "new", earlier)
+
+	config = Config{TargetDir: targetDir, SoxCommand: "true", NoPreserveMetadata: true, SkipExisting: true}
+	output, err := captureOutput(func() {
+		if err := runConverter(nil, []string{sourceDir}); err != nil {
+			t.Errorf("runConverter failed: %v", err)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(output, "Skipping (up to date): "+filepath.Join(sourceDir, "Album", "01 Done.mp3")) {
+		t.Errorf("Expected the up to date file to be skipped, got:\n%s", output)
+	}
+	for name, want := range map[string]string{"01 Done.mp3": "old", "02 Stale.mp3": "new", "03 Missing.mp3": "new"} {
+		data, err := os.ReadFile(filepath.Join(targetDir, "Album", name))
+		if err != nil || string(data) != want {
+			t.Errorf("Expected %s to contain %q, got %q (%v)", name, want, data, err)
+		}
+	}
+
+	config = Config{TargetDir: targetDir, SoxCommand: "true", SkipExisting: true, DryRun: true}
+	os.Chtimes(filepath.Join(sourceDir, "Album", "02 Stale.mp3"), time.Now().Add(time.Hour), time.Now().Add(time.Hour))
+	output, err = captureOutput(func() {
+		if err := convertLibrary([]string{sourceDir}); err != nil {
+			t.Errorf("convertLibrary failed: %v", err)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(output, "Would skip Album/01 Done.mp3 (up to date)\n") || !strings.Contains(output, "Would copy Album/02 Stale.mp3") {
+		t.Errorf("Unexpected plan:\n%s", output)
+	}
+
+	// An ALAC source is checked against the FLAC file it is converted to
+	write(filepath.Join(sourceDir, "Album", "04 Lossless.m4a"), "new", earlier)
+	write(filepath.Join(targetDir, "Album", "04 Lossless.flac"), "old", later)
+	config = Config{SourceDir: sourceDir, TargetDir: targetDir}
+	if !targetUpToDate(config.EnforceOutputFormat, filepath.Join(sourceDir, "Album", "04 Lossless.m4a"), filepath.Join("Album", "04 Lossless.m4a")) {
+		t.Error("Expected the FLAC output of an ALAC source to count as up to date")
+	}
+
+	// A conversion killed halfway leaves no truncated target behind that
+	// would count as up to date on the next run
+	sox := writeFakeTool(t, tmpDir, "sox", `if [ "$1" = "--i" ]; then
+  printf 'Channels       : 2\nSample Rate    : 44100\nSample Encoding: 16-bit FLAC\n'
+  exit 0
+fi
+for a in "$@"; do case "$a" in *.mp3) echo partial > "$a"; exit 137;; esac; done`)
+	killed := filepath.Join(sourceDir, "Album", "05 Killed.flac")
+	write(killed, "new", earlier)
+	config = Config{SourceDir: sourceDir, TargetDir: targetDir, SoxCommand: sox, NoPreserveMetadata: true, SkipExisting: true, EnforceOutputFormat: "mp3"}
+	captureOutput(func() {
+		if err := processSourceFile(newFileTask(killed), ".flac"); err == nil {
+			t.Error("Expected the killed conversion to fail")
+		}
+	})
+	if _, err := os.Stat(filepath.Join(targetDir, "Album", "05 Killed.mp3")); !os.IsNotExist(err) {
+		t.Errorf("Expected no output under the final name, got %v", err)
+	}
+	if targetUpToDate(config.EnforceOutputFormat, killed, filepath.Join("Album", "05 Killed.flac")) {
+		t.Error("Expected the killed conversion not to count as up to date")
+	}
+
+	// Copies are renamed into place once complete
+	copied := filepath.Join(sourceDir, "Album", "06 Copied.mp3")
+	write(copied, "new", earlier)
+	if err := copyFile(nil, copied, filepath.Join(targetDir, "Album", "06 Copied.mp3")); err != nil {
+		t.Fatalf("copyFile failed: %v", err)
+	}
+	if leftovers, _ := filepath.Glob(filepath.Join(targetDir, "Album", ".*")); len(leftovers) != 0 {
+		t.Errorf("Expected no partial files, found %v", leftovers)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig; progress = &progressReporter{}; resetAssignedPaths() }()
+
+	tmpDir := t.TempDir()
+	sourceDir := filepath.Join(tmpDir, "source")
+	targetDir := filepath.Join(tmpDir, "target")
+	album := filepath.Join(sourceDir, "Album")
+	os.MkdirAll(album, 0755)
+	for _, name := range []string{"1 hires.flac", "2 cd.flac", "3 lossy.mp3", "4 notes.txt", "cover.jpg"} {
+		os.WriteFile(filepath.Join(album, name), []byte(name), 0644)
+	}
+	sox := writeFakeTool(t, tmpDir, "sox", `if [ "$1" = "--i" ]; then
+  case "$2" in *hires.flac) rate=96000 bits=24;; *) rate=44100 bits=16;; esac
+  printf 'Channels       : 2\nSample Rate    : %s\nSample Encoding: %s-bit FLAC\n' $rate $bits
+  exit 0
+fi
+echo converted > `+filepath.Join(tmpDir, "invoked"))
+
+	config = Config{TargetDir: targetDir, SoxCommand: sox, DryRun: true}
+	output, err := captureOutput(func() {
+		if err := convertLibrary([]string{sourceDir}); err != nil {
+			t.Errorf("convertLibrary failed: %v", err)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "Would convert Album/1 hires.flac → Album/1 hires.flac (24-bit 96000 Hz → 16-bit 48000 Hz)\n" +
+		"Would copy Album/2 cd.flac → Album/2 cd.flac (already 16-bit 44100 Hz)\n" +
+		"Would copy Album/3 lossy.mp3 → Album/3 lossy.mp3 (lossy files are not converted to lossless formats)\n" +
+		"Would skip Album/4 notes.txt (unsupported file type)\n" +
+		"Dry run: 1 to convert, 2 to copy, 1 to skip\n" +
+		"Outputs: 2 FLAC, 1 MP3\n"
+	if output != want {
+		t.Errorf("Unexpected plan:\n%s\nwant:\n%s", output, want)
+	}
+	if _, err := os.Stat(targetDir); !os.IsNotExist(err) {
+		t.Error("Expected --dry-run not to create the target directory")
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, "invoked")); err == nil {
+		t.Error("Expected --dry-run to only read audio info")
+	}
+
+	// Plans for several formats can be compared
+	config = Config{SourceDir: sourceDir, TargetDir: targetDir, SoxCommand: sox, DryRun: true, EnforceOutputFormat: "flac,mp3"}
+	output, _ = captureOutput(func() {
+		if err := printDryRun(); err != nil {
+			t.Errorf("printDryRun failed: %v", err)
+		}
+	})
+	if !strings.Contains(output, "Would convert Album/2 cd.flac → Album/2 cd.mp3 (") ||
+		!strings.Contains(output, "Would copy Album/3 lossy.mp3 → Album/3 lossy.mp3 (already in target format)") ||
+		!strings.HasSuffix(output, "Dry run: 3 to convert, 3 to copy, 1 to skip\nOutputs: 2 FLAC, 4 MP3\n") {
+		t.Errorf("Unexpected plan for flac and mp3:\n%s", output)
+	}
+
+	// Images and playlists are listed when they would be copied
+	os.WriteFile(filepath.Join(album, "list.m3u"), []byte("1 hires.flac\n"), 0644)
+	config = Config{SourceDir: sourceDir, TargetDir: targetDir, SoxCommand: sox, DryRun: true, CopyImages: true, CopyPlaylists: true}
+	output, _ = captureOutput(func() {
+		if err := printDryRun(); err != nil {
+			t.Errorf("printDryRun failed: %v", err)
+		}
+	})
+	if !strings.Contains(output, "Would copy Album/cover.jpg → Album/cover.jpg (--copy-images)\n"+
+		"Would copy Album/list.m3u → Album/list.m3u (playlist entries rewritten to the outputs)\n") ||
+		!strings.HasSuffix(output, "Dry run: 1 to convert, 4 to copy, 1 to skip\nOutputs: 2 FLAC, 1 JPG, 1 M3U, 1 MP3\n") {
+		t.Errorf("Unexpected plan with images and playlists:\n%s", output)
+	}
+	if _, err := os.Stat(targetDir); !os.IsNotExist(err) {
+		t.Error("Expected --dry-run not to create the target directory")
+	}
+}
+
+func TestComparePlan(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig; progress = &progressReporter{}; resetAssignedPaths() }()
+
+	tmpDir := t.TempDir()
+	sourceDir := filepath.Join(tmpDir, "source")
+	targetDir := filepath.Join(tmpDir, "target")
+	album := filepath.Join(sourceDir, "Album")
+	os.MkdirAll(album, 0755)
+	for _, name := range []string{"1 96k.flac", "2 192k.flac", "3 88k.flac", "4 48k.flac"} {
+		os.WriteFile(filepath.Join(album, name), []byte(name), 0644)
+	}
+	sox := writeFakeTool(t, tmpDir, "sox", `if [ "$1" = "--i" ]; then
+  case "$2" in *96k.flac) rate=96000;; *192k.flac) rate=192000;; *88k.flac) rate=88200;; *) rate=48000;; esac
+  printf 'Channels       : 2\nSample Rate    : %s\nSample Encoding: 16-bit FLAC\n' $rate
+  exit 0
+fi
+exit 1`)
+
+	config = Config{TargetDir: targetDir, SoxCommand: sox, TargetSampleRate: "auto", ComparePlan: true, AltFlags: "--target-sample-rate 44100"}
+	output, err := captureOutput(func() {
+		if err := convertLibrary([]string{sourceDir}); err != nil {
+			t.Errorf("convertLibrary failed: %v", err)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "Album/1 96k.flac (flac):\n" +
+		"  current:   convert → Album/1 96k.flac (16-bit 96000 Hz → 16-bit 48000 Hz)\n" +
+		"  alternate: convert → Album/1 96k.flac (16-bit 96000 Hz → 16-bit 44100 Hz)\n" +
+		"Album/2 192k.flac (flac):\n" +
+		"  current:   convert → Album/2 192k.flac (16-bit 192000 Hz → 16-bit 48000 Hz)\n" +
+		"  alternate: convert → Album/2 192k.flac (16-bit 192000 Hz → 16-bit 44100 Hz)\n" +
+		"Compared plans: 2 of 4 planned outputs differ with --target-sample-rate 44100\n"
+	if output != want {
+		t.Errorf("Unexpected comparison:\n%s\nwant:\n%s", output, want)
+	}
+	if config.TargetSampleRate != "auto" {
+		t.Errorf("Expected the current configuration to be restored, got target-sample-rate %q", config.TargetSampleRate)
+	}
+	if _, err := os.Stat(targetDir); !os.IsNotExist(err) {
+		t.Error("Expected --compare-plan not to create the target directory")
+	}
+
+	// A format only the alternative produces is listed too
+	config = Config{TargetDir: targetDir, SoxCommand: sox, ComparePlan: true, AltFlags: "--enforce-output-format=mp3"}
+	output, _ = captureOutput(func() {
+		if err := convertLibrary([]string{sourceDir}); err != nil {
+			t.Errorf("convertLibrary failed: %v", err)
+		}
+	})
+	if !strings.Contains(output, "Album/4 48k.flac (mp3):\n  current:   not planned\n  alternate: convert → Album/4 48k.mp3 (") ||
+		!strings.HasSuffix(output, "Compared plans: 8 of 8 planned outputs differ with --enforce-output-format=mp3\n") {
+		t.Errorf("Unexpected comparison with another format:\n%s", output)
+	}
+
+	for _, tc := range []struct {
+		cfg  Config
+		want string
+	}{
+		{Config{ComparePlan: true}, "requires --alt-flags"},
+		{Config{AltFlags: "--verbose"}, "only be used with --compare-plan"},
+		{Config{ComparePlan: true, AltFlags: "--no-such-flag"}, "invalid alt-flags"},
+		{Config{ComparePlan: true, AltFlags: "extra"}, "is not a flag"},
+		{Config{ComparePlan: true, AltFlags: "--target-sample-rate 96000"}, "alt-flags: invalid target-sample-rate"},
+		{Config{ComparePlan: true, AltFlags: "--verbose", DryRun: true}, "cannot be used with --dry-run"},
+	} {
+		config = tc.cfg
+		config.TargetDir = targetDir
+		config.SoxCommand = sox
+		if err := convertLibrary([]string{sourceDir}); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%+v: expected an error containing %q, got %v", tc.cfg, tc.want, err)
+		}
+	}
+}
+
+func TestConvertToMatchExisting(t *testing.T) {
+	originalConfig := config
+	originalPath := os.Getenv("PATH")
+	defer func() {
+		config = originalConfig
+		os.Setenv("PATH", originalPath)
+		progress = &progressReporter{}
+		resetAssignedPaths()
+		resetExistingSpecs()
+	}()
+
+	tmpDir := t.TempDir()
+	sourceDir := filepath.Join(tmpDir, "source")
+	targetDir := filepath.Join(tmpDir, "target")
+	for _, name := range []string{"Album/03 New.flac", "Other/01 Single.flac"} {
+		path := filepath.Join(sourceDir, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(path), 0755)
+		os.WriteFile(path, []byte(name), 0644)
+	}
+	// The album was converted to 16-bit 44.1 kHz MP3 before
+	for _, name := range []string{"01 Old.mp3", "02 Old.mp3"} {
+		path := filepath.Join(targetDir, "Album", name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		os.WriteFile(path, []byte(name), 0644)
+	}
+	writeFakeTool(t, tmpDir, "ffprobe", `echo '{"streams":[{"codec_name":"mp3","codec_type":"audio","sample_rate":"44100","channels":2}],"format":{"format_name":"mp3"}}'`)
+	os.Setenv("PATH", tmpDir+string(os.PathListSeparator)+originalPath)
+	sox := writeFakeTool(t, tmpDir, "sox", `printf 'Channels       : 2\nSample Rate    : 96000\nSample Encoding: 24-bit FLAC\n'`)
+
+	config = Config{TargetDir: targetDir, SoxCommand: sox, DryRun: true, ConvertToMatch: true}
+	output, err := captureOutput(func() {
+		if err := convertLibrary([]string{sourceDir}); err != nil {
+			t.Errorf("convertLibrary failed: %v", err)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Without a match a 96 kHz source would be encoded at 48 kHz
+	if !strings.Contains(output, "Matching existing MP3 files in "+filepath.Join(targetDir, "Album")+" (44100 Hz, 2 channels)") ||
+		!strings.Contains(output, "Would convert Album/03 New.flac → Album/03 New.mp3 (encoded to MP3 at 44100 Hz)") {
+		t.Errorf("Expected the new track to be converted to matching MP3, got:\n%s", output)
+	}
+	// An empty target directory falls back to the regular settings
+	if !strings.Contains(output, "Would convert Other/01 Single.flac → Other/01 Single.flac (24-bit 96000 Hz → 16-bit 48000 Hz)") {
+		t.Errorf("Expected the default FLAC conversion without existing files, got:\n%s", output)
+	}
+
+	config = Config{TargetDir: targetDir, ConvertToMatch: true, FormatSubdir: true}
+	if err := convertLibrary([]string{sourceDir}); err == nil {
+		t.Error("Expected --convert-to-match-existing to be rejected with --format-subdir")
+	}
+}
+
+func TestRetryExitCodes(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a shell script")
+	}
+	originalConfig := config
+	defer func() { config = originalConfig }()
+
+	// failing runs a tool exiting with each code in turn, then succeeding
+	failing := func(codes ...int) (func() error, *int) {
+		calls := 0
+		return func() error {
+			calls++
+			if calls > len(codes) {
+				return nil
+			}
+			if err := newCommand("sh", "-c", fmt.Sprintf("exit %d", codes[calls-1])).Run(); err != nil {
+				return fmt.Errorf("SoX conversion failed: %w", err)
+			}
+			return nil
+		}, &calls
+	}
+
+	tests := []struct {
+		name      string
+		retries   int
+		codes     []int
+		exits     []int
+		wantCalls int
+		wantErr   bool
+	}{
+		{"configured code is retried", 2, []int{125, 137}, []int{125}, 2, false},
+		{"other code is not retried", 2, []int{125, 137}, []int{2}, 1, true},
+		{"retry stops at a non-retryable code", 3, []int{125}, []int{125, 2}, 2, true},
+		{"retries are limited", 1, []int{125}, []int{125, 125}, 2, true},
+		{"no codes retries any tool failure", 1, nil, []int{2}, 2, false},
+		{"no retries by default", 0, []int{125}, []int{125}, 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config = Config{Retries: tt.retries, RetryExitCodes: tt.codes}
+			fn, calls := failing(tt.exits...)
+			var err error
+			captureOutput(func() { err = withRetries(newFileTask("song.flac"), fn) })
+			if *calls != tt.wantCalls || (err != nil) != tt.wantErr {
+				t.Errorf("Expected %d calls and error %v, got %d calls and %v", tt.wantCalls, tt.wantErr, *calls, err)
+			}
+		})
+	}
+
+	if retryableError(errors.New("not a tool failure")) {
+		t.Error("Expected errors without an exit code not to be retried")
+	}
+}
+
+func TestDedupeArt(t *testing.T) {
+	originalConfig := config
+	originalDigest := embeddedArtDigest
+	originalPath := os.Getenv("PATH")
+	defer func() {
+		config = originalConfig
+		embeddedArtDigest = originalDigest
+		os.Setenv("PATH", originalPath)
+		resetProducedFiles()
+	}()
+
+	tmpDir := t.TempDir()
+	// The fake ffmpeg writes "picture" when extracting and "stripped" when
+	// rewriting a track; the output path is always the last argument
+	writeFakeTool(t, tmpDir, "ffmpeg", `for last in "$@"; do :; done
+case "$*" in *"-map 0:a"*) echo stripped > "$last";; *) printf picture > "$last";; esac`)
+	os.Setenv("PATH", tmpDir+string(os.PathListSeparator)+originalPath)
+
+	pictureDigest := fmt.Sprintf("%x", md5.Sum([]byte("picture")))
+	digests := map[string]string{}
+	embeddedArtDigest = func(path string) (string, error) { return digests[path], nil }
+
+	targetDir := filepath.Join(tmpDir, "target")
+	album := func(name string, trackDigests ...string) []string {
+		dir := filepath.Join(targetDir, name)
+		os.MkdirAll(dir, 0755)
+		var tracks []string
+		for i, digest := range trackDigests {
+			track := filepath.Join(dir, fmt.Sprintf("%02d.flac", i+1))
+			os.WriteFile(track, []byte("audio"), 0644)
+			digests[track] = digest
+			probeCache.Lock()
+			probeCache.results[track] = &ProbeResult{Streams: []ProbeStream{
+				{CodecType: "audio", CodecName: "flac"},
+				{CodecType: "video", CodecName: "mjpeg", Disposition: map[string]int{"attached_pic": 1}},
+			}}
+			probeCache.Unlock()
+			recordProduced(track)
+			tracks = append(tracks, track)
+		}
+		return tracks
+	}
+	read := func(path string) string {
+		data, _ := os.ReadFile(path)
+		return string(data)
+	}
+
+	t.Run("folder", func(t *testing.T) {
+		resetProducedFiles()
+		config = Config{TargetDir: targetDir, DedupeArt: "folder"}
+		same := album("Same", pictureDigest, pictureDigest)
+		mixed := album("Mixed", pictureDigest, "other")
+		captureOutput(dedupeArt)
+
+		if read(filepath.Join(targetDir, "Same", "folder.jpg")) != "picture" {
+			t.Error("Expected the shared picture to be written as folder.jpg")
+		}
+		for _, track := range same {
+			if read(track) != "stripped\n" {
+				t.Errorf("Expected the embedded art to be stripped from %s", track)
+			}
+		}
+		if _, err := os.Stat(filepath.Join(targetDir, "Mixed", "folder.jpg")); err == nil {
+			t.Error("Expected no folder image when the tracks embed different pictures")
+		}
+		for _, track := range mixed {
+			if read(track) != "audio" {
+				t.Errorf("Expected %s to be left alone", track)
+			}
+		}
+	})
+
+	t.Run("folder with prune", func(t *testing.T) {
+		resetProducedFiles()
+		sourceDir := filepath.Join(tmpDir, "source")
+		os.MkdirAll(filepath.Join(sourceDir, "Pruned"), 0755)
+		for _, name := range []string{"01.flac", "02.flac"} {
+			os.WriteFile(filepath.Join(sourceDir, "Pruned", name), []byte("source"), 0644)
+		}
+		config = Config{SourceDir: sourceDir, TargetDir: targetDir, DedupeArt: "folder", Prune: true}
+		album("Pruned", pictureDigest, pictureDigest)
+		captureOutput(dedupeArt)
+
+		folderArt := filepath.Join(targetDir, "Pruned", "folder.jpg")
+		orphans, err := findOrphans()
+		if err != nil {
+			t.Fatalf("findOrphans failed: %v", err)
+		}
+		if read(folderArt) != "picture" || slices.Contains(orphans, folderArt) {
+			t.Errorf("Expected the folder image written by --dedupe-art to survive --prune, orphans: %v", orphans)
+		}
+	})
+
+	t.Run("embedded", func(t *testing.T) {
+		resetProducedFiles()
+		config = Config{TargetDir: targetDir, DedupeArt: "embedded"}
+		album("Embedded", pictureDigest, pictureDigest)
+		dir := filepath.Join(targetDir, "Embedded")
+		for _, name := range []string{"folder.jpg", "cover.png", "back.jpg"} {
+			content := "picture"
+			if name == "back.jpg" {
+				content = "another picture"
+			}
+			os.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+		}
+		recordProduced(filepath.Join(dir, "folder.jpg"))
+		recordProduced(filepath.Join(dir, "back.jpg"))
+		captureOutput(dedupeArt)
+
+		if _, err := os.Stat(filepath.Join(dir, "folder.jpg")); err == nil {
+			t.Error("Expected the duplicate folder.jpg to be removed")
+		}
+		if _, err := os.Stat(filepath.Join(dir, "cover.png")); err != nil {
+			t.Error("Expected cover.png to stay, it was not produced by the run")
+		}
+		if _, err := os.Stat(filepath.Join(dir, "back.jpg")); err != nil {
+			t.Error("Expected a different picture to stay")
+		}
+	})
+
+	t.Run("IncompleteDirectory", func(t *testing.T) {
+		resetProducedFiles()
+		defer resetDirectoryBarrier()
+		config = Config{TargetDir: targetDir, DedupeArt: "folder"}
+		tracks := album("Interrupted", pictureDigest, pictureDigest)
+		// Three source files, the run stopped before the last one
+		source := filepath.Join(tmpDir, "source", "Interrupted")
+		expectDirectories([]audioWork{
+			{path: filepath.Join(source, "01.flac")},
+			{path: filepath.Join(source, "02.flac")},
+			{path: filepath.Join(source, "03.flac")},
+		})
+		finishInDirectory(filepath.Join(source, "01.flac"), tracks[:1])
+		finishInDirectory(filepath.Join(source, "02.flac"), tracks[1:])
+		output, _ := captureOutput(dedupeArt)
+
+		if !strings.Contains(output, "not all of its tracks finished") {
+			t.Errorf("Expected the incomplete directory to be skipped, got:\n%s", output)
+		}
+		for _, track := range tracks {
+			if read(track) != "audio" {
+				t.Errorf("Expected %s to be left alone", track)
+			}
+		}
+	})
+}
+
+func TestDirectoryBarrier(t *testing.T) {
+	resetDirectoryBarrier()
+	defer resetDirectoryBarrier()
+
+	// --order largest interleaves the albums; two source directories share a
+	// target directory, as with --name-template
+	expectDirectories([]audioWork{
+		{path: "/src/A/1.flac"},
+		{path: "/src/B/1.flac"},
+		{path: "/src/A/2.flac"},
+		{path: "/src/C/1.flac"},
+	})
+	finishInDirectory("/src/A/1.flac", []string{"/dst/A/1.flac"})
+	finishInDirectory("/src/B/1.flac", []string{"/dst/A/3.flac"})
+	if directoryComplete("/dst/A") {
+		t.Error("Expected /dst/A to wait for the second file of /src/A")
+	}
+	// A failed file finishes its directory too
+	finishInDirectory("/src/A/2.flac", nil)
+	if !directoryComplete("/dst/A") {
+		t.Error("Expected /dst/A to be complete once all of its sources finished")
+	}
+	if !directoryComplete("/dst/C") {
+		t.Error("Expected a directory without finished outputs to be unaffected")
+	}
+}
+
+func TestCopyPlaylistsRewritten(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig; progress = &progressReporter{} }()
+
+	tmpDir := t.TempDir()
+	sourceDir := filepath.Join(tmpDir, "source")
+	targetDir := filepath.Join(tmpDir, "target")
+	album := filepath.Join(sourceDir, "Album")
+	os.MkdirAll(album, 0755)
+	for _, name := range []string{"01 One.flac", "02 Two.flac", "03 Three.mp3"} {
+		os.WriteFile(filepath.Join(album, name), []byte(name), 0644)
+	}
+
+	sox := writeFakeTool(t, tmpDir, "sox", `if [ "$1" = "--i" ]; then
+  printf 'Sample Rate    : 44100\nSample Encoding: 16-bit FLAC\n'
+  exit 0
+fi
+for a in "$@"; do case "$a" in *.mp3) touch "$a";; esac; done`)
+
+	os.WriteFile(filepath.Join(sourceDir, "Mix.m3u8"), []byte("#EXTM3U\r\n"+
+		"#EXTINF:123,One\r\n"+
+		"Album/01 One.flac\r\n"+
+		filepath.Join(album, "02 Two.flac")+"\r\n"+
+		"Album\\03 Three.mp3\r\n"+
+		"http://radio.example/stream.flac\r\n"+
+		"../elsewhere.flac\r\n"), 0644)
+	os.WriteFile(filepath.Join(album, "Album.m3u"), []byte("01 One.flac\n02 Two.flac\n"), 0644)
+
+	config = Config{TargetDir: targetDir, SoxCommand: sox, NoPreserveMetadata: true, EnforceOutputFormat: "mp3", CopyPlaylists: true}
+	captureOutput(func() {
+		if err := runConverter(nil, []string{sourceDir}); err != nil {
+			t.Fatalf("runConverter failed: %v", err)
+		}
+	})
+
+	data, err := os.ReadFile(filepath.Join(targetDir, "Mix.m3u8"))
+	if err != nil {
+		t.Fatalf("Playlist was not copied: %v", err)
+	}
+	want := "#EXTM3U\r\n" +
+		"#EXTINF:123,One\r\n" +
+		"Album/01 One.mp3\r\n" +
+		filepath.Join(targetDir, "Album", "02 Two.mp3") + "\r\n" +
+		"Album/03 Three.mp3\r\n" +
+		"http://radio.example/stream.flac\r\n" +
+		"../elsewhere.flac\r\n"
+	if string(data) != want {
+		t.Errorf("Unexpected playlist:\n%q\nwant:\n%q", data, want)
+	}
+
+	data, _ = os.ReadFile(filepath.Join(targetDir, "Album", "Album.m3u"))
+	if string(data) != "01 One.mp3\n02 Two.mp3\n" {
+		t.Errorf("Unexpected album playlist: %q", data)
+	}
+	for _, name := range []string{"01 One.mp3", "02 Two.mp3", "03 Three.mp3"} {
+		if _, err := os.Stat(filepath.Join(targetDir, "Album", name)); err != nil {
+			t.Errorf("Playlist entry %s does not point at a produced file: %v", name, err)
+		}
+	}
+}
+
+func TestUpsampleModes(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig; resetUpsampleDecisions() }()
+
+	tests := []struct {
+		name       string
+		config     Config
+		decision   string
+		wantErr    bool
+		outputRate int
+		mp3Rate    string
+	}{
+		{"warns by default", Config{ResampleAll: 48000}, "upsampled", false, 48000, "48000"},
+		{"no-upsample keeps the rate", Config{ResampleAll: 48000, NoUpsample: true}, "kept_rate", false, 0, "44100"},
+		{"strict-upsample fails", Config{ResampleAll: 48000, StrictUpsample: true}, "failed", true, 48000, "48000"},
+		{"mp3-rate applies to MP3 output", Config{EnforceOutputFormat: "mp3", MP3Rate: 48000, NoUpsample: true}, "kept_rate", false, 0, "44100"},
+		{"mp3-rate does not apply to FLAC output", Config{EnforceOutputFormat: "flac", MP3Rate: 48000, StrictUpsample: true}, "", false, 0, "48000"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config = tt.config
+			resetUpsampleDecisions()
+			info := &AudioInfo{Bits: 24, Rate: 44100}
+			var err error
+			captureOutput(func() { err = checkUpsampling(newFileTask("song.flac"), "song.flac", info) })
+			if (err != nil) != tt.wantErr || (err != nil && !errors.Is(err, errUpsample)) {
+				t.Errorf("checkUpsampling error = %v, want error %v", err, tt.wantErr)
+			}
+			decisions := recordedUpsampleDecisions()
+			if tt.decision == "" {
+				if len(decisions) != 0 {
+					t.Errorf("Expected no decision, got %+v", decisions)
+				}
+			} else if len(decisions) != 1 || decisions[0].Decision != tt.decision || decisions[0].SourceRate != 44100 || decisions[0].TargetRate != 48000 || decisions[0].Reason == "" {
+				t.Errorf("Expected a %s decision, got %+v", tt.decision, decisions)
+			}
+			if got := policyFromConfig().rate(info.Rate); got != tt.outputRate {
+				t.Errorf("rate = %d, want %d", got, tt.outputRate)
+			}
+			if got := mp3SampleRate(policyFromConfig(), info); got != tt.mp3Rate {
+				t.Errorf("mp3SampleRate = %s, want %s", got, tt.mp3Rate)
+			}
+			// The bit depth is still reduced when the rate is kept
+			if needs, bitArgs, _ := determineConversion(policyFromConfig(), info); !needs || len(bitArgs) == 0 {
+				t.Errorf("Expected the bit depth to be converted, got %v %v", needs, bitArgs)
+			}
+		})
+	}
+
+	config = Config{ResampleAll: 48000, NoUpsample: true, StrictUpsample: true}
+	if err := convertLibrary([]string{t.TempDir()}); err == nil {
+		t.Error("Expected --no-upsample and --strict-upsample to be rejected together")
+	}
+}
+
+func TestOrderDispatch(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig; progress = &progressReporter{} }()
+
+	tmpDir := t.TempDir()
+	sourceDir := filepath.Join(tmpDir, "source")
+	os.MkdirAll(sourceDir, 0755)
+	now := time.Now()
+	files := []struct {
+		name string
+		size int
+		age  time.Duration
+	}{
+		{"a.mp3", 300, 3 * time.Hour},
+		{"b.mp3", 100, time.Hour},
+		{"c.mp3", 400, 2 * time.Hour},
+		{"d.mp3", 200, 4 * time.Hour},
+	}
+	for _, file := range files {
+		path := filepath.Join(sourceDir, file.name)
+		os.WriteFile(path, bytes.Repeat([]byte("x"), file.size), 0644)
+		modTime := now.Add(-file.age)
+		os.Chtimes(path, modTime, modTime)
+	}
+
+	tests := []struct {
+		order string
+		sort  string
+		want  []string
+	}{
+		{"name", "", []string{"a.mp3", "b.mp3", "c.mp3", "d.mp3"}},
+		{"largest", "", []string{"c.mp3", "a.mp3", "d.mp3", "b.mp3"}},
+		{"smallest", "", []string{"b.mp3", "d.mp3", "a.mp3", "c.mp3"}},
+		{"newest", "", []string{"b.mp3", "c.mp3", "a.mp3", "d.mp3"}},
+		{"oldest", "", []string{"d.mp3", "a.mp3", "c.mp3", "b.mp3"}},
+		{"name", "size-desc", []string{"c.mp3", "a.mp3", "d.mp3", "b.mp3"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.order+tt.sort, func(t *testing.T) {
+			var dispatched []string
+			config = Config{SourceDir: sourceDir, TargetDir: filepath.Join(tmpDir, "target"), NoPreserveMetadata: true, Order: tt.order, Sort: tt.sort}
+			config.OnEvent = func(event Event) {
+				if started, ok := event.(FileStarted); ok {
+					dispatched = append(dispatched, filepath.Base(started.Path))
+				}
+			}
+			progress = &progressReporter{}
+			captureOutput(func() {
+				if err := processAudioFiles(); err != nil {
+					t.Errorf("processAudioFiles failed: %v", err)
+				}
+			})
+			if !slices.Equal(dispatched, tt.want) {
+				t.Errorf("dispatch order = %v, want %v", dispatched, tt.want)
+			}
+		})
+	}
+}
+
+func TestALACChannelLayouts(t *testing.T) {
+	originalConfig := config
+	originalPath := os.Getenv("PATH")
+	defer func() { config = originalConfig; os.Setenv("PATH", originalPath) }()
+
+	tmpDir := t.TempDir()
+	argsFile := filepath.Join(tmpDir, "args")
+	sox := writeFakeTool(t, tmpDir, "sox", `for a in "$@"; do case "$a" in *.flac) touch "$a";; esac; done`)
+	writeFakeTool(t, tmpDir, "ffmpeg", `echo "$@" > `+argsFile+`; for a in "$@"; do case "$a" in *.m4a) touch "$a";; esac; done`)
+	os.Setenv("PATH", tmpDir+string(os.PathListSeparator)+originalPath)
+
+	source := filepath.Join(tmpDir, "song.flac")
+	os.WriteFile(source, []byte("flac"), 0644)
+
+	tests := []struct {
+		name     string
+		info     AudioInfo
+		downmix  bool
+		want     string
+		wantErr  string
+		unwanted string
+	}{
+		{"mono", AudioInfo{Bits: 16, Rate: 44100, Channels: 1}, false, "-af aformat=channel_layouts=mono -c:a alac", "", "-ac"},
+		{"5.1", AudioInfo{Bits: 16, Rate: 44100, Channels: 6}, false, "-af aformat=channel_layouts=5.1 -c:a alac", "", "-ac"},
+		{"5.1 downmixed", AudioInfo{Bits: 16, Rate: 44100, Channels: 6}, true, "-ac 2 -c:a alac", "", "aformat"},
+		{"stereo is not downmixed", AudioInfo{Bits: 16, Rate: 44100, Channels: 2}, true, "-af aformat=channel_layouts=stereo", "", "-ac"},
+		{"unknown channel count", AudioInfo{Bits: 16, Rate: 44100}, false, "-i", "", "aformat"},
+		{"unsupported layout", AudioInfo{Bits: 16, Rate: 44100, Channels: 10, ChannelLayout: "5.1.4"}, false, "", "(5.1.4)", ""},
+		{"unsupported channel count", AudioInfo{Bits: 16, Rate: 44100, Channels: 12}, false, "", "(12 channels)", ""},
+		{"unsupported layout downmixed", AudioInfo{Bits: 16, Rate: 44100, Channels: 10}, true, "-ac 2", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config = Config{SourceDir: tmpDir, TargetDir: tmpDir, SoxCommand: sox, NoPreserveMetadata: true, Downmix: tt.downmix, ALACCompression: -1}
+			os.Remove(argsFile)
+			var err error
+			captureOutput(func() { err = convertToALAC(newFileTask(source), source, filepath.Join(tmpDir, "out.m4a"), &tt.info) })
+			if tt.wantErr != "" {
+				if !errors.Is(err, errUnsupportedLayout) || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("Expected an unsupported layout error naming %s, got %v", tt.wantErr, err)
+				}
+				if _, statErr := os.Stat(argsFile); statErr == nil {
+					t.Error("Expected FFmpeg not to run for an unsupported layout")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("convertToALAC failed: %v", err)
+			}
+			data, _ := os.ReadFile(argsFile)
+			args := string(data)
+			if !strings.Contains(args, tt.want) || (tt.unwanted != "" && strings.Contains(args, tt.unwanted)) {
+				t.Errorf("Expected FFmpeg arguments with %q and without %q, got %q", tt.want, tt.unwanted, args)
+			}
+		})
+	}
+}
+
+func TestProbeTuningFlags(t *testing.T) {
+	originalConfig := config
+	originalPath := os.Getenv("PATH")
+	defer func() { config = originalConfig; os.Setenv("PATH", originalPath) }()
+
+	tmpDir := t.TempDir()
+	argsFile := filepath.Join(tmpDir, "args")
+	writeFakeTool(t, tmpDir, "ffprobe", `echo "$@" > `+argsFile+`; echo '{"streams":[],"format":{}}'`)
+	os.Setenv("PATH", tmpDir+string(os.PathListSeparator)+originalPath)
+
+	source := filepath.Join(tmpDir, "odd.m4a")
+	os.WriteFile(source, []byte("m4a"), 0644)
+
+	probe := func() string {
+		defer forgetProbe(source)
+		if _, err := probeFile(nil, source); err != nil {
+			t.Fatalf("probeFile failed: %v", err)
+		}
+		data, _ := os.ReadFile(argsFile)
+		return strings.TrimSpace(string(data))
+	}
+
+	config = Config{SourceDir: tmpDir, TargetDir: tmpDir}
+	if args := probe(); strings.Contains(args, "-analyzeduration") || strings.Contains(args, "-probesize") {
+		t.Errorf("Expected FFmpeg's defaults without the flags, got %q", args)
+	}
+
+	config = Config{SourceDir: tmpDir, TargetDir: tmpDir, ProbeDuration: 100000000, ProbeSize: 50000000}
+	want := "-v quiet -analyzeduration 100000000 -probesize 50000000 -of json -show_streams -show_format " + source
+	if args := probe(); args != want {
+		t.Errorf("ffprobe arguments = %q, want %q", args, want)
+	}
+
+	config = Config{ProbeSize: 16}
+	if err := convertLibrary([]string{tmpDir}); err == nil || !strings.Contains(err.Error(), "probe-size") {
+		t.Errorf("Expected a probe-size error, got %v", err)
+	}
+}
+
+func TestTargetPreflight(t *testing.T) {
+	originalConfig := config
+	originalFreeSpace := diskFreeSpace
+	defer func() { config = originalConfig; diskFreeSpace = originalFreeSpace; progress = &progressReporter{} }()
+
+	tmpDir := t.TempDir()
+	sourceDir := filepath.Join(tmpDir, "source")
+	os.MkdirAll(sourceDir, 0755)
+	os.WriteFile(filepath.Join(sourceDir, "a.mp3"), []byte("a"), 0644)
+
+	if err := checkWritable("target", tmpDir); err != nil {
+		t.Errorf("Expected a writable directory to pass, got %v", err)
+	}
+	if entries, _ := os.ReadDir(tmpDir); len(entries) != 1 {
+		t.Errorf("Expected the test file to be removed, got %v", entries)
+	}
+
+	// A full filesystem fails the run once, before any file is processed
+	diskFreeSpace = func(dir string) (uint64, bool) { return 4096, true }
+	for _, tempDir := range []string{"", filepath.Join(tmpDir, "temp")} {
+		config = Config{TargetDir: filepath.Join(tmpDir, "target"), TempDir: tempDir, SoxCommand: "true", NoPreserveMetadata: true}
+		var err error
+		output, _ := captureOutput(func() { err = runConverter(nil, []string{sourceDir}) })
+		if err == nil || !strings.Contains(err.Error(), "target directory") || !strings.Contains(err.Error(), "is full") || exitCode(err) != exitEnvironment {
+			t.Errorf("Expected a full target error, got %v", err)
+		}
+		if strings.Contains(output, "Processing:") {
+			t.Errorf("Expected no file to be processed, got:\n%s", output)
+		}
+	}
+
+	diskFreeSpace = func(dir string) (uint64, bool) {
+		if strings.HasSuffix(dir, "temp") {
+			return 0, true
+		}
+		return 1 << 30, true
+	}
+	config = Config{TargetDir: filepath.Join(tmpDir, "target"), TempDir: filepath.Join(tmpDir, "temp"), SoxCommand: "true", NoPreserveMetadata: true}
+	var err error
+	captureOutput(func() { err = runConverter(nil, []string{sourceDir}) })
+	if err == nil || !strings.Contains(err.Error(), "temp directory") {
+		t.Errorf("Expected a full temp directory error, got %v", err)
+	}
+
+	if runtime.GOOS == "windows" || os.Geteuid() == 0 {
+		return
+	}
+	diskFreeSpace = originalFreeSpace
+	readOnly := filepath.Join(tmpDir, "readonly")
+	os.MkdirAll(readOnly, 0555)
+	if err := checkWritable("target", readOnly); err == nil || !strings.Contains(err.Error(), "not writable") {
+		t.Errorf("Expected a read-only directory to fail, got %v", err)
+	}
+}
+
+func TestLossyPassthroughExtensions(t *testing.T) {
+	originalConfig := config
+	originalPath := os.Getenv("PATH")
+	defer func() { config = originalConfig; os.Setenv("PATH", originalPath) }()
+
+	tmpDir := t.TempDir()
+	argsFile := filepath.Join(tmpDir, "args")
+	writeFakeTool(t, tmpDir, "ffmpeg", `echo "$@" > `+argsFile+`; for a in "$@"; do case "$a" in *.mp3) touch "$a";; esac; done`)
+	os.Setenv("PATH", tmpDir+string(os.PathListSeparator)+originalPath)
+
+	sourceDir := filepath.Join(tmpDir, "source")
+	os.MkdirAll(sourceDir, 0755)
+
+	for _, ext := range []string{".aac", ".mp4", ".m4r"} {
+		t.Run(ext, func(t *testing.T) {
+			if !isAudioExtension(ext) {
+				t.Fatalf("%s should be an audio extension", ext)
+			}
+			source := filepath.Join(sourceDir, "song"+ext)
+			os.WriteFile(source, []byte("aac"+ext), 0644)
+
+			// Copied unchanged in the default mode and the lossless modes
+			for _, format := range []string{"", "flac", "alac", "mp3"} {
+				targetDir := filepath.Join(tmpDir, "copy"+ext+format)
+				config = Config{SourceDir: sourceDir, TargetDir: targetDir, EnforceOutputFormat: format, NoPreserveMetadata: true}
+				if got := outputExtension(config.EnforceOutputFormat, ext); got != ext {
+					t.Errorf("format %q: outputExtension = %q, want %q", format, got, ext)
+				}
+				captureOutput(func() {
+					if err := processSourceFile(newFileTask(source), ext); err != nil {
+						t.Errorf("format %q: processSourceFile failed: %v", format, err)
+					}
+				})
+				if data, _ := os.ReadFile(filepath.Join(targetDir, "song"+ext)); string(data) != "aac"+ext {
+					t.Errorf("format %q: expected the source to be copied, got %q", format, data)
+				}
+			}
+
+			// Transcoded to MP3 through FFmpeg with --reencode-lossy
+			targetDir := filepath.Join(tmpDir, "mp3"+ext)
+			config = Config{SourceDir: sourceDir, TargetDir: targetDir, EnforceOutputFormat: "mp3", ReencodeLossy: true, NoPreserveMetadata: true}
+			if got := outputExtension(config.EnforceOutputFormat, ext); got != ".mp3" {
+				t.Errorf("outputExtension with --reencode-lossy = %q, want .mp3", got)
+			}
+			probeCache.Lock()
+			probeCache.results[source] = &ProbeResult{Streams: []ProbeStream{{CodecType: "audio", CodecName: "aac", SampleRate: "48000"}}}
+			probeCache.Unlock()
+			captureOutput(func() {
+				if err := processSourceFile(newFileTask(source), ext); err != nil {
+					t.Errorf("processSourceFile with --reencode-lossy failed: %v", err)
+				}
+			})
+			if _, err := os.Stat(filepath.Join(targetDir, "song.mp3")); err != nil {
+				t.Errorf("Expected an MP3 output: %v", err)
+			}
+			args, _ := os.ReadFile(argsFile)
+			if !strings.Contains(string(args), "-c:a libmp3lame -b:a 320k -ar 48000") {
+				t.Errorf("Expected an FFmpeg CBR encode at the source rate, got %q", strings.TrimSpace(string(args)))
+			}
+		})
+	}
+}
+
+func TestKeepOriginalOnFormatMismatch(t *testing.T) {
+	originalConfig := config
+	originalPath := os.Getenv("PATH")
+	defer func() { config = originalConfig; os.Setenv("PATH", originalPath); resetConversionFailures() }()
+
+	tmpDir := t.TempDir()
+	sourceDir := filepath.Join(tmpDir, "source")
+	os.MkdirAll(sourceDir, 0755)
+	source := filepath.Join(sourceDir, "song.flac")
+	os.WriteFile(source, []byte("original flac"), 0644)
+
+	// SoX produces the intermediate FLAC, the ALAC encode then fails after
+	// leaving a partial output behind
+	sox := writeFakeTool(t, tmpDir, "sox", `if [ "$1" = "--i" ]; then
+  printf 'Channels       : 2\nSample Rate    : 44100\nSample Encoding: 16-bit FLAC\n'
+  exit 0
+fi
+for a in "$@"; do case "$a" in *.flac) touch "$a";; esac; done`)
+	writeFakeTool(t, tmpDir, "ffmpeg", `for a in "$@"; do last="$a"; done; echo broken > "$last"; exit 1`)
+	os.Setenv("PATH", tmpDir+string(os.PathListSeparator)+originalPath)
+
+	for _, keep := range []bool{false, true} {
+		targetDir := filepath.Join(tmpDir, fmt.Sprintf("target-%v", keep))
+		config = Config{SourceDir: sourceDir, TargetDir: targetDir, SoxCommand: sox, EnforceOutputFormat: "alac", NoPreserveMetadata: true, KeepOriginal: keep}
+		resetConversionFailures()
+		var err error
+		captureOutput(func() { err = processSourceFile(newFileTask(source), ".flac") })
+
+		if !keep {
+			if err == nil {
+				t.Error("Expected the failed ALAC conversion to fail the file")
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Expected the original to be kept, got %v", err)
+		}
+		if data, _ := os.ReadFile(filepath.Join(targetDir, "song.flac")); string(data) != "original flac" {
+			t.Errorf("Expected the original FLAC in the target, got %q", data)
+		}
+		if _, err := os.Stat(filepath.Join(targetDir, "song.m4a")); !os.IsNotExist(err) {
+			t.Errorf("Expected the broken ALAC output to be removed, got %v", err)
+		}
+		if failures := recordedConversionFailures(); len(failures) != 1 || failures[0].Path != source {
+			t.Errorf("Expected the mismatch to be recorded as a conversion failure, got %+v", failures)
+		}
+	}
+}
+
+func TestBenchmark(t *testing.T) {
+	originalConfig := config
+	originalPath := os.Getenv("PATH")
+	defer func() { config = originalConfig; os.Setenv("PATH", originalPath) }()
+
+	tmpDir := t.TempDir()
+	synthFile := filepath.Join(tmpDir, "synth")
+	sox := writeFakeTool(t, tmpDir, "sox", `if [ "$1" = "--i" ]; then
+  printf 'Channels       : 2\nSample Rate    : 96000\nSample Encoding: 24-bit FLAC\n'
+  exit 0
+fi
+if [ "$1" = "-n" ]; then echo "$@" > `+synthFile+`; echo sample > "$8"; exit 0; fi
+for a in "$@"; do case "$a" in */target/*) echo converted > "$a";; esac; done`)
+	writeFakeTool(t, tmpDir, "ffmpeg", `for a in "$@"; do last="$a"; done; echo converted > "$last"`)
+	os.Setenv("PATH", tmpDir+string(os.PathListSeparator)+originalPath)
+
+	config = Config{SoxCommand: sox, NoPreserveMetadata: true, NoPostcheck: true, Benchmark: true, BenchJobs: []int{1, 2}}
+	var err error
+	output, _ := captureOutput(func() { err = runConverter(nil, nil) })
+	if err != nil {
+		t.Fatalf("benchmark failed: %v", err)
+	}
+	if args, _ := os.ReadFile(synthFile); !strings.Contains(string(args), "-r 96000 -b 24 -c 2") {
+		t.Errorf("Expected a synthesized 24-bit 96 kHz sample, got %q", args)
+	}
+	rows := map[string]bool{}
+	for _, line := range strings.Split(output, "\n") {
+		if fields := strings.Fields(line); len(fields) == 6 && fields[2] == "8" {
+			rows[fields[0]+"/"+fields[1]] = true
+		}
+	}
+	for _, format := range []string{"flac", "mp3", "alac"} {
+		for _, jobs := range []string{"1", "2"} {
+			if !rows[format+"/"+jobs] {
+				t.Errorf("Expected a timing row for %s with %s job(s), got:\n%s", format, jobs, output)
+			}
+		}
+	}
+
+	config = Config{SoxCommand: sox, Benchmark: true, BenchJobs: []int{0}}
+	if err := runConverter(nil, nil); err == nil {
+		t.Error("Expected an error for a concurrency level of 0")
+	}
+	config = Config{SoxCommand: sox, Benchmark: true, BenchSample: filepath.Join(tmpDir, "song.mp3")}
+	if err := runConverter(nil, nil); err == nil {
+		t.Error("Expected an error for an MP3 sample")
+	}
+}
+
+func TestFilePipeline(t *testing.T) {
+	originalConfig := config
+	originalPath := os.Getenv("PATH")
+	defer func() { config = originalConfig; os.Setenv("PATH", originalPath); resetPipelines() }()
+
+	config = Config{SoxCommand: "/usr/local/bin/sox_ng"}
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"sox_ng", []string{"--i", "a.flac"}, "sox"},
+		{"ffprobe", []string{"-show_streams", "a.m4a"}, "ffprobe"},
+		{"ffmpeg", []string{"-y", "-i", "a.flac", "-c:a", "alac", "a.m4a"}, "ffmpeg"},
+		{"ffmpeg", []string{"-i", "a.flac", "-i", "b.flac", "-map", "1", "-map_metadata", "0", "-c", "copy", "c.flac"}, "ffmpeg-merge"},
+		{"docker", []string{"run", "--rm", "img", "a.flac", "b.flac"}, "sox(docker)"},
+		{"docker", []string{"run", "--rm", "--entrypoint", "ffprobe", "img", "a.m4a"}, "ffprobe(docker)"},
+	}
+	for _, tt := range tests {
+		if got := pipelineStage(tt.name, tt.args); got != tt.want {
+			t.Errorf("pipelineStage(%s %v) = %q, want %q", tt.name, tt.args, got, tt.want)
+		}
+	}
+
+	tmpDir := t.TempDir()
+	sourceDir := filepath.Join(tmpDir, "source")
+	os.MkdirAll(sourceDir, 0755)
+	hires := filepath.Join(sourceDir, "hires.flac")
+	os.WriteFile(hires, []byte("hires"), 0644)
+	song := filepath.Join(sourceDir, "song.mp3")
+	os.WriteFile(song, []byte("mp3"), 0644)
+
+	sox := writeFakeTool(t, tmpDir, "sox", `if [ "$1" = "--i" ]; then
+  printf 'Channels       : 2\nSample Rate    : 96000\nSample Encoding: 24-bit FLAC\n'
+  exit 0
+fi
+for a in "$@"; do case "$a" in *.tmp.flac) echo converted > "$a";; esac; done`)
+	writeFakeTool(t, tmpDir, "ffmpeg", `for a in "$@"; do last="$a"; done; echo merged > "$last"`)
+	os.Setenv("PATH", tmpDir+string(os.PathListSeparator)+originalPath)
+
+	config = Config{SourceDir: sourceDir, TargetDir: filepath.Join(tmpDir, "target"), SoxCommand: sox, NoPostcheck: true, Verbose: true}
+	resetPipelines()
+	output, _ := captureOutput(func() {
+		for _, path := range []string{hires, song} {
+			if err := processSourceFile(newFileTask(path), strings.ToLower(filepath.Ext(path))); err != nil {
+				t.Errorf("processSourceFile(%s) failed: %v", path, err)
+			}
+		}
+	})
+	if !strings.Contains(output, "Pipeline: sox→sox→ffmpeg-merge\nDecision: convert: 24-bit 96000 Hz → 16-bit 48000 Hz\n") {
+		t.Errorf("Expected the pipeline and decision in verbose output, got:\n%s", output)
+	}
+	got := recordedPipelines()
+	wantDecision := Decision{Action: "convert", TargetBits: 16, TargetRate: 48000, Reason: "24-bit 96000 Hz → 16-bit 48000 Hz"}
+	if len(got) != 2 || got[0].Decision == nil || *got[0].Decision != wantDecision || got[1].Decision != nil {
+		t.Fatalf("Expected the hi-res decision to be recorded, got %+v", got)
+	}
+	got[0].Decision = nil
+	want := []FilePipeline{
+		{Path: hires, Format: "flac", Pipeline: "sox→sox→ffmpeg-merge"},
+		{Path: song, Format: "flac", Pipeline: "copy"},
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("recordedPipelines() = %+v, want %+v", got, want)
+	}
+}
+
+func TestCopyOnly(t *testing.T) {
+	originalConfig := config
+	originalPath := os.Getenv("PATH")
+	defer func() {
+		config = originalConfig
+		os.Setenv("PATH", originalPath)
+		progress = &progressReporter{}
+	}()
+
+	tmpDir := t.TempDir()
+	sourceDir := filepath.Join(tmpDir, "source")
+	targetDir := filepath.Join(tmpDir, "target")
+	os.MkdirAll(filepath.Join(sourceDir, "Album"), 0755)
+	os.MkdirAll(filepath.Join(targetDir, "Old"), 0755)
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, name := range []string{"hires.flac", "song.m4a", "song.mp3", "cover.jpg"} {
+		path := filepath.Join(sourceDir, "Album", name)
+		os.WriteFile(path, []byte(name), 0644)
+		os.Chtimes(path, modTime, modTime)
+	}
+	orphan := filepath.Join(targetDir, "Old", "gone.flac")
+	os.WriteFile(orphan, []byte("gone"), 0644)
+
+	// No SoX, FFmpeg or Docker is available
+	os.Setenv("PATH", t.TempDir())
+
+	reportPath := filepath.Join(tmpDir, "report.json")
+	config = Config{TargetDir: targetDir, SoxCommand: "sox", CopyOnly: true, Prune: true, Yes: true, ReportPath: reportPath, Verbose: true}
+	captureOutput(func() {
+		if err := runConverter(nil, []string{sourceDir}); err != nil {
+			t.Fatalf("copy-only run failed: %v", err)
+		}
+	})
+
+	for _, name := range []string{"hires.flac", "song.m4a", "song.mp3", "cover.jpg"} {
+		path := filepath.Join(targetDir, "Album", name)
+		data, err := os.ReadFile(path)
+		if err != nil || string(data) != name {
+			t.Errorf("Expected %s to be copied unchanged, got %q (%v)", name, data, err)
+			continue
+		}
+		if info, _ := os.Stat(path); !info.ModTime().Equal(modTime) {
+			t.Errorf("Expected %s to keep its timestamp, got %v", name, info.ModTime())
+		}
+	}
+	if _, err := os.Stat(filepath.Join(targetDir, "Album", "song.flac")); !os.IsNotExist(err) {
+		t.Error("The ALAC file should not be converted in copy-only mode")
+	}
+	if _, err := os.Stat(orphan); !os.IsNotExist(err) {
+		t.Error("Expected the orphan to be pruned")
+	}
+	if summary := progress.summary(); summary.Completed != 3 || summary.Results[actionCopied] != 3 {
+		t.Errorf("Expected three copied files in the summary, got %+v", summary)
+	}
+	var report RunReport
+	data, _ := os.ReadFile(reportPath)
+	if err := json.Unmarshal(data, &report); err != nil {
+		t.Fatalf("Failed to read the report: %v", err)
+	}
+	if len(report.Pipelines) != 3 || report.Pipelines[0].Pipeline != "copy" {
+		t.Errorf("Expected copy pipelines for the audio files, got %+v", report.Pipelines)
+	}
+
+	config = Config{TargetDir: targetDir, CopyOnly: true, EnforceOutputFormat: "mp3"}
+	if err := runConverter(nil, []string{sourceDir}); err == nil || !strings.Contains(err.Error(), "--enforce-output-format") {
+		t.Errorf("Expected --copy-only to conflict with --enforce-output-format, got %v", err)
+	}
+}
+
+func TestFromStdinNullSeparated(t *testing.T) {
+	originalConfig := config
+	originalInput := fileListInput
+	defer func() {
+		config = originalConfig
+		fileListInput = originalInput
+		inputList = nil
+		progress = &progressReporter{}
+	}()
+
+	list, err := readInputList(strings.NewReader("a.flac\x00line\nbreak.mp3\x00\x00last.m4a"), true)
+	if err != nil {
+		t.Fatalf("readInputList failed: %v", err)
+	}
+	if want := []string{"a.flac", "line\nbreak.mp3", "last.m4a"}; !slices.Equal(list, want) {
+		t.Errorf("NUL separated list = %q, want %q", list, want)
+	}
+	list, _ = readInputList(strings.NewReader("a.flac\r\n\nb.mp3\n"), false)
+	if want := []string{"a.flac", "b.mp3"}; !slices.Equal(list, want) {
+		t.Errorf("Newline separated list = %q, want %q", list, want)
+	}
+
+	tmpDir := t.TempDir()
+	sourceDir := filepath.Join(tmpDir, "source")
+	targetDir := filepath.Join(tmpDir, "target")
+	os.MkdirAll(sourceDir, 0755)
+	newline := filepath.Join(sourceDir, "line\nbreak.mp3")
+	listed := filepath.Join(sourceDir, "listed.mp3")
+	for _, path := range []string{newline, listed, filepath.Join(sourceDir, "unlisted.mp3")} {
+		os.WriteFile(path, []byte("mp3"), 0644)
+	}
+
+	fileListInput = strings.NewReader(newline + "\x00" + listed + "\x00" + filepath.Join(tmpDir, "outside.mp3") + "\x00")
+	config = Config{TargetDir: targetDir, CopyOnly: true, FromStdin: true, NullSeparated: true}
+	captureOutput(func() {
+		if err := runConverter(nil, []string{sourceDir}); err != nil {
+			t.Fatalf("runConverter failed: %v", err)
+		}
+	})
+	for _, name := range []string{"line\nbreak.mp3", "listed.mp3"} {
+		if _, err := os.Stat(filepath.Join(targetDir, name)); err != nil {
+			t.Errorf("Expected listed file %q to be processed: %v", name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(targetDir, "unlisted.mp3")); !os.IsNotExist(err) {
+		t.Error("Files missing from the list should not be processed")
+	}
+
+	config = Config{TargetDir: targetDir, CopyOnly: true, NullSeparated: true}
+	if err := runConverter(nil, []string{sourceDir}); err == nil {
+		t.Error("Expected --null without --from-stdin to be rejected")
+	}
+}
+
+func TestALACEncoderCheck(t *testing.T) {
+	originalConfig := config
+	originalPath := os.Getenv("PATH")
+	defer func() { config = originalConfig; os.Setenv("PATH", originalPath) }()
+
+	listing := `Encoders:
+ V..... = Video
+ A..... = Audio
+ ------
+ A....D aac                  AAC (Advanced Audio Coding)
+ A....D alac                 ALAC (Apple Lossless Audio Codec)
+ A....D flac                 FLAC (Free Lossless Audio Codec)
+`
+	if !hasAudioEncoder(listing, "alac") {
+		t.Error("Expected alac to be found in the encoder list")
+	}
+	if hasAudioEncoder(strings.ReplaceAll(listing, " alac ", " alacx "), "alac") {
+		t.Error("Only an exact encoder name should match")
+	}
+
+	tmpDir := t.TempDir()
+	sox := writeFakeTool(t, tmpDir, "sox", "exit 0")
+	os.Setenv("PATH", tmpDir+string(os.PathListSeparator)+originalPath)
+
+	tests := []struct {
+		name     string
+		format   string
+		encoders string
+		wantErr  string
+	}{
+		{"alac encoder present", "alac", listing, ""},
+		{"alac encoder missing", "flac,alac", strings.ReplaceAll(listing, " alac ", " aptx "), "without the ALAC encoder"},
+		{"not needed for flac", "flac", "", ""},
+		{"libopus encoder present", "opus", listing + " A....D libopus              libopus Opus\n", ""},
+		{"libopus encoder missing", "opus", listing, "without the Opus encoder"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			writeFakeTool(t, tmpDir, "ffmpeg", "cat <<'EOF'\n"+tt.encoders+"EOF")
+			config = Config{SourceDir: tmpDir, TargetDir: tmpDir, SoxCommand: sox, EnforceOutputFormat: tt.format}
+			err := setupSoxCommand()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("setupSoxCommand() failed: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Expected an error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestIndependentThresholds(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig }()
+
+	config = Config{ResampleAbove: 48000, ReduceBitsAbove: 16}
+	tests := []struct {
+		name     string
+		info     AudioInfo
+		wantBits []string
+		wantRate string
+	}{
+		{"deep and fast", AudioInfo{Bits: 24, Rate: 96000}, []string{"-b", "16"}, "48000"},
+		{"deep only", AudioInfo{Bits: 24, Rate: 48000}, []string{"-b", "16"}, ""},
+		{"fast only", AudioInfo{Bits: 16, Rate: 176400}, nil, "44100"},
+		{"neither", AudioInfo{Bits: 16, Rate: 44100}, nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			needs, bitArgs, rateArgs := determineConversion(policyFromConfig(), &tt.info)
+			if !slices.Equal(bitArgs, tt.wantBits) {
+				t.Errorf("bit depth args = %v, want %v", bitArgs, tt.wantBits)
+			}
+			gotRate := ""
+			if len(rateArgs) > 3 {
+				gotRate = rateArgs[3]
+			}
+			if gotRate != tt.wantRate {
+				t.Errorf("rate = %q, want %q", gotRate, tt.wantRate)
+			}
+			if needs != (tt.wantBits != nil || tt.wantRate != "") {
+				t.Errorf("needsConversion = %v", needs)
+			}
+		})
+	}
+
+	// Keep 24-bit but resample to at most 48 kHz, or reduce to 16-bit but keep 96 kHz
+	config = Config{ResampleAbove: 48000, ReduceBitsAbove: 24}
+	if _, bitArgs, rateArgs := determineConversion(policyFromConfig(), &AudioInfo{Bits: 24, Rate: 192000}); bitArgs != nil || rateArgs[3] != "48000" {
+		t.Errorf("Expected 24-bit to be kept and 192 kHz reduced to 48 kHz, got %v %v", bitArgs, rateArgs)
+	}
+	config = Config{ResampleAbove: 96000, ReduceBitsAbove: 16}
+	if _, bitArgs, rateArgs := determineConversion(policyFromConfig(), &AudioInfo{Bits: 24, Rate: 96000}); !slices.Equal(bitArgs, []string{"-b", "16"}) || len(rateArgs) != 3 {
+		t.Errorf("Expected 16-bit at 96 kHz, got %v %v", bitArgs, rateArgs)
+	}
+	if rate := policyFromConfig().rate(352800); rate != 88200 {
+		t.Errorf("rate(352800) with --resample-above 96000 = %d, want 88200", rate)
+	}
+
+	for _, invalid := range []Config{{ReduceBitsAbove: 20}, {ResampleAbove: 100}, {ResampleAbove: 48000, ResampleAll: 44100}, {ReduceBitsAbove: 16, DownsampleOnly: true}} {
+		config = invalid
+		if err := runConverter(nil, []string{t.TempDir()}); err == nil || strings.Contains(err.Error(), "not installed") {
+			t.Errorf("Expected %+v to be rejected, got %v", invalid, err)
+		}
+	}
+}
+
+func TestAudioDurationTotals(t *testing.T) {
+	info, err := parseAudioInfo(`Channels       : 2
+Sample Rate    : 96000
+Precision      : 24-bit
+Duration       : 01:02:03.50 = 357456000 samples ~ 279262 CDDA sectors
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Hour + 2*time.Minute + 3500*time.Millisecond; info.Duration != want {
+		t.Errorf("Duration = %v, want %v", info.Duration, want)
+	}
+
+	probe := &ProbeResult{Streams: []ProbeStream{{CodecType: "audio", CodecName: "alac", SampleRate: "44100", Channels: 2, BitsPerRawSample: "16"}}}
+	probe.Format.Duration = "245.5"
+	probeCache.Lock()
+	probeCache.results["/music/song.m4a"] = probe
+	probeCache.Unlock()
+	defer func() {
+		probeCache.Lock()
+		delete(probeCache.results, "/music/song.m4a")
+		probeCache.Unlock()
+	}()
+	if info, err := getAudioInfo(nil, "/music/song.m4a"); err != nil || info.Duration != 245500*time.Millisecond {
+		t.Fatalf("getAudioInfo() = %+v, %v", info, err)
+	}
+	if duration := takeDuration("/music/song.m4a"); duration != 245500*time.Millisecond {
+		t.Errorf("takeDuration() = %v", duration)
+	}
+	if duration := takeDuration("/music/song.m4a"); duration != 0 {
+		t.Errorf("Expected the duration to be forgotten, got %v", duration)
+	}
+
+	p := &progressReporter{}
+	p.runStarted(2)
+	p.started = time.Now().Add(-time.Minute)
+	p.fileCompleted(FileCompleted{Path: "a.flac", Action: "converted", Duration: 30 * time.Minute})
+	p.fileCompleted(FileCompleted{Path: "b.flac", Action: "copied", Duration: 15 * time.Minute})
+	summary := p.summary()
+	if summary.Duration != 45*time.Minute || summary.DurationByAction["converted"] != 30*time.Minute {
+		t.Errorf("Unexpected duration totals: %v %v", summary.Duration, summary.DurationByAction)
+	}
+	if factor := summary.RealtimeFactor(); factor < 40 || factor > 45 {
+		t.Errorf("RealtimeFactor() = %v, want about 45", factor)
+	}
+	totals := audioTotals(summary)
+	if totals == nil || totals.Seconds != 2700 || totals.SecondsByAction["copied"] != 900 {
+		t.Errorf("Unexpected report totals: %+v", totals)
+	}
+	if audioTotals(RunSummary{}) != nil {
+		t.Error("Expected no audio totals without durations")
+	}
+
+	output, _ := captureOutput(func() {
+		(&consoleWriter{}).handleEvent(RunCompleted{Summary: summary})
+	})
+	if !strings.Contains(output, "0.8 hours of audio processed at") || !strings.Contains(output, "× realtime") {
+		t.Errorf("Expected the audio total in the summary, got %q", output)
+	}
+}
+
+// flacWithStreamInfo returns the start of a FLAC file whose STREAMINFO
+// describes the given format
+func flacWithStreamInfo(bits, rate, channels int, samples int64) []byte {
+	block := make([]byte, 34)
+	block[10] = byte(rate >> 12)
+	block[11] = byte(rate >> 4)
+	block[12] = byte(rate<<4) | byte(channels-1)<<1 | byte(bits-1)>>4
+	block[13] = byte(bits-1)<<4 | byte(samples>>32)&0x0f
+	block[14] = byte(samples >> 24)
+	block[15] = byte(samples >> 16)
+	block[16] = byte(samples >> 8)
+	block[17] = byte(samples)
+	data := append([]byte("fLaC"), 0x80, 0, 0, 34)
+	return append(data, block...)
+}
+
+// flacWithLargeTags builds a FLAC file behind an ID3v2 tag holding an
+// attached picture of pictureBytes, with a VORBIS_COMMENT block carrying a
+// LYRICS comment of lyricsBytes and a FLAC PICTURE block of pictureBytes
+func flacWithLargeTags(bits, rate, channels int, lyricsBytes, pictureBytes int) []byte {
+	syncsafe := func(n int) []byte {
+		return []byte{byte(n >> 21 & 0x7f), byte(n >> 14 & 0x7f), byte(n >> 7 & 0x7f), byte(n & 0x7f)}
+	}
+	blockHeader := func(kind byte, length int) []byte {
+		return []byte{kind, byte(length >> 16), byte(length >> 8), byte(length)}
+	}
+
+	apic := append([]byte{0, 'i', 'm', 'a', 'g', 'e', '/', 'j', 'p', 'e', 'g', 0, 3, 0}, bytes.Repeat([]byte{0xff}, pictureBytes)...)
+	frame := append(append([]byte("APIC"), syncsafe(len(apic))...), 0, 0)
+	frame = append(frame, apic...)
+	data := append(append([]byte("ID3\x04\x00\x00"), syncsafe(len(frame))...), frame...)
+
+	stream := flacWithStreamInfo(bits, rate, channels, int64(rate))
+	stream[4] = 0 // STREAMINFO is no longer the last block
+	data = append(data, stream...)
+
+	comment := "LYRICS=" + strings.Repeat("la ", lyricsBytes/3)
+	vorbis := binary.LittleEndian.AppendUint32(nil, 4)
+	vorbis = append(vorbis, "lilt"...)
+	vorbis = binary.LittleEndian.AppendUint32(vorbis, 1)
+	vorbis = binary.LittleEndian.AppendUint32(vorbis, uint32(len(comment)))
+	vorbis = append(vorbis, comment...)
+	data = append(append(data, blockHeader(4, len(vorbis))...), vorbis...)
+
+	picture := bytes.Repeat([]byte{0xff}, pictureBytes)
+	return append(append(data, blockHeader(0x80|6, len(picture))...), picture...)
+}
+
+func TestLargeTagBlocks(t *testing.T) {
+	originalConfig := config
+	originalPath := os.Getenv("PATH")
+	defer func() { config = originalConfig; os.Setenv("PATH", originalPath) }()
+	config = Config{}
+
+	tmpDir := t.TempDir()
+	source := filepath.Join(tmpDir, "huge.flac")
+	if err := os.WriteFile(source, flacWithLargeTags(24, 96000, 2, 2<<20, 8<<20), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// STREAMINFO is found behind an 8 MiB ID3 picture
+	info, err := readFLACStreamInfo(source)
+	if err != nil {
+		t.Fatalf("readFLACStreamInfo failed: %v", err)
+	}
+	if info.Bits != 24 || info.Rate != 96000 || info.Channels != 2 {
+		t.Errorf("readFLACStreamInfo = %+v", info)
+	}
+
+	// ffprobe output with megabytes of lyrics is decoded and the lyrics cut
+	report := filepath.Join(tmpDir, "report.json")
+	lyrics := strings.Repeat("é", 1<<20)
+	output, _ := json.Marshal(map[string]any{
+		"streams": []map[string]any{{"codec_name": "flac", "codec_type": "audio", "sample_rate": "96000", "bits_per_raw_sample": "24"}},
+		"format":  map[string]any{"format_name": "flac", "tags": map[string]string{"TITLE": "Song", "LYRICS": lyrics}},
+	})
+	os.WriteFile(report, output, 0644)
+	writeFakeTool(t, tmpDir, "ffprobe", "cat "+report)
+	os.Setenv("PATH", tmpDir+string(os.PathListSeparator)+originalPath)
+
+	probe, err := probeFile(nil, source)
+	forgetProbe(source)
+	if err != nil {
+		t.Fatalf("probeFile failed: %v", err)
+	}
+	if probe.Format.Tags["TITLE"] != "Song" {
+		t.Errorf("TITLE = %q", probe.Format.Tags["TITLE"])
+	}
+	kept := probe.Format.Tags["LYRICS"]
+	if len(kept) > maxProbeTagValue || len(kept) < maxProbeTagValue-utf8.UTFMax || !utf8.ValidString(kept) {
+		t.Errorf("LYRICS kept %d bytes, valid UTF-8 %v", len(kept), utf8.ValidString(kept))
+	}
+
+	// The same report captured for --error-log-dir is cut the same way
+	config.ErrorLogDir = tmpDir
+	probe, err = probeFile(newFileTask(source), source)
+	forgetProbe(source)
+	if err != nil {
+		t.Fatalf("probeFile with captured output failed: %v", err)
+	}
+	if got := probe.Format.Tags["LYRICS"]; got != kept {
+		t.Errorf("captured LYRICS kept %d bytes, want %d", len(got), len(kept))
+	}
+
+	if _, err := parseProbeJSON([]byte(`{"format":{"tags":["not","an","object"]}}`)); err == nil {
+		t.Error("expected error for tags that are not an object")
+	}
+}
+
+func TestSoxOutputPostcheck(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig }()
+
+	tmpDir := t.TempDir()
+	flac := filepath.Join(tmpDir, "stream.flac")
+	os.WriteFile(flac, flacWithStreamInfo(24, 96000, 2, 96000*90), 0644)
+	info, err := readFLACStreamInfo(flac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Bits != 24 || info.Rate != 96000 || info.Channels != 2 || info.Duration != 90*time.Second {
+		t.Errorf("readFLACStreamInfo() = %+v", info)
+	}
+
+	tagged := filepath.Join(tmpDir, "tagged.flac")
+	os.WriteFile(tagged, append([]byte("ID3\x04\x00\x00\x00\x00\x00\x05hello"), flacWithStreamInfo(16, 44100, 1, 0)...), 0644)
+	if info, err := readFLACStreamInfo(tagged); err != nil || info.Bits != 16 || info.Rate != 44100 || info.Channels != 1 {
+		t.Errorf("readFLACStreamInfo() after an ID3 tag = %+v, %v", info, err)
+	}
+	if _, err := readFLACStreamInfo(filepath.Join(tmpDir, "missing.flac")); err == nil {
+		t.Error("Expected an error for a missing file")
+	}
+
+	// SoX ignored -b 16 and kept 24-bit
+	sox := writeFakeTool(t, tmpDir, "sox", `for a in "$@"; do case "$a" in *out.tmp.flac) cp `+flac+` "$a";; esac; done`)
+	config = Config{SourceDir: tmpDir, TargetDir: tmpDir, SoxCommand: sox, NoPreserveMetadata: true}
+	source := filepath.Join(tmpDir, "song.flac")
+	os.WriteFile(source, flacWithStreamInfo(24, 96000, 2, 0), 0644)
+	target := filepath.Join(tmpDir, "out.flac")
+	err = processFlac(newFileTask(source), source, target, true, []string{"-b", "16"}, []string{"rate", "-v", "-L", "96000"})
+	if !errors.Is(err, errPostcheck) || !strings.Contains(err.Error(), "expected 16-bit, got 24-bit") {
+		t.Errorf("Expected a bit depth mismatch, got %v", err)
+	}
+	if _, statErr := os.Stat(target); !os.IsNotExist(statErr) {
+		t.Error("Expected the mismatching output to be removed")
+	}
+	err = processFlac(newFileTask(source), source, target, true, nil, []string{"rate", "-v", "-L", "48000"})
+	if !errors.Is(err, errPostcheck) || !strings.Contains(err.Error(), "expected 48000 Hz, got 96000 Hz") {
+		t.Errorf("Expected a sample rate mismatch, got %v", err)
+	}
+	if err := processFlac(newFileTask(source), source, target, true, []string{"-b", "24"}, []string{"rate", "-v", "-L", "96000"}); err != nil {
+		t.Errorf("Expected a matching output to pass, got %v", err)
+	}
+
+	config.NoPostcheck = true
+	if err := processFlac(newFileTask(source), source, target, true, []string{"-b", "16"}, []string{"rate", "-v", "-L", "96000"}); err != nil {
+		t.Errorf("Expected --no-postcheck to skip the check, got %v", err)
+	}
+}
+
+func TestArtOnly(t *testing.T) {
+	originalConfig := config
+	originalPath := os.Getenv("PATH")
+	defer func() { config = originalConfig; os.Setenv("PATH", originalPath) }()
+
+	tmpDir := t.TempDir()
+	sourceDir := filepath.Join(tmpDir, "source")
+	targetDir := filepath.Join(tmpDir, "target")
+	album := filepath.Join(sourceDir, "Album")
+	os.MkdirAll(album, 0755)
+	os.WriteFile(filepath.Join(album, "01.flac"), []byte("flac"), 0644)
+	os.WriteFile(filepath.Join(album, "cover.jpg"), []byte("jpeg"), 0644)
+
+	soxLog := filepath.Join(tmpDir, "sox.log")
+	ffmpegLog := filepath.Join(tmpDir, "ffmpeg.log")
+	sox := writeFakeTool(t, tmpDir, "sox", `if [ "$1" = "--i" ]; then
+  printf 'Channels       : 2\nSample Rate    : 44100\nSample Encoding: 16-bit FLAC\n'
+  exit 0
+fi
+echo "$@" >> `+soxLog)
+	writeFakeTool(t, tmpDir, "ffmpeg", `echo "$@" >> `+ffmpegLog+`; for a in "$@"; do last="$a"; done; echo embedded > "$last"`)
+	os.Setenv("PATH", tmpDir+string(os.PathListSeparator)+originalPath)
+
+	config = Config{SourceDir: sourceDir, TargetDir: targetDir, SoxCommand: sox, ArtOnly: true, ArtSource: "folder"}
+	progress = &progressReporter{}
+	captureOutput(func() {
+		if err := processAudioFiles(); err != nil {
+			t.Errorf("processAudioFiles failed: %v", err)
+		}
+	})
+
+	if _, err := os.Stat(soxLog); !os.IsNotExist(err) {
+		t.Error("Expected SoX not to run for a compliant file")
+	}
+	logged, err := os.ReadFile(ffmpegLog)
+	if err != nil {
+		t.Fatalf("Expected FFmpeg to embed the cover: %v", err)
+	}
+	command := strings.TrimSpace(string(logged))
+	for _, want := range []string{"-i " + filepath.Join(album, "cover.jpg"), "-map 0:a -map 1:v -disposition:v attached_pic", "-c copy"} {
+		if !strings.Contains(command, want) {
+			t.Errorf("Expected %q in the FFmpeg command, got %q", want, command)
+		}
+	}
+	if data, _ := os.ReadFile(filepath.Join(targetDir, "Album", "01.flac")); string(data) != "embedded\n" {
+		t.Errorf("Expected the output written by FFmpeg, got %q", data)
+	}
+
+	config = Config{SourceDir: sourceDir, TargetDir: targetDir, ArtOnly: true, NoPreserveMetadata: true}
+	if err := runConverter(nil, []string{sourceDir}); err == nil || !strings.Contains(err.Error(), "--art-only") {
+		t.Errorf("Expected --art-only to be rejected with --no-preserve-metadata, got %v", err)
+	}
+}
+
+func TestSpecFile(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig; fileSpecs = nil }()
+
+	tmpDir := t.TempDir()
+	sourceDir := filepath.Join(tmpDir, "source")
+	targetDir := filepath.Join(tmpDir, "target")
+	os.MkdirAll(sourceDir, 0755)
+	for _, name := range []string{"keep.flac", "mono.flac", "default.flac", "lossy.flac"} {
+		os.WriteFile(filepath.Join(sourceDir, name), []byte(name), 0644)
+	}
+	specPath := filepath.Join(tmpDir, "spec.json")
+	os.WriteFile(specPath, []byte(`{
+  "keep.flac": {"bits": 24, "rate": 96000},
+  "mono.flac": {"channels": 1, "rate": 44100},
+  "lossy.flac": {"format": "MP3"},
+  "missing.flac": {"bits": 16}
+}`), 0644)
+
+	output, _ := captureOutput(func() {
+		specs, err := loadFileSpecs(specPath, sourceDir)
+		if err != nil {
+			t.Fatalf("loadFileSpecs failed: %v", err)
+		}
+		fileSpecs = specs
+	})
+	if !strings.Contains(output, `"missing.flac" does not match any source file`) {
+		t.Errorf("Expected a warning for the unmatched entry, got %q", output)
+	}
+	if fileSpecs["lossy.flac"].Format != "mp3" {
+		t.Errorf("Expected formats to be lower-cased, got %+v", fileSpecs["lossy.flac"])
+	}
+
+	argsLog := filepath.Join(tmpDir, "sox.log")
+	sox := writeFakeTool(t, tmpDir, "sox", `if [ "$1" = "--i" ]; then
+  printf 'Channels       : 2\nSample Rate    : 96000\nSample Encoding: 24-bit FLAC\n'
+  exit 0
+fi
+echo "$@" >> `+argsLog+`
+for a in "$@"; do case "$a" in `+targetDir+`/*) echo converted > "$a";; esac; done`)
+	config = Config{SourceDir: sourceDir, TargetDir: targetDir, SoxCommand: sox, NoPreserveMetadata: true, NoPostcheck: true}
+	progress = &progressReporter{}
+	captureOutput(func() {
+		if err := processAudioFiles(); err != nil {
+			t.Errorf("processAudioFiles failed: %v", err)
+		}
+	})
+
+	commands := map[string]string{}
+	data, _ := os.ReadFile(argsLog)
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		for _, name := range []string{"keep.flac", "mono.flac", "default.flac", "lossy.flac"} {
+			if strings.Contains(line, filepath.Join(sourceDir, name)) {
+				commands[name] = line
+			}
+		}
+	}
+	if command, ok := commands["keep.flac"]; ok {
+		t.Errorf("Expected keep.flac to be copied as 24/96, got %q", command)
+	}
+	if data, _ := os.ReadFile(filepath.Join(targetDir, "keep.flac")); string(data) != "keep.flac" {
+		t.Errorf("Expected keep.flac to be copied unchanged, got %q", data)
+	}
+	if command := commands["mono.flac"]; !strings.Contains(command, "-b 16 -c 1 ") || !strings.HasSuffix(command, "rate -v -L 44100 dither") {
+		t.Errorf("Expected mono.flac to be remixed to one channel at 44100 Hz, got %q", command)
+	}
+	if command := commands["default.flac"]; !strings.Contains(command, "-b 16 ") || strings.Contains(command, "-c ") || !strings.HasSuffix(command, "rate -v -L 48000 dither") {
+		t.Errorf("Expected default.flac to use the default rules, got %q", command)
+	}
+	if command := commands["lossy.flac"]; !strings.Contains(command, "-t mp3") {
+		t.Errorf("Expected lossy.flac to be converted to MP3, got %q", command)
+	}
+	if _, err := os.Stat(filepath.Join(targetDir, "lossy.mp3")); err != nil {
+		t.Errorf("Expected lossy.mp3 in the target: %v", err)
+	}
+	if paths := outputPaths(filepath.Join(sourceDir, "lossy.flac")); len(paths) != 1 || filepath.Base(paths[0]) != "lossy.mp3" {
+		t.Errorf("outputPaths() = %v, want the MP3 output", paths)
+	}
+
+	for name, content := range map[string]string{
+		"unknown field":  `{"a.flac": {"bitrate": 320}}`,
+		"bad format":     `{"a.flac": {"format": "ogg"}}`,
+		"bad bits":       `{"a.flac": {"bits": 20}}`,
+		"bad rate":       `{"a.flac": {"rate": 12345}}`,
+		"bad channels":   `{"a.flac": {"channels": 9}}`,
+		"absolute path":  `{"/music/a.flac": {"bits": 16}}`,
+		"outside source": `{"../a.flac": {"bits": 16}}`,
+		"not an object":  `["a.flac"]`,
+	} {
+		os.WriteFile(specPath, []byte(content), 0644)
+		if _, err := loadFileSpecs(specPath, sourceDir); err == nil {
+			t.Errorf("Expected the %s spec to be rejected", name)
+		}
+	}
+}
+
+func TestSummaryJSON(t *testing.T) {
+	originalConfig := config
+	originalConsole := console
+	originalStderr := os.Stderr
+	defer func() {
+		config = originalConfig
+		console = originalConsole
+		os.Stderr = originalStderr
+		progress = &progressReporter{}
+	}()
+
+	tmpDir := t.TempDir()
+	sourceDir := filepath.Join(tmpDir, "source")
+	os.MkdirAll(filepath.Join(sourceDir, "Album"), 0755)
+	os.WriteFile(filepath.Join(sourceDir, "Album", "a.mp3"), []byte("a"), 0644)
+	os.WriteFile(filepath.Join(sourceDir, "Album", "b.mp3"), []byte("bb"), 0644)
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stderr = w
+	config = Config{TargetDir: filepath.Join(tmpDir, "target"), SoxCommand: "true", NoPreserveMetadata: true, SummaryJSON: true}
+	stdout, _ := captureOutput(func() {
+		if err := runConverter(nil, []string{sourceDir}); err != nil {
+			t.Errorf("runConverter failed: %v", err)
+		}
+	})
+	w.Close()
+	stderr, _ := io.ReadAll(r)
+
+	decoder := json.NewDecoder(strings.NewReader(stdout))
+	var summary SummaryOutput
+	if err := decoder.Decode(&summary); err != nil {
+		t.Fatalf("Expected a JSON summary on stdout, got %q: %v", stdout, err)
+	}
+	if decoder.More() {
+		t.Errorf("Expected exactly one JSON object on stdout, got %q", stdout)
+	}
+	if summary.Completed != 2 || summary.Failed != 0 || summary.Results[actionCopied] != 2 || summary.BytesIn != 3 {
+		t.Errorf("Unexpected summary: %+v", summary)
+	}
+	for _, want := range []string{"── Album (2 files)", "Copying MP3 file", "Processing complete!"} {
+		if !strings.Contains(string(stderr), want) {
+			t.Errorf("Expected %q on stderr, got %q", want, stderr)
+		}
+	}
+
+	config = Config{TargetDir: filepath.Join(tmpDir, "target"), SummaryJSON: true, Tree: true}
+	if err := runConverter(nil, []string{sourceDir}); err == nil || !strings.Contains(err.Error(), "--summary-json") {
+		t.Errorf("Expected --summary-json to be rejected with --tree, got %v", err)
+	}
+}
+
+func TestIncludeHidden(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig; resetProducedFiles() }()
+
+	tmpDir := t.TempDir()
+	// A dot-named source root is still walked
+	sourceDir := filepath.Join(tmpDir, ".music")
+	for _, name := range []string{
+		"Album/01.mp3",
+		"Album/._01.mp3",
+		"Album/cover.jpg",
+		"Album/._cover.jpg",
+		".Trash/deleted.mp3",
+		".Trash/cover.jpg",
+	} {
+		path := filepath.Join(sourceDir, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(path), 0755)
+		os.WriteFile(path, []byte("data"), 0644)
+	}
+	targetDir := filepath.Join(tmpDir, "target")
+
+	collected := func() []string {
+		work, err := collectAudioFiles()
+		if err != nil {
+			t.Fatalf("collectAudioFiles failed: %v", err)
+		}
+		var paths []string
+		for _, item := range work {
+			relPath, _ := filepath.Rel(sourceDir, item.path)
+			paths = append(paths, filepath.ToSlash(relPath))
+		}
+		return paths
+	}
+	copiedImages := func() []string {
+		os.RemoveAll(targetDir)
+		captureOutput(func() {
+			if err := copyImageFiles(config.EnforceOutputFormat); err != nil {
+				t.Errorf("copyImageFiles failed: %v", err)
+			}
+		})
+		var paths []string
+		filepath.Walk(targetDir, func(path string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				relPath, _ := filepath.Rel(targetDir, path)
+				paths = append(paths, filepath.ToSlash(relPath))
+			}
+			return nil
+		})
+		return paths
+	}
+
+	t.Run("SkippedByDefault", func(t *testing.T) {
+		config = Config{SourceDir: sourceDir, TargetDir: targetDir}
+		if got, want := collected(), []string{"Album/01.mp3"}; !slices.Equal(got, want) {
+			t.Errorf("Expected audio files %v, got %v", want, got)
+		}
+		if got, want := copiedImages(), []string{"Album/cover.jpg"}; !slices.Equal(got, want) {
+			t.Errorf("Expected images %v, got %v", want, got)
+		}
+	})
+
+	t.Run("IncludeHidden", func(t *testing.T) {
+		config = Config{SourceDir: sourceDir, TargetDir: targetDir, IncludeHidden: true}
+		if got, want := collected(), []string{".Trash/deleted.mp3", "Album/._01.mp3", "Album/01.mp3"}; !slices.Equal(got, want) {
+			t.Errorf("Expected audio files %v, got %v", want, got)
+		}
+		if got, want := copiedImages(), []string{".Trash/cover.jpg", "Album/._cover.jpg", "Album/cover.jpg"}; !slices.Equal(got, want) {
+			t.Errorf("Expected images %v, got %v", want, got)
+		}
+	})
+}
+
+func TestWAVInput(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig; progress = &progressReporter{} }()
+
+	pcm := `Input File     : 'master.wav'
+Channels       : 2
+Sample Rate    : 96000
+Precision      : 24-bit
+Duration       : 00:00:01.00 = 96000 samples ~ 75 CDDA sectors
+File Size      : 576k
+Bit Rate       : 4.61M
+Sample Encoding: 24-bit Signed Integer PCM
+`
+	info, err := parseAudioInfo(pcm)
+	if err != nil || info.Bits != 24 || info.Rate != 96000 || info.Channels != 2 {
+		t.Errorf("parseAudioInfo(PCM WAV) = %+v, %v", info, err)
+	}
+	adpcm := "Channels       : 1\nSample Rate    : 22050\nPrecision      : 16-bit\nSample Encoding: 4-bit IMA ADPCM\n"
+	if info, err := parseAudioInfo(adpcm); err != nil || info.Bits != 16 {
+		t.Errorf("Expected the precision of an ADPCM WAV, got %+v, %v", info, err)
+	}
+
+	tmpDir := t.TempDir()
+	sourceDir := filepath.Join(tmpDir, "source")
+	targetDir := filepath.Join(tmpDir, "target")
+	os.MkdirAll(filepath.Join(sourceDir, "Album"), 0755)
+	os.WriteFile(filepath.Join(sourceDir, "Album", "master.wav"), []byte("RIFF"), 0644)
+	os.WriteFile(filepath.Join(sourceDir, "Album", "cd.wav"), []byte("RIFF"), 0644)
+	converted := filepath.Join(tmpDir, "converted.flac")
+	os.WriteFile(converted, flacWithStreamInfo(16, 48000, 2, 0), 0644)
+	soxLog := filepath.Join(tmpDir, "sox.log")
+	sox := writeFakeTool(t, tmpDir, "sox", `if [ "$1" = "--i" ]; then
+  case "$2" in
+  *master.wav) printf '`+strings.ReplaceAll(pcm, "\n", `\n`)+`';;
+  *) printf 'Channels       : 2\nSample Rate    : 44100\nPrecision      : 16-bit\nSample Encoding: 16-bit Signed Integer PCM\n';;
+  esac
+  exit 0
+fi
+echo "$@" >> `+soxLog+`
+for a in "$@"; do case "$a" in *.flac) cp `+converted+` "$a";; esac; done`)
+
+	config = Config{SourceDir: sourceDir, TargetDir: targetDir, SoxCommand: sox, NoPreserveMetadata: true, NoPostcheck: true}
+	progress = &progressReporter{}
+	output, _ := captureOutput(func() {
+		if err := processAudioFiles(); err != nil {
+			t.Errorf("processAudioFiles failed: %v", err)
+		}
+	})
+
+	for _, name := range []string{"master.flac", "cd.flac"} {
+		if _, err := os.Stat(filepath.Join(targetDir, "Album", name)); err != nil {
+			t.Errorf("Expected %s in the target: %v", name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(targetDir, "Album", "cd.wav")); err == nil {
+		t.Error("Expected a 16-bit WAV to be converted to FLAC, not copied")
+	}
+	if !strings.Contains(output, "Converting WAV to FLAC") || !strings.Contains(output, "24-bit 96000 Hz → 16-bit 48000 Hz") || !strings.Contains(output, "WAV to FLAC, keeping 16-bit 44100 Hz") {
+		t.Errorf("Unexpected output:\n%s", output)
+	}
+	soxCalls, _ := os.ReadFile(soxLog)
+	if !strings.Contains(string(soxCalls), "-b 16") {
+		t.Errorf("Expected the hi-res master to be reduced to 16-bit, got:\n%s", soxCalls)
+	}
+
+	t.Run("EnforcedALAC", func(t *testing.T) {
+		config = Config{SourceDir: sourceDir, TargetDir: targetDir, EnforceOutputFormat: "alac"}
+		if got := outputExtension(config.EnforceOutputFormat, ".wav"); got != ".m4a" {
+			t.Errorf("Expected WAV to be written as .m4a, got %s", got)
+		}
+		decision := policyFor("alac").Decide(&AudioInfo{Bits: 16, Rate: 44100, Format: "wav"})
+		if decision.Action != "convert" || decision.Reason != "WAV to ALAC, keeping 16-bit 44100 Hz" {
+			t.Errorf("Unexpected decision %v", decision)
+		}
+	})
+}
+
+func TestFixPermissions(t *testing.T) {
+	originalConfig := config
+	defer func() { config = originalConfig; progress = &progressReporter{}; resetProducedFiles() }()
+	// Directories created by the run would otherwise be 0700 too
+	defer syscall.Umask(syscall.Umask(0077))
+
+	tmpDir := t.TempDir()
+	sourceDir := filepath.Join(tmpDir, "source")
+	os.MkdirAll(filepath.Join(sourceDir, "Album"), 0700)
+	os.WriteFile(filepath.Join(sourceDir, "Album", "01.mp3"), []byte("mp3"), 0600)
+	os.WriteFile(filepath.Join(sourceDir, "Album", "cover.jpg"), []byte("jpeg"), 0600)
+
+	run := func(fix bool) string {
+		targetDir := filepath.Join(tmpDir, fmt.Sprintf("target-%v", fix))
+		config = Config{TargetDir: targetDir, SoxCommand: "true", NoPreserveMetadata: true, CopyImages: true, FixPermissions: fix}
+		captureOutput(func() {
+			if err := runConverter(nil, []string{sourceDir}); err != nil {
+				t.Errorf("runConverter failed: %v", err)
+			}
+		})
+		return targetDir
+	}
+	mode := func(path string) os.FileMode {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info.Mode().Perm()
+	}
+
+	targetDir := run(false)
+	if got := mode(filepath.Join(targetDir, "Album", "01.mp3")); got != 0600 {
+		t.Errorf("Expected the source mode to be kept without --fix-permissions, got %o", got)
+	}
+
+	targetDir = run(true)
+	for _, name := range []string{"01.mp3", "cover.jpg"} {
+		if got := mode(filepath.Join(targetDir, "Album", name)); got&0644 != 0644 {
+			t.Errorf("Expected %s to be at least 0644, got %o", name, got)
+		}
+	}
+	for _, dir := range []string{targetDir, filepath.Join(targetDir, "Album")} {
+		if got := mode(dir); got&0755 != 0755 {
+			t.Errorf("Expected %s to be at least 0755, got %o", dir, got)
+		}
+	}
+	if got := mode(filepath.Join(sourceDir, "Album", "01.mp3")); got != 0600 {
+		t.Errorf("Expected the source to be left alone, got %o", got)
+	}
+}
+
+func TestJobs(t *testing.T) {
+	originalConfig := config
+	defer func() {
+		config = originalConfig
+		progress = &progressReporter{}
+		console = &consoleWriter{}
+		fileSpecs = nil
+	}()
+
+	tmpDir := t.TempDir()
+	sourceDir := filepath.Join(tmpDir, "source")
+	for _, name := range []string{"A/01.flac", "A/02.flac", "B/01.flac", "B/02.flac"} {
+		path := filepath.Join(sourceDir, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(path), 0755)
+		os.WriteFile(path, flacWithStreamInfo(24, 96000, 2, 0), 0644)
+	}
+	converted := filepath.Join(tmpDir, "converted.flac")
+	os.WriteFile(converted, flacWithStreamInfo(16, 48000, 2, 0), 0644)
+	scratchLog := filepath.Join(tmpDir, "scratch.log")
+	// Conversions take long enough for concurrent files to overlap
+	sox := writeFakeTool(t, tmpDir, "sox", `if [ "$1" = "--i" ]; then
+  printf 'Channels       : 2\nSample Rate    : 96000\nSample Encoding: 24-bit FLAC\n'
+  exit 0
+fi
+sleep 0.3
+source="$3"
+for a in "$@"; do case "$a" in *.flac) [ "$a" != "$source" ] && cp `+converted+` "$a" && echo "$a" >> `+scratchLog+`;; esac; done
+exit 0`)
+
+	runs := 0
+	run := func(extra Config) (int, string) {
+		// OnEvent calls are serialized, even for concurrent files
+		inFlight, most := 0, 0
+		runs++
+		config = extra
+		config.SourceDir = sourceDir
+		config.TargetDir = filepath.Join(tmpDir, fmt.Sprintf("target-%d", runs))
+		config.SoxCommand = sox
+		config.NoPreserveMetadata = true
+		config.OnEvent = func(event Event) {
+			switch event.(type) {
+			case FileStarted:
+				inFlight++
+				most = max(most, inFlight)
+			case FileCompleted:
+				inFlight--
+			}
+		}
+		progress = &progressReporter{}
+		output, _ := captureOutput(func() {
+			if err := runConverter(nil, []string{sourceDir}); err != nil {
+				t.Errorf("runConverter failed: %v", err)
+			}
+		})
+		for _, name := range []string{"A/01.flac", "A/02.flac", "B/01.flac", "B/02.flac"} {
+			if _, err := os.Stat(filepath.Join(config.TargetDir, filepath.FromSlash(name))); err != nil {
+				t.Errorf("Expected %s to be converted: %v", name, err)
+			}
+		}
+		return most, output
+	}
+
+	if most, output := run(Config{Jobs: 4}); most < 2 || !strings.Contains(output, "Processing up to 4 files at a time") {
+		t.Errorf("Expected files to be converted concurrently, at most %d were in flight:\n%s", most, output)
+	}
+	// Concurrent files write their intermediates to the scratch of their own worker
+	data, _ := os.ReadFile(scratchLog)
+	scratches := map[string]bool{}
+	for _, path := range strings.Fields(string(data)) {
+		for _, part := range strings.Split(filepath.ToSlash(path), "/") {
+			if strings.HasPrefix(part, "worker-") {
+				scratches[part] = true
+			}
+		}
+	}
+	if len(scratches) < 2 || scratches["worker-0"] {
+		t.Errorf("Expected concurrent files to use separate worker scratch directories, got:\n%s", data)
+	}
+	if most, _ := run(Config{Jobs: 1}); most != 1 {
+		t.Errorf("Expected one file at a time with --jobs 1, got %d", most)
+	}
+	// Each concurrent file keeps its own pipeline for the report
+	report := filepath.Join(tmpDir, "report.json")
+	if most, output := run(Config{Jobs: 4, ReportPath: report, Verbose: true}); most < 2 || strings.Contains(output, "one file at a time") {
+		t.Errorf("Expected --report and --verbose to run files concurrently, at most %d were in flight:\n%s", most, output)
+	}
+	var written RunReport
+	data, _ = os.ReadFile(report)
+	if err := json.Unmarshal(data, &written); err != nil {
+		t.Fatalf("Invalid report: %v", err)
+	}
+	if len(written.Pipelines) != 4 {
+		t.Errorf("Expected a pipeline per file, got %+v", written.Pipelines)
+	}
+	for _, pipeline := range written.Pipelines {
+		if pipeline.Pipeline != "sox→sox" || pipeline.Decision == nil || pipeline.Decision.TargetBits != 16 {
+			t.Errorf("Unexpected pipeline %+v", pipeline)
+		}
+	}
+
+	// Albums are grouped with several jobs too, each written once and whole
+	_, output := run(Config{Jobs: 4, NiceOutput: true})
+	for _, album := range []string{"A", "B"} {
+		header := "── " + album + " (2 files)\n"
+		group, _, _ := strings.Cut(output[strings.Index(output, header)+len(header):], "└")
+		if strings.Count(output, header) != 1 || strings.Count(group, "├ 0") != 2 || strings.Contains(group, "──") {
+			t.Errorf("Expected album %s to be written once as a whole:\n%s", album, output)
+		}
+	}
+	// Structured logs and per-file specs keep every job
+	spec := filepath.Join(tmpDir, "spec.json")
+	os.WriteFile(spec, []byte(`{"A/01.flac": {"bits": 24}}`), 0644)
+	for name, extra := range map[string]Config{
+		"--json-logs": {Jobs: 4, JSONLogs: true},
+		"--spec-file": {Jobs: 4, SpecFile: spec},
+	} {
+		if most, output := run(extra); most < 2 {
+			t.Errorf("Expected %s to run files concurrently, at most %d were in flight:\n%s", name, most, output)
+		}
+	}
+
+	if flag := rootCmd.Flags().ShorthandLookup("j"); flag == nil || flag.Name != "jobs" {
+		t.Errorf("Expected -j to be short for --jobs, got %v", flag)
+	}
+	if flag := probeCmd.Flags().ShorthandLookup("j"); flag == nil || flag.Name != "jobs" {
+		t.Errorf("Expected -j to be short for --jobs of the probe command, got %v", flag)
+	}
+
+	config = Config{Jobs: -1}
+	if err := runConverter(nil, []string{sourceDir}); err == nil || !strings.Contains(err.Error(), "invalid jobs") {
+		t.Errorf("Expected a negative --jobs to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !unix
+
+package main
+
+import "os/exec"
+
+// configureCommand is a no-op on platforms without process groups
+func configureCommand(cmd *exec.Cmd) {}
+
+// watchPauseSignals is a no-op, pausing relies on Unix signals
+func watchPauseSignals() func() {
+	return func() {}
+}
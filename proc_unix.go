@@ -0,0 +1,45 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+)
+
+// configureCommand starts the tool in its own process group so an interrupt
+// from the terminal reaches lilt only, which then decides whether the tool may
+// finish.
+func configureCommand(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// watchPauseSignals pauses the run on SIGUSR1 and resumes it on SIGUSR2 or a
+// second SIGUSR1. The returned function stops watching.
+func watchPauseSignals() func() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1, syscall.SIGUSR2)
+	done := make(chan struct{})
+
+	go func() {
+		for {
+			select {
+			case sig := <-signals:
+				if sig == syscall.SIGUSR2 {
+					control.resume()
+				} else {
+					control.togglePause()
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(signals)
+		close(done)
+	}
+}